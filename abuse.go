@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type windowCounter struct {
+	start time.Time
+	count int
+}
+
+func (c *windowCounter) incr(now time.Time, window time.Duration) int {
+	if now.Sub(c.start) >= window {
+		c.start = now
+		c.count = 0
+	}
+	c.count++
+	return c.count
+}
+
+// abuseDetector keeps per-minute counters of submissions and errors and
+// temporarily throttles keys that cross the configured thresholds.
+type abuseDetector struct {
+	mu sync.Mutex
+
+	window           time.Duration
+	throttleFor      time.Duration
+	maxAddsPerWindow int
+	maxDuplicates    int
+	maxErrors        int
+
+	adds      map[string]*windowCounter
+	urls      map[string]*windowCounter
+	errors    windowCounter
+	throttled map[string]time.Time
+	alerted   map[string]time.Time
+}
+
+var abuse *abuseDetector
+
+func initAbuseDetector() {
+	abuse = &abuseDetector{
+		window:           time.Minute,
+		throttleFor:      envDuration("ABUSE_THROTTLE_DURATION", 15*time.Minute),
+		maxAddsPerWindow: envInt("ABUSE_ADDS_PER_MINUTE", 100),
+		maxDuplicates:    envInt("ABUSE_DUPLICATE_SUBMISSIONS", 5),
+		maxErrors:        envInt("ABUSE_ERRORS_PER_MINUTE", 50),
+		adds:             make(map[string]*windowCounter),
+		urls:             make(map[string]*windowCounter),
+		throttled:        make(map[string]time.Time),
+		alerted:          make(map[string]time.Time),
+	}
+
+	go abuse.sweep()
+}
+
+// requestKey identifies the caller for abuse accounting and rate limits:
+// the API key when it is one the server knows (see verifiedKey), otherwise
+// the client IP. Made-up keys are ignored, so sending a new one does not
+// buy a fresh quota.
+func requestKey(r *http.Request) string {
+	if key := verifiedKey(r); key != "" {
+		return "key:" + key
+	}
+	return "ip:" + clientIP(r)
+}
+
+// submitterID identifies the caller of r in the rows it leaves behind
+// (submitted URLs, asynchronous submissions and reports): "key:" and the
+// hash of its API key, verified or not, or "ip:" and its client IP without
+// one. Unlike requestKey it does not depend on whether the key is known,
+// so a purge of a key finds everything sent with it, and raw keys are
+// never stored.
+func submitterID(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return keySubmitterID(key)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// keySubmitterID is the submitterID of requests sent with key.
+func keySubmitterID(key string) string {
+	return "key:" + keyHash(key)
+}
+
+// abuseKeys returns the keys submissions of the caller of r are counted
+// and throttled by: its client IP and, with a verified API key, the key
+// too. A throttled caller cannot get out of it by changing headers, and a
+// key stays throttled wherever it is used from.
+func abuseKeys(r *http.Request) []string {
+	keys := []string{"ip:" + clientIP(r)}
+	if key := verifiedKey(r); key != "" {
+		keys = append(keys, "key:"+key)
+	}
+	return keys
+}
+
+// throttledUntil returns the latest end of the throttles of keys.
+func (d *abuseDetector) throttledUntil(keys ...string) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var latest time.Time
+	for _, key := range keys {
+		if until, ok := d.throttled[key]; ok && until.After(latest) {
+			latest = until
+		}
+	}
+	if time.Now().After(latest) {
+		return time.Time{}, false
+	}
+	return latest, true
+}
+
+// recordAdd counts a submission of url under every one of keys, throttling
+// them all when any crosses a threshold.
+func (d *abuseDetector) recordAdd(keys []string, url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	who := strings.Join(keys, ", ")
+
+	for _, key := range keys {
+		c, ok := d.adds[key]
+		if !ok {
+			c = &windowCounter{start: now}
+			d.adds[key] = c
+		}
+		if n := c.incr(now, d.window); n > d.maxAddsPerWindow {
+			d.throttleAll(keys, now)
+			d.alertOnce("add_rate:"+key, now, Alert{
+				Kind:    "abuse.add_rate",
+				Message: fmt.Sprintf("%s added %d URLs within %s; throttled for %s", who, n, d.window, d.throttleFor),
+				Tags:    map[string]string{"key": key},
+			})
+		}
+	}
+
+	u, ok := d.urls[url]
+	if !ok {
+		u = &windowCounter{start: now}
+		d.urls[url] = u
+	}
+	if n := u.incr(now, d.window); n > d.maxDuplicates {
+		d.throttleAll(keys, now)
+		d.alertOnce("duplicate:"+url, now, Alert{
+			Kind:    "abuse.duplicate_url",
+			Message: fmt.Sprintf("%s was submitted %d times within %s (last by %s)", url, n, d.window, who),
+			Tags:    map[string]string{"key": keys[len(keys)-1], "url": url},
+		})
+	}
+}
+
+func (d *abuseDetector) recordError(source string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if n := d.errors.incr(now, d.window); n > d.maxErrors {
+		d.alertOnce("errors", now, Alert{
+			Kind:    "abuse.error_spike",
+			Message: fmt.Sprintf("%d errors within %s (last from %s)", n, d.window, source),
+			Level:   "error",
+			Tags:    map[string]string{"source": source},
+		})
+	}
+}
+
+func (d *abuseDetector) throttleAll(keys []string, now time.Time) {
+	for _, key := range keys {
+		d.throttled[key] = now.Add(d.throttleFor)
+	}
+}
+
+// alertOnce suppresses repeats of the same alert while the throttle is in
+// effect; callers must hold d.mu.
+func (d *abuseDetector) alertOnce(id string, now time.Time, alert Alert) {
+	if last, ok := d.alerted[id]; ok && now.Sub(last) < d.throttleFor {
+		return
+	}
+	d.alerted[id] = now
+	sendAlert(alert)
+}
+
+func (d *abuseDetector) sweep() {
+	for range time.Tick(d.window) {
+		d.mu.Lock()
+		now := time.Now()
+		for k, c := range d.adds {
+			if now.Sub(c.start) >= d.window {
+				delete(d.adds, k)
+			}
+		}
+		for k, c := range d.urls {
+			if now.Sub(c.start) >= d.window {
+				delete(d.urls, k)
+			}
+		}
+		for k, until := range d.throttled {
+			if now.After(until) {
+				delete(d.throttled, k)
+			}
+		}
+		for k, at := range d.alerted {
+			if now.Sub(at) >= d.throttleFor {
+				delete(d.alerted, k)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
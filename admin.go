@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// adminMux serves operator-only endpoints on a separate listener
+// (ADMIN_ADDR) so they are never exposed on the public port.
+var adminMux = http.NewServeMux()
+
+// requireAdmin rejects requests that do not carry ADMIN_TOKEN as a bearer
+// token or a trusted client certificate (see admintls.go). When neither is
+// configured the admin listener's network restriction is the only
+// protection.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trustedClientCert(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS != nil && os.Getenv("ADMIN_TLS_REQUIRE_CLIENT_CERT") == "true" {
+			http.Error(w, "Client certificate not trusted", http.StatusForbidden)
+			return
+		}
+		token := os.Getenv("ADMIN_TOKEN")
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func startAdminServer() {
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		log.Println("Admin listener disabled (ADMIN_ADDR not set).")
+		return
+	}
+
+	adminMux.HandleFunc("/api/admin/urls/", adminURL)
+	adminMux.HandleFunc("/api/admin/videos/", adminRefreshVideo)
+	adminMux.HandleFunc("/api/admin/reports", listReports)
+	adminMux.HandleFunc("/api/admin/reports/", reviewReports)
+	adminMux.HandleFunc("/api/admin/takedowns", listTakedowns)
+	adminMux.HandleFunc("/api/admin/takedowns/", reviewTakedown)
+	adminMux.HandleFunc("/api/admin/duplicates", listDuplicates)
+	adminMux.HandleFunc("/api/admin/duplicates/", reviewDuplicate)
+	adminMux.HandleFunc("/api/admin/suggestions", listSuggestions)
+	adminMux.HandleFunc("/api/admin/suggestions/", reviewSuggestion)
+	adminMux.HandleFunc("/api/admin/retention", retentionPolicies)
+	adminMux.HandleFunc("/api/admin/retention/", retentionPolicies)
+	adminMux.HandleFunc("/api/admin/purge", adminPurgeSubject)
+	adminMux.HandleFunc("/api/admin/backups", adminBackups)
+	adminMux.HandleFunc("/api/admin/keys", adminKeys)
+	adminMux.HandleFunc("/api/admin/keys/", adminKeys)
+	adminMux.HandleFunc("/api/admin/captures", adminCaptures)
+	adminMux.HandleFunc("/api/admin/captures/", adminCaptures)
+	adminMux.HandleFunc("/api/admin/stats", adminStats)
+	adminMux.HandleFunc("/api/admin/serves", adminServes)
+	adminMux.HandleFunc("/api/debug/selection", explainSelection)
+	adminMux.HandleFunc("/api/admin/jobs", jobsAPI)
+	adminMux.HandleFunc("/api/admin/jobs/", jobsAPI)
+
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: addr, Handler: logRequests(requireAdmin(readOnly(adminMux))), TLSConfig: tlsConfig}
+
+	go func() {
+		if tlsConfig != nil {
+			log.Printf("Admin listener starting on %s with TLS...\n", addr)
+			log.Fatal(server.ListenAndServeTLS("", ""))
+		}
+		log.Printf("Admin listener starting on %s...\n", addr)
+		log.Fatal(server.ListenAndServe())
+	}()
+}
+
+// urlStatusEvent is the data of url.approved events.
+type urlStatusEvent struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// adminURL handles GET, PATCH and DELETE /api/admin/urls/{id},
+// POST /api/admin/urls/{id}/block|unblock, and POST/DELETE
+// /api/admin/urls/{id}/pin, where pinning with {"every": N} serves the video
+// on every N-th /api/get response, POST /api/admin/urls/{id}/weight for
+// the weighted selection strategy, and POST /api/admin/urls/{id}/restrict
+// with {"countries": [...]} to withhold the video in those countries. The
+// urls_changed trigger broadcasts the change to every replica.
+//
+// Every change bumps the URL's version, which GET returns as the ETag.
+// PATCH and DELETE must send it back in If-Match (or ?version=) so an admin
+// working from a stale copy gets 409 instead of overwriting someone else's
+// change; the other actions check it when it is given.
+func adminURL(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/urls/"), "/"), "/")
+	id := parts[0]
+	if _, err := uuid.Parse(id); err != nil {
+		http.Error(w, "Invalid URL id", http.StatusBadRequest)
+		return
+	}
+	expected, versioned, err := expectedVersion(r)
+	if err != nil {
+		http.Error(w, "If-Match must be the URL's version as returned in its ETag", http.StatusBadRequest)
+		return
+	}
+	conn, err := catalog.DB(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error locating URL %s: %v\n", id, err)
+		http.Error(w, "Error reading URL", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		query string
+		args  = []interface{}{id}
+		event string
+	)
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		getAdminURL(w, conn, id)
+		return
+	case r.Method == http.MethodPatch && len(parts) == 1:
+		patchAdminURL(w, r, conn, id, expected, versioned)
+		return
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		if !versioned {
+			http.Error(w, "DELETE requires If-Match with the URL's version", http.StatusPreconditionRequired)
+			return
+		}
+		query = "DELETE FROM urls WHERE id = $1"
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "block":
+		query = "UPDATE urls SET status = 'blocked' WHERE id = $1"
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "unblock":
+		query = "UPDATE urls SET status = 'active' WHERE id = $1"
+		event = "url.approved"
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "pin":
+		var body struct {
+			Every int `json:"every"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body.Every < 1 {
+			http.Error(w, "Body must be {\"every\": N} with N >= 1", http.StatusBadRequest)
+			return
+		}
+		query = "UPDATE urls SET pinned_every = $2 WHERE id = $1"
+		args = append(args, body.Every)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "weight":
+		var body struct {
+			Weight float64 `json:"weight"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body.Weight < 0 {
+			http.Error(w, "Body must be {\"weight\": W} with W >= 0", http.StatusBadRequest)
+			return
+		}
+		query = "UPDATE urls SET weight = $2 WHERE id = $1"
+		args = append(args, body.Weight)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "restrict":
+		var body struct {
+			Countries []string `json:"countries"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "Body must be {\"countries\": [\"CC\", ...]}", http.StatusBadRequest)
+			return
+		}
+		countries, ok := normalizeCountries(body.Countries)
+		if !ok {
+			http.Error(w, "Countries must be ISO 3166-1 alpha-2 codes", http.StatusBadRequest)
+			return
+		}
+		query = "UPDATE urls SET restricted_countries = $2 WHERE id = $1"
+		args = append(args, pq.Array(countries))
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[1] == "pin":
+		query = "UPDATE urls SET pinned_every = NULL WHERE id = $1"
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if versioned {
+		args = append(args, expected)
+		query += fmt.Sprintf(" AND version = $%d", len(args))
+	}
+	var result sql.Result
+	switch {
+	case event != "" && !catalog.Sharded():
+		result, err = execWithEvent(query, event, urlStatusEvent{ID: id, Status: "active"}, args...)
+	case event != "":
+		// The outbox cannot span databases, so the event is emitted
+		// directly.
+		if result, err = conn.Exec(query, args...); err == nil {
+			if n, _ := result.RowsAffected(); n > 0 {
+				emitEvent(event, urlStatusEvent{ID: id, Status: "active"})
+			}
+		}
+	default:
+		result, err = conn.Exec(query, args...)
+	}
+	if err != nil {
+		http.Error(w, "Error updating URL", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeURLUnchanged(w, conn, id, versioned)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminURLRecord is the editable state of a URL.
+type adminURLRecord struct {
+	ID          string   `json:"id"`
+	URL         string   `json:"url"`
+	Status      string   `json:"status"`
+	Collection  string   `json:"collection"`
+	PinnedEvery int      `json:"pinned_every"`
+	Weight      float64  `json:"weight"`
+	Restricted  []string `json:"restricted_countries"`
+	Version     int64    `json:"version"`
+}
+
+const adminURLColumns = "id, url, status, collection_id, COALESCE(pinned_every, 0), weight, restricted_countries, version"
+
+func scanAdminURL(row rowScanner) (adminURLRecord, error) {
+	var u adminURLRecord
+	err := row.Scan(&u.ID, &u.URL, &u.Status, &u.Collection, &u.PinnedEvery, &u.Weight, pq.Array(&u.Restricted), &u.Version)
+	return u, err
+}
+
+func writeAdminURL(w http.ResponseWriter, u adminURLRecord) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(u.Version, 10)))
+	writeJSON(w, http.StatusOK, u)
+}
+
+func getAdminURL(w http.ResponseWriter, conn *sql.DB, id string) {
+	u, err := scanAdminURL(conn.QueryRow("SELECT "+adminURLColumns+" FROM urls WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading URL %s: %v\n", id, err)
+		http.Error(w, "Error reading URL", http.StatusInternalServerError)
+		return
+	}
+	writeAdminURL(w, u)
+}
+
+// patchAdminURL updates the fields present in the body: collection,
+// pinned_every (0 unpins), weight and restricted_countries. Status changes
+// go through block and unblock. The version may also be given in the body.
+// A sharded catalog keeps a URL in its shard, so it can only move to a
+// collection on the same shard.
+func patchAdminURL(w http.ResponseWriter, r *http.Request, conn *sql.DB, id string, expected int64, versioned bool) {
+	var body struct {
+		Collection  *string   `json:"collection"`
+		PinnedEvery *int      `json:"pinned_every"`
+		Weight      *float64  `json:"weight"`
+		Restricted  *[]string `json:"restricted_countries"`
+		Version     *int64    `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !versioned && body.Version != nil {
+		expected, versioned = *body.Version, true
+	}
+	if !versioned {
+		http.Error(w, "PATCH requires If-Match with the URL's version", http.StatusPreconditionRequired)
+		return
+	}
+
+	var (
+		sets []string
+		args = []interface{}{id}
+	)
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if body.Collection != nil {
+		if strings.TrimSpace(*body.Collection) == "" {
+			http.Error(w, "collection must not be empty", http.StatusBadRequest)
+			return
+		}
+		collection := strings.TrimSpace(*body.Collection)
+		if catalog.ShardDB(catalog.Shard(collection)) != conn {
+			http.Error(w, "collection is on another shard", http.StatusConflict)
+			return
+		}
+		set("collection_id", collection)
+	}
+	if body.PinnedEvery != nil {
+		if *body.PinnedEvery < 0 {
+			http.Error(w, "pinned_every must be >= 0", http.StatusBadRequest)
+			return
+		}
+		set("pinned_every", sql.NullInt64{Int64: int64(*body.PinnedEvery), Valid: *body.PinnedEvery > 0})
+	}
+	if body.Weight != nil {
+		if *body.Weight < 0 {
+			http.Error(w, "weight must be >= 0", http.StatusBadRequest)
+			return
+		}
+		set("weight", *body.Weight)
+	}
+	if body.Restricted != nil {
+		countries, ok := normalizeCountries(*body.Restricted)
+		if !ok {
+			http.Error(w, "Countries must be ISO 3166-1 alpha-2 codes", http.StatusBadRequest)
+			return
+		}
+		set("restricted_countries", pq.Array(countries))
+	}
+	if len(sets) == 0 {
+		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		return
+	}
+
+	args = append(args, expected)
+	u, err := scanAdminURL(conn.QueryRow(fmt.Sprintf("UPDATE urls SET %s WHERE id = $1 AND version = $%d RETURNING %s",
+		strings.Join(sets, ", "), len(args), adminURLColumns), args...))
+	if err == sql.ErrNoRows {
+		writeURLUnchanged(w, conn, id, true)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating URL %s: %v\n", id, err)
+		http.Error(w, "Error updating URL", http.StatusInternalServerError)
+		return
+	}
+	writeAdminURL(w, u)
+}
+
+// expectedVersion reads the version a change is based on from If-Match or
+// the version query parameter.
+func expectedVersion(r *http.Request) (version int64, given bool, err error) {
+	value := strings.TrimPrefix(r.Header.Get("If-Match"), "W/")
+	if value == "" {
+		value = r.URL.Query().Get("version")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	version, err = strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	return version, err == nil, err
+}
+
+// writeURLUnchanged answers a change that matched no row: 409 when the URL
+// exists with another version, 404 otherwise.
+func writeURLUnchanged(w http.ResponseWriter, conn *sql.DB, id string, versioned bool) {
+	var current int64
+	err := conn.QueryRow("SELECT version FROM urls WHERE id = $1", id).Scan(&current)
+	if versioned && err == nil {
+		w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(current, 10)))
+		http.Error(w, "URL was changed by someone else; reload it and retry", http.StatusConflict)
+		return
+	}
+	http.Error(w, "URL not found", http.StatusNotFound)
+}
+
+// normalizeCountries normalizes ISO 3166-1 alpha-2 codes, reporting false
+// if any is invalid.
+func normalizeCountries(codes []string) ([]string, bool) {
+	countries := []string{}
+	for _, c := range codes {
+		c = normalizeCountry(c)
+		if c == "" {
+			return nil, false
+		}
+		countries = append(countries, c)
+	}
+	return countries, true
+}
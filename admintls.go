@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The admin listener serves TLS when ADMIN_TLS_CERT and ADMIN_TLS_KEY are
+// set. With ADMIN_TLS_CLIENT_CA as well, backend services can authenticate
+// with a client certificate signed by that CA instead of ADMIN_TOKEN;
+// ADMIN_TLS_CLIENT_NAMES restricts which certificates (by common name or
+// DNS name) are trusted, and ADMIN_TLS_REQUIRE_CLIENT_CERT=true refuses
+// connections without one, leaving the token unused.
+
+// adminTLSConfig returns the TLS configuration of the admin listener, or
+// nil to serve plain HTTP.
+func adminTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("ADMIN_TLS_CERT"), os.Getenv("ADMIN_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading admin TLS certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if caFile := os.Getenv("ADMIN_TLS_CLIENT_CA"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading admin client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if os.Getenv("ADMIN_TLS_REQUIRE_CLIENT_CERT") == "true" {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// trustedClientCert reports whether r came with a verified client
+// certificate allowed by ADMIN_TLS_CLIENT_NAMES.
+func trustedClientCert(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	names := os.Getenv("ADMIN_TLS_CLIENT_NAMES")
+	if names == "" {
+		return true
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && (name == leaf.Subject.CommonName || slices.Contains(leaf.DNSNames, name)) {
+			return true
+		}
+	}
+	return false
+}
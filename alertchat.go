@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chat alerts: ALERT_SLACK_WEBHOOK_URL and ALERT_DISCORD_WEBHOOK_URL post
+// alerts to a Slack or Discord channel through an incoming webhook. So a
+// burst of alerts doesn't flood the channel (or hit the webhook's rate
+// limit), they are queued and posted as one message every
+// ALERT_CHAT_INTERVAL; past ALERT_CHAT_MAX_BATCH alerts per message the
+// rest are only counted.
+
+type chatNotifier struct {
+	kind string
+	url  string
+	// limit is the longest message the service accepts.
+	limit int
+
+	mu      sync.Mutex
+	pending []Alert
+	dropped int
+}
+
+var chatNotifiers []*chatNotifier
+
+func newChatNotifiers() []*chatNotifier {
+	var ns []*chatNotifier
+	if hook := os.Getenv("ALERT_SLACK_WEBHOOK_URL"); hook != "" {
+		ns = append(ns, &chatNotifier{kind: "slack", url: hook, limit: 40000})
+	}
+	if hook := os.Getenv("ALERT_DISCORD_WEBHOOK_URL"); hook != "" {
+		ns = append(ns, &chatNotifier{kind: "discord", url: hook, limit: 2000})
+	}
+	return ns
+}
+
+// Notify queues the alert for the next message.
+func (n *chatNotifier) Notify(alert Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.pending) >= envInt("ALERT_CHAT_MAX_BATCH", 20) {
+		n.dropped++
+		return nil
+	}
+	n.pending = append(n.pending, alert)
+	return nil
+}
+
+// flush posts the queued alerts as one message.
+func (n *chatNotifier) flush() error {
+	n.mu.Lock()
+	alerts, dropped := n.pending, n.dropped
+	n.pending, n.dropped = nil, 0
+	n.mu.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, a := range alerts {
+		lines = append(lines, chatAlertLine(n.kind, a))
+	}
+	if dropped > 0 {
+		lines = append(lines, fmt.Sprintf("…and %d more alerts, see the logs.", dropped))
+	}
+	text := strings.Join(lines, "\n")
+	if len(text) > n.limit {
+		text = text[:strings.LastIndex(text[:n.limit-len("\n…")], "\n")+1] + "…"
+	}
+
+	payload := map[string]string{"text": text}
+	if n.kind == "discord" {
+		payload = map[string]string{"content": text}
+	}
+	if err := postJSON(alertClient, n.url, payload, nil); err != nil {
+		return fmt.Errorf("error posting %d alerts to %s: %w", len(alerts), n.kind, err)
+	}
+	return nil
+}
+
+// chatAlertLine formats an alert in the markup of kind.
+func chatAlertLine(kind string, a Alert) string {
+	icon := map[string]string{"error": "🔴", "warning": "🟠", "info": "🟢"}[a.Level]
+	if icon == "" {
+		icon = "⚪"
+	}
+	bold := "*"
+	if kind == "discord" {
+		bold = "**"
+	}
+	return fmt.Sprintf("%s %s%s%s %s (%s)", icon, bold, a.Kind, bold, a.Message, a.Time.Format("15:04:05 MST"))
+}
+
+func flushChatAlerts() error {
+	var failed []string
+	for _, n := range chatNotifiers {
+		if err := n.flush(); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func init() {
+	schedule("chat-alerts", "ALERT_CHAT_INTERVAL", 30*time.Second, flushChatAlerts)
+}
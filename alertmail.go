@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Alert emails: with ALERT_EMAIL_TO set (and SMTP configured, see mail.go),
+// alerts are also emailed, for operators without a webhook receiver. The
+// messages come from the templates "subject" and "body", executed against
+// the Alert; ALERT_EMAIL_TEMPLATE names a text/template file that
+// redefines them, or defines "subject:<kind>" and "body:<kind>" for the
+// alerts of one kind, for example:
+//
+//	{{define "subject:upstream_down"}}[shoti] TikTok resolution is down{{end}}
+//	{{define "body:upstream_down"}}{{.Message}}
+//	Check the tikwm keys and the upstream status page.{{end}}
+
+const defaultAlertEmailTemplates = `{{define "subject"}}[shoti] {{.Level}}: {{.Kind}}{{end}}
+{{define "body"}}{{.Message}}
+
+Kind:  {{.Kind}}
+Level: {{.Level}}
+Time:  {{.Time.Format "2006-01-02 15:04:05 MST"}}
+{{range $k, $v := .Tags}}{{$k}}: {{$v}}
+{{end}}{{end}}`
+
+type emailNotifier struct {
+	to        []string
+	templates *template.Template
+}
+
+func newEmailNotifier(to string) (*emailNotifier, error) {
+	if !mailEnabled() {
+		return nil, fmt.Errorf("SMTP_ADDR and SMTP_FROM are not set")
+	}
+	n := &emailNotifier{}
+	for _, addr := range strings.Split(to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			n.to = append(n.to, addr)
+		}
+	}
+
+	t, err := template.New("alert").Parse(defaultAlertEmailTemplates)
+	if err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("ALERT_EMAIL_TEMPLATE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading alert email template: %w", err)
+		}
+		if t, err = t.Parse(string(content)); err != nil {
+			return nil, fmt.Errorf("error parsing alert email template: %w", err)
+		}
+	}
+	n.templates = t
+	return n, nil
+}
+
+func (n *emailNotifier) Notify(alert Alert) error {
+	subject, err := n.render("subject", alert)
+	if err != nil {
+		return err
+	}
+	body, err := n.render("body", alert)
+	if err != nil {
+		return err
+	}
+	return sendMail(n.to, strings.TrimSpace(subject), body)
+}
+
+// render executes the template name for the kind of alert, or name itself.
+func (n *emailNotifier) render(name string, alert Alert) (string, error) {
+	t := n.templates.Lookup(name + ":" + alert.Kind)
+	if t == nil {
+		t = n.templates.Lookup(name)
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, alert); err != nil {
+		return "", fmt.Errorf("error rendering alert email %s: %w", name, err)
+	}
+	return out.String(), nil
+}
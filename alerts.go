@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Alert struct {
+	Kind    string            `json:"kind"`
+	Message string            `json:"message"`
+	Level   string            `json:"level"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+// Notifier delivers operational alerts to an external system.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+var notifiers []Notifier
+
+func initNotifiers() {
+	if hook := os.Getenv("ALERT_WEBHOOK_URL"); hook != "" {
+		notifiers = append(notifiers, &webhookNotifier{url: hook})
+	}
+
+	chatNotifiers = newChatNotifiers()
+	for _, n := range chatNotifiers {
+		notifiers = append(notifiers, n)
+	}
+
+	if to := os.Getenv("ALERT_EMAIL_TO"); to != "" {
+		notifier, err := newEmailNotifier(to)
+		if err != nil {
+			log.Printf("Alert emails disabled: %v\n", err)
+		} else {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+
+	if dsn := os.Getenv("SENTRY_DSN"); dsn != "" {
+		notifier, err := newSentryNotifier(dsn)
+		if err != nil {
+			log.Printf("Sentry alerts disabled: %v\n", err)
+		} else {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+}
+
+// sendAlert logs the alert and fans it out to every configured notifier
+// in the background so callers on the request path never block on it.
+func sendAlert(alert Alert) {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now().UTC()
+	}
+	if alert.Level == "" {
+		alert.Level = "warning"
+	}
+
+	log.Printf("ALERT [%s] %s\n", alert.Kind, alert.Message)
+
+	for _, n := range notifiers {
+		n := n
+		background(func() {
+			if err := n.Notify(alert); err != nil {
+				log.Printf("Error delivering alert: %v\n", err)
+			}
+		})
+	}
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(client *http.Client, target string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %w", req.URL.Host, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", req.URL.Host, response.StatusCode)
+	}
+
+	return nil
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Notify(alert Alert) error {
+	return postJSON(alertClient, n.url, alert, nil)
+}
+
+type sentryNotifier struct {
+	storeURL  string
+	publicKey string
+}
+
+// newSentryNotifier parses a DSN of the form https://<key>@<host>/<project>.
+func newSentryNotifier(dsn string) (*sentryNotifier, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: %w", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: missing public key")
+	}
+
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: missing project id")
+	}
+
+	return &sentryNotifier{
+		storeURL:  fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+func (n *sentryNotifier) Notify(alert Alert) error {
+	tags := map[string]string{"kind": alert.Kind}
+	for k, v := range alert.Tags {
+		tags[k] = v
+	}
+
+	event := map[string]interface{}{
+		"event_id":  strings.ReplaceAll(uuid.New().String(), "-", ""),
+		"timestamp": alert.Time.Format(time.RFC3339),
+		"level":     alert.Level,
+		"logger":    "shoti-srv",
+		"platform":  "go",
+		"message":   alert.Message,
+		"tags":      tags,
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=shoti-srv/1.0, sentry_key=%s", n.publicKey)
+	return postJSON(alertClient, n.storeURL, event, map[string]string{"X-Sentry-Auth": auth})
+}
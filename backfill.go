@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// The backfill job resolves URLs that have never been resolved (legacy
+// rows from the original id/url schema, or adds whose background resolve
+// failed) so they gain titles, stats and hashtags. Each run takes up to
+// BACKFILL_BATCH rows and resolves them at BACKFILL_RATE per second; a row
+// that fails is retried no sooner than BACKFILL_RETRY_AFTER later.
+var backfillJob *scheduledJob
+
+func backfillMetadata() error {
+	batch := envInt("BACKFILL_BATCH", 500)
+	rate := envInt("BACKFILL_RATE", 1)
+	if rate < 1 {
+		rate = 1
+	}
+	retryAfter := envDuration("BACKFILL_RETRY_AFTER", 24*time.Hour)
+
+	// Each shard offers a batch, of which the batch most overdue is taken.
+	type backfill struct {
+		id, url   string
+		conn      *sql.DB
+		attempted sql.NullTime
+		added     time.Time
+	}
+	var pending []backfill
+	for _, conn := range catalog.DBs() {
+		rows, err := conn.Query(`
+		SELECT id, url, backfill_attempted_at, created_at FROM urls
+		WHERE stats_updated_at IS NULL AND (backfill_attempted_at IS NULL OR backfill_attempted_at < $1)
+		ORDER BY backfill_attempted_at NULLS FIRST, created_at
+		LIMIT $2
+		`, time.Now().Add(-retryAfter), batch)
+		if err != nil {
+			return fmt.Errorf("error finding URLs to backfill: %w", err)
+		}
+		for rows.Next() {
+			u := backfill{conn: conn}
+			if err := rows.Scan(&u.id, &u.url, &u.attempted, &u.added); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning URLs to backfill: %w", err)
+			}
+			pending = append(pending, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error finding URLs to backfill: %w", err)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if a.attempted.Valid != b.attempted.Valid {
+			return !a.attempted.Valid
+		}
+		if !a.attempted.Time.Equal(b.attempted.Time) {
+			return a.attempted.Time.Before(b.attempted.Time)
+		}
+		return a.added.Before(b.added)
+	})
+	pending = pending[:min(batch, len(pending))]
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	progress := jobProgress{Total: len(pending)}
+	backfillJob.reportProgress(progress)
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for _, u := range pending {
+		<-ticker.C
+
+		_, err := u.conn.Exec("UPDATE urls SET backfill_attempted_at = now() WHERE id = $1", u.id)
+		if err != nil {
+			return fmt.Errorf("error marking backfill attempt: %w", err)
+		}
+
+		video, err := videoCache.get(u.url)
+		if err != nil {
+			log.Printf("Error backfilling %s: %v\n", u.url, err)
+			progress.Failed++
+		} else {
+			recordResolved(u.id, video)
+			progress.Done++
+		}
+		backfillJob.reportProgress(progress)
+	}
+
+	log.Printf("Backfilled metadata for %d of %d URL(s).\n", progress.Done, progress.Total)
+	return nil
+}
+
+func init() {
+	backfillJob = schedule("backfill", "BACKFILL_INTERVAL", 10*time.Minute, backfillMetadata)
+	backfillJob.LeaderOnly = true
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// Backups are a gzipped stream of JSON lines, one per row, encrypted with
+// AES-256-GCM under BACKUP_KEY (32 bytes, hex encoded; generate one with
+// `openssl rand -hex 32`). The first line is a backupHeader.
+//
+// backupTables lists every table worth keeping, parents before the tables
+// that reference them; new tables must be added here.
+//
+// On a sharded catalog every shard with its own database is backed up too,
+// its rows tagged with the shard name, and restored to the shard of that
+// name, which CATALOG_SHARDS must then configure. Each database is read in
+// its own snapshot and restored in its own transaction.
+var backupTables = []string{
+	"urls",
+	"hashtags",
+	"favorites",
+	"playlists",
+	"duplicate_candidates",
+	"retention_policies",
+	"reports",
+	"takedowns",
+	"deletion_tombstones",
+	"api_key_tiers",
+	"api_keys",
+	"url_suggestions",
+	"author_feed_checks",
+	"submissions",
+	"video_stats_history",
+}
+
+type backupHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Migration string    `json:"migration"`
+}
+
+type backupRecord struct {
+	// Shard is the shard the row was read from, "" for the DB_* database.
+	Shard string          `json:"shard,omitempty"`
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// backupDBs returns the databases to back up or restore by shard name: the
+// DB_* database as "" and each shard that is not it.
+func backupDBs() (map[string]*sql.DB, error) {
+	dbs := map[string]*sql.DB{"": db}
+	shards, err := catalogShards()
+	if err != nil {
+		return nil, err
+	}
+	for name, dsn := range shards {
+		if dsn != "" {
+			dbs[name] = catalog.ShardDB(name)
+		}
+	}
+	return dbs, nil
+}
+
+// backupStats counts rows per table.
+type backupStats map[string]int
+
+func backupKey() ([]byte, error) {
+	encoded := secret("BACKUP_KEY")
+	if encoded == "" {
+		return nil, errors.New("BACKUP_KEY is not set")
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("BACKUP_KEY must be 32 bytes, hex encoded")
+	}
+	return key, nil
+}
+
+// writeBackup dumps every table in backupTables to w.
+func writeBackup(w io.Writer, key []byte) (backupStats, error) {
+	enc, err := newBackupEncrypter(w, key)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(enc)
+	out := json.NewEncoder(gz)
+
+	header := backupHeader{Version: 1, CreatedAt: time.Now().UTC(), Migration: store.Migrations[len(store.Migrations)-1].Name}
+	if err := out.Encode(header); err != nil {
+		return nil, err
+	}
+
+	dbs, err := backupDBs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats := make(backupStats)
+	for _, name := range names {
+		if err := backupDB(out, name, dbs[name], stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return stats, enc.Close()
+}
+
+// backupDB writes the rows of every table in backupTables of conn, the
+// shard named shard, to out.
+func backupDB(out *json.Encoder, shard string, conn *sql.DB, stats backupStats) error {
+	// A repeatable-read transaction gives a consistent snapshot across
+	// tables while the server keeps running.
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		return err
+	}
+
+	for _, table := range backupTables {
+		rows, err := tx.Query(fmt.Sprintf("SELECT row_to_json(t) FROM %s t", table))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", table, err)
+		}
+		for rows.Next() {
+			var row json.RawMessage
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return fmt.Errorf("error reading %s: %w", table, err)
+			}
+			if err := out.Encode(backupRecord{Shard: shard, Table: table, Row: row}); err != nil {
+				rows.Close()
+				return err
+			}
+			stats[table]++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// restoreBackup loads a backup in a single transaction. Rows that already
+// exist are kept unless replace is set, in which case every backed-up
+// table is emptied first.
+func restoreBackup(r io.Reader, key []byte, replace bool) (backupStats, error) {
+	gz, err := gzip.NewReader(newBackupDecrypter(r, key))
+	if err != nil {
+		return nil, fmt.Errorf("error opening backup (wrong BACKUP_KEY?): %w", err)
+	}
+	in := json.NewDecoder(bufio.NewReader(gz))
+
+	var header backupHeader
+	if err := in.Decode(&header); err != nil {
+		return nil, fmt.Errorf("error reading backup header: %w", err)
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+	known := false
+	for _, m := range store.Migrations {
+		known = known || m.Name == header.Migration
+	}
+	if !known {
+		return nil, fmt.Errorf("backup was taken at migration %s, which this build does not know; upgrade first", header.Migration)
+	}
+
+	dbs, err := backupDBs()
+	if err != nil {
+		return nil, err
+	}
+	txs := make(map[string]*sql.Tx)
+	defer func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+	}()
+	for name, conn := range dbs {
+		tx, err := conn.Begin()
+		if err != nil {
+			return nil, err
+		}
+		txs[name] = tx
+		if !replace {
+			continue
+		}
+		for i := len(backupTables) - 1; i >= 0; i-- {
+			if _, err := tx.Exec("DELETE FROM " + backupTables[i]); err != nil {
+				return nil, fmt.Errorf("error clearing %s: %w", backupTables[i], err)
+			}
+		}
+	}
+
+	allowed := make(map[string]bool)
+	for _, table := range backupTables {
+		allowed[table] = true
+	}
+	columns := make(map[string]map[string]bool)
+
+	stats := make(backupStats)
+	for {
+		var rec backupRecord
+		err := in.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading backup: %w", err)
+		}
+		if !allowed[rec.Table] {
+			return nil, fmt.Errorf("backup contains unknown table %q", rec.Table)
+		}
+		tx, ok := txs[rec.Shard]
+		if !ok {
+			return nil, fmt.Errorf("backup contains shard %q, which CATALOG_SHARDS does not configure", rec.Shard)
+		}
+		if columns[rec.Table] == nil {
+			if columns[rec.Table], err = tableColumns(tx, rec.Table); err != nil {
+				return nil, err
+			}
+		}
+		if err := restoreRow(tx, rec.Table, columns[rec.Table], rec.Row); err != nil {
+			return nil, fmt.Errorf("error restoring %s row: %w", rec.Table, err)
+		}
+		stats[rec.Table]++
+	}
+
+	names := make([]string, 0, len(txs))
+	for name := range txs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := txs[name].Commit(); err != nil {
+			return nil, fmt.Errorf("error committing the restore of shard %q: %w", name, err)
+		}
+		delete(txs, name)
+	}
+	return stats, nil
+}
+
+// tableColumns returns the columns of table.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", table)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns[column] = true
+	}
+	return columns, rows.Err()
+}
+
+// restoreRow inserts row, a JSON object, into table, keeping a row that
+// exists already. Only the columns row has are inserted, so those added
+// by migrations after the backup was taken get their defaults.
+func restoreRow(tx *sql.Tx, table string, columns map[string]bool, row json.RawMessage) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !columns[name] {
+			return fmt.Errorf("%s has no column %q", table, name)
+		}
+		names = append(names, pq.QuoteIdentifier(name))
+	}
+	sort.Strings(names)
+	list := strings.Join(names, ", ")
+	_, err := tx.Exec(fmt.Sprintf(
+		"INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM json_populate_record(NULL::%[1]s, $1) ON CONFLICT DO NOTHING", table, list,
+	), string(row))
+	return err
+}
+
+// The archive is "SHOTIBK1", a 7-byte random nonce prefix, then chunks of
+// up to backupChunkSize plaintext bytes, each a 4-byte length and a GCM
+// sealed box. Chunk nonces are prefix || counter || final flag, so chunks
+// cannot be reordered and truncation is detected.
+const (
+	backupMagic     = "SHOTIBK1"
+	backupChunkSize = 64 << 10
+)
+
+type backupEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newBackupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func backupNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newBackupEncrypter(w io.Writer, key []byte) (*backupEncrypter, error) {
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, backupMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &backupEncrypter{w: w, aead: aead, prefix: prefix}, nil
+}
+
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := backupChunkSize - len(e.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		e.buf = append(e.buf, p[:take]...)
+		p = p[take:]
+		// A full chunk is only sealed once more data arrives, so the last
+		// chunk can always be marked final on Close.
+		if len(e.buf) == backupChunkSize && len(p) > 0 {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *backupEncrypter) seal(final bool) error {
+	box := e.aead.Seal(nil, backupNonce(e.prefix, e.counter, final), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(box)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(box)
+	return err
+}
+
+func (e *backupEncrypter) Close() error {
+	return e.seal(true)
+}
+
+type backupDecrypter struct {
+	r       io.Reader
+	key     []byte
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func newBackupDecrypter(r io.Reader, key []byte) *backupDecrypter {
+	return &backupDecrypter{r: r, key: key}
+}
+
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	if d.aead == nil {
+		head := make([]byte, len(backupMagic)+7)
+		if _, err := io.ReadFull(d.r, head); err != nil {
+			return 0, fmt.Errorf("error reading backup: %w", err)
+		}
+		if string(head[:len(backupMagic)]) != backupMagic {
+			return 0, errors.New("not a shoti-srv backup")
+		}
+		aead, err := newBackupAEAD(d.key)
+		if err != nil {
+			return 0, err
+		}
+		d.aead = aead
+		d.prefix = head[len(backupMagic):]
+	}
+
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *backupDecrypter) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return errors.New("backup is truncated")
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > backupChunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("backup is corrupt")
+	}
+	box := make([]byte, size)
+	if _, err := io.ReadFull(d.r, box); err != nil {
+		return errors.New("backup is truncated")
+	}
+
+	// Only the last chunk opens with the final flag set.
+	plain, err := d.aead.Open(nil, backupNonce(d.prefix, d.counter, false), box, nil)
+	if err != nil {
+		plain, err = d.aead.Open(nil, backupNonce(d.prefix, d.counter, true), box, nil)
+		if err != nil {
+			return errors.New("backup could not be decrypted (wrong BACKUP_KEY or corrupt file)")
+		}
+		d.done = true
+	}
+	d.counter++
+	d.buf = plain
+	return nil
+}
+
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("out", "", "file to write the encrypted backup to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	initDB()
+	key, err := backupKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	stats, err := writeBackup(f, key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	for _, table := range backupTables {
+		fmt.Printf("%-22s %d\n", table, stats[table])
+	}
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	in := fs.String("in", "", "encrypted backup to restore")
+	replace := fs.Bool("replace", false, "delete existing data before restoring")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+
+	initDB()
+	key, err := backupKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stats, err := restoreBackup(f, key, *replace)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range backupTables {
+		fmt.Printf("%-22s %d\n", table, stats[table])
+	}
+	return nil
+}
+
+func init() {
+	commands["backup"] = command{Summary: "write an encrypted backup of the database", Run: backupCommand}
+	commands["restore"] = command{Summary: "load an encrypted backup into the database", Run: restoreCommand}
+}
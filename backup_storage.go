@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scheduled backups upload an encrypted dump every BACKUP_INTERVAL (24h by
+// default) to BACKUP_S3_BUCKET at BACKUP_S3_ENDPOINT (for R2,
+// https://<account>.r2.cloudflarestorage.com with BACKUP_S3_REGION=auto),
+// keeping the newest BACKUP_RETENTION objects under BACKUP_S3_PREFIX.
+// Credentials come from BACKUP_S3_ACCESS_KEY_ID and
+// BACKUP_S3_SECRET_ACCESS_KEY. BACKUP_STORE=disk (BACKUP_DISK_DIR) or
+// BACKUP_STORE=gcs (BACKUP_GCS_BUCKET) store them elsewhere.
+
+var backupUploadJob *scheduledJob
+
+// backupStorage returns the store configured by the BACKUP_* settings (see
+// openBlobStore) and the key prefix of backups in it.
+func backupStorage() (BlobStore, string, error) {
+	store, err := openBlobStore("BACKUP")
+	if err == errBlobStoreDisabled {
+		return nil, "", errBackupStorageDisabled
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := os.Getenv("BACKUP_S3_PREFIX")
+	if prefix == "" {
+		prefix = "backups/"
+	}
+	return store, prefix, nil
+}
+
+var errBackupStorageDisabled = errors.New("backup storage is not configured (BACKUP_STORE or BACKUP_S3_BUCKET)")
+
+// uploadBackup writes a backup to a temporary file, uploads it and then
+// deletes the oldest backups beyond the retention count.
+func uploadBackup() error {
+	store, prefix, err := backupStorage()
+	if err == errBackupStorageDisabled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	key, err := backupKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp("", "shoti-backup-*.enc")
+	if err != nil {
+		return fmt.Errorf("error creating backup file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stats, err := writeBackup(f, key)
+	if err != nil {
+		return fmt.Errorf("error writing backup: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	name := prefix + "shoti-" + time.Now().UTC().Format("20060102T150405Z") + ".enc"
+	if err := store.Put(name, f, size); err != nil {
+		return fmt.Errorf("error uploading backup: %w", err)
+	}
+	log.Printf("Uploaded backup %s (%d bytes, %d urls).\n", name, size, stats["urls"])
+
+	return rotateBackups(store, prefix)
+}
+
+func rotateBackups(store BlobStore, prefix string) error {
+	keep := envInt("BACKUP_RETENTION", 7)
+	if keep < 1 {
+		return nil
+	}
+
+	objects, err := listBackups(store, prefix)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects[min(keep, len(objects)):] {
+		if err := store.Delete(o.Key); err != nil {
+			return fmt.Errorf("error deleting old backup %s: %w", o.Key, err)
+		}
+		log.Printf("Deleted old backup %s.\n", o.Key)
+	}
+	return nil
+}
+
+// listBackups returns the stored backups, newest first.
+func listBackups(store BlobStore, prefix string) ([]blobObject, error) {
+	objects, err := store.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing backups: %w", err)
+	}
+	backups := objects[:0]
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, ".enc") {
+			backups = append(backups, o)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Key > backups[j].Key })
+	return backups, nil
+}
+
+// adminBackups handles GET /api/admin/backups, listing stored backups, and
+// POST /api/admin/backups, which starts one in the background; follow its
+// progress at /api/admin/jobs/backup.
+func adminBackups(w http.ResponseWriter, r *http.Request) {
+	store, prefix, err := backupStorage()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		backups, err := listBackups(store, prefix)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadGateway, "failed to list backups")
+			return
+		}
+		if backups == nil {
+			backups = []blobObject{}
+		}
+		writeJSON(w, http.StatusOK, backups)
+	case http.MethodPost:
+		if !isLeader() {
+			writeError(w, http.StatusConflict, "backups run on the leader replica only")
+			return
+		}
+		go backupUploadJob.runOnce()
+		writeJSON(w, http.StatusAccepted, backupUploadJob.status())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func init() {
+	backupUploadJob = schedule("backup", "BACKUP_INTERVAL", 24*time.Hour, uploadBackup)
+	backupUploadJob.LeaderOnly = true
+}
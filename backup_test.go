@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestRestoreOlderBackup restores an api_keys row backed up before
+// 0033_collection_routes and 0034_api_key_notifications added NOT NULL
+// columns, which must get their defaults.
+func TestRestoreOlderBackup(t *testing.T) {
+	benchDB(t)
+	key := bytes.Repeat([]byte{7}, 32)
+	id := uuid.NewString()
+	t.Cleanup(func() { db.Exec("DELETE FROM api_keys WHERE id = $1", id) })
+
+	var archive bytes.Buffer
+	enc, err := newBackupEncrypter(&archive, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(enc)
+	out := json.NewEncoder(gz)
+	row, _ := json.Marshal(map[string]interface{}{
+		"id":         id,
+		"key_hash":   "restore-test-" + id,
+		"name":       "old key",
+		"scopes":     []string{"read"},
+		"expires_at": nil,
+		"created_at": "2024-01-02T03:04:05Z",
+	})
+	out.Encode(backupHeader{Version: 1, Migration: "0032_submissions"})
+	out.Encode(backupRecord{Table: "api_keys", Row: row})
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := restoreBackup(&archive, key, false)
+	if err != nil {
+		t.Fatalf("restoreBackup: %v", err)
+	}
+	if stats["api_keys"] != 1 {
+		t.Errorf("restored %d api_keys rows, want 1", stats["api_keys"])
+	}
+
+	var name, collection, notifyURL, notifyEmail string
+	err = db.QueryRow("SELECT name, collection, notify_url, notify_email FROM api_keys WHERE id = $1", id).
+		Scan(&name, &collection, &notifyURL, &notifyEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "old key" || collection != "" || notifyURL != "" || notifyEmail != "" {
+		t.Errorf("restored (%q, %q, %q, %q), want (\"old key\", \"\", \"\", \"\")", name, collection, notifyURL, notifyEmail)
+	}
+}
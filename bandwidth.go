@@ -0,0 +1,126 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Media bandwidth limits: each response of the media proxy is paced to
+// MEDIA_RATE_LIMIT bytes per second, and each caller (API key, or IP
+// without one) may download the media bytes of its tier (see tiers.go;
+// MEDIA_KEY_QUOTA for the free tier) per MEDIA_KEY_QUOTA_WINDOW before
+// getting 429s. Usage is counted per
+// replica. Zero disables either limit.
+
+var mediaBytesServed = expvar.NewInt("media_bytes_served")
+
+type mediaUsageWindow struct {
+	start time.Time
+	bytes int64
+}
+
+var mediaUsage = struct {
+	mu      sync.Mutex
+	windows map[string]*mediaUsageWindow
+}{windows: make(map[string]*mediaUsageWindow)}
+
+// mediaQuotaExhausted reports whether key has used its quota and, if so,
+// when its window resets.
+func mediaQuotaExhausted(key string, quota int64) (time.Time, bool) {
+	if quota <= 0 {
+		return time.Time{}, false
+	}
+	window := envDuration("MEDIA_KEY_QUOTA_WINDOW", 24*time.Hour)
+
+	mediaUsage.mu.Lock()
+	defer mediaUsage.mu.Unlock()
+	u, ok := mediaUsage.windows[key]
+	if !ok || time.Since(u.start) >= window || u.bytes < quota {
+		return time.Time{}, false
+	}
+	return u.start.Add(window), true
+}
+
+func recordMediaBytes(key string, n, quota int64) {
+	mediaBytesServed.Add(n)
+	if quota <= 0 {
+		return
+	}
+	window := envDuration("MEDIA_KEY_QUOTA_WINDOW", 24*time.Hour)
+
+	mediaUsage.mu.Lock()
+	u, ok := mediaUsage.windows[key]
+	if !ok || time.Since(u.start) >= window {
+		u = &mediaUsageWindow{start: time.Now()}
+		mediaUsage.windows[key] = u
+	}
+	u.bytes += n
+	used, reset := u.bytes, u.start.Add(window)
+	mediaUsage.mu.Unlock()
+	noteQuotaUsage(key, key, "media_bytes", used, quota, reset)
+}
+
+// sweepMediaUsage forgets windows that have ended.
+func sweepMediaUsage() error {
+	window := envDuration("MEDIA_KEY_QUOTA_WINDOW", 24*time.Hour)
+	mediaUsage.mu.Lock()
+	defer mediaUsage.mu.Unlock()
+	for key, u := range mediaUsage.windows {
+		if time.Since(u.start) >= window {
+			delete(mediaUsage.windows, key)
+		}
+	}
+	return nil
+}
+
+// meteredWriter counts the bytes written towards the caller's quota and
+// paces them to rate bytes per second.
+type meteredWriter struct {
+	http.ResponseWriter
+	key   string
+	quota int64
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newMeteredWriter(w http.ResponseWriter, key string, quota int64) *meteredWriter {
+	return &meteredWriter{ResponseWriter: w, key: key, quota: quota, rate: int64(envInt("MEDIA_RATE_LIMIT", 0)), start: time.Now()}
+}
+
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if mw.rate > 0 {
+			// Write at most a tenth of a second's worth at a time, then
+			// sleep until the average rate is back under the limit.
+			if limit := int(mw.rate/10) + 1; len(chunk) > limit {
+				chunk = chunk[:limit]
+			}
+		}
+
+		n, err := mw.ResponseWriter.Write(chunk)
+		written += n
+		mw.sent += int64(n)
+		recordMediaBytes(mw.key, int64(n), mw.quota)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		if mw.rate > 0 {
+			due := mw.start.Add(time.Duration(mw.sent * int64(time.Second) / mw.rate))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+	return written, nil
+}
+
+func init() {
+	schedule("media-usage-sweep", "MEDIA_USAGE_SWEEP_INTERVAL", 10*time.Minute, sweepMediaUsage)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libyzxy0/shoti-srv/resolver"
+	"github.com/libyzxy0/shoti-srv/selector"
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+func sampleVideo() *Video {
+	return &Video{
+		ID:       "7301234567890123456",
+		Provider: "tikwm",
+		Region:   "PH",
+		Title:    "sample shoti #fyp #foryou",
+		Cover:    "https://p16-sign.tiktokcdn.com/obj/cover.jpeg",
+		PlayURL:  "https://www.tikwm.com/video/media/hdplay/7301234567890123456.mp4",
+		Duration: 15,
+		Author: VideoAuthor{
+			ID:       "6801234567890123456",
+			Username: "shoti.user",
+			Nickname: "Shoti User",
+		},
+	}
+}
+
+// benchDB connects to the database from the environment, skipping the
+// benchmark or test when none is configured.
+func benchDB(b testing.TB) {
+	b.Helper()
+	if os.Getenv("DB_HOST") == "" && os.Getenv("DB_HOST_FILE") == "" {
+		b.Skip("DB_HOST not set")
+	}
+	if db != nil {
+		return
+	}
+
+	db = sql.OpenDB(rotatingConnector{})
+	if err := db.Ping(); err != nil {
+		b.Fatalf("unable to connect to the database: %v", err)
+	}
+	if err := store.Migrate(db); err != nil {
+		b.Fatal(err)
+	}
+	if err := prepareStatements(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkGetRandomURL(b *testing.B) {
+	benchDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getRandomURL(selector.Uniform{}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestQueryPlans checks with EXPLAIN that the hot queries can use the
+// indexes made for them. Sequential scans are disabled, since on a small
+// test database they would win regardless.
+func TestQueryPlans(t *testing.T) {
+	benchDB(t)
+	statements := catalog.Statements()
+	cases := []struct {
+		query string
+		args  []interface{}
+		index string
+	}{
+		{statements["randomFrom"], []interface{}{uuid.NewString()}, "urls_status_id_idx"},
+		{statements["list"], []interface{}{"cats"}, "urls_collection_id_idx"},
+		{statements["listPage"], []interface{}{time.Now(), uuid.NewString(), 100, ""}, "urls_created_at_id_idx"},
+		{"SELECT id FROM urls WHERE video_id = $1 LIMIT 1", []interface{}{"7301234567890123456"}, "urls_video_id_idx"},
+		{"SELECT id FROM urls WHERE author_id = $1", []interface{}{"6801234567890123456"}, "urls_author_id_idx"},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SET LOCAL enable_seqscan = off"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		var plan []byte
+		if err := tx.QueryRow("EXPLAIN (FORMAT JSON) "+c.query, c.args...).Scan(&plan); err != nil {
+			t.Fatalf("EXPLAIN %s: %v", c.query, err)
+		}
+		var root []struct{ Plan json.RawMessage }
+		if err := json.Unmarshal(plan, &root); err != nil || len(root) == 0 {
+			t.Fatalf("unexpected plan %s: %v", plan, err)
+		}
+		if used := planIndexes(root[0].Plan); !used[c.index] {
+			t.Errorf("%s\ndoes not use %s:\n%s", c.query, c.index, plan)
+		}
+	}
+}
+
+// planIndexes returns the indexes scanned by an EXPLAIN (FORMAT JSON) plan
+// node and its children.
+func planIndexes(node json.RawMessage) map[string]bool {
+	var n struct {
+		IndexName string            `json:"Index Name"`
+		Plans     []json.RawMessage `json:"Plans"`
+	}
+	used := make(map[string]bool)
+	if json.Unmarshal(node, &n) != nil {
+		return used
+	}
+	if n.IndexName != "" {
+		used[n.IndexName] = true
+	}
+	for _, child := range n.Plans {
+		for index := range planIndexes(child) {
+			used[index] = true
+		}
+	}
+	return used
+}
+
+func BenchmarkIndexRandom(b *testing.B) {
+	ix := &urlIndex{loaded: true}
+	for i := 0; i < 100000; i++ {
+		ix.entries = append(ix.entries, catalogEntry{ID: fmt.Sprint(i), URL: "https://www.tiktok.com/@shoti/video/" + fmt.Sprint(i)})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ok, _ := ix.selectWith(selector.Uniform{}, nil); !ok {
+				b.Fatal("empty index")
+			}
+		}
+	})
+}
+
+func BenchmarkEngagementSelect(b *testing.B) {
+	entries := make([]catalogEntry, 100000)
+	for i := range entries {
+		entries[i] = catalogEntry{ID: fmt.Sprint(i), Likes: int64(i * 37 % 100000), Weight: 1}
+	}
+	sel := selectors["engagement"]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := sel.Select(entries, nil); !ok {
+			b.Fatal("nothing selected")
+		}
+	}
+}
+
+func BenchmarkMetadataCacheHit(b *testing.B) {
+	c := &metadataCache{entries: make(map[string]*cachedVideo), inflight: make(map[string]*inflightFetch)}
+	url := "https://www.tiktok.com/@shoti/video/1"
+	c.store(url, sampleVideo())
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.get(url); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNewVideoDataResponse(b *testing.B) {
+	info := sampleVideo()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newVideoDataResponse(info)
+	}
+}
+
+func BenchmarkEncodeVideoDataResponse(b *testing.B) {
+	response := newVideoDataResponse(sampleVideo())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoder := json.NewEncoder(io.Discard)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(response); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeTikwm(b *testing.B) {
+	payload, err := os.ReadFile("testdata/providers/tikwm/video.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := resolver.DecodeTikwm(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore stores opaque objects by key. Keys use "/" as separator
+// whatever the backend.
+type BlobStore interface {
+	Put(key string, body io.ReadSeeker, size int64) error
+	// Get returns errBlobNotFound when key does not exist.
+	Get(key string) (io.ReadCloser, error)
+	// Delete succeeds when key does not exist.
+	Delete(key string) error
+	// List returns every object whose key starts with prefix.
+	List(prefix string) ([]blobObject, error)
+	String() string
+}
+
+type blobObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+var (
+	errBlobNotFound      = errors.New("blob not found")
+	errBlobStoreDisabled = errors.New("blob store is not configured")
+)
+
+// openBlobStore returns the store configured for a feature by settings
+// prefixed with name: <name>_STORE selects s3, disk or gcs (s3 when unset
+// and <name>_S3_BUCKET is set), configured by <name>_S3_BUCKET,
+// <name>_S3_ENDPOINT, <name>_S3_REGION, <name>_S3_ACCESS_KEY_ID and
+// <name>_S3_SECRET_ACCESS_KEY; <name>_DISK_DIR; or <name>_GCS_BUCKET with
+// GCS_CREDENTIALS_FILE. It returns errBlobStoreDisabled when none is set.
+func openBlobStore(name string) (BlobStore, error) {
+	kind := os.Getenv(name + "_STORE")
+	if kind == "" && os.Getenv(name+"_S3_BUCKET") != "" {
+		kind = "s3"
+	}
+
+	switch kind {
+	case "":
+		return nil, errBlobStoreDisabled
+	case "s3":
+		bucket := os.Getenv(name + "_S3_BUCKET")
+		if bucket == "" {
+			return nil, fmt.Errorf("%s_S3_BUCKET is not set", name)
+		}
+		region := os.Getenv(name + "_S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv(name + "_S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return &s3Client{
+			Endpoint:  endpoint,
+			Region:    region,
+			Bucket:    bucket,
+			AccessKey: secret(name + "_S3_ACCESS_KEY_ID"),
+			SecretKey: secret(name + "_S3_SECRET_ACCESS_KEY"),
+		}, nil
+	case "disk":
+		dir := os.Getenv(name + "_DISK_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("%s_DISK_DIR is not set", name)
+		}
+		return newDiskStore(dir)
+	case "gcs":
+		bucket := os.Getenv(name + "_GCS_BUCKET")
+		if bucket == "" {
+			return nil, fmt.Errorf("%s_GCS_BUCKET is not set", name)
+		}
+		return newGCSStore(bucket, os.Getenv("GCS_CREDENTIALS_FILE"))
+	default:
+		return nil, fmt.Errorf("unknown %s_STORE %q", name, kind)
+	}
+}
+
+// diskStore keeps objects as files under a directory, for self-hosters
+// without object storage.
+type diskStore struct {
+	root string
+}
+
+func newDiskStore(root string) (*diskStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", root, err)
+	}
+	return &diskStore{root: root}, nil
+}
+
+func (d *diskStore) String() string {
+	return "file://" + d.root
+}
+
+// path maps key into the root, rejecting keys that would escape it.
+func (d *diskStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if key == "" || strings.HasSuffix(key, "/") || clean != "/"+strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(d.root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial
+// object.
+func (d *diskStore) Put(key string, body io.ReadSeeker, size int64) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, body)
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d of %d bytes", n, size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", key, err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *diskStore) Get(key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (d *diskStore) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *diskStore) List(prefix string) ([]blobObject, error) {
+	var objects []blobObject
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(d.root, path)
+		key := filepath.ToSlash(rel)
+		if entry.IsDir() {
+			// Skip directories that cannot contain keys with prefix.
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, blobObject{Key: key, Size: info.Size(), LastModified: info.ModTime().UTC()})
+		return nil
+	})
+	return objects, err
+}
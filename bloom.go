@@ -0,0 +1,110 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// bloomFilter is a fixed-size set membership filter with no false
+// negatives and a configurable false-positive rate.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter sizes a filter for capacity items, at least one.
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	n := float64(max(capacity, 1))
+	m := uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / n * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// locations derives k bit positions by double hashing one 64-bit FNV hash.
+func (b *bloomFilter) locations(s string, fn func(uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	for i := uint64(0); i < b.k; i++ {
+		fn((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *bloomFilter) add(s string) {
+	b.locations(s, func(i uint64) { b.bits[i/64] |= 1 << (i % 64) })
+}
+
+func (b *bloomFilter) has(s string) bool {
+	found := true
+	b.locations(s, func(i uint64) {
+		if b.bits[i/64]&(1<<(i%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// rotatingBloom remembers what was added during roughly the last one to
+// two windows using two generations of filters, so memory stays bounded no
+// matter how long a session lives.
+type rotatingBloom struct {
+	mu        sync.RWMutex
+	current   *bloomFilter
+	previous  *bloomFilter
+	rotatedAt time.Time
+	usedAt    time.Time
+	capacity  int
+	fpRate    float64
+}
+
+func newRotatingBloom(capacity int, fpRate float64) *rotatingBloom {
+	now := time.Now()
+	return &rotatingBloom{
+		current:   newBloomFilter(capacity, fpRate),
+		previous:  newBloomFilter(capacity, fpRate),
+		rotatedAt: now,
+		usedAt:    now,
+		capacity:  capacity,
+		fpRate:    fpRate,
+	}
+}
+
+func (r *rotatingBloom) add(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current.add(s)
+	r.usedAt = time.Now()
+}
+
+func (r *rotatingBloom) has(s string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.has(s) || r.previous.has(s)
+}
+
+func (r *rotatingBloom) rotate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.previous = r.current
+	r.current = newBloomFilter(r.capacity, r.fpRate)
+	r.rotatedAt = time.Now()
+}
+
+// reset forgets everything, used when a session has seen the whole catalog.
+func (r *rotatingBloom) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.previous = newBloomFilter(r.capacity, r.fpRate)
+	r.current = newBloomFilter(r.capacity, r.fpRate)
+	r.rotatedAt = time.Now()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var staleServed = expvar.NewInt("metadata_stale_served")
+
+type cachedVideo struct {
+	info       *Video
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// metadataCache holds resolved upstream metadata by URL with
+// stale-while-revalidate semantics: entries younger than METADATA_CACHE_TTL
+// are served as-is, entries up to METADATA_STALE_TTL old are served
+// immediately while a single background refresh runs, and only older or
+// missing entries make the caller wait on the upstream.
+type metadataCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cachedVideo
+	inflight map[string]*inflightFetch
+}
+
+type inflightFetch struct {
+	done chan struct{}
+	info *Video
+	err  error
+}
+
+var videoCache = &metadataCache{
+	entries:  make(map[string]*cachedVideo),
+	inflight: make(map[string]*inflightFetch),
+}
+
+func (c *metadataCache) get(url string) (*Video, error) {
+	fresh := envDuration("METADATA_CACHE_TTL", 10*time.Minute)
+	stale := envDuration("METADATA_STALE_TTL", time.Hour)
+
+	c.mu.Lock()
+	if cached, ok := c.entries[url]; ok {
+		age := time.Since(cached.fetchedAt)
+		if age < fresh {
+			c.mu.Unlock()
+			return cached.info, nil
+		}
+		if age < stale {
+			if !cached.refreshing {
+				cached.refreshing = true
+				background(func() { c.fetch(url) })
+			}
+			c.mu.Unlock()
+			return cached.info, nil
+		}
+	}
+	c.mu.Unlock()
+
+	info, err := c.fetch(url)
+	if pe, ok := err.(*providerError); ok && pe.Kind == providerRateLimited {
+		// Expired metadata beats an error while the upstream is saturated.
+		if cached := c.peek(url); cached != nil {
+			staleServed.Add(1)
+			return cached, nil
+		}
+	}
+	return info, err
+}
+
+// fetch resolves url from the upstream, collapsing concurrent fetches of
+// the same URL into one.
+func (c *metadataCache) fetch(url string) (*Video, error) {
+	c.mu.Lock()
+	if f, ok := c.inflight[url]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.info, f.err
+	}
+	f := &inflightFetch{done: make(chan struct{})}
+	c.inflight[url] = f
+	c.mu.Unlock()
+
+	start := time.Now()
+	f.info, f.err = resolveVideo(url)
+	observeUpstream(url, start, f.err)
+	if f.err != nil {
+		publishEvent("resolve.failed", resolveFailure{URL: url, Error: f.err.Error()})
+	}
+	upstreamHealth.record(f.err)
+
+	c.mu.Lock()
+	delete(c.inflight, url)
+	if f.err == nil {
+		c.store(url, f.info)
+	} else if cached, ok := c.entries[url]; ok {
+		cached.refreshing = false
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.info, f.err
+}
+
+type resolveFailure struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// store must be called with c.mu held.
+func (c *metadataCache) store(url string, info *Video) {
+	if _, ok := c.entries[url]; !ok && len(c.entries) >= envInt("METADATA_CACHE_SIZE", 10000) {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[url] = &cachedVideo{info: info, fetchedAt: time.Now()}
+}
+
+// cachedAt returns when the metadata of url was fetched, if it is cached
+// and young enough to be served without waiting on the upstream.
+func (c *metadataCache) cachedAt(url string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.entries[url]
+	if !ok || time.Since(cached.fetchedAt) >= envDuration("METADATA_STALE_TTL", time.Hour) {
+		return time.Time{}, false
+	}
+	return cached.fetchedAt, true
+}
+
+// peek returns the cached metadata for url regardless of its age.
+func (c *metadataCache) peek(url string) *Video {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.entries[url]; ok {
+		return cached.info
+	}
+	return nil
+}
+
+func (c *metadataCache) evict(url string) {
+	c.mu.Lock()
+	delete(c.entries, url)
+	c.mu.Unlock()
+}
+
+// evictChanged is an invalidation hook dropping cached metadata for URLs
+// that were edited or left the catalog.
+func (c *metadataCache) evictChanged(ev invalidation) {
+	if ev.Op == "TRUNCATE" {
+		c.mu.Lock()
+		c.entries = make(map[string]*cachedVideo)
+		c.mu.Unlock()
+		return
+	}
+	if ev.URL != "" && (ev.Op == "UPDATE" || ev.Op == "DELETE") {
+		c.evict(ev.URL)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var captchaVerifyURLs = map[string]string{
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+}
+
+type captchaVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// captchaEnabled reports whether submissions must carry a captcha token.
+// It is switched on by setting CAPTCHA_PROVIDER to "turnstile" or "hcaptcha".
+func captchaEnabled() bool {
+	return os.Getenv("CAPTCHA_PROVIDER") != ""
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed when the request comes from one of TRUSTED_PROXIES, and then
+// read from the right, skipping the trusted proxies, so a client cannot
+// choose its address by sending the header itself.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies, _ := trustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if len(proxies) == 0 || !trustedProxy(proxies, host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(proxies, hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// trustedProxies parses a comma-separated list of addresses and CIDR
+// prefixes.
+func trustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func trustedProxy(proxies []netip.Prefix, host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyCaptcha(token, remoteIP string) error {
+	provider := strings.ToLower(os.Getenv("CAPTCHA_PROVIDER"))
+	verifyURL, ok := captchaVerifyURLs[provider]
+	if !ok {
+		return fmt.Errorf("unknown captcha provider: %s", provider)
+	}
+
+	if token == "" {
+		return fmt.Errorf("missing captcha token")
+	}
+
+	form := url.Values{}
+	form.Set("secret", os.Getenv("CAPTCHA_SECRET"))
+	form.Set("response", token)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.PostForm(verifyURL, form)
+	if err != nil {
+		return fmt.Errorf("error verifying captcha: %w", err)
+	}
+	defer response.Body.Close()
+
+	var result captchaVerifyResponse
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("error decoding captcha response: %w", err)
+	}
+
+	if !result.Success {
+		return fmt.Errorf("captcha rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CDN fronting: cacheable endpoints send Cache-Control, Vary and
+// surrogate keys (Surrogate-Key for Fastly, Cache-Tag for Cloudflare) so a
+// CDN can serve them, and removed content is purged by key.
+
+type cacheWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader keeps error responses out of shared caches.
+func (cw *cacheWriter) WriteHeader(status int) {
+	if !cw.wroteHeader && status >= 400 {
+		cw.Header().Set("Cache-Control", "no-store")
+		cw.Header().Del("Surrogate-Key")
+		cw.Header().Del("Cache-Tag")
+	}
+	cw.wroteHeader = true
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	return cw.ResponseWriter.Write(b)
+}
+
+// cacheable serves h with CACHE_CONTROL (a shared-cache policy by default)
+// and tags the response with keys for purging.
+func cacheable(h http.HandlerFunc, keys ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		control := os.Getenv("CACHE_CONTROL")
+		if control == "" {
+			control = "public, max-age=60, s-maxage=300, stale-while-revalidate=60"
+		}
+		w.Header().Set("Cache-Control", control)
+		w.Header().Set("Vary", "Accept-Encoding")
+		addSurrogateKeys(w, keys...)
+
+		h(&cacheWriter{ResponseWriter: w}, r)
+	}
+}
+
+// noStore marks per-request responses such as random picks as uncacheable.
+func noStore(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		h(w, r)
+	}
+}
+
+func addSurrogateKeys(w http.ResponseWriter, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	if existing := w.Header().Get("Surrogate-Key"); existing != "" {
+		keys = append(strings.Fields(existing), keys...)
+	}
+	w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+	w.Header().Set("Cache-Tag", strings.Join(keys, ","))
+}
+
+func videoSurrogateKey(urlID string) string {
+	return "video-" + urlID
+}
+
+// cdnPurger batches surrogate keys and purges them from the configured CDN
+// (CDN_PROVIDER=cloudflare with CDN_ZONE_ID, or fastly with
+// CDN_SERVICE_ID; CDN_API_TOKEN in both cases).
+var cdnPurger = struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}{pending: make(map[string]bool)}
+
+func purgeSurrogateKeys(keys ...string) {
+	if os.Getenv("CDN_PROVIDER") == "" {
+		return
+	}
+	cdnPurger.mu.Lock()
+	for _, k := range keys {
+		cdnPurger.pending[k] = true
+	}
+	cdnPurger.mu.Unlock()
+}
+
+func flushCDNPurges() error {
+	cdnPurger.mu.Lock()
+	keys := make([]string, 0, len(cdnPurger.pending))
+	for k := range cdnPurger.pending {
+		keys = append(keys, k)
+	}
+	cdnPurger.pending = make(map[string]bool)
+	cdnPurger.mu.Unlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	token := secret("CDN_API_TOKEN")
+
+	switch provider := os.Getenv("CDN_PROVIDER"); provider {
+	case "cloudflare":
+		// Cloudflare accepts at most 30 tags per purge request.
+		for start := 0; start < len(keys); start += 30 {
+			end := start + 30
+			if end > len(keys) {
+				end = len(keys)
+			}
+			target := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/purge_cache", os.Getenv("CDN_ZONE_ID"))
+			err := postJSON(alertClient, target, map[string][]string{"tags": keys[start:end]}, map[string]string{
+				"Authorization": "Bearer " + token,
+			})
+			if err != nil {
+				return fmt.Errorf("error purging cloudflare tags: %w", err)
+			}
+		}
+	case "fastly":
+		target := fmt.Sprintf("https://api.fastly.com/service/%s/purge", os.Getenv("CDN_SERVICE_ID"))
+		err := postJSON(alertClient, target, map[string][]string{"surrogate_keys": keys}, map[string]string{
+			"Fastly-Key": token,
+		})
+		if err != nil {
+			return fmt.Errorf("error purging fastly keys: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown CDN_PROVIDER %q", provider)
+	}
+
+	log.Printf("Purged %d surrogate key(s) from the CDN.\n", len(keys))
+	return nil
+}
+
+// purgeRemovedContent is an invalidation hook: when a URL leaves the
+// active catalog, its video and every listing that could include it are
+// purged.
+func purgeRemovedContent(ev invalidation) {
+	if ev.Op == "INSERT" || (ev.Op == "UPDATE" && ev.Status == "active") {
+		return
+	}
+	keys := []string{"catalog"}
+	if ev.ID != "" {
+		keys = append(keys, videoSurrogateKey(ev.ID))
+	}
+	purgeSurrogateKeys(keys...)
+}
+
+func init() {
+	schedule("cdn-purge", "CDN_PURGE_INTERVAL", 2*time.Second, flushCDNPurges)
+}
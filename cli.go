@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a maintenance subcommand of the server binary, run as
+// `shoti-srv <name> [flags]` instead of starting the server.
+type command struct {
+	Summary string
+	Run     func(args []string) error
+}
+
+var commands = map[string]command{}
+
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		}
+		printUsage()
+		return 2
+	}
+
+	if err := cmd.Run(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: shoti-srv [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nWithout a command the server starts. Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].Summary)
+	}
+}
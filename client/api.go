@@ -0,0 +1,448 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Video is a served video, as returned by /api/get, /api/daily and
+// playlists.
+type Video struct {
+	Region   string `json:"region"`
+	URL      string `json:"url"`
+	Cover    string `json:"cover"`
+	Title    string `json:"title"`
+	Duration string `json:"duration"`
+	VideoID  string `json:"video_id"`
+	// ServeID identifies this serve for Report.
+	ServeID string `json:"serve_id"`
+	User    struct {
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+		UserID   string `json:"userID"`
+	} `json:"user"`
+	// Subtitles are the caption tracks of the video, if it has any.
+	Subtitles []Subtitle `json:"subtitles"`
+}
+
+// Subtitle is a caption track. Format is "webvtt" or "srt".
+type Subtitle struct {
+	Language string `json:"language"`
+	Format   string `json:"format"`
+	URL      string `json:"url"`
+}
+
+// RandomOptions narrows the selection of Random. The zero value picks any
+// active video.
+type RandomOptions struct {
+	Hashtag    string
+	MusicID    string
+	Collection string
+	MinLikes   int64
+	MinPlays   int64
+	// Session avoids repeating videos already served to the session.
+	Session string
+	// Seed makes the pick deterministic.
+	Seed string
+	// User selects the end user for favorites and cohorts.
+	User string
+	// FromFavorites picks from the favorites of the API key (and User).
+	FromFavorites bool
+	Country       string
+	Exclude       []string
+	// Quality "discord" asks for a transcoded rendition under 8 MB when
+	// the server offers one.
+	Quality string
+}
+
+// Random returns a random video.
+func (c *Client) Random(ctx context.Context, opts RandomOptions) (*Video, error) {
+	var video Video
+	_, err := c.data(ctx, randomRequest(opts), &video)
+	return &video, err
+}
+
+// DryRun is the video Random would have returned.
+type DryRun struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Collection string `json:"collection"`
+	Strategy   string `json:"strategy"`
+	// Cached is whether the metadata would be served without an upstream
+	// lookup.
+	Cached   bool       `json:"cached"`
+	CachedAt *time.Time `json:"cached_at"`
+}
+
+// DryRun reports which URL Random would pick with opts, without resolving
+// it or counting a serve.
+func (c *Client) DryRun(ctx context.Context, opts RandomOptions) (*DryRun, error) {
+	req := randomRequest(opts)
+	req.query.Set("dry_run", "true")
+	var pick DryRun
+	_, err := c.data(ctx, req, &pick)
+	return &pick, err
+}
+
+func randomRequest(opts RandomOptions) request {
+	query := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	set("hashtag", opts.Hashtag)
+	set("music_id", opts.MusicID)
+	set("collection", opts.Collection)
+	set("session", opts.Session)
+	set("seed", opts.Seed)
+	set("user", opts.User)
+	set("country", opts.Country)
+	set("quality", opts.Quality)
+	if opts.MinLikes > 0 {
+		query.Set("min_likes", strconv.FormatInt(opts.MinLikes, 10))
+	}
+	if opts.MinPlays > 0 {
+		query.Set("min_plays", strconv.FormatInt(opts.MinPlays, 10))
+	}
+	if opts.FromFavorites {
+		query.Set("from", "favorites")
+	}
+
+	req := request{method: http.MethodGet, path: "/api/get", query: query, signed: true}
+	if len(opts.Exclude) > 0 {
+		// Long exclusion lists go in the body instead of the URL.
+		req.method = http.MethodPost
+		req.body = map[string][]string{"exclude": opts.Exclude}
+	}
+	return req
+}
+
+// Daily returns the video of the day, the same for every caller until
+// midnight UTC.
+func (c *Client) Daily(ctx context.Context) (*Video, error) {
+	var video Video
+	_, err := c.data(ctx, request{method: http.MethodGet, path: "/api/daily"}, &video)
+	return &video, err
+}
+
+// URL is a catalog entry.
+type URL struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Collection is set for URLs added through a collection route.
+	Collection string `json:"collection,omitempty"`
+}
+
+// AddURL submits a TikTok URL to the catalog. captchaToken is required when
+// the instance has captcha enabled.
+func (c *Client) AddURL(ctx context.Context, videoURL, captchaToken string) (*URL, error) {
+	req := request{method: http.MethodPost, path: "/api/new", body: URL{URL: videoURL}, unsafe: true}
+	if captchaToken != "" {
+		req.header = http.Header{"X-Captcha-Token": {captchaToken}}
+	}
+	var added URL
+	_, err := c.do(ctx, req, &added)
+	return &added, err
+}
+
+// Submission is an asynchronous submission of a URL.
+type Submission struct {
+	ID string `json:"id"`
+	// URLID is the id the URL has in the catalog once accepted.
+	URLID     string    `json:"url_id"`
+	URL       string    `json:"url"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Done reports whether the submission was accepted or failed.
+func (s *Submission) Done() bool {
+	return s.Status == "accepted" || s.Status == "failed"
+}
+
+// SubmitURL submits a TikTok URL without waiting for it to be added; poll
+// Submission for the outcome.
+func (c *Client) SubmitURL(ctx context.Context, videoURL, captchaToken string) (*Submission, error) {
+	req := request{method: http.MethodPost, path: "/api/new", body: URL{URL: videoURL}, unsafe: true, header: http.Header{"Prefer": {"respond-async"}}}
+	if captchaToken != "" {
+		req.header.Set("X-Captcha-Token", captchaToken)
+	}
+	var s Submission
+	_, err := c.do(ctx, req, &s)
+	return &s, err
+}
+
+// Submission returns the status of a submission made with SubmitURL.
+func (c *Client) Submission(ctx context.Context, id string) (*Submission, error) {
+	var s Submission
+	_, err := c.data(ctx, request{method: http.MethodGet, path: "/api/submissions/" + url.PathEscape(id)}, &s)
+	return &s, err
+}
+
+// ListURLs returns every URL in the catalog.
+func (c *Client) ListURLs(ctx context.Context) ([]URL, error) {
+	var urls []URL
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/api/list"}, &urls)
+	return urls, err
+}
+
+// CatalogVideo is a catalog entry with its resolved metadata.
+type CatalogVideo struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Status     string `json:"status"`
+	Collection string `json:"collection"`
+	VideoID    string `json:"video_id"`
+	Title      string `json:"title"`
+	Duration   int    `json:"duration"`
+	Region     string `json:"region"`
+	Author     struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+	} `json:"author"`
+	Music struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"music"`
+	Stats struct {
+		Plays    int64 `json:"plays"`
+		Likes    int64 `json:"likes"`
+		Comments int64 `json:"comments"`
+		Shares   int64 `json:"shares"`
+		Serves   int64 `json:"serves"`
+	} `json:"stats"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	Version    int64      `json:"version"`
+}
+
+// VideosQuery filters and paginates Videos. Zero fields use the server
+// defaults.
+type VideosQuery struct {
+	Page       int
+	Cursor     string // NextCursor of the previous page, instead of Page
+	PerPage    int
+	Sort       string // newest, oldest, likes, plays or serves
+	Status     string // active (default), suspended, blocked, archived or all
+	Collection string
+	Author     string
+	Hashtag    string
+	Search     string
+	MinLikes   int64
+	MinPlays   int64
+}
+
+// VideosPage is one page of Videos.
+type VideosPage struct {
+	Videos     []CatalogVideo `json:"videos"`
+	Page       int            `json:"page"`
+	PerPage    int            `json:"per_page"`
+	Total      int            `json:"total"` // -1 on pages requested by Cursor
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// Videos lists the catalog with resolved metadata.
+func (c *Client) Videos(ctx context.Context, q VideosQuery) (*VideosPage, error) {
+	query := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	setInt := func(name string, value int64) {
+		if value > 0 {
+			query.Set(name, strconv.FormatInt(value, 10))
+		}
+	}
+	setInt("page", int64(q.Page))
+	setInt("per_page", int64(q.PerPage))
+	set("cursor", q.Cursor)
+	set("sort", q.Sort)
+	set("status", q.Status)
+	set("collection", q.Collection)
+	set("author", q.Author)
+	set("hashtag", strings.TrimPrefix(q.Hashtag, "#"))
+	set("q", q.Search)
+	setInt("min_likes", q.MinLikes)
+	setInt("min_plays", q.MinPlays)
+
+	var page VideosPage
+	_, err := c.data(ctx, request{method: http.MethodGet, path: "/api/videos", query: query}, &page)
+	return &page, err
+}
+
+// RelatedVideo is a video sharing the author, music or hashtags of
+// another. Score is 3 for the same author, 2 for the same music and 1 per
+// shared hashtag.
+type RelatedVideo struct {
+	CatalogVideo
+	SameAuthor     bool `json:"same_author"`
+	SameMusic      bool `json:"same_music"`
+	SharedHashtags int  `json:"shared_hashtags"`
+	Score          int  `json:"score"`
+}
+
+// Related returns up to limit (0 for the server default) active videos
+// related to videoID, an upstream video id or URL id, best matches first.
+func (c *Client) Related(ctx context.Context, videoID string, limit int) ([]RelatedVideo, error) {
+	var related []RelatedVideo
+	req := request{method: http.MethodGet, path: "/api/related/" + url.PathEscape(videoID), query: limitQuery(limit)}
+	_, err := c.data(ctx, req, &related)
+	return related, err
+}
+
+// StatsPoint is a snapshot of the engagement stats of a video. Change is
+// the difference from the previous point, nil on the first.
+type StatsPoint struct {
+	Time     time.Time `json:"time"`
+	Plays    int64     `json:"plays"`
+	Likes    int64     `json:"likes"`
+	Comments int64     `json:"comments"`
+	Shares   int64     `json:"shares"`
+	Change   *struct {
+		Plays    int64 `json:"plays"`
+		Likes    int64 `json:"likes"`
+		Comments int64 `json:"comments"`
+		Shares   int64 `json:"shares"`
+	} `json:"change,omitempty"`
+}
+
+// History returns up to limit (0 for the server default) snapshots of the
+// stats of videoID, an upstream video id or URL id, taken after since (any
+// time when zero), oldest first.
+func (c *Client) History(ctx context.Context, videoID string, since time.Time, limit int) ([]StatsPoint, error) {
+	query := limitQuery(limit)
+	if !since.IsZero() {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("since", since.UTC().Format(time.RFC3339))
+	}
+	var history struct {
+		Points []StatsPoint `json:"points"`
+	}
+	req := request{method: http.MethodGet, path: "/api/videos/" + url.PathEscape(videoID) + "/history", query: query}
+	_, err := c.data(ctx, req, &history)
+	return history.Points, err
+}
+
+// QR returns a PNG QR code of the /watch/ link of videoID, a public video
+// id or URL id, with scale pixels per module (0 for the server default) at
+// error correction level L, M, Q or H ("" for M).
+func (c *Client) QR(ctx context.Context, videoID string, scale int, level string) ([]byte, error) {
+	query := url.Values{}
+	if scale > 0 {
+		query.Set("scale", strconv.Itoa(scale))
+	}
+	if level != "" {
+		query.Set("level", level)
+	}
+	var png []byte
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/api/qr/" + url.PathEscape(videoID), query: query}, &png)
+	return png, err
+}
+
+// Report flags a served video, identified by the ServeID of the response
+// it came in, for moderation.
+func (c *Client) Report(ctx context.Context, serveID, reason string) error {
+	body := map[string]string{"serve_id": serveID, "reason": reason}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/api/report", body: body}, nil)
+	return err
+}
+
+// Hashtag is a tag with the number of active videos carrying it.
+type Hashtag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// Hashtags lists up to limit tags (0 for the server default).
+func (c *Client) Hashtags(ctx context.Context, limit int) ([]Hashtag, error) {
+	var tags []Hashtag
+	_, err := c.data(ctx, request{method: http.MethodGet, path: "/api/hashtags", query: limitQuery(limit)}, &tags)
+	return tags, err
+}
+
+// Music is a sound with the number of active videos using it.
+type Music struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Count int    `json:"count"`
+}
+
+// TopMusic lists the most used sounds (limit 0 for the server default).
+func (c *Client) TopMusic(ctx context.Context, limit int) ([]Music, error) {
+	var music []Music
+	_, err := c.data(ctx, request{method: http.MethodGet, path: "/api/music/top", query: limitQuery(limit)}, &music)
+	return music, err
+}
+
+// Playlist is a fixed, non-repeating selection stepped through with
+// PlaylistNext.
+type Playlist struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+	Next string `json:"next"`
+}
+
+// CreatePlaylist creates a playlist of size videos.
+func (c *Client) CreatePlaylist(ctx context.Context, size int) (*Playlist, error) {
+	var playlist Playlist
+	req := request{method: http.MethodPost, path: "/api/playlist", body: map[string]int{"size": size}, unsafe: true}
+	_, err := c.data(ctx, req, &playlist)
+	return &playlist, err
+}
+
+// PlaylistNext returns the next video of the playlist. Each call advances
+// the playlist, so it is not retried after a server error.
+func (c *Client) PlaylistNext(ctx context.Context, playlistID string) (*Video, error) {
+	var video Video
+	_, err := c.data(ctx, request{method: http.MethodGet, path: "/api/playlist/" + url.PathEscape(playlistID) + "/next", unsafe: true}, &video)
+	return &video, err
+}
+
+// Collage returns a JPEG grid of the covers of videoIDs, public video ids
+// or URL ids, in order. tile is the width of a cover in pixels and cols the
+// number of columns, 0 for the server defaults.
+func (c *Client) Collage(ctx context.Context, videoIDs []string, tile, cols int) ([]byte, error) {
+	query := collageQuery(tile, cols)
+	query.Set("ids", strings.Join(videoIDs, ","))
+	var jpeg []byte
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/api/collage", query: query}, &jpeg)
+	return jpeg, err
+}
+
+// PlaylistCollage returns the collage of the videos of a playlist; see
+// Collage.
+func (c *Client) PlaylistCollage(ctx context.Context, playlistID string, tile, cols int) ([]byte, error) {
+	var jpeg []byte
+	req := request{method: http.MethodGet, path: "/api/playlist/" + url.PathEscape(playlistID) + "/collage", query: collageQuery(tile, cols)}
+	_, err := c.do(ctx, req, &jpeg)
+	return jpeg, err
+}
+
+func collageQuery(tile, cols int) url.Values {
+	query := url.Values{}
+	if tile > 0 {
+		query.Set("tile", strconv.Itoa(tile))
+	}
+	if cols > 0 {
+		query.Set("cols", strconv.Itoa(cols))
+	}
+	return query
+}
+
+func limitQuery(limit int) url.Values {
+	if limit <= 0 {
+		return nil
+	}
+	return url.Values{"limit": {strconv.Itoa(limit)}}
+}
@@ -0,0 +1,320 @@
+// Package client is a typed Go client for the shoti-srv API.
+//
+//	c := client.New("https://shoti.example.com", client.WithAPIKey(key))
+//	video, err := c.Random(ctx, client.RandomOptions{Hashtag: "cats"})
+//
+// Requests that fail with a network error, 429 or 5xx are retried with
+// exponential backoff and jitter, honouring Retry-After. Requests that
+// create something (AddURL, CreatePlaylist) are only retried on 429 and 503,
+// when the server is known not to have processed them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls a shoti-srv instance. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	signingID  string
+	verifyKey  ed25519.PublicKey
+	httpClient *http.Client
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sends key as X-API-Key, required for favorites and used for
+// per-key quotas.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithSigningKey signs every request with key, a key issued for signing
+// with the given id, instead of sending it.
+func WithSigningKey(id, key string) Option {
+	return func(c *Client) {
+		c.signingID = id
+		c.apiKey = key
+	}
+}
+
+// WithResponseVerification makes Random and DryRun fail unless the
+// response is signed with key, the instance's RESPONSE_SIGNING_KEY (see
+// its /.well-known/jwks.json).
+func WithResponseVerification(key ed25519.PublicKey) Option {
+	return func(c *Client) { c.verifyKey = key }
+}
+
+// WithHTTPClient replaces the default http.Client (30s timeout).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times a failed request is retried (default 3)
+// and the backoff bounds (default 200ms to 5s).
+func WithRetries(max int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New returns a client for the instance at baseURL.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is returned for responses with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("shoti: %d %s", e.StatusCode, e.Msg)
+}
+
+// envelope is the {code, msg, data} wrapper of most responses.
+type envelope struct {
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+// request describes one API call. Unsafe requests are only retried when the
+// server is known not to have processed them.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	unsafe bool
+	header http.Header
+	// signed responses are verified with WithResponseVerification.
+	signed bool
+}
+
+func (c *Client) do(ctx context.Context, req request, out interface{}) (*http.Response, error) {
+	var payload []byte
+	if req.body != nil {
+		var err error
+		if payload, err = json.Marshal(req.body); err != nil {
+			return nil, err
+		}
+	}
+
+	target := c.baseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, target, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range req.header {
+			httpReq.Header[name] = values
+		}
+		if payload != nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+		if c.signingID != "" {
+			if err := c.sign(httpReq, payload); err != nil {
+				return nil, err
+			}
+		} else if c.apiKey != "" {
+			httpReq.Header.Set("X-API-Key", c.apiKey)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		if attempt < c.maxRetries && c.retryable(req, resp, err) {
+			if werr := sleep(ctx, c.backoff(attempt, resp)); werr != nil {
+				return nil, werr
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 300 {
+			return resp, decodeError(resp.StatusCode, body)
+		}
+		if req.signed && c.verifyKey != nil {
+			if err := VerifyResponse(c.verifyKey, body, resp.Header.Get("X-JWS-Signature")); err != nil {
+				return resp, err
+			}
+		}
+		switch out := out.(type) {
+		case nil:
+		case *[]byte:
+			// Images are returned as they are.
+			*out = body
+		default:
+			if err := json.Unmarshal(body, out); err != nil {
+				return resp, fmt.Errorf("shoti: decoding %s response: %w", req.path, err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) retryable(req request, resp *http.Response, err error) bool {
+	if err != nil {
+		return !req.unsafe && ctxErr(err) == nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		return true
+	case resp.StatusCode >= 500:
+		return !req.unsafe
+	}
+	return false
+}
+
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	d := c.minBackoff << attempt
+	if d <= 0 || d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	// Full jitter keeps many bots from retrying in lockstep.
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func ctxErr(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return nil
+}
+
+func decodeError(status int, body []byte) error {
+	var env envelope
+	if json.Unmarshal(body, &env) == nil && env.Msg != "" {
+		return &Error{StatusCode: status, Msg: env.Msg}
+	}
+	return &Error{StatusCode: status, Msg: strings.TrimSpace(string(body))}
+}
+
+// data calls req and decodes the data field of the response envelope.
+func (c *Client) data(ctx context.Context, req request, out interface{}) (*http.Response, error) {
+	var env envelope
+	resp, err := c.do(ctx, req, &env)
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(env.Data, out); err != nil {
+		return resp, fmt.Errorf("shoti: decoding %s data: %w", req.path, err)
+	}
+	return resp, nil
+}
+
+// ErrBadResponseSignature is returned for responses whose X-JWS-Signature
+// is missing or does not verify.
+var ErrBadResponseSignature = errors.New("shoti: response signature is invalid")
+
+// VerifyResponse checks signature, the X-JWS-Signature header of a
+// response, against its body and the instance's public key.
+func VerifyResponse(key ed25519.PublicKey, body []byte, signature string) error {
+	protected, sig, ok := strings.Cut(signature, "..")
+	if !ok {
+		return ErrBadResponseSignature
+	}
+	header, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return ErrBadResponseSignature
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(header, &h) != nil || h.Alg != "EdDSA" {
+		return ErrBadResponseSignature
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrBadResponseSignature
+	}
+	input := protected + "." + base64.RawURLEncoding.EncodeToString(body)
+	if !ed25519.Verify(key, []byte(input), raw) {
+		return ErrBadResponseSignature
+	}
+	return nil
+}
+
+// sign sets the signature headers of req, whose body is payload. Every
+// attempt gets a new nonce, as the server refuses repeated ones.
+func (c *Client) sign(req *http.Request, payload []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := crand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := sha256.Sum256(payload)
+	mac := hmac.New(sha256.New, []byte(c.apiKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x\n%x", req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+
+	req.Header.Set("X-Key-Id", c.signingID)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,707 @@
+// Code generated by `shoti-srv client-ts` from openapi.json. DO NOT EDIT.
+// shoti-srv API 1.0.0
+
+export interface ClientOptions {
+  /** Sent as X-API-Key; required for favorites. */
+  apiKey?: string;
+  /** Retries after network errors, 429 and 5xx (default 3). */
+  retries?: number;
+  minBackoffMs?: number;
+  maxBackoffMs?: number;
+  fetch?: typeof fetch;
+}
+
+export class ShotiError extends Error {
+  constructor(public readonly status: number, message: string) {
+    super(`shoti: ${status} ${message}`);
+    this.name = "ShotiError";
+  }
+}
+
+type Query = Record<string, string | number | boolean | undefined>;
+
+class BaseClient {
+  private readonly baseUrl: string;
+  private readonly options: Required<Omit<ClientOptions, "apiKey">> & { apiKey?: string };
+
+  constructor(baseUrl: string, options: ClientOptions = {}) {
+    this.baseUrl = baseUrl.replace(/\/+$/, "");
+    this.options = {
+      retries: 3,
+      minBackoffMs: 200,
+      maxBackoffMs: 5000,
+      fetch: globalThis.fetch.bind(globalThis),
+      ...options,
+    };
+  }
+
+  protected async request<T>(method: string, path: string, query: Query, headers: Record<string, string | undefined>, body: unknown, unsafe: boolean, binary = false): Promise<T> {
+    const url = new URL(this.baseUrl + path);
+    for (const [name, value] of Object.entries(query)) {
+      if (value !== undefined && value !== "") url.searchParams.set(name, String(value));
+    }
+    const init: RequestInit = { method, headers: {} };
+    const h = init.headers as Record<string, string>;
+    for (const [name, value] of Object.entries(headers)) {
+      if (value !== undefined) h[name] = value;
+    }
+    if (this.options.apiKey) h["X-API-Key"] = this.options.apiKey;
+    if (body !== undefined) {
+      h["Content-Type"] = "application/json";
+      init.body = JSON.stringify(body);
+    }
+
+    for (let attempt = 0; ; attempt++) {
+      let res: Response;
+      try {
+        res = await this.options.fetch(url, init);
+      } catch (err) {
+        if (unsafe || attempt >= this.options.retries) throw err;
+        await sleep(this.backoff(attempt));
+        continue;
+      }
+
+      const retryable = res.status === 429 || res.status === 503 || (!unsafe && res.status >= 500);
+      if (retryable && attempt < this.options.retries) {
+        await sleep(this.backoff(attempt, res.headers.get("Retry-After")));
+        continue;
+      }
+
+      if (res.ok && binary) return (await res.blob()) as T;
+      const text = await res.text();
+      if (!res.ok) {
+        let message = text.trim();
+        try {
+          message = JSON.parse(text).msg ?? message;
+        } catch {
+          // Not every error is JSON.
+        }
+        throw new ShotiError(res.status, message);
+      }
+      return (text ? JSON.parse(text) : undefined) as T;
+    }
+  }
+
+  private backoff(attempt: number, retryAfter?: string | null): number {
+    const seconds = Number(retryAfter);
+    if (retryAfter && Number.isInteger(seconds) && seconds >= 0) return seconds * 1000;
+    const max = Math.min(this.options.minBackoffMs * 2 ** attempt, this.options.maxBackoffMs);
+    return Math.random() * max;
+  }
+}
+
+function sleep(ms: number): Promise<void> {
+  return new Promise((resolve) => setTimeout(resolve, ms));
+}
+
+export interface CatalogAuthor {
+  id: string;
+  nickname: string;
+  username: string;
+}
+
+export interface CatalogMusic {
+  id: string;
+  title: string;
+}
+
+export interface CatalogStats {
+  comments: number;
+  likes: number;
+  plays: number;
+  serves: number;
+  shares: number;
+}
+
+export interface CatalogVideo {
+  author: CatalogAuthor;
+  collection: string;
+  created_at: string;
+  duration: number;
+  id: string;
+  music: CatalogMusic;
+  region: string;
+  resolved_at: string | null;
+  stats: CatalogStats;
+  status: string;
+  title: string;
+  url: string;
+  /** Changes on every moderation change; admin changes send it in If-Match. */
+  version: number;
+  video_id: string;
+}
+
+export interface DryRun {
+  /** Whether the metadata would be served without an upstream lookup. */
+  cached: boolean;
+  cached_at?: string;
+  collection: string;
+  id: string;
+  /** Selection strategy that picked the URL, such as uniform or pinned. */
+  strategy: string;
+  url: string;
+}
+
+export interface DryRunResponse {
+  code: number;
+  data: DryRun;
+  msg: string;
+}
+
+export interface Hashtag {
+  count: number;
+  tag: string;
+}
+
+export interface HashtagsResponse {
+  code: number;
+  data: Hashtag[];
+  msg: string;
+}
+
+export interface History {
+  id: string;
+  points: StatsPoint[];
+  video_id: string;
+}
+
+export interface HistoryResponse {
+  code: number;
+  data: History;
+  msg: string;
+}
+
+export interface LegacyVideo {
+  cover: string;
+  duration: string;
+  region: string;
+  title: string;
+  url: string;
+  user: User;
+}
+
+export interface LegacyVideoResponse {
+  code: number;
+  data: LegacyVideo;
+  message: string;
+  result: LegacyVideo;
+}
+
+export interface Music {
+  count: number;
+  id: string;
+  title: string;
+}
+
+export interface MusicResponse {
+  code: number;
+  data: Music[];
+  msg: string;
+}
+
+export interface NewURL {
+  url: string;
+}
+
+export interface Playlist {
+  id: string;
+  next: string;
+  size: number;
+}
+
+export interface PlaylistRequest {
+  size?: number;
+}
+
+export interface PlaylistResponse {
+  code: number;
+  data: Playlist;
+  msg: string;
+}
+
+export interface RelatedResponse {
+  code: number;
+  data: RelatedVideo[];
+  msg: string;
+}
+
+export interface RelatedVideo {
+  author: CatalogAuthor;
+  collection: string;
+  created_at: string;
+  duration: number;
+  id: string;
+  music: CatalogMusic;
+  region: string;
+  resolved_at: string | null;
+  same_author: boolean;
+  same_music: boolean;
+  /** 3 for the same author, 2 for the same music and 1 per shared hashtag. */
+  score: number;
+  shared_hashtags: number;
+  stats: CatalogStats;
+  status: string;
+  title: string;
+  url: string;
+  version: number;
+  video_id: string;
+}
+
+export interface ReportRequest {
+  reason?: string;
+  serve_id: string;
+}
+
+export interface SelectionBody {
+  exclude?: string[];
+}
+
+export interface StatsChange {
+  comments: number;
+  likes: number;
+  plays: number;
+  shares: number;
+}
+
+export interface StatsPoint {
+  change?: StatsChange;
+  comments: number;
+  likes: number;
+  plays: number;
+  shares: number;
+  time: string;
+}
+
+export interface Status {
+  code: number;
+  /** Machine-readable failure code, such as catalog_empty. */
+  error?: string;
+  hint?: string;
+  msg: string;
+}
+
+export interface Submission {
+  created_at: string;
+  error?: string;
+  id: string;
+  status: "pending" | "processing" | "accepted" | "failed";
+  updated_at: string;
+  url: string;
+  /** Id of the URL in the catalog once accepted. */
+  url_id: string;
+}
+
+export interface SubmissionResponse {
+  code: number;
+  data: Submission;
+  msg: string;
+}
+
+export interface Subtitle {
+  /** webvtt or srt. */
+  format: string;
+  language: string;
+  url: string;
+}
+
+export interface TakedownReceipt {
+  id: string;
+}
+
+export interface TakedownRequest {
+  email: string;
+  name: string;
+  statement: string;
+  url: string;
+}
+
+export interface TakedownResponse {
+  code: number;
+  data: TakedownReceipt;
+  msg: string;
+}
+
+export interface URLEntry {
+  /** Set for URLs added through a collection route. */
+  collection?: string;
+  id: string;
+  url: string;
+}
+
+export interface URLListResponse {
+  code: number;
+  data: URLEntry[];
+  msg: string;
+  /** Cursor of the next page, when paginating and the page is full. */
+  next_cursor?: string;
+}
+
+export interface URLResponse {
+  code: number;
+  data: URLEntry;
+  msg: string;
+}
+
+export interface User {
+  nickname: string;
+  userID: string;
+  username: string;
+}
+
+export interface UserV2 {
+  nickname: string;
+  user_id: string;
+  username: string;
+}
+
+export interface Video {
+  cover: string;
+  duration: string;
+  region: string;
+  /** Identifies this serve for reportVideo. */
+  serve_id?: string;
+  /** Caption tracks, when the provider has any. */
+  subtitles?: Subtitle[];
+  title: string;
+  url: string;
+  user: User;
+  video_id: string;
+}
+
+export interface VideoResponse {
+  code: number;
+  data: Video;
+  msg: string;
+}
+
+export interface VideoResponseV2 {
+  code: number;
+  data: VideoV2;
+  msg: string;
+}
+
+export interface VideoV2 {
+  cover: string;
+  /** When the URL was added to the catalog. */
+  created_at?: string;
+  /** Seconds. */
+  duration: number;
+  /** When the video was posted upstream. */
+  posted_at?: string;
+  region: string;
+  /** Identifies this serve for reportVideo. */
+  serve_id?: string;
+  /** Caption tracks, when the provider has any. */
+  subtitles?: Subtitle[];
+  title: string;
+  url: string;
+  user: UserV2;
+  video_id: string;
+}
+
+export interface VideosPage {
+  /** Continues after this page when sorted by newest or oldest. */
+  next_cursor?: string;
+  page: number;
+  per_page: number;
+  /** -1 on pages requested by cursor. */
+  total: number;
+  videos: CatalogVideo[];
+}
+
+export interface VideosResponse {
+  code: number;
+  data: VideosPage;
+  msg: string;
+}
+
+export interface CollageParams {
+  /** Comma-separated public video ids or URL ids; unknown ones are skipped. */
+  ids: string;
+  /** Width of a cover in pixels, 60 to 480, default 180; covers are 3:4. */
+  tile?: number;
+  /** Number of columns, by default enough for a square grid. */
+  cols?: number;
+}
+
+export interface AddFavoriteParams {
+  /** End user of the bot, for favorites and cohorts. */
+  user?: string;
+}
+
+export interface RemoveFavoriteParams {
+  /** End user of the bot, for favorites and cohorts. */
+  user?: string;
+}
+
+export interface GetRandomParams {
+  hashtag?: string;
+  music_id?: string;
+  collection?: string;
+  min_likes?: number;
+  min_plays?: number;
+  /** Avoid repeating videos already served to this session. */
+  session?: string;
+  /** Makes the pick deterministic. */
+  seed?: string;
+  /** End user of the bot, for favorites and cohorts. */
+  user?: string;
+  from?: "favorites";
+  /** ISO 3166-1 alpha-2 country of the viewer. */
+  country?: string;
+  /** Comma-separated URL ids to skip. */
+  exclude?: string;
+  /** discord points the video URL at a transcoded rendition under 8 MB when transcoding is enabled. */
+  quality?: "original" | "discord";
+}
+
+export interface GetRandomExcludingParams {
+  hashtag?: string;
+  music_id?: string;
+  collection?: string;
+  /** Avoid repeating videos already served to this session. */
+  session?: string;
+  /** End user of the bot, for favorites and cohorts. */
+  user?: string;
+  /** ISO 3166-1 alpha-2 country of the viewer. */
+  country?: string;
+}
+
+export interface ListHashtagsParams {
+  limit?: number;
+}
+
+export interface ListURLsParams {
+  /** Paginates the list in pages of this size, in insertion order. */
+  limit?: number;
+  /** next_cursor of the previous page. */
+  cursor?: string;
+}
+
+export interface TopMusicParams {
+  limit?: number;
+}
+
+export interface AddURLParams {
+  /** Required when captcha is enabled. */
+  captchaToken?: string;
+  /** respond-async to get 202 with a submission instead of waiting for the URL to be added. */
+  prefer?: string;
+  /** Same as Prefer: respond-async. */
+  async?: boolean;
+}
+
+export interface PlaylistCollageParams {
+  /** Width of a cover in pixels, 60 to 480, default 180; covers are 3:4. */
+  tile?: number;
+  /** Number of columns, by default enough for a square grid. */
+  cols?: number;
+}
+
+export interface QrCodeParams {
+  /** Pixels per module, 1 to 32, default 8. */
+  scale?: number;
+  /** Error correction level, default M. */
+  level?: "L" | "M" | "Q" | "H";
+}
+
+export interface ListRelatedParams {
+  /** 1 to 50, default 10. */
+  limit?: number;
+  /** ISO 3166-1 alpha-2 country of the viewer. */
+  country?: string;
+}
+
+export interface SubmitTakedownParams {
+  /** Required when captcha is enabled. */
+  captchaToken?: string;
+}
+
+export interface GetRandomLegacyParams {
+  hashtag?: string;
+  collection?: string;
+}
+
+export interface GetRandomV2Params {
+  hashtag?: string;
+  music_id?: string;
+  collection?: string;
+  min_likes?: number;
+  min_plays?: number;
+  /** Avoid repeating videos already served to this session. */
+  session?: string;
+  /** Makes the pick deterministic. */
+  seed?: string;
+  /** End user of the bot, for favorites and cohorts. */
+  user?: string;
+  from?: "favorites";
+  /** ISO 3166-1 alpha-2 country of the viewer. */
+  country?: string;
+  /** Comma-separated URL ids to skip. */
+  exclude?: string;
+  /** discord points the video URL at a transcoded rendition under 8 MB when transcoding is enabled. */
+  quality?: "original" | "discord";
+}
+
+export interface ListURLsV2Params {
+  /** Paginates the list in pages of this size, in insertion order. */
+  limit?: number;
+  /** next_cursor of the previous page. */
+  cursor?: string;
+}
+
+export interface AddURLV2Params {
+  /** Required when captcha is enabled. */
+  captchaToken?: string;
+}
+
+export interface ListVideosParams {
+  page?: number;
+  per_page?: number;
+  /** next_cursor of the previous page. */
+  cursor?: string;
+  sort?: "newest" | "oldest" | "likes" | "plays" | "serves";
+  status?: "active" | "suspended" | "blocked" | "archived" | "all";
+  collection?: string;
+  author?: string;
+  hashtag?: string;
+  /** Case-insensitive title search. */
+  q?: string;
+  min_likes?: number;
+  min_plays?: number;
+  resolved?: boolean;
+}
+
+export interface VideoHistoryParams {
+  /** Only snapshots after this RFC 3339 time. */
+  since?: string;
+  /** 1 to 1000, default 1000. */
+  limit?: number;
+}
+
+export class ShotiClient extends BaseClient {
+  /** A JPEG grid of the covers of some videos, in order. Covers that cannot be fetched are left blank. */
+  collage(params: CollageParams): Promise<Blob> {
+    return this.request<Blob>("GET", `/api/collage`, { "ids": params.ids, "tile": params.tile, "cols": params.cols }, {}, undefined, false, true);
+  }
+
+  /** The video of the day, the same for every caller until midnight UTC. */
+  getDaily(): Promise<VideoResponse> {
+    return this.request<VideoResponse>("GET", `/api/daily`, {}, {}, undefined, false);
+  }
+
+  /** Favorite a served video for the API key (and user). */
+  addFavorite(video_id: string, params: AddFavoriteParams = {}): Promise<Status> {
+    return this.request<Status>("POST", `/api/favorites/${encodeURIComponent(video_id)}`, { "user": params.user }, {}, undefined, false);
+  }
+
+  /** Remove a favorite. */
+  removeFavorite(video_id: string, params: RemoveFavoriteParams = {}): Promise<Status> {
+    return this.request<Status>("DELETE", `/api/favorites/${encodeURIComponent(video_id)}`, { "user": params.user }, {}, undefined, false);
+  }
+
+  /** Serve a random active video. */
+  getRandom(params: GetRandomParams = {}): Promise<VideoResponse> {
+    return this.request<VideoResponse>("GET", `/api/get`, { "hashtag": params.hashtag, "music_id": params.music_id, "collection": params.collection, "min_likes": params.min_likes, "min_plays": params.min_plays, "session": params.session, "seed": params.seed, "user": params.user, "from": params.from, "country": params.country, "exclude": params.exclude, "quality": params.quality }, {}, undefined, false);
+  }
+
+  /** Serve a random active video, skipping a long list of URL ids sent in the body. */
+  getRandomExcluding(params: GetRandomExcludingParams = {}, body?: SelectionBody): Promise<VideoResponse> {
+    return this.request<VideoResponse>("POST", `/api/get`, { "hashtag": params.hashtag, "music_id": params.music_id, "collection": params.collection, "session": params.session, "user": params.user, "country": params.country }, {}, body, false);
+  }
+
+  /** Hashtags of active videos with their counts. */
+  listHashtags(params: ListHashtagsParams = {}): Promise<HashtagsResponse> {
+    return this.request<HashtagsResponse>("GET", `/api/hashtags`, { "limit": params.limit }, {}, undefined, false);
+  }
+
+  /** Every URL in the catalog. */
+  listURLs(params: ListURLsParams = {}): Promise<URLEntry[]> {
+    return this.request<URLEntry[]>("GET", `/api/list`, { "limit": params.limit, "cursor": params.cursor }, {}, undefined, false);
+  }
+
+  /** Sounds used by the most active videos. */
+  topMusic(params: TopMusicParams = {}): Promise<MusicResponse> {
+    return this.request<MusicResponse>("GET", `/api/music/top`, { "limit": params.limit }, {}, undefined, false);
+  }
+
+  /** Submit a TikTok URL to the catalog. */
+  addURL(body: NewURL, params: AddURLParams = {}): Promise<URLEntry> {
+    return this.request<URLEntry>("POST", `/api/new`, { "async": params.async }, { "X-Captcha-Token": params.captchaToken, "Prefer": params.prefer }, body, true);
+  }
+
+  /** Create a fixed, non-repeating playlist. */
+  createPlaylist(body?: PlaylistRequest): Promise<PlaylistResponse> {
+    return this.request<PlaylistResponse>("POST", `/api/playlist`, {}, {}, body, true);
+  }
+
+  /** A JPEG grid of the covers of the playlist's videos, in order. */
+  playlistCollage(id: string, params: PlaylistCollageParams = {}): Promise<Blob> {
+    return this.request<Blob>("GET", `/api/playlist/${encodeURIComponent(id)}/collage`, { "tile": params.tile, "cols": params.cols }, {}, undefined, false, true);
+  }
+
+  /** Advance the playlist and serve its next video. */
+  playlistNext(id: string): Promise<VideoResponse> {
+    return this.request<VideoResponse>("GET", `/api/playlist/${encodeURIComponent(id)}/next`, {}, {}, undefined, true);
+  }
+
+  /** A PNG QR code of the video's /watch/ link. */
+  qrCode(id: string, params: QrCodeParams = {}): Promise<Blob> {
+    return this.request<Blob>("GET", `/api/qr/${encodeURIComponent(id)}`, { "scale": params.scale, "level": params.level }, {}, undefined, false, true);
+  }
+
+  /** Active videos by the same author, with the same music or sharing hashtags, best matches first. */
+  listRelated(video_id: string, params: ListRelatedParams = {}): Promise<RelatedResponse> {
+    return this.request<RelatedResponse>("GET", `/api/related/${encodeURIComponent(video_id)}`, { "limit": params.limit, "country": params.country }, {}, undefined, false);
+  }
+
+  /** Report a served video for moderation. */
+  reportVideo(body: ReportRequest): Promise<Status> {
+    return this.request<Status>("POST", `/api/report`, {}, {}, body, false);
+  }
+
+  /** Status of an asynchronous submission, visible to the key that made it. */
+  getSubmission(id: string): Promise<SubmissionResponse> {
+    return this.request<SubmissionResponse>("GET", `/api/submissions/${encodeURIComponent(id)}`, {}, {}, undefined, false);
+  }
+
+  /** File a rights holder claim against a video. */
+  submitTakedown(body: TakedownRequest, params: SubmitTakedownParams = {}): Promise<TakedownResponse> {
+    return this.request<TakedownResponse>("POST", `/api/takedowns`, {}, { "X-Captcha-Token": params.captchaToken }, body, true);
+  }
+
+  /** Serve a random active video in the response shape of the Node.js shoti API. */
+  getRandomLegacy(params: GetRandomLegacyParams = {}): Promise<LegacyVideoResponse> {
+    return this.request<LegacyVideoResponse>("GET", `/api/v1/get`, { "hashtag": params.hashtag, "collection": params.collection }, {}, undefined, false);
+  }
+
+  /** The video of the day in the v2 format. */
+  getDailyV2(): Promise<VideoResponseV2> {
+    return this.request<VideoResponseV2>("GET", `/api/v2/daily`, {}, {}, undefined, false);
+  }
+
+  /** Serve a random active video in the v2 format. Takes the parameters of getRandom. */
+  getRandomV2(params: GetRandomV2Params = {}): Promise<VideoResponseV2> {
+    return this.request<VideoResponseV2>("GET", `/api/v2/get`, { "hashtag": params.hashtag, "music_id": params.music_id, "collection": params.collection, "min_likes": params.min_likes, "min_plays": params.min_plays, "session": params.session, "seed": params.seed, "user": params.user, "from": params.from, "country": params.country, "exclude": params.exclude, "quality": params.quality }, {}, undefined, false);
+  }
+
+  /** Every URL in the catalog; the v2 response is enveloped. */
+  listURLsV2(params: ListURLsV2Params = {}): Promise<URLListResponse> {
+    return this.request<URLListResponse>("GET", `/api/v2/list`, { "limit": params.limit, "cursor": params.cursor }, {}, undefined, false);
+  }
+
+  /** Submit a TikTok URL to the catalog; the v2 response is enveloped. */
+  addURLV2(body: NewURL, params: AddURLV2Params = {}): Promise<URLResponse> {
+    return this.request<URLResponse>("POST", `/api/v2/new`, {}, { "X-Captcha-Token": params.captchaToken }, body, true);
+  }
+
+  /** The catalog joined with resolved metadata, paginated. */
+  listVideos(params: ListVideosParams = {}): Promise<VideosResponse> {
+    return this.request<VideosResponse>("GET", `/api/videos`, { "page": params.page, "per_page": params.per_page, "cursor": params.cursor, "sort": params.sort, "status": params.status, "collection": params.collection, "author": params.author, "hashtag": params.hashtag, "q": params.q, "min_likes": params.min_likes, "min_plays": params.min_plays, "resolved": params.resolved }, {}, undefined, false);
+  }
+
+  /** Snapshots of a video's engagement stats over time, oldest first. */
+  videoHistory(id: string, params: VideoHistoryParams = {}): Promise<HistoryResponse> {
+    return this.request<HistoryResponse>("GET", `/api/videos/${encodeURIComponent(id)}/history`, { "since": params.since, "limit": params.limit }, {}, undefined, false);
+  }
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// Collages: GET /api/collage?ids=a,b,c and GET /api/playlist/{id}/collage
+// answer a JPEG grid of the covers of some videos, in order, so a bot can
+// post one preview image for a set of videos. ids takes the ids found in
+// media and watch links (see publicid.go). tile sets the width of a cover
+// in pixels (covers are 3:4) and cols the number of columns, by default
+// enough for a square grid. Covers that cannot be fetched or decoded are
+// left blank. On a collection route, videos of other collections are left
+// out, as the other endpoints there do not know them either.
+
+const (
+	collageGap     = 4
+	collageWorkers = 4
+)
+
+var (
+	collageBackground = color.RGBA{0x16, 0x16, 0x1a, 0xff}
+	collageBlank      = color.RGBA{0x3a, 0x3a, 0x42, 0xff}
+)
+
+// serveCollage handles GET /api/collage.
+func serveCollage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var entries []catalogEntry
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		entry, err := entryByPublicID(id)
+		if err == sql.ErrNoRows || (err == nil && !inRouteCollection(r, entry)) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error looking up %s: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		entries = append(entries, entry)
+	}
+	writeCollage(w, r, entries)
+}
+
+// playlistCollage handles GET /api/playlist/{id}/collage.
+func playlistCollage(w http.ResponseWriter, r *http.Request, id string) {
+	var ids []string
+	err := db.QueryRow("SELECT url_ids FROM playlists WHERE id = $1", id).Scan(pq.Array(&ids))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading playlist %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	var entries []catalogEntry
+	for _, urlID := range ids {
+		if entry, err := activeEntryByID(urlID); err == nil && inRouteCollection(r, entry) {
+			entries = append(entries, entry)
+		}
+	}
+	writeCollage(w, r, entries)
+}
+
+// inRouteCollection reports whether entry may be shown on the route r was
+// made on: any entry on the main API, and only those of its collection on a
+// collection route.
+func inRouteCollection(r *http.Request, entry catalogEntry) bool {
+	collection := routeCollection(r)
+	return collection == "" || entry.Collection == collection
+}
+
+func writeCollage(w http.ResponseWriter, r *http.Request, entries []catalogEntry) {
+	query := r.URL.Query()
+	maxTiles := envInt("COLLAGE_MAX_TILES", 25)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "no videos to show")
+		return
+	}
+	if len(entries) > maxTiles {
+		entries = entries[:maxTiles]
+	}
+	tile, err := queryInt(query.Get("tile"), 180, 60, 480)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "tile must be between 60 and 480")
+		return
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(len(entries)))))
+	if v := query.Get("cols"); v != "" {
+		if cols, err = strconv.Atoi(v); err != nil || cols < 1 || cols > maxTiles {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("cols must be between 1 and %d", maxTiles))
+			return
+		}
+	}
+	cols = min(cols, len(entries))
+
+	img := composeCollage(fetchCovers(entries), cols, tile, tile*4/3)
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 85}); err != nil {
+		log.Printf("Error encoding collage: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(out.Bytes())
+}
+
+// fetchCovers returns the decoded cover of every entry, nil for those that
+// could not be fetched.
+func fetchCovers(entries []catalogEntry) []image.Image {
+	covers := make([]image.Image, len(entries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(collageWorkers, len(entries)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				cover, err := fetchCover(entries[i])
+				if err != nil {
+					log.Printf("Error fetching cover of %s: %v\n", entries[i].ID, err)
+					continue
+				}
+				covers[i] = cover
+			}
+		}()
+	}
+	for i := range entries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return covers
+}
+
+func fetchCover(entry catalogEntry) (image.Image, error) {
+	video, err := videoCache.get(entry.URL)
+	if err != nil {
+		return nil, err
+	}
+	if video.Cover == "" {
+		return nil, fmt.Errorf("no cover")
+	}
+	response, err := coverClient.Get(video.Cover)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching cover: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cover responded with status %d", response.StatusCode)
+	}
+	img, _, err := image.Decode(io.LimitReader(response.Body, 10<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding cover: %w", err)
+	}
+	return img, nil
+}
+
+// composeCollage lays covers out in a grid of cols columns of w×h tiles.
+func composeCollage(covers []image.Image, cols, w, h int) *image.RGBA {
+	rows := (len(covers) + cols - 1) / cols
+	img := image.NewRGBA(image.Rect(0, 0, cols*(w+collageGap)+collageGap, rows*(h+collageGap)+collageGap))
+	draw.Draw(img, img.Bounds(), image.NewUniform(collageBackground), image.Point{}, draw.Src)
+	for i, cover := range covers {
+		x := collageGap + (i%cols)*(w+collageGap)
+		y := collageGap + (i/cols)*(h+collageGap)
+		rect := image.Rect(x, y, x+w, y+h)
+		if cover == nil {
+			draw.Draw(img, rect, image.NewUniform(collageBlank), image.Point{}, draw.Src)
+			continue
+		}
+		drawCropped(img, rect, cover)
+	}
+	return img
+}
+
+// drawCropped scales src to fill rect, cropping its center to the aspect
+// ratio of rect.
+func drawCropped(dst *image.RGBA, rect image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() {
+		return
+	}
+	if sb.Dx()*rect.Dy() > sb.Dy()*rect.Dx() {
+		cw := sb.Dy() * rect.Dx() / rect.Dy()
+		sb.Min.X += (sb.Dx() - cw) / 2
+		sb.Max.X = sb.Min.X + cw
+	} else {
+		ch := sb.Dx() * rect.Dy() / rect.Dx()
+		sb.Min.Y += (sb.Dy() - ch) / 2
+		sb.Max.Y = sb.Min.Y + ch
+	}
+	for y := 0; y < rect.Dy(); y++ {
+		sy := sb.Min.Y + y*sb.Dy()/rect.Dy()
+		for x := 0; x < rect.Dx(); x++ {
+			sx := sb.Min.X + x*sb.Dx()/rect.Dx()
+			dst.Set(rect.Min.X+x, rect.Min.Y+y, src.At(sx, sy))
+		}
+	}
+}
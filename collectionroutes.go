@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Collection routes: COLLECTION_ROUTES serves collections as if each had
+// its own deployment, under a path prefix or on a host of its own, e.g.
+//
+//	cats=/cats,dogs=dogs.example.com
+//
+// serves the cats collection at /cats/api/get and the dogs collection at
+// dogs.example.com/api/get. Requests on a route are bound to its collection:
+// the collection parameter of /api/get, /api/videos and the rest is set to
+// it and URLs added through /api/new go into it, and the main API refuses
+// to name a routed collection. Issued keys belong to one collection or to
+// the main API (see issueKey) and are refused elsewhere; any other key
+// belongs to the main API. Rate limits are counted apart for every
+// collection, and request logs and the collection_route_requests counter
+// tell collections apart.
+
+var collectionRouteRequests = expvar.NewMap("collection_route_requests")
+
+type (
+	routeCollectionKey struct{}
+	requestURIKey      struct{}
+)
+
+// collectionRoute is a collection served on its own path prefix or host.
+type collectionRoute struct {
+	Collection string
+	Prefix     string
+	Host       string
+}
+
+// collectionRoutes returns the configured routes.
+func collectionRoutes() []collectionRoute {
+	var routes []collectionRoute
+	for _, entry := range strings.Split(os.Getenv("COLLECTION_ROUTES"), ",") {
+		collection, target, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		collection, target = strings.TrimSpace(collection), strings.TrimSpace(target)
+		if !ok || collection == "" || target == "" {
+			continue
+		}
+		if strings.HasPrefix(target, "/") {
+			routes = append(routes, collectionRoute{Collection: collection, Prefix: strings.TrimRight(target, "/")})
+		} else {
+			routes = append(routes, collectionRoute{Collection: collection, Host: strings.ToLower(target)})
+		}
+	}
+	return routes
+}
+
+// match reports whether r was made on the route, returning the path
+// without the route's prefix.
+func (c collectionRoute) match(r *http.Request) (string, bool) {
+	if c.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return r.URL.Path, strings.EqualFold(host, c.Host)
+	}
+	if c.Prefix == "" {
+		return "", false
+	}
+	if r.URL.Path == c.Prefix {
+		return "/", true
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, c.Prefix+"/")
+	return "/" + rest, ok
+}
+
+// routeCollection is the collection r is bound to by its route, or "" on
+// the main API.
+func routeCollection(r *http.Request) string {
+	collection, _ := r.Context().Value(routeCollectionKey{}).(string)
+	return collection
+}
+
+// requestURI is the request URI r was made with, before routeCollections
+// rewrote it; signatures cover this one.
+func requestURI(r *http.Request) string {
+	if uri, ok := r.Context().Value(requestURIKey{}).(string); ok {
+		return uri
+	}
+	return r.URL.RequestURI()
+}
+
+// routeCollections strips the prefix of requests made on a collection
+// route and binds them to its collection, whatever their collection
+// parameter says. On the main API, a collection parameter naming a routed
+// collection is refused: those are only served on their routes.
+func routeCollections(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes := collectionRoutes()
+		for _, route := range routes {
+			path, ok := route.match(r)
+			if !ok {
+				continue
+			}
+			collectionRouteRequests.Add(route.Collection, 1)
+			ctx := context.WithValue(r.Context(), requestURIKey{}, r.URL.RequestURI())
+			r = r.WithContext(context.WithValue(ctx, routeCollectionKey{}, route.Collection))
+			r.URL.Path = path
+			r.URL.RawPath = ""
+			query := r.URL.Query()
+			query.Set("collection", route.Collection)
+			r.URL.RawQuery = query.Encode()
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if collection := r.URL.Query().Get("collection"); collection != "" {
+			for _, route := range routes {
+				if route.Collection == collection {
+					writeError(w, http.StatusForbidden, "collection "+collection+" is only served on its own route")
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCollectionRouteIsolation checks that requests are kept to the
+// collection of their route: the collection parameter cannot point
+// elsewhere, and keys that were not issued for a route are refused on it.
+func TestCollectionRouteIsolation(t *testing.T) {
+	t.Setenv("COLLECTION_ROUTES", "cats=/cats")
+
+	var served string
+	h := routeCollections(authorizeKeys(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = routeCollection(r) + " " + r.URL.Query().Get("collection")
+	})))
+
+	for _, tc := range []struct {
+		name, target, key string
+		status            int
+		served            string
+	}{
+		{"route", "/cats/api/get", "", http.StatusOK, "cats cats"},
+		{"other collection on route", "/cats/api/get?collection=dogs", "", http.StatusOK, "cats cats"},
+		{"free-form key on route", "/cats/api/get", "my-bot", http.StatusForbidden, ""},
+		{"main API", "/api/get?collection=dogs", "my-bot", http.StatusOK, " dogs"},
+		{"routed collection on main API", "/api/get?collection=cats", "", http.StatusForbidden, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			served = ""
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.key != "" {
+				r.Header.Set("X-API-Key", tc.key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status %d, want %d", w.Code, tc.status)
+			}
+			if served != tc.served {
+				t.Errorf("served %q, want %q", served, tc.served)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %d\n", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %s\n", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %g\n", name, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+// loadDotenv loads .env.<APP_ENV> (e.g. .env.production) and then .env.
+// Variables already set are never overridden, so the process environment
+// wins over the profile, which wins over the shared .env. Missing files are
+// skipped; on Railway no files are loaded at all.
+func loadDotenv() error {
+	if _, exists := os.LookupEnv("RAILWAY_ENVIRONMENT"); exists {
+		return nil
+	}
+
+	files := []string{".env"}
+	if env := os.Getenv("APP_ENV"); env != "" {
+		files = []string{".env." + env, ".env"}
+	}
+
+	for _, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		if err := godotenv.Load(file); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		log.Printf("Loaded %s\n", file)
+	}
+	return nil
+}
+
+// printExampleConfig writes a commented .env covering every setting, with
+// defaults filled in and everything else left blank.
+func printExampleConfig(w io.Writer) {
+	fmt.Fprintln(w, "# shoti-srv configuration. Generated by `shoti-srv config print-example`.")
+	fmt.Fprintln(w, "# Settings marked secret can also be read from NAME_FILE or Vault.")
+
+	group := ""
+	for _, s := range settings {
+		if s.Group != group {
+			group = s.Group
+			fmt.Fprintf(w, "\n# --- %s ---\n", group)
+		}
+
+		fmt.Fprintf(w, "\n# %s\n", s.Help)
+		var notes []string
+		if s.Required {
+			notes = append(notes, "required")
+		}
+		if s.Secret {
+			notes = append(notes, "secret")
+		}
+		if s.Kind == kindEnum {
+			notes = append(notes, "one of: "+strings.Join(s.Values, ", "))
+		}
+		if len(s.Requires) > 0 {
+			notes = append(notes, "also set: "+strings.Join(s.Requires, ", "))
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(w, "# (%s)\n", strings.Join(notes, "; "))
+		}
+
+		if s.Required {
+			fmt.Fprintf(w, "%s=%s\n", s.Name, s.Default)
+		} else {
+			fmt.Fprintf(w, "#%s=%s\n", s.Name, s.Default)
+		}
+	}
+}
+
+func configCommand(args []string) error {
+	if len(args) != 1 || args[0] != "print-example" {
+		return fmt.Errorf("usage: shoti-srv config print-example")
+	}
+	printExampleConfig(os.Stdout)
+	return nil
+}
+
+func init() {
+	commands["config"] = command{Summary: "print-example: print a commented example .env", Run: configCommand}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The daily pick is the active entry with the lowest hash of date and id
+// (rendezvous hashing), so every replica agrees on it without coordination
+// and URLs added during the day rarely change it. The resolved video is
+// cached until the UTC date rolls over, or until its URL changes: a pick
+// that is blocked, suspended or deleted is replaced by the next one, and so
+// is one the content filters reject or, for the caller, the policy. Each
+// collection route has a daily pick of its own collection, and the main
+// API one of the whole catalog.
+var daily = struct {
+	mu    sync.Mutex
+	picks map[string]dailyPick // by route collection
+}{picks: make(map[string]dailyPick)}
+
+type dailyPick struct {
+	day   string
+	entry catalogEntry
+	info  *Video
+}
+
+func dailyVideo(w http.ResponseWriter, r *http.Request) {
+	day := time.Now().UTC().Format("2006-01-02")
+	collection := routeCollection(r)
+
+	// The lock only guards the cached picks; resolving and writing happen
+	// outside it so a slow upstream or client does not hold up others.
+	daily.mu.Lock()
+	pick := daily.picks[collection]
+	daily.mu.Unlock()
+	cached := pick.day == day && pick.info != nil
+	entry, info := pick.entry, pick.info
+	pickID := entry.ID
+
+	// The policy depends on the caller, so it is checked on every request:
+	// a caller it rejects the pick for gets the next candidate it allows.
+	if !cached || rejectedByPolicy(r, entry, info) {
+		info = nil
+		entries, err := activeEntries()
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+
+		// The daily pick is shared by every visitor and cached by the CDN,
+		// so videos restricted anywhere are not eligible.
+		entries = slices.DeleteFunc(entries, func(e catalogEntry) bool {
+			return len(e.Restricted) > 0 || (collection != "" && e.Collection != collection)
+		})
+		if len(entries) == 0 {
+			writeCatalogEmpty(w)
+			return
+		}
+
+		for _, candidate := range rendezvousTop(entries, "daily:"+day, 3) {
+			start := time.Now()
+			resolved, err := videoCache.get(candidate.URL)
+			addUpstreamTime(r, time.Since(start))
+			captureUpstream(r, candidate.URL, time.Since(start), resolved, err)
+			if err != nil {
+				log.Printf("Error resolving daily candidate %s: %v\n", candidate.URL, err)
+				continue
+			}
+			if rejectsTitle(candidate.Collection, resolved.Title) || rejectedByPlugins(candidate.Collection, resolved) {
+				continue
+			}
+			if !cached {
+				// The first candidate passing the content filters is the
+				// pick of the day, whatever the policy says for this caller.
+				cached, pickID = true, candidate.ID
+				daily.mu.Lock()
+				daily.picks[collection] = dailyPick{day: day, entry: candidate, info: resolved}
+				daily.mu.Unlock()
+				if !degraded.Load() {
+					background(func() { recordResolved(candidate.ID, resolved) })
+				}
+			}
+			if rejectedByPolicy(r, candidate, resolved) {
+				continue
+			}
+			entry, info = candidate, resolved
+			break
+		}
+
+		if info == nil {
+			writeError(w, http.StatusBadRequest, "failed")
+			return
+		}
+	}
+
+	if entry.ID == pickID {
+		tomorrow := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(time.Until(tomorrow).Seconds())))
+	} else {
+		// A fallback for a caller the policy rejected the pick for.
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	addSurrogateKeys(w, videoSurrogateKey(entry.ID))
+
+	// The daily video is not counted as served, so there is no change to
+	// tie its event to.
+	served := writeVideoResponse(w, r, entry, info)
+	emitEvent(served.Type, served)
+}
+
+// forgetDailyPick drops the cached daily picks whose URL changes, so the
+// next request picks again among the active entries.
+func forgetDailyPick(ev invalidation) {
+	daily.mu.Lock()
+	defer daily.mu.Unlock()
+	for collection, pick := range daily.picks {
+		if ev.Op == "TRUNCATE" || ev.ID == pick.entry.ID {
+			delete(daily.picks, collection)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Debug captures: to look into an issue an integrator reports, an admin
+// can capture every request made with their API key for a while, with
+// headers, bodies and the upstream lookups the request made, without
+// turning up logging for everyone:
+//
+//	PUT /api/admin/captures/{key} {"duration": "15m"}
+//	GET /api/admin/captures/{key}
+//
+// {key} is the key hash (see tiers.go) or the id of an issued key. Every
+// replica reloads the active captures each DEBUG_CAPTURE_REFRESH_INTERVAL
+// and stores what it captures in the database, so the GET sees requests
+// served anywhere. Credentials are redacted and bodies cut at 64 KiB.
+// Captures are deleted DEBUG_CAPTURE_RETENTION after they end.
+
+const maxCapturedBody = 64 << 10
+
+var redactedHeaders = []string{"X-Api-Key", "Authorization", "X-Signature", "Cookie"}
+
+type debugCapture struct {
+	KeyHash   string    `json:"key_hash"`
+	KeyID     string    `json:"key_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Requests  int       `json:"requests"`
+}
+
+type capturedExchange struct {
+	Time            time.Time          `json:"time"`
+	Method          string             `json:"method"`
+	URL             string             `json:"url"`
+	RequestHeaders  http.Header        `json:"request_headers"`
+	RequestBody     string             `json:"request_body,omitempty"`
+	Status          int                `json:"status"`
+	ResponseHeaders http.Header        `json:"response_headers"`
+	ResponseBody    string             `json:"response_body,omitempty"`
+	LatencyMS       float64            `json:"latency_ms"`
+	Upstream        []capturedUpstream `json:"upstream,omitempty"`
+}
+
+// capturedUpstream is a video lookup made while serving a captured
+// request, answered by the metadata cache or the upstream.
+type capturedUpstream struct {
+	URL        string  `json:"url"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+	Video      *Video  `json:"video,omitempty"`
+}
+
+var activeCaptures = struct {
+	mu      sync.RWMutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+type captureKey struct{}
+
+// capturing reports whether the requests of key hash are being captured.
+func capturing(hash string) bool {
+	activeCaptures.mu.RLock()
+	defer activeCaptures.mu.RUnlock()
+	expires, ok := activeCaptures.expires[hash]
+	return ok && time.Now().Before(expires)
+}
+
+// captureUpstream records a video lookup made for r when r is captured.
+func captureUpstream(r *http.Request, url string, d time.Duration, video *Video, err error) {
+	c, ok := r.Context().Value(captureKey{}).(*capturedExchange)
+	if !ok {
+		return
+	}
+	u := capturedUpstream{URL: url, DurationMS: float64(d.Microseconds()) / 1000, Video: video}
+	if err != nil {
+		u.Error = err.Error()
+	}
+	c.Upstream = append(c.Upstream, u)
+}
+
+// captureRecorder keeps the start of the response body.
+type captureRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (cr *captureRecorder) WriteHeader(status int) {
+	if cr.status == 0 {
+		cr.status = status
+	}
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *captureRecorder) Write(b []byte) (int, error) {
+	if cr.status == 0 {
+		cr.status = http.StatusOK
+	}
+	if room := maxCapturedBody - cr.body.Len(); room > 0 {
+		cr.body.Write(b[:min(room, len(b))])
+	}
+	return cr.ResponseWriter.Write(b)
+}
+
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "[redacted]")
+		}
+	}
+	return h
+}
+
+// capturedBody returns body as text, or a note of its size when it is not
+// text.
+func capturedBody(contentType string, body []byte, size int) string {
+	if size == 0 {
+		return ""
+	}
+	if contentType != "" && !strings.Contains(contentType, "json") && !strings.HasPrefix(contentType, "text/") {
+		return fmt.Sprintf("[%d bytes of %s]", size, contentType)
+	}
+	if size > len(body) {
+		return string(body) + fmt.Sprintf("... [%d bytes]", size)
+	}
+	return string(body)
+}
+
+// captureDebug records the requests of API keys being captured.
+func captureDebug(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" || degraded.Load() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hash := keyHash(key)
+		if !capturing(hash) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		c := &capturedExchange{
+			Time:           start.UTC(),
+			Method:         r.Method,
+			URL:            r.URL.RequestURI(),
+			RequestHeaders: redactHeaders(r.Header),
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, maxCapturedBody+1))
+			c.RequestBody = capturedBody(r.Header.Get("Content-Type"), body[:min(len(body), maxCapturedBody)], len(body))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+
+		cr := &captureRecorder{ResponseWriter: w}
+		h.ServeHTTP(cr, r.WithContext(context.WithValue(r.Context(), captureKey{}, c)))
+
+		c.Status = cr.status
+		if c.Status == 0 {
+			c.Status = http.StatusOK
+		}
+		c.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		c.ResponseHeaders = redactHeaders(w.Header())
+		c.ResponseBody = capturedBody(w.Header().Get("Content-Type"), cr.body.Bytes(), cr.body.Len())
+		background(func() {
+			if err := saveCapturedExchange(hash, c); err != nil {
+				log.Println(err)
+			}
+		})
+	})
+}
+
+func saveCapturedExchange(hash string, c *capturedExchange) error {
+	entry, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error encoding captured request: %w", err)
+	}
+	_, err = db.Exec("INSERT INTO debug_capture_entries (key_hash, captured_at, entry) VALUES ($1, $2, $3)", hash, c.Time, entry)
+	if err != nil {
+		return fmt.Errorf("error saving captured request: %w", err)
+	}
+	return nil
+}
+
+func reloadCaptures() error {
+	rows, err := db.Query("SELECT key_hash, expires_at FROM debug_captures WHERE expires_at > now()")
+	if err != nil {
+		return fmt.Errorf("error loading debug captures: %w", err)
+	}
+	defer rows.Close()
+
+	expires := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			hash string
+			at   time.Time
+		)
+		if err := rows.Scan(&hash, &at); err != nil {
+			return fmt.Errorf("error scanning debug captures: %w", err)
+		}
+		expires[hash] = at
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error loading debug captures: %w", err)
+	}
+
+	activeCaptures.mu.Lock()
+	activeCaptures.expires = expires
+	activeCaptures.mu.Unlock()
+	return nil
+}
+
+// deleteEndedCaptures deletes captures, with what they captured, that
+// ended more than DEBUG_CAPTURE_RETENTION ago.
+func deleteEndedCaptures() error {
+	cutoff := time.Now().Add(-envDuration("DEBUG_CAPTURE_RETENTION", 24*time.Hour))
+	result, err := db.Exec("DELETE FROM debug_captures WHERE expires_at < $1", cutoff)
+	if err != nil {
+		return fmt.Errorf("error deleting ended debug captures: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Deleted %d ended debug capture(s).\n", n)
+	}
+	return nil
+}
+
+func init() {
+	schedule("debug-captures", "DEBUG_CAPTURE_REFRESH_INTERVAL", 10*time.Second, reloadCaptures)
+	schedule("expire-debug-captures", "", time.Hour, deleteEndedCaptures).LeaderOnly = true
+}
+
+// captureKeyHash returns the key hash named by ref, a key hash or the id
+// of an issued key.
+func captureKeyHash(ref string) (string, *httpError) {
+	if keyHashPattern.MatchString(ref) {
+		return ref, nil
+	}
+	if _, err := uuid.Parse(ref); err != nil {
+		return "", &httpError{http.StatusBadRequest, "key must be a key hash or the id of an issued key"}
+	}
+	var hash string
+	err := db.QueryRow("SELECT key_hash FROM api_keys WHERE id = $1", ref).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", &httpError{http.StatusNotFound, "API key not found"}
+	}
+	if err != nil {
+		log.Printf("Error looking up API key %s: %v\n", ref, err)
+		return "", &httpError{http.StatusInternalServerError, "failed"}
+	}
+	return hash, nil
+}
+
+// adminCaptures handles GET /api/admin/captures, which lists the captures,
+// and PUT/GET/DELETE /api/admin/captures/{key}, which start (or extend) a
+// capture with {"duration": "15m"}, return what it captured, oldest first,
+// and stop it, discarding what it captured.
+func adminCaptures(w http.ResponseWriter, r *http.Request) {
+	ref := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/captures"), "/")
+	if ref == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		rows, err := db.Query(`
+		SELECT c.key_hash, c.expires_at, c.created_at, count(e.id)
+		FROM debug_captures c LEFT JOIN debug_capture_entries e ON e.key_hash = c.key_hash
+		GROUP BY c.key_hash ORDER BY c.created_at
+		`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		defer rows.Close()
+
+		captures := []debugCapture{}
+		for rows.Next() {
+			var c debugCapture
+			if err := rows.Scan(&c.KeyHash, &c.ExpiresAt, &c.CreatedAt, &c.Requests); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed")
+				return
+			}
+			c.KeyID = c.KeyHash[:8]
+			captures = append(captures, c)
+		}
+		writeJSON(w, http.StatusOK, captures)
+		return
+	}
+
+	hash, herr := captureKeyHash(ref)
+	if herr != nil {
+		writeHTTPError(w, herr)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+		duration, err := time.ParseDuration(body.Duration)
+		limit := envDuration("DEBUG_CAPTURE_MAX_DURATION", time.Hour)
+		if err != nil || duration <= 0 || duration > limit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("duration must be a positive duration up to %s", limit))
+			return
+		}
+
+		c := debugCapture{KeyHash: hash, KeyID: hash[:8], ExpiresAt: time.Now().Add(duration).UTC()}
+		err = db.QueryRow(`
+		INSERT INTO debug_captures (key_hash, expires_at) VALUES ($1, $2)
+		ON CONFLICT (key_hash) DO UPDATE SET expires_at = $2
+		RETURNING created_at, (SELECT count(*) FROM debug_capture_entries WHERE key_hash = $1)
+		`, hash, c.ExpiresAt).Scan(&c.CreatedAt, &c.Requests)
+		if err != nil {
+			log.Printf("Error saving debug capture: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		activeCaptures.mu.Lock()
+		activeCaptures.expires[hash] = c.ExpiresAt
+		activeCaptures.mu.Unlock()
+		writeJSON(w, http.StatusOK, c)
+
+	case http.MethodGet:
+		rows, err := db.Query("SELECT entry FROM debug_capture_entries WHERE key_hash = $1 ORDER BY captured_at, id", hash)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		defer rows.Close()
+
+		entries := []json.RawMessage{}
+		for rows.Next() {
+			var entry json.RawMessage
+			if err := rows.Scan(&entry); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed")
+				return
+			}
+			entries = append(entries, entry)
+		}
+		writeJSON(w, http.StatusOK, entries)
+
+	case http.MethodDelete:
+		if _, err := db.Exec("DELETE FROM debug_captures WHERE key_hash = $1", hash); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		activeCaptures.mu.Lock()
+		delete(activeCaptures.expires, hash)
+		activeCaptures.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache keeps fetched payloads as files under dir, evicting the least
+// recently used ones once their total size exceeds maxBytes; payloads
+// larger than maxBytes on their own are served once and not kept. Each
+// payload has a JSON sidecar with its SHA-256, checked on the first read
+// after a restart and whenever the file's size or modification time
+// changes, so a corrupted file is refetched instead of served.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List // of *diskCacheEntry, most recently used first
+	entries  map[string]*list.Element
+	size     int64
+	inflight map[string]*diskCacheFill
+}
+
+type diskCacheEntry struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+
+	// modTime is the modification time of the payload when its hash was
+	// last checked, zero until then.
+	modTime time.Time
+}
+
+type diskCacheFill struct {
+	done  chan struct{}
+	entry diskCacheEntry
+	err   error
+
+	// path is where the payload was written: its place in the cache, or
+	// a temporary file when it is not kept, removed once every reader
+	// sharing the fill has opened it.
+	path    string
+	kept    bool
+	readers int
+}
+
+var (
+	diskCacheHits      = expvar.NewInt("media_cache_hits")
+	diskCacheMisses    = expvar.NewInt("media_cache_misses")
+	diskCacheEvictions = expvar.NewInt("media_cache_evictions")
+	diskCacheCorrupt   = expvar.NewInt("media_cache_corrupt")
+)
+
+// openDiskCache loads the entries already in dir, oldest first.
+func openDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", dir, err)
+	}
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*diskCacheFill),
+	}
+
+	sidecars, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	type loaded struct {
+		entry diskCacheEntry
+		used  int64
+	}
+	var found []loaded
+	for _, sidecar := range sidecars {
+		raw, err := os.ReadFile(sidecar)
+		if err != nil {
+			continue
+		}
+		var e diskCacheEntry
+		info, statErr := os.Stat(strings.TrimSuffix(sidecar, ".json") + ".bin")
+		if json.Unmarshal(raw, &e) != nil || statErr != nil || info.Size() != e.Size {
+			os.Remove(sidecar)
+			continue
+		}
+		found = append(found, loaded{e, info.ModTime().UnixNano()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].used < found[j].used })
+	for _, l := range found {
+		e := l.entry
+		c.entries[e.Key] = c.lru.PushFront(&e)
+		c.size += e.Size
+	}
+
+	tmps, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *diskCache) path(key, ext string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// open returns the cached payload of key, calling fill to write it on a
+// miss. Concurrent misses of the same key share one fill. hit reports
+// whether the payload was already cached.
+func (c *diskCache) open(key string, fill func(w io.Writer) (contentType string, err error)) (f *os.File, entry diskCacheEntry, hit bool, err error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		entry = *el.Value.(*diskCacheEntry)
+		c.mu.Unlock()
+
+		var checked time.Time
+		f, checked, err = c.verified(entry)
+		if err == nil {
+			if !checked.Equal(entry.modTime) {
+				c.mu.Lock()
+				if current, ok := c.entries[key]; ok && current == el {
+					el.Value.(*diskCacheEntry).modTime = checked
+				}
+				c.mu.Unlock()
+			}
+			diskCacheHits.Add(1)
+			return f, entry, true, nil
+		}
+		log.Printf("Discarding cached %s: %v\n", key, err)
+		diskCacheCorrupt.Add(1)
+		c.remove(key)
+		c.mu.Lock()
+	}
+
+	pending, ok := c.inflight[key]
+	if ok {
+		pending.readers++
+		c.mu.Unlock()
+		<-pending.done
+	} else {
+		pending = &diskCacheFill{done: make(chan struct{}), readers: 1}
+		c.inflight[key] = pending
+		c.mu.Unlock()
+
+		diskCacheMisses.Add(1)
+		pending.entry, pending.path, pending.err = c.fill(key, fill)
+		pending.kept = pending.err == nil && pending.entry.Size <= c.maxBytes
+		if pending.kept {
+			if pending.err = c.keep(&pending.entry, pending.path); pending.err == nil {
+				pending.path = c.path(key, ".bin")
+			} else {
+				pending.path, pending.kept = "", false
+			}
+		}
+
+		c.mu.Lock()
+		delete(c.inflight, key)
+		if pending.kept {
+			e := pending.entry
+			c.entries[key] = c.lru.PushFront(&e)
+			c.size += e.Size
+			c.evict()
+		}
+		c.mu.Unlock()
+		close(pending.done)
+	}
+
+	if pending.err == nil {
+		f, err = os.Open(pending.path)
+	} else {
+		err = pending.err
+	}
+	c.release(pending)
+	if err != nil {
+		return nil, entry, false, err
+	}
+	return f, pending.entry, false, nil
+}
+
+// release drops a reader of a fill, removing a payload that is not kept
+// once every reader has opened it.
+func (c *diskCache) release(pending *diskCacheFill) {
+	c.mu.Lock()
+	pending.readers--
+	last := pending.readers == 0
+	c.mu.Unlock()
+	if last && !pending.kept && pending.path != "" {
+		os.Remove(pending.path)
+	}
+}
+
+// fill writes the payload of key to a temporary file and returns its entry
+// and path. The file is removed if fill fails.
+func (c *diskCache) fill(key string, fill func(w io.Writer) (string, error)) (diskCacheEntry, string, error) {
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return diskCacheEntry{}, "", err
+	}
+
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, h)}
+	contentType, err := fill(counter)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return diskCacheEntry{}, "", err
+	}
+
+	entry := diskCacheEntry{Key: key, Size: counter.n, SHA256: hex.EncodeToString(h.Sum(nil)), ContentType: contentType}
+	return entry, tmp.Name(), nil
+}
+
+// keep moves the payload written to tmp into the cache with its sidecar.
+// The payload was hashed as it was written, so entry is marked as checked
+// at its modification time.
+func (c *diskCache) keep(entry *diskCacheEntry, tmp string) error {
+	sidecar, _ := json.Marshal(entry)
+	err := os.WriteFile(c.path(entry.Key, ".json"), sidecar, 0o640)
+	if err == nil {
+		err = os.Rename(tmp, c.path(entry.Key, ".bin"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if info, err := os.Stat(c.path(entry.Key, ".bin")); err == nil {
+		entry.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// verified opens the payload of entry, checking its size and hash unless
+// they were checked at its current modification time, which it returns.
+func (c *diskCache) verified(entry diskCacheEntry) (*os.File, time.Time, error) {
+	f, err := os.Open(c.path(entry.Key, ".bin"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == entry.Size && !entry.modTime.IsZero() && info.ModTime().Equal(entry.modTime) {
+		return f, entry.modTime, nil
+	}
+	if err == nil {
+		h := sha256.New()
+		var n int64
+		n, err = io.Copy(h, f)
+		if err == nil && (n != entry.Size || hex.EncodeToString(h.Sum(nil)) != entry.SHA256) {
+			err = errors.New("checksum mismatch")
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, info.ModTime(), nil
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.drop(el)
+	}
+}
+
+// evict must be called with c.mu held. Files still open by readers stay
+// readable until closed.
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.drop(c.lru.Back())
+		diskCacheEvictions.Add(1)
+	}
+}
+
+// drop must be called with c.mu held.
+func (c *diskCache) drop(el *list.Element) {
+	e := c.lru.Remove(el).(*diskCacheEntry)
+	delete(c.entries, e.Key)
+	c.size -= e.Size
+	os.Remove(c.path(e.Key, ".bin"))
+	os.Remove(c.path(e.Key, ".json"))
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// doctorCheck is one line of the `shoti-srv doctor` report. A check that
+// returns errSkipped is reported as not applicable instead of failed.
+type doctorCheck struct {
+	Name string
+	Run  func() (string, error)
+}
+
+var errSkipped = errors.New("skipped")
+
+func doctorCommand(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	videoURL := fs.String("video", "", "video URL resolved to test the upstream (default: first active URL)")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each network check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadDotenv(); err != nil {
+		return err
+	}
+	if err := loadVaultSecrets(); err != nil {
+		return fmt.Errorf("error loading secrets: %w", err)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	checks := []doctorCheck{
+		{"config", func() (string, error) {
+			if err := validateConfig(); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d settings valid", len(settings)), nil
+		}},
+		{"database", func() (string, error) { return doctorDatabase(*timeout) }},
+		{"migrations", doctorMigrations},
+		{"upstream", func() (string, error) { return doctorUpstream(*videoURL) }},
+		{"cache", doctorCache},
+		{"storage", doctorStorage},
+		{"timescale", func() (string, error) { return doctorTimescale(*timeout) }},
+		{"alert webhook", func() (string, error) { return doctorWebhook(client) }},
+	}
+
+	failed := 0
+	for _, check := range checks {
+		detail, err := check.Run()
+		switch {
+		case err == errSkipped:
+			fmt.Printf("SKIP  %-14s %s\n", check.Name, detail)
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL  %-14s %v\n", check.Name, err)
+		default:
+			fmt.Printf("PASS  %-14s %s\n", check.Name, detail)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func doctorDatabase(timeout time.Duration) (string, error) {
+	db = sql.OpenDB(rotatingConnector{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		db = nil
+		return "", fmt.Errorf("error connecting: %w", err)
+	}
+	return fmt.Sprintf("connected to %s in %s", os.Getenv("DB_HOST"), time.Since(start).Round(time.Millisecond)), nil
+}
+
+// doctorMigrations reports pending migrations without applying them.
+func doctorMigrations() (string, error) {
+	if db == nil {
+		return "no database connection", errSkipped
+	}
+
+	applied := make(map[string]bool)
+	rows, err := db.Query("SELECT name FROM schema_migrations")
+	if err != nil {
+		return "", fmt.Errorf("error reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", fmt.Errorf("error scanning schema_migrations: %w", err)
+		}
+		applied[name] = true
+	}
+
+	var pending []string
+	for _, m := range store.Migrations {
+		if !applied[m.Name] {
+			pending = append(pending, m.Name)
+		}
+	}
+	if len(pending) > 0 {
+		return "", fmt.Errorf("%d pending, starting with %s (applied on next server start)", len(pending), pending[0])
+	}
+	return fmt.Sprintf("all %d applied", len(store.Migrations)), nil
+}
+
+func doctorUpstream(videoURL string) (string, error) {
+	if videoURL == "" {
+		if db == nil {
+			return "no database connection and no -video given", errSkipped
+		}
+		err := db.QueryRow("SELECT url FROM urls WHERE status = 'active' ORDER BY id LIMIT 1").Scan(&videoURL)
+		if err == sql.ErrNoRows {
+			return "no active URLs; pass -video", errSkipped
+		}
+		if err != nil {
+			return "", fmt.Errorf("error picking a URL: %w", err)
+		}
+	}
+
+	start := time.Now()
+	video, err := resolveVideo(videoURL)
+	if err != nil {
+		return "", err
+	}
+
+	provider := "tikwm"
+	if externalResolver() != nil {
+		provider = "external resolver"
+	}
+	return fmt.Sprintf("%s resolved %s in %s", provider, video.ID, time.Since(start).Round(time.Millisecond)), nil
+}
+
+func doctorCache() (string, error) {
+	detail := fmt.Sprintf("in-memory metadata cache (%d entries)", envInt("METADATA_CACHE_SIZE", 10000))
+	if provider := os.Getenv("CDN_PROVIDER"); provider != "" {
+		detail += ", CDN purges via " + provider
+	}
+	return detail, nil
+}
+
+// doctorStorage writes, lists and deletes a probe object in the backup
+// bucket, which needs the same permissions as scheduled backups.
+func doctorStorage() (string, error) {
+	store, prefix, err := backupStorage()
+	if err == errBackupStorageDisabled {
+		return "no backup storage configured", errSkipped
+	}
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%sdoctor-%d", prefix, time.Now().UnixNano())
+	body := []byte("shoti-srv doctor\n")
+	if err := store.Put(key, bytes.NewReader(body), int64(len(body))); err != nil {
+		return "", fmt.Errorf("error writing %s: %w", key, err)
+	}
+	if _, err := store.List(prefix); err != nil {
+		return "", fmt.Errorf("error listing %s: %w", prefix, err)
+	}
+	if err := store.Delete(key); err != nil {
+		return "", fmt.Errorf("error deleting %s: %w", key, err)
+	}
+	return fmt.Sprintf("read/write/delete on %s/%s", store, prefix), nil
+}
+
+// doctorTimescale checks that TIMESCALE_URL reaches a database with the
+// timescaledb extension, which the serve log and growth exports need.
+func doctorTimescale(timeout time.Duration) (string, error) {
+	if secret("TIMESCALE_URL") == "" {
+		return "TIMESCALE_URL not set", errSkipped
+	}
+	initTimescale()
+	if timescale == nil {
+		return "", fmt.Errorf("invalid TIMESCALE_URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var version string
+	err := timescale.QueryRowContext(ctx, "SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'").Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("the timescaledb extension is not installed")
+	}
+	if err != nil {
+		return "", fmt.Errorf("error connecting: %w", err)
+	}
+	return "timescaledb " + version, nil
+}
+
+// doctorWebhook only checks that the alert webhook answers, so running the
+// doctor does not page anyone.
+func doctorWebhook(client *http.Client) (string, error) {
+	target := os.Getenv("ALERT_WEBHOOK_URL")
+	if target == "" {
+		return "ALERT_WEBHOOK_URL not set", errSkipped
+	}
+
+	resp, err := client.Head(target)
+	if err != nil {
+		return "", fmt.Errorf("error reaching webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return fmt.Sprintf("reachable (%s)", resp.Status), nil
+}
+
+func init() {
+	commands["doctor"] = command{
+		Summary: "check configuration, database, upstream, storage and webhooks",
+		Run:     doctorCommand,
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domain events (url.added, url.approved, video.served, resolve.failed) are
+// published to an optional event bus selected by EVENT_BUS: "nats"
+// publishes to EVENT_NATS_URL on subject <EVENT_SUBJECT_PREFIX><type>,
+// "kafka" produces to EVENT_KAFKA_TOPIC through the Kafka REST proxy at
+// EVENT_KAFKA_REST_URL (Confluent REST Proxy or Redpanda's HTTP proxy),
+// keyed by event type. Publishing is asynchronous; events are dropped when
+// the queue of EVENT_QUEUE_SIZE is full rather than slowing down requests,
+// unless they go through the outbox (see outbox.go).
+
+type domainEvent struct {
+	// ID is set on events relayed from the outbox, which may be
+	// delivered more than once.
+	ID       string      `json:"id,omitempty"`
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	Region   string      `json:"region,omitempty"`
+	Instance string      `json:"instance"`
+	Data     interface{} `json:"data"`
+}
+
+// eventPublisher delivers encoded events to a bus.
+type eventPublisher interface {
+	Publish(eventType string, payload []byte) error
+	Close() error
+}
+
+var (
+	eventsPublished = expvar.NewMap("events_published")
+	eventsDropped   = expvar.NewInt("events_dropped")
+)
+
+var eventBus struct {
+	publisher eventPublisher
+	queue     chan domainEvent
+	done      chan struct{}
+
+	// mu guards sending on queue against closeEventBus closing it: the
+	// scheduler and background tasks may still publish during shutdown,
+	// and those events are dropped once closed is set.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func initEventBus() {
+	var (
+		publisher eventPublisher
+		err       error
+	)
+	switch kind := os.Getenv("EVENT_BUS"); kind {
+	case "":
+		return
+	case "nats":
+		publisher, err = newNATSPublisher(os.Getenv("EVENT_NATS_URL"), os.Getenv("EVENT_SUBJECT_PREFIX"))
+	case "kafka":
+		publisher, err = newKafkaRESTPublisher(os.Getenv("EVENT_KAFKA_REST_URL"), os.Getenv("EVENT_KAFKA_TOPIC"))
+	default:
+		err = fmt.Errorf("unknown EVENT_BUS %q", kind)
+	}
+	if err != nil {
+		log.Printf("Event bus disabled: %v\n", err)
+		return
+	}
+
+	eventBus.publisher = publisher
+	eventBus.queue = make(chan domainEvent, envInt("EVENT_QUEUE_SIZE", 10000))
+	eventBus.done = make(chan struct{})
+	go runEventBus()
+}
+
+// publishEvent queues an event of type eventType. It never blocks.
+func publishEvent(eventType string, data interface{}) {
+	if eventBus.queue == nil {
+		return
+	}
+
+	ev := domainEvent{
+		Type:     eventType,
+		Time:     time.Now().UTC(),
+		Region:   currentRegion(),
+		Instance: instanceName(),
+		Data:     data,
+	}
+	eventBus.mu.RLock()
+	defer eventBus.mu.RUnlock()
+	if eventBus.closed {
+		eventsDropped.Add(1)
+		return
+	}
+	select {
+	case eventBus.queue <- ev:
+	default:
+		eventsDropped.Add(1)
+	}
+}
+
+func runEventBus() {
+	defer close(eventBus.done)
+	for ev := range eventBus.queue {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("Error encoding %s event: %v\n", ev.Type, err)
+			continue
+		}
+		if err := eventBus.publisher.Publish(ev.Type, payload); err != nil {
+			log.Printf("Error publishing %s event: %v\n", ev.Type, err)
+			eventsDropped.Add(1)
+			continue
+		}
+		eventsPublished.Add(ev.Type, 1)
+	}
+}
+
+// closeEventBus publishes the queued events and closes the publisher.
+// Events published afterwards are dropped.
+func closeEventBus() {
+	if eventBus.queue == nil {
+		return
+	}
+	eventBus.mu.Lock()
+	if eventBus.closed {
+		eventBus.mu.Unlock()
+		return
+	}
+	eventBus.closed = true
+	close(eventBus.queue)
+	eventBus.mu.Unlock()
+	<-eventBus.done
+	if err := eventBus.publisher.Close(); err != nil {
+		log.Printf("Error closing event bus: %v\n", err)
+	}
+}
+
+// natsPublisher speaks the core NATS text protocol, which is all publishing
+// needs: CONNECT once, then PUB per event, answering the server's PINGs.
+type natsPublisher struct {
+	server *url.URL
+	prefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func newNATSPublisher(server, prefix string) (*natsPublisher, error) {
+	if server == "" {
+		return nil, fmt.Errorf("EVENT_NATS_URL is not set")
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EVENT_NATS_URL: %w", err)
+	}
+	if prefix == "" {
+		prefix = "shoti."
+	}
+	return &natsPublisher{server: u, prefix: prefix}, nil
+}
+
+// connect must be called with p.mu held.
+func (p *natsPublisher) connect() error {
+	host := p.server.Host
+	if p.server.Port() == "" {
+		host = net.JoinHostPort(p.server.Hostname(), "4222")
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if p.server.Scheme == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: p.server.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to NATS: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting %q: %v", info, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "shoti-srv", "lang": "go"}
+	if u := p.server.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			options["user"], options["pass"] = u.Username(), pass
+		} else {
+			options["auth_token"] = u.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\n", connect)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return fmt.Errorf("error sending CONNECT: %w", err)
+	}
+
+	p.conn, p.w = conn, w
+	go p.read(conn, r)
+	return nil
+}
+
+// read answers PINGs so the server keeps the connection open, and logs
+// errors the server reports.
+func (p *natsPublisher) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			p.mu.Lock()
+			if p.conn == conn {
+				p.conn, p.w = nil, nil
+			}
+			p.mu.Unlock()
+			conn.Close()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			p.mu.Lock()
+			if p.conn == conn {
+				p.w.WriteString("PONG\r\n")
+				p.w.Flush()
+			}
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS: %s\n", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (p *natsPublisher) Publish(eventType string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(p.w, "PUB %s%s %d\r\n", p.prefix, eventType, len(payload))
+	p.w.Write(payload)
+	p.w.WriteString("\r\n")
+	if err := p.w.Flush(); err != nil {
+		p.conn.Close()
+		p.conn, p.w = nil, nil
+		return fmt.Errorf("error publishing to NATS: %w", err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn, p.w = nil, nil
+	return err
+}
+
+// kafkaRESTPublisher produces records through the Kafka REST proxy v2 API.
+type kafkaRESTPublisher struct {
+	target string
+	client *http.Client
+}
+
+func newKafkaRESTPublisher(proxy, topic string) (*kafkaRESTPublisher, error) {
+	if proxy == "" {
+		return nil, fmt.Errorf("EVENT_KAFKA_REST_URL is not set")
+	}
+	if topic == "" {
+		topic = "shoti-events"
+	}
+	return &kafkaRESTPublisher{
+		target: strings.TrimRight(proxy, "/") + "/topics/" + url.PathEscape(topic),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *kafkaRESTPublisher) Publish(eventType string, payload []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": eventType, "value": json.RawMessage(payload)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+
+	response, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error producing to Kafka: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("Kafka REST proxy responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) Close() error {
+	return nil
+}
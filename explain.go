@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+// Selection explanations answer "why do I keep getting this video"
+// reports: GET /api/debug/selection?params=hashtag%3Dcats%26user%3D42 on
+// the admin listener runs the selection of /api/get with those parameters
+// as a dry run and reports the filters that applied, how many videos each
+// of them ruled out, how many candidates were left and how the strategy
+// chose among them. An X-API-Key header is passed on, for from=favorites
+// and for sessions of that key. Sessions are per replica, so a session may
+// look different on the replica answering the explanation.
+
+type selectionExplanation struct {
+	Params     string                `json:"params"`
+	Filters    []filterExplanation   `json:"filters"`
+	Catalog    int                   `json:"catalog"`
+	Candidates int                   `json:"candidates"`
+	Strategy   string                `json:"strategy"`
+	Seed       string                `json:"seed,omitempty"`
+	Chosen     *candidateExplanation `json:"chosen,omitempty"`
+	Reason     string                `json:"reason"`
+	Notes      []string              `json:"notes,omitempty"`
+}
+
+type filterExplanation struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Rejected counts the videos this filter rules out on its own.
+	Rejected int `json:"rejected"`
+}
+
+type candidateExplanation struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Collection string    `json:"collection"`
+	Weight     float64   `json:"weight"`
+	Likes      int64     `json:"likes"`
+	PinEvery   int       `json:"pin_every,omitempty"`
+	LastServed time.Time `json:"last_served"`
+	// Probability is the chance of this pick among the candidates, for
+	// random strategies.
+	Probability float64 `json:"probability,omitempty"`
+}
+
+type selectionFilter struct {
+	name, value string
+	pass        func(catalogEntry) bool
+}
+
+// selectionFilters lists the filters of p one by one, as applied together
+// by p.matches.
+func selectionFilters(p selectionParams) []selectionFilter {
+	var filters []selectionFilter
+	add := func(name, value string, pass func(catalogEntry) bool) {
+		filters = append(filters, selectionFilter{name, value, pass})
+	}
+	if len(p.Exclude) > 0 {
+		add("exclude", strconv.Itoa(len(p.Exclude))+" ids", func(e catalogEntry) bool {
+			return !p.Exclude[e.ID] && (e.VideoID == "" || !p.Exclude[e.VideoID])
+		})
+	}
+	if p.MinLikes > 0 {
+		add("min_likes", strconv.FormatInt(p.MinLikes, 10), func(e catalogEntry) bool { return e.Likes >= p.MinLikes })
+	}
+	if p.MinPlays > 0 {
+		add("min_plays", strconv.FormatInt(p.MinPlays, 10), func(e catalogEntry) bool { return e.Plays >= p.MinPlays })
+	}
+	if p.Hashtag != "" {
+		add("hashtag", p.Hashtag, func(e catalogEntry) bool { return slices.Contains(e.Hashtags, p.Hashtag) })
+	}
+	if p.MusicID != "" {
+		add("music_id", p.MusicID, func(e catalogEntry) bool { return e.MusicID == p.MusicID })
+	}
+	if p.Collection != "" {
+		add("collection", p.Collection, func(e catalogEntry) bool { return e.Collection == p.Collection })
+	}
+	if p.Country != "" {
+		add("country", p.Country, func(e catalogEntry) bool { return !slices.Contains(e.Restricted, p.Country) })
+	}
+	if p.Cohort != nil {
+		value := fmt.Sprintf("bucket %d of %d", p.Cohort.bucket, p.Cohort.buckets)
+		add("cohort", value, p.Cohort.contains)
+	}
+	if p.Seen != nil {
+		add("session", "already served", func(e catalogEntry) bool { return !p.Seen.has(e.ID) })
+	}
+	return filters
+}
+
+// explainSelection handles GET /api/debug/selection.
+func explainSelection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query().Get("params")
+	if _, err := url.ParseQuery(query); err != nil {
+		writeError(w, http.StatusBadRequest, "params must be a query string such as hashtag=cats&user=42")
+		return
+	}
+	getReq, err := http.NewRequest(http.MethodGet, "/api/get?"+query, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "params must be a query string such as hashtag=cats&user=42")
+		return
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		getReq.Header.Set("X-API-Key", key)
+	}
+
+	p, err := parseSelectionParams(getReq)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	p.DryRun = true
+
+	var entries []catalogEntry
+	switch {
+	case p.Favorites != nil:
+		entries, err = favoriteEntries(*p.Favorites)
+	default:
+		var loaded bool
+		if entries, loaded = index.snapshot(); !loaded {
+			entries, err = activeEntries()
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	ex := selectionExplanation{Params: query, Filters: []filterExplanation{}, Catalog: len(entries), Seed: p.Seed}
+	filters := selectionFilters(p)
+	for _, f := range filters {
+		fe := filterExplanation{Name: f.name, Value: f.value}
+		for _, e := range entries {
+			if !f.pass(e) {
+				fe.Rejected++
+			}
+		}
+		ex.Filters = append(ex.Filters, fe)
+	}
+	candidates := entries
+	if match := p.matcher(); match != nil {
+		candidates = selector.Filter(append([]catalogEntry(nil), entries...), match)
+	}
+	ex.Candidates = len(candidates)
+
+	chosen, strategy, err := newPicker(p)()
+	ex.Strategy = strategy
+	switch err {
+	case nil:
+	case errNoFavorites, errNoMatches, errNoURLs:
+		ex.Reason = err.Error()
+		writeJSON(w, http.StatusOK, ex)
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	if len(candidates) == 0 || !slices.ContainsFunc(candidates, func(e catalogEntry) bool { return e.ID == chosen.ID }) {
+		// The picker widened the filters rather than fail.
+		if p.Cohort != nil {
+			ex.Notes = append(ex.Notes, "no candidate in the user's cohort, so the cohort filter was dropped")
+		}
+		if p.Seen != nil {
+			ex.Notes = append(ex.Notes, "the session has been served every candidate, so its rotation starts over")
+		}
+	}
+	ex.Chosen = &candidateExplanation{
+		ID:         chosen.ID,
+		URL:        chosen.URL,
+		Collection: chosen.Collection,
+		Weight:     chosen.Weight,
+		Likes:      chosen.Likes,
+		PinEvery:   chosen.PinEvery,
+		LastServed: chosen.LastServed,
+	}
+	ex.Reason = explainPick(strategy, chosen, candidates, ex.Chosen)
+	writeJSON(w, http.StatusOK, ex)
+}
+
+// explainPick describes why strategy picked e among candidates and fills
+// in the probability of the pick.
+func explainPick(strategy string, e catalogEntry, candidates []catalogEntry, c *candidateExplanation) string {
+	n := len(candidates)
+	switch strategy {
+	case "pinned":
+		return fmt.Sprintf("pinned to every %d responses, and the next response of this replica is due for it", e.PinEvery)
+	case "seeded":
+		return "ranked first among the candidates for this seed; the same seed picks the same video on every replica"
+	case "favorites":
+		c.Probability = 1 / float64(max(n, 1))
+		return fmt.Sprintf("random pick among %d favorites", n)
+	case "lrs":
+		return "served longest ago among a random sample of the candidates"
+	}
+
+	if sel, ok := selectors[strategy].(selector.Weighted); ok {
+		var total float64
+		for _, candidate := range candidates {
+			total += max(sel.Weight(candidate), 0)
+		}
+		if total > 0 {
+			c.Probability = max(sel.Weight(e), 0) / total
+		}
+		return fmt.Sprintf("weighted random pick among %d candidates, with weight %g of %g", n, sel.Weight(e), total)
+	}
+	c.Probability = 1 / float64(max(n, 1))
+	return fmt.Sprintf("uniform random pick among %d candidates", n)
+}
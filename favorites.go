@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+var errNoFavorites = errors.New("no favorites found")
+
+// favoriteOwner scopes favorites to an API key and, optionally, to an end
+// user of that key's bot passed as ?user=. Favorites are stored under the
+// hash of the key (see keyHash), never the key itself.
+type favoriteOwner struct {
+	KeyHash string
+	User    string
+}
+
+func favoritesOwner(w http.ResponseWriter, r *http.Request) (favoriteOwner, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		writeError(w, http.StatusUnauthorized, "favorites require an X-API-Key header")
+		return favoriteOwner{}, false
+	}
+	return favoriteOwner{KeyHash: keyHash(key), User: r.URL.Query().Get("user")}, true
+}
+
+// favorite handles POST and DELETE /api/favorites/{video_id}. Only videos
+// that have been served (and so have a known video_id) can be favorited.
+func favorite(w http.ResponseWriter, r *http.Request) {
+	videoID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/favorites/"), "/")
+	if videoID == "" || strings.Contains(videoID, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	owner, ok := favoritesOwner(w, r)
+	if !ok {
+		return
+	}
+
+	urlID, err := findURLID("SELECT id FROM urls WHERE video_id = $1 LIMIT 1", videoID)
+	var conn *sql.DB
+	if err == nil {
+		// Favorites are kept in the shard of their video.
+		conn, err = catalog.DB(urlID)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up video %s: %v\n", videoID, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		_, err = conn.Exec(`
+		INSERT INTO favorites (api_key, user_id, url_id) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		`, owner.KeyHash, owner.User, urlID)
+	case http.MethodDelete:
+		_, err = conn.Exec("DELETE FROM favorites WHERE api_key = $1 AND user_id = $2 AND url_id = $3", owner.KeyHash, owner.User, urlID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating favorite: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusResponse{Code: 200, Msg: "success"})
+}
+
+// favoriteEntries returns the active favorites of owner on every shard.
+func favoriteEntries(owner favoriteOwner) ([]catalogEntry, error) {
+	var entries []catalogEntry
+	for _, conn := range catalog.DBs() {
+		rows, err := conn.Query(`
+		SELECT `+store.EntryColumns+` FROM urls
+		WHERE status = 'active' AND id IN (
+			SELECT url_id FROM favorites WHERE api_key = $1 AND user_id = $2
+		)
+		`, owner.KeyHash, owner.User)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving favorites: %w", err)
+		}
+		for rows.Next() {
+			e, err := store.ScanEntry(rows)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning favorite: %w", err)
+			}
+			entries = append(entries, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error retrieving favorites: %w", err)
+		}
+	}
+	return entries, nil
+}
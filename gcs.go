@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsStore talks to the Google Cloud Storage JSON API. It authenticates
+// with a service account key file (GCS_CREDENTIALS_FILE, falling back to
+// GOOGLE_APPLICATION_CREDENTIALS) or, without one, with the metadata server
+// of the GCP instance it runs on.
+type gcsStore struct {
+	bucket string
+	creds  *gcsCredentials
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type gcsCredentials struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+const (
+	gcsAPI         = "https://storage.googleapis.com"
+	gcsScope       = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+func newGCSStore(bucket, credentialsFile string) (*gcsStore, error) {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	store := &gcsStore{bucket: bucket, client: &http.Client{Timeout: 5 * time.Minute}}
+	if credentialsFile == "" {
+		return store, nil
+	}
+
+	raw, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GCS credentials: %w", err)
+	}
+	var creds gcsCredentials
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, fmt.Errorf("error decoding GCS credentials: %w", err)
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("GCS credentials have no private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing GCS private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GCS private key is not RSA")
+	}
+	creds.key = key
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	store.creds = &creds
+	return store, nil
+}
+
+func (g *gcsStore) String() string {
+	return "gs://" + g.bucket
+}
+
+// accessToken returns a cached OAuth token, refreshing it a minute before
+// it expires.
+func (g *gcsStore) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+	if g.creds == nil {
+		req, err = http.NewRequest(http.MethodGet, gcsMetadataURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		assertion, err := g.creds.jwt()
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		req, err = http.NewRequest(http.MethodPost, g.creds.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	response, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching GCS token: %w", err)
+	}
+	defer response.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching GCS token: %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error decoding GCS token: %w", err)
+	}
+
+	g.token = token.AccessToken
+	g.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+// jwt builds the signed assertion exchanged for an access token.
+func (c *gcsCredentials) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": gcsScope,
+		"aud":   c.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing GCS token request: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (g *gcsStore) do(method, target string, body io.Reader, size int64) (*http.Response, error) {
+	token, err := g.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	response, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if response.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, response.Status, strings.TrimSpace(string(msg)))
+	}
+	return response, nil
+}
+
+func (g *gcsStore) objectURL(key string) string {
+	return gcsAPI + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (g *gcsStore) Put(key string, body io.ReadSeeker, size int64) error {
+	target := gcsAPI + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?" + url.Values{"uploadType": {"media"}, "name": {key}}.Encode()
+	response, err := g.do(http.MethodPost, target, body, size)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (g *gcsStore) Get(key string) (io.ReadCloser, error) {
+	response, err := g.do(http.MethodGet, g.objectURL(key)+"?alt=media", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (g *gcsStore) Delete(key string) error {
+	response, err := g.do(http.MethodDelete, g.objectURL(key), nil, 0)
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (g *gcsStore) List(prefix string) ([]blobObject, error) {
+	var (
+		objects []blobObject
+		page    string
+	)
+	for {
+		query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+		if page != "" {
+			query.Set("pageToken", page)
+		}
+		response, err := g.do(http.MethodGet, gcsAPI+"/storage/v1/b/"+url.PathEscape(g.bucket)+"/o?"+query.Encode(), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    string    `json:"size"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding object list: %w", err)
+		}
+
+		for _, item := range result.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, blobObject{Key: item.Name, Size: size, LastModified: item.Updated})
+		}
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		page = result.NextPageToken
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Videos can be restricted in a list of countries. The requester's country
+// comes from ?country=, else from GEOIP_HEADER when a CDN or proxy sets one
+// (such as CF-IPCountry), else from looking up the client IP in GEOIP_FILE,
+// a CSV of "network,country" lines such as "1.0.0.0/24,AU".
+
+func normalizeCountry(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return ""
+	}
+	return code
+}
+
+// requestCountry returns the requester's ISO country code, or "" when it is
+// unknown, in which case no restriction applies.
+func requestCountry(r *http.Request) string {
+	if c := normalizeCountry(r.URL.Query().Get("country")); c != "" {
+		return c
+	}
+	if header := os.Getenv("GEOIP_HEADER"); header != "" {
+		if c := normalizeCountry(r.Header.Get(header)); c != "" {
+			return c
+		}
+	}
+	if addr, err := netip.ParseAddr(clientIP(r)); err == nil {
+		return geoDB().lookup(addr.Unmap())
+	}
+	return ""
+}
+
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// geoRanges is sorted by start address for binary search.
+type geoRanges []geoRange
+
+func (g geoRanges) lookup(addr netip.Addr) string {
+	i := sort.Search(len(g), func(i int) bool { return addr.Less(g[i].start) })
+	if i == 0 {
+		return ""
+	}
+	r := g[i-1]
+	if r.start.BitLen() == addr.BitLen() && !r.end.Less(addr) {
+		return r.country
+	}
+	return ""
+}
+
+var geo struct {
+	once   sync.Once
+	ranges geoRanges
+}
+
+func geoDB() geoRanges {
+	geo.once.Do(func() {
+		path := os.Getenv("GEOIP_FILE")
+		if path == "" {
+			return
+		}
+		ranges, err := loadGeoRanges(path)
+		if err != nil {
+			log.Printf("Error loading GeoIP data, country lookup disabled: %v\n", err)
+			return
+		}
+		geo.ranges = ranges
+		log.Printf("Loaded %d GeoIP ranges.\n", len(ranges))
+	})
+	return geo.ranges
+}
+
+func loadGeoRanges(path string) (geoRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges geoRanges
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		network, country, ok := strings.Cut(text, ",")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected network,country", path, line)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+		if err != nil {
+			if line == 1 {
+				continue // header row
+			}
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		prefix = prefix.Masked()
+		ranges = append(ranges, geoRange{
+			start:   prefix.Addr(),
+			end:     lastAddr(prefix),
+			country: normalizeCountry(country),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	return ranges, nil
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
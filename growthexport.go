@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// Growth exports: every GROWTH_EXPORT_INTERVAL the leader writes the
+// engagement stats and serve count of every resolved active video to the
+// time-series databases configured, for Grafana dashboards of how the
+// catalog performs:
+//
+//   - INFLUX_WRITE_URL, an InfluxDB write endpoint such as
+//     http://influx:8086/api/v2/write?org=o&bucket=shoti, gets the points
+//     in line protocol as the measurement shoti_video, authenticated with
+//     INFLUX_TOKEN;
+//   - REMOTE_WRITE_URL, a Prometheus remote-write receiver, gets the gauges
+//     shoti_video_plays, _likes, _comments, _shares and _serves (see
+//     remotewrite.go), authenticated with REMOTE_WRITE_TOKEN or the user
+//     of the URL;
+//   - TIMESCALE_URL, a Postgres database with the timescaledb extension
+//     (see servelog.go), gets rows in the hypertable video_engagement,
+//     created on first use.
+//
+// Every point is tagged with the URL id, collection and upstream video id.
+
+// growthExporter writes the engagement of videos at a time somewhere.
+type growthExporter interface {
+	Export(at time.Time, videos []store.Engagement) error
+}
+
+var growthExporters = map[string]growthExporter{}
+
+var growthExportClient = &http.Client{Timeout: 30 * time.Second}
+
+func initGrowthExporters() {
+	if target := os.Getenv("INFLUX_WRITE_URL"); target != "" {
+		growthExporters["influx"] = &influxExporter{url: target, token: secret("INFLUX_TOKEN")}
+	}
+	if target := secret("REMOTE_WRITE_URL"); target != "" {
+		growthExporters["remote-write"] = &remoteWriteExporter{url: target, token: secret("REMOTE_WRITE_TOKEN")}
+	}
+	if timescale != nil {
+		growthExporters["timescale"] = &timescaleExporter{db: timescale}
+	}
+}
+
+// exportGrowth writes the current engagement of the catalog to every
+// exporter.
+func exportGrowth() error {
+	if len(growthExporters) == 0 {
+		return nil
+	}
+	videos, err := catalog.Engagements()
+	if err != nil {
+		return err
+	}
+	at := time.Now().UTC()
+	var errs []error
+	for name, exporter := range growthExporters {
+		if err := exporter.Export(at, videos); err != nil {
+			errs = append(errs, fmt.Errorf("error exporting to %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type influxExporter struct {
+	url   string
+	token string
+}
+
+// influxBatch is the number of lines written per request, within the
+// limits InfluxDB recommends.
+const influxBatch = 5000
+
+func (e *influxExporter) Export(at time.Time, videos []store.Engagement) error {
+	for start := 0; start < len(videos); start += influxBatch {
+		var body bytes.Buffer
+		for _, v := range videos[start:min(start+influxBatch, len(videos))] {
+			fmt.Fprintf(&body, "shoti_video,collection=%s,id=%s", influxTag(v.Collection), influxTag(v.ID))
+			if v.VideoID != "" {
+				fmt.Fprintf(&body, ",video_id=%s", influxTag(v.VideoID))
+			}
+			fmt.Fprintf(&body, " plays=%di,likes=%di,comments=%di,shares=%di,serves=%di %d\n",
+				v.Stats.Plays, v.Stats.Likes, v.Stats.Comments, v.Stats.Shares, v.Serves, at.UnixNano())
+		}
+		if err := e.write(body.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *influxExporter) write(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Token "+e.token)
+	}
+	response, err := growthExportClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %w", req.URL.Host, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", req.URL.Host, response.StatusCode)
+	}
+	return nil
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxTag escapes a tag value for line protocol.
+func influxTag(value string) string {
+	return influxTagEscaper.Replace(value)
+}
+
+type timescaleExporter struct {
+	db    *sql.DB
+	ready bool
+}
+
+// setup creates the hypertable, so a database that was down at startup is
+// set up when it comes back.
+func (e *timescaleExporter) setup() error {
+	if e.ready {
+		return nil
+	}
+	_, err := e.db.Exec(`
+	CREATE TABLE IF NOT EXISTS video_engagement (
+		time TIMESTAMPTZ NOT NULL,
+		url_id UUID NOT NULL,
+		collection TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		plays BIGINT NOT NULL,
+		likes BIGINT NOT NULL,
+		comments BIGINT NOT NULL,
+		shares BIGINT NOT NULL,
+		serves BIGINT NOT NULL
+	);
+	SELECT create_hypertable('video_engagement', 'time', if_not_exists => TRUE);
+	CREATE INDEX IF NOT EXISTS video_engagement_url_idx ON video_engagement (url_id, time DESC);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating video_engagement: %w", err)
+	}
+	e.ready = true
+	return nil
+}
+
+func (e *timescaleExporter) Export(at time.Time, videos []store.Engagement) error {
+	if err := e.setup(); err != nil {
+		return err
+	}
+	tx, err := e.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting export: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("video_engagement",
+		"time", "url_id", "collection", "video_id", "plays", "likes", "comments", "shares", "serves"))
+	if err != nil {
+		return fmt.Errorf("error starting copy: %w", err)
+	}
+	for _, v := range videos {
+		st := v.Stats
+		if _, err := stmt.Exec(at, v.ID, v.Collection, v.VideoID, st.Plays, st.Likes, st.Comments, st.Shares, v.Serves); err != nil {
+			stmt.Close()
+			return fmt.Errorf("error copying %s: %w", v.ID, err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("error copying engagement: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("error copying engagement: %w", err)
+	}
+	return tx.Commit()
+}
+
+func init() {
+	schedule("growth-export", "GROWTH_EXPORT_INTERVAL", 5*time.Minute, exportGrowth).LeaderOnly = true
+}
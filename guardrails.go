@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Catalog size guardrails: with CATALOG_MIN_ACTIVE set, an alert fires as
+// soon as the active URLs drop below it (after mass takedowns or an
+// over-eager retention policy, say) and another once they recover, well
+// before /api/get runs dry. With CATALOG_GUARD_RETENTION=true, retention
+// runs that would take the catalog below the minimum are skipped, leaving
+// it to an operator to add videos or lower the policies.
+
+// retentionPaused is whether the last retention run was skipped. Retention
+// only runs on the leader, one run at a time.
+var retentionPaused bool
+
+func catalogMinimum() int {
+	return envInt("CATALOG_MIN_ACTIVE", 0)
+}
+
+// noteCatalogMinimum alerts when the number of active URLs crosses
+// CATALOG_MIN_ACTIVE. It is called with the index lock held, on every
+// change, so it only acts on crossings.
+func noteCatalogMinimum(active int) {
+	minimum := catalogMinimum()
+	var below int64
+	if minimum > 0 && active < minimum {
+		below = 1
+	}
+	switch {
+	case below == 1 && catalogBelowMinimum.Value() == 0:
+		sendAlert(Alert{
+			Kind:    "catalog_below_minimum",
+			Message: fmt.Sprintf("The catalog has %d active URLs, below the minimum of %d.", active, minimum),
+			Tags:    map[string]string{"active": fmt.Sprint(active), "minimum": fmt.Sprint(minimum)},
+		})
+	case below == 0 && catalogBelowMinimum.Value() == 1:
+		sendAlert(Alert{
+			Kind:    "catalog_recovered",
+			Level:   "info",
+			Message: fmt.Sprintf("The catalog is back to %d active URLs.", active),
+			Tags:    map[string]string{"active": fmt.Sprint(active)},
+		})
+	}
+	catalogBelowMinimum.Set(below)
+}
+
+// retentionGuarded reports whether archiving n of active URLs would take
+// the catalog below CATALOG_MIN_ACTIVE with CATALOG_GUARD_RETENTION on.
+func retentionGuarded(active, n int) bool {
+	minimum := catalogMinimum()
+	return os.Getenv("CATALOG_GUARD_RETENTION") == "true" && minimum > 0 && active-n < minimum
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type hashtagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type hashtagsResponse struct {
+	Code int            `json:"code"`
+	Msg  string         `json:"msg"`
+	Data []hashtagCount `json:"data"`
+}
+
+// getHashtags handles GET /api/hashtags, listing the tags of active videos
+// (of the route's collection on a collection route) with how many videos
+// carry each.
+func getHashtags(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	// Every shard's counts are needed for an exact top list, so a limit
+	// only applies in the database when there is one.
+	collection := routeCollection(r)
+	conns := collectionDBs(collection)
+	var shardLimit interface{}
+	if len(conns) == 1 {
+		shardLimit = limit
+	}
+	counts := make(map[string]int)
+	for _, conn := range conns {
+		if err := countHashtags(conn, collection, shardLimit, counts); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+	}
+
+	response := hashtagsResponse{Code: 200, Msg: "success", Data: []hashtagCount{}}
+	for tag, count := range counts {
+		response.Data = append(response.Data, hashtagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(response.Data, func(i, j int) bool {
+		a, b := response.Data[i], response.Data[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Tag < b.Tag
+	})
+	response.Data = response.Data[:min(limit, len(response.Data))]
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// countHashtags adds the counts of the tags of active videos in conn to
+// counts, only the top limit of them unless limit is nil.
+func countHashtags(conn *sql.DB, collection string, limit interface{}, counts map[string]int) error {
+	rows, err := conn.Query(`
+	SELECT h.tag, COUNT(*) FROM hashtags h
+	JOIN urls u ON u.id = h.url_id
+	WHERE u.status = 'active' AND ($2 = '' OR u.collection_id = $2)
+	GROUP BY h.tag
+	ORDER BY COUNT(*) DESC, h.tag
+	LIMIT $1
+	`, limit, collection)
+	if err != nil {
+		return fmt.Errorf("error retrieving hashtags: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c hashtagCount
+		if err := rows.Scan(&c.Tag, &c.Count); err != nil {
+			return fmt.Errorf("error scanning hashtag: %w", err)
+		}
+		counts[c.Tag] += c.Count
+	}
+	return rows.Err()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// Stats history: every VIDEO_HISTORY_INTERVAL at most, a resolve also
+// records a snapshot of the video's engagement stats, and
+// GET /api/videos/{id}/history returns them oldest first, with the change
+// since the previous snapshot, for growth charts of curated videos. since
+// (RFC 3339) and limit narrow the range. Snapshots older than
+// VIDEO_HISTORY_RETENTION are deleted; 0 keeps them forever, and a zero
+// VIDEO_HISTORY_INTERVAL records none.
+
+type statsPoint struct {
+	Time     time.Time `json:"time"`
+	Plays    int64     `json:"plays"`
+	Likes    int64     `json:"likes"`
+	Comments int64     `json:"comments"`
+	Shares   int64     `json:"shares"`
+	// Change is the difference from the previous point, absent on the
+	// first.
+	Change *statsChange `json:"change,omitempty"`
+}
+
+type statsChange struct {
+	Plays    int64 `json:"plays"`
+	Likes    int64 `json:"likes"`
+	Comments int64 `json:"comments"`
+	Shares   int64 `json:"shares"`
+}
+
+type historyResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		ID      string       `json:"id"`
+		VideoID string       `json:"video_id"`
+		Points  []statsPoint `json:"points"`
+	} `json:"data"`
+}
+
+// recordHistory adds the stats of a resolve to the history of id.
+func recordHistory(id string, stats resolver.Stats) {
+	every := envDuration("VIDEO_HISTORY_INTERVAL", time.Hour)
+	if every <= 0 {
+		return
+	}
+	if err := catalog.RecordHistory(id, stats, every); err != nil {
+		log.Printf("Error recording history of %s: %v\n", id, err)
+	}
+}
+
+// videoHistory handles GET /api/videos/{id}/history.
+func videoHistory(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/videos/")
+	id, ok := strings.CutSuffix(rest, "/history")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	r.URL.Path = "/api/videos/" + id
+	entry, ok := publicIDEntry(w, r, "/api/videos/")
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), 1000, 1, 1000)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+		return
+	}
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+	}
+
+	history, err := catalog.History(entry.ID, since, limit)
+	if err != nil {
+		log.Printf("Error loading history of %s: %v\n", entry.ID, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	response := historyResponse{Code: 200, Msg: "success"}
+	response.Data.ID = entry.ID
+	response.Data.VideoID = entry.VideoID
+	response.Data.Points = make([]statsPoint, len(history))
+	for i, snap := range history {
+		st := snap.Stats
+		p := statsPoint{Time: snap.RecordedAt, Plays: st.Plays, Likes: st.Likes, Comments: st.Comments, Shares: st.Shares}
+		if i > 0 {
+			prev := history[i-1].Stats
+			p.Change = &statsChange{
+				Plays:    st.Plays - prev.Plays,
+				Likes:    st.Likes - prev.Likes,
+				Comments: st.Comments - prev.Comments,
+				Shares:   st.Shares - prev.Shares,
+			}
+		}
+		response.Data.Points[i] = p
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// pruneHistory deletes the snapshots older than VIDEO_HISTORY_RETENTION.
+func pruneHistory() error {
+	retention := envDuration("VIDEO_HISTORY_RETENTION", 365*24*time.Hour)
+	if retention <= 0 {
+		return nil
+	}
+	n, err := catalog.PruneHistory(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Pruned %d stats history snapshot(s).\n", n)
+	}
+	return nil
+}
+
+func init() {
+	schedule("prune-history", "", time.Hour, pruneHistory).LeaderOnly = true
+}
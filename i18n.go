@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The msg field of public responses follows the request's Accept-Language.
+// English is the default; Filipino ("fil", or "tl" for Tagalog) is the only
+// translation so far. localize picks the language and records it as the
+// Content-Language header, which writeJSON reads back when it encodes an
+// envelope, so handlers keep writing English messages. Messages missing from
+// the catalog stay in English.
+
+var messageCatalog = map[string]map[string]string{
+	"fil": {
+		"success":                                "tagumpay",
+		"failed":                                 "nabigo",
+		"not found":                              "hindi nahanap",
+		"method not allowed":                     "hindi pinapayagan ang method na ito",
+		"invalid request payload":                "hindi wasto ang laman ng request",
+		"invalid id":                             "hindi wasto ang id",
+		"invalid URL id":                         "hindi wasto ang id ng URL",
+		"invalid playlist id":                    "hindi wasto ang id ng playlist",
+		"video not found":                        "hindi nahanap ang video",
+		"video not found in the catalog":         "wala sa katalogo ang video",
+		"URL not found":                          "hindi nahanap ang URL",
+		"submission not found":                   "hindi nahanap ang submission",
+		"the catalog is empty":                   "walang laman ang katalogo",
+		"no videos match the requested filters":  "walang video na tugma sa mga filter",
+		"no favorites found":                     "walang nahanap na paborito",
+		"favorites require an X-API-Key header":  "kailangan ng X-API-Key header para sa mga paborito",
+		"too many requests, try again later":     "masyadong maraming request, subukan ulit mamaya",
+		"the upstream cannot resolve this video": "hindi ma-resolve ng upstream ang video na ito",
+		"the upstream rate limit was reached, try again shortly": "naabot ang rate limit ng upstream, subukan ulit maya-maya",
+		"failed to resolve video":                                "hindi ma-resolve ang video",
+		"failed to fetch media":                                  "hindi makuha ang media",
+		"failed to transcode video":                              "hindi ma-transcode ang video",
+		"transcoding is not available":                           "hindi available ang transcoding",
+		"no such media for this video":                           "walang ganitong media ang video na ito",
+		"media bandwidth quota exhausted":                        "ubos na ang quota ng media bandwidth",
+		"playlist finished or not found":                         "tapos na o hindi nahanap ang playlist",
+		"serve_id has expired":                                   "expired na ang serve_id",
+		"reason must be between 1 and 500 characters":            "ang reason ay dapat 1 hanggang 500 na karakter",
+		"report received":                                        "natanggap ang ulat",
+		"claim received":                                         "natanggap ang claim",
+		"captcha verification failed":                            "nabigo ang pag-verify ng captcha",
+		"email is not a valid address":                           "hindi wastong email address",
+		"url, name, email and statement are required":            "kailangan ang url, name, email at statement",
+		"statement must be at most 5000 characters":              "ang statement ay hanggang 5000 na karakter lamang",
+		"page must be a positive integer":                        "ang page ay dapat positibong numero",
+		"per_page must be between 1 and 500":                     "ang per_page ay dapat 1 hanggang 500",
+		"limit must be between 1 and 1000":                       "ang limit ay dapat 1 hanggang 1000",
+		"since must be an RFC 3339 time":                         "ang since ay dapat oras na RFC 3339",
+		"invalid cursor":                                         "hindi wasto ang cursor",
+		"cursor and page cannot be combined":                     "hindi puwedeng pagsabayin ang cursor at page",
+		"cursor requires sort newest or oldest":                  "kailangan ng sort na newest o oldest para sa cursor",
+		"read-only while the database is unavailable":            "read-only habang hindi available ang database",
+		"database unavailable":                                   "hindi available ang database",
+		"API key has expired or was revoked":                     "expired o binawi na ang API key",
+		"API key is not allowed to use this endpoint":            "hindi pinapayagan ang API key sa endpoint na ito",
+		"API key is not valid for this collection":               "hindi valid ang API key para sa koleksyong ito",
+		"request signature is invalid":                           "hindi wasto ang pirma ng request",
+		"request timestamp is too far from the server's clock":   "masyadong malayo ang oras ng request sa orasan ng server",
+		"request was already received":                           "natanggap na ang request na ito",
+	},
+}
+
+// localize negotiates the response language of h.
+func localize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		if lang := negotiateLanguage(r.Header.Get("Accept-Language")); lang != "en" {
+			w.Header().Set("Content-Language", lang)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// negotiateLanguage returns the supported language with the highest
+// q-value in header, or "en".
+func negotiateLanguage(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		switch base {
+		case "tl":
+			base = "fil"
+		case "fil", "en":
+		default:
+			continue
+		}
+		if q > 0 {
+			choices = append(choices, choice{base, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return "en"
+	}
+	return choices[0].lang
+}
+
+func translate(lang, msg string) string {
+	if translated, ok := messageCatalog[lang][msg]; ok {
+		return translated
+	}
+	return msg
+}
+
+// localizeEnvelope returns v with its Msg field translated to the language
+// recorded on w, or v itself when there is nothing to translate.
+func localizeEnvelope(w http.ResponseWriter, v interface{}) interface{} {
+	lang := w.Header().Get("Content-Language")
+	if lang == "" {
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return v
+	}
+	msg := rv.FieldByName("Msg")
+	if !msg.IsValid() || msg.Kind() != reflect.String {
+		return v
+	}
+
+	copied := reflect.New(rv.Type()).Elem()
+	copied.Set(rv)
+	copied.FieldByName("Msg").SetString(translate(lang, msg.String()))
+	return copied.Interface()
+}
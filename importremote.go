@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libyzxy0/shoti-srv/client"
+)
+
+// Migrating from another instance: `shoti-srv import-remote --from
+// https://old.example.com` copies the active catalog of another shoti-srv,
+// with collections and the time each URL was added, into this one. With
+// --format list it reads any API that lists URLs as JSON instead, such as
+// the Node shoti APIs: an array of URLs or of objects with a url (or link)
+// field, bare or in a data field, at --path. URLs already in the catalog,
+// by URL or TikTok video id, are skipped, so the import can be re-run;
+// with --every it keeps running, picking up what is still being added to
+// the old instance while both take writes during the move.
+
+// remoteURL is a URL listed by the instance being imported.
+type remoteURL struct {
+	URL        string
+	Collection string
+	AddedAt    time.Time
+}
+
+// fetchShotiCatalog lists the active catalog of a shoti-srv instance.
+func fetchShotiCatalog(ctx context.Context, c *client.Client) ([]remoteURL, error) {
+	var urls []remoteURL
+	q := client.VideosQuery{PerPage: 500, Sort: "oldest"}
+	for {
+		page, err := c.Videos(ctx, q)
+		if err != nil {
+			return nil, fmt.Errorf("error listing videos: %w", err)
+		}
+		for _, v := range page.Videos {
+			urls = append(urls, remoteURL{URL: v.URL, Collection: v.Collection, AddedAt: v.CreatedAt})
+		}
+		if page.NextCursor == "" || len(page.Videos) == 0 {
+			return urls, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// fetchURLList reads a JSON list of URLs from target.
+func fetchURLList(ctx context.Context, target, apiKey string) ([]remoteURL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	response, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s responded with status %d", target, response.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(response.Body, 256<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseURLList(raw)
+}
+
+// parseURLList accepts the list shapes of the common shoti APIs.
+func parseURLList(raw []byte) ([]remoteURL, error) {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(raw, &envelope) == nil && len(envelope.Data) > 0 {
+		raw = envelope.Data
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, errors.New("expected a JSON array of URLs, possibly in a data field")
+	}
+	urls := make([]remoteURL, 0, len(items))
+	for _, item := range items {
+		var u string
+		if json.Unmarshal(item, &u) != nil {
+			var obj struct {
+				URL        string `json:"url"`
+				Link       string `json:"link"`
+				Collection string `json:"collection"`
+				CreatedAt  string `json:"created_at"`
+			}
+			if json.Unmarshal(item, &obj) != nil {
+				continue
+			}
+			u = obj.URL
+			if u == "" {
+				u = obj.Link
+			}
+			if u != "" {
+				// Timestamps in other formats are dropped rather than
+				// failing the import.
+				addedAt, _ := time.Parse(time.RFC3339, obj.CreatedAt)
+				urls = append(urls, remoteURL{URL: u, Collection: obj.Collection, AddedAt: addedAt})
+			}
+			continue
+		}
+		if u != "" {
+			urls = append(urls, remoteURL{URL: u})
+		}
+	}
+	return urls, nil
+}
+
+// dedupKeys returns the keys a URL is known by: the URL without query,
+// fragment or trailing slash, and its TikTok video id when it has one.
+func dedupKeys(rawURL string) []string {
+	keys := []string{"url:" + normalizeImportURL(rawURL)}
+	if m := tiktokVideoIDPattern.FindStringSubmatch(rawURL); m != nil {
+		keys = append(keys, "video:"+m[1])
+	}
+	return keys
+}
+
+func normalizeImportURL(rawURL string) string {
+	u, err := neturl.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return strings.TrimSpace(rawURL)
+	}
+	u.RawQuery, u.Fragment = "", ""
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	return u.String()
+}
+
+// knownURLs returns the dedup keys of every URL in the catalog, whatever
+// its status, so deleted or blocked videos are not brought back.
+func knownURLs() (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, conn := range catalog.DBs() {
+		if err := addKnownURLs(conn, known); err != nil {
+			return nil, err
+		}
+	}
+	return known, nil
+}
+
+func addKnownURLs(conn *sql.DB, known map[string]bool) error {
+	rows, err := conn.Query("SELECT url, COALESCE(video_id, '') FROM urls")
+	if err != nil {
+		return fmt.Errorf("error listing URLs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u, videoID string
+		if err := rows.Scan(&u, &videoID); err != nil {
+			return err
+		}
+		for _, key := range dedupKeys(u) {
+			known[key] = true
+		}
+		if videoID != "" {
+			known["video:"+videoID] = true
+		}
+	}
+	return rows.Err()
+}
+
+type importStats struct {
+	Listed, Added, Skipped int
+}
+
+// importRemote adds the URLs in remote that the catalog does not know.
+func importRemote(remote []remoteURL, source, collection string, dryRun bool) (importStats, error) {
+	stats := importStats{Listed: len(remote)}
+	known, err := knownURLs()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, r := range remote {
+		keys := dedupKeys(r.URL)
+		duplicate := false
+		for _, key := range keys {
+			duplicate = duplicate || known[key]
+		}
+		if duplicate || !strings.HasPrefix(keys[0], "url:http") {
+			stats.Skipped++
+			continue
+		}
+		for _, key := range keys {
+			known[key] = true
+		}
+
+		target := collection
+		if target == "" {
+			target = r.Collection
+		}
+		if target == "" {
+			target = "default"
+		}
+		addedAt := r.AddedAt
+		if addedAt.IsZero() {
+			addedAt = time.Now()
+		}
+		if !dryRun {
+			_, err := catalog.ShardDB(catalog.Shard(target)).Exec(
+				"INSERT INTO urls (id, url, collection_id, submitted_by, created_at) VALUES ($1, $2, $3, $4, $5)",
+				uuid.New().String(), strings.TrimSpace(r.URL), target, "import:"+source, addedAt)
+			if err != nil {
+				return stats, fmt.Errorf("error adding %s: %w", r.URL, err)
+			}
+		}
+		stats.Added++
+	}
+	return stats, nil
+}
+
+func importRemoteCommand(args []string) error {
+	fs := flag.NewFlagSet("import-remote", flag.ContinueOnError)
+	from := fs.String("from", "", "base URL of the instance to import from")
+	format := fs.String("format", "shoti-srv", "shoti-srv, or list for a JSON list of URLs at --path")
+	path := fs.String("path", "/api/list", "path of the URL list with --format list")
+	apiKey := fs.String("api-key", "", "API key for the remote instance")
+	collection := fs.String("collection", "", "collection to import into (default: the remote collection, or default)")
+	every := fs.Duration("every", 0, "keep importing at this interval, while both instances take writes")
+	dryRun := fs.Bool("dry-run", false, "only report what would be imported")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return errors.New("--from is required")
+	}
+	if *format != "shoti-srv" && *format != "list" {
+		return fmt.Errorf("unknown --format %q", *format)
+	}
+	base := strings.TrimRight(*from, "/")
+	source := base
+	if u, err := neturl.Parse(base); err == nil && u.Host != "" {
+		source = u.Host
+	}
+
+	initDB()
+	if degraded.Load() {
+		return errors.New("the database is unavailable")
+	}
+
+	var opts []client.Option
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	remote := client.New(base, opts...)
+
+	for {
+		ctx := context.Background()
+		var urls []remoteURL
+		var err error
+		if *format == "list" {
+			urls, err = fetchURLList(ctx, base+*path, *apiKey)
+		} else {
+			urls, err = fetchShotiCatalog(ctx, remote)
+		}
+		if err == nil {
+			var stats importStats
+			stats, err = importRemote(urls, source, *collection, *dryRun)
+			fmt.Printf("%s: listed %d, added %d, skipped %d already known or invalid.\n", source, stats.Listed, stats.Added, stats.Skipped)
+		}
+		if *every <= 0 {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error importing from %s: %v\n", source, err)
+		}
+		time.Sleep(*every)
+	}
+}
+
+func init() {
+	commands["import-remote"] = command{
+		Summary: "copy the catalog of another shoti instance into this one",
+		Run:     importRemoteCommand,
+	}
+}
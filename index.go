@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/selector"
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// catalogEntry is the per-URL data kept in memory for selection.
+type catalogEntry = selector.Entry
+
+type rowScanner = store.Scanner
+
+// urlIndex is an in-memory snapshot of the active URLs so random selection
+// needs no database round trip. The database stays the source of truth:
+// the snapshot is patched from the row events broadcast over LISTEN/NOTIFY
+// and fully reloaded periodically as a safety net.
+type urlIndex struct {
+	mu       sync.RWMutex
+	entries  []catalogEntry
+	pos      map[string]int
+	pinned   map[string]bool
+	served   uint64
+	loaded   bool
+	loadedAt time.Time
+}
+
+var index = &urlIndex{}
+
+func (ix *urlIndex) reload() error {
+	// Through the store, so a sharded catalog is loaded from every shard.
+	entries, err := catalog.Active()
+	if err != nil {
+		return fmt.Errorf("error loading URL index: %w", err)
+	}
+
+	pos := make(map[string]int, len(entries))
+	pinned := make(map[string]bool)
+	for i, e := range entries {
+		pos[e.ID] = i
+		if e.PinEvery > 0 {
+			pinned[e.ID] = true
+		}
+	}
+
+	ix.mu.Lock()
+	ix.entries = entries
+	ix.pos = pos
+	ix.pinned = pinned
+	ix.loaded = true
+	ix.loadedAt = time.Now()
+	ix.noteSize()
+	ix.mu.Unlock()
+
+	return nil
+}
+
+// apply updates the snapshot in place from a single row change, re-reading
+// the row so every catalogEntry field stays current.
+func (ix *urlIndex) apply(ev invalidation) {
+	if ev.Op == "TRUNCATE" {
+		if err := ix.reload(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	var (
+		e      catalogEntry
+		active bool
+	)
+	if ev.Op != "DELETE" {
+		var err error
+		e, err = activeEntryByID(ev.ID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error refreshing URL %s in index: %v\n", ev.ID, err)
+			return
+		}
+		active = err == nil
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if !ix.loaded {
+		return
+	}
+
+	i, exists := ix.pos[ev.ID]
+
+	switch {
+	case active && exists:
+		ix.entries[i] = e
+	case active:
+		ix.pos[e.ID] = len(ix.entries)
+		ix.entries = append(ix.entries, e)
+	case exists:
+		last := len(ix.entries) - 1
+		ix.entries[i] = ix.entries[last]
+		ix.pos[ix.entries[i].ID] = i
+		ix.entries = ix.entries[:last]
+		delete(ix.pos, ev.ID)
+	}
+
+	if active && e.PinEvery > 0 {
+		ix.pinned[ev.ID] = true
+	} else {
+		delete(ix.pinned, ev.ID)
+	}
+	ix.noteSize()
+}
+
+// noteSize updates the catalog_empty gauge and alerts when the catalog
+// becomes empty, which right after a deploy usually means the database is
+// the wrong one or was not seeded. It must be called with ix.mu held.
+func (ix *urlIndex) noteSize() {
+	var empty int64
+	if len(ix.entries) == 0 {
+		empty = 1
+	}
+	if empty == 1 && catalogEmpty.Value() == 0 {
+		sendAlert(Alert{Kind: "catalog_empty", Message: "The catalog has no active URLs; /api/get is answering 503."})
+	}
+	catalogEmpty.Set(empty)
+	noteCatalogMinimum(len(ix.entries))
+}
+
+// duePin counts a response and returns a pinned entry whose frequency
+// comes up on this count, so a video pinned every N is served on every
+// N-th response of this replica.
+func (ix *urlIndex) duePin(match func(catalogEntry) bool) (catalogEntry, bool) {
+	return ix.pinAt(atomic.AddUint64(&ix.served, 1), match)
+}
+
+// nextPin returns the pin duePin would return next, without counting a
+// serve.
+func (ix *urlIndex) nextPin(match func(catalogEntry) bool) (catalogEntry, bool) {
+	return ix.pinAt(atomic.LoadUint64(&ix.served)+1, match)
+}
+
+func (ix *urlIndex) pinAt(n uint64, match func(catalogEntry) bool) (catalogEntry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	for id := range ix.pinned {
+		e := ix.entries[ix.pos[id]]
+		if n%uint64(e.PinEvery) == 0 && (match == nil || match(e)) {
+			return e, true
+		}
+	}
+	return catalogEntry{}, false
+}
+
+// update patches the entry with the given id in place, if present.
+func (ix *urlIndex) update(id string, fn func(e *catalogEntry)) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if i, ok := ix.pos[id]; ok {
+		fn(&ix.entries[i])
+	}
+}
+
+// lookup returns the entry with the given id, if present.
+func (ix *urlIndex) lookup(id string) (catalogEntry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if i, ok := ix.pos[id]; ok {
+		return ix.entries[i], true
+	}
+	return catalogEntry{}, false
+}
+
+// find returns the first entry accepted by match. loaded is false until
+// the first successful reload.
+func (ix *urlIndex) find(match func(catalogEntry) bool) (e catalogEntry, found bool, loaded bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	for _, e := range ix.entries {
+		if match(e) {
+			return e, true, ix.loaded
+		}
+	}
+	return catalogEntry{}, false, ix.loaded
+}
+
+// remoteSelector is a Selector calling out of the process, like a plugin's,
+// which must not hold up the index while it waits.
+type remoteSelector interface {
+	Selector
+	remote()
+}
+
+// selectWith runs sel over the current entries without copying them, or a
+// remoteSelector over a copy of those matching, outside the lock. loaded
+// is false until the first successful reload, in which case callers should
+// fall back to the DB.
+func (ix *urlIndex) selectWith(sel Selector, match func(catalogEntry) bool) (e catalogEntry, ok bool, loaded bool) {
+	if _, remote := sel.(remoteSelector); remote {
+		candidates, loaded := ix.matching(match)
+		if !loaded {
+			return e, false, false
+		}
+		e, ok = sel.Select(candidates, nil)
+		return e, ok, true
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if !ix.loaded {
+		return e, false, false
+	}
+	e, ok = sel.Select(ix.entries, match)
+	return e, ok, true
+}
+
+// matching returns a copy of the entries match accepts, all of them when
+// match is nil.
+func (ix *urlIndex) matching(match func(catalogEntry) bool) ([]catalogEntry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if !ix.loaded {
+		return nil, false
+	}
+	var entries []catalogEntry
+	for _, e := range ix.entries {
+		if match == nil || match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, true
+}
+
+// sample returns up to n distinct random entries.
+func (ix *urlIndex) sample(n int) ([]catalogEntry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if !ix.loaded {
+		return nil, false
+	}
+
+	if n >= len(ix.entries) {
+		picked := make([]catalogEntry, 0, len(ix.entries))
+		for _, i := range rand.Perm(len(ix.entries)) {
+			picked = append(picked, ix.entries[i])
+		}
+		return picked, true
+	}
+
+	seen := make(map[int]bool, n)
+	picked := make([]catalogEntry, 0, n)
+	for len(picked) < n {
+		i := rand.Intn(len(ix.entries))
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		picked = append(picked, ix.entries[i])
+	}
+	return picked, true
+}
+
+// snapshot returns a copy of the current entries.
+func (ix *urlIndex) snapshot() ([]catalogEntry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if !ix.loaded {
+		return nil, false
+	}
+	return append([]catalogEntry(nil), ix.entries...), true
+}
+
+func (ix *urlIndex) size() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.entries)
+}
+
+func startURLIndex() {
+	if err := index.reload(); err != nil {
+		log.Printf("URL index unavailable, selecting from the database: %v\n", err)
+	} else {
+		log.Printf("URL index loaded with %d URLs.\n", index.size())
+	}
+
+	onInvalidate(index.apply)
+	onListenerReconnect(func() {
+		if err := index.reload(); err != nil {
+			log.Println(err)
+		}
+	})
+
+	refreshEvery := envDuration("INDEX_REFRESH_INTERVAL", 5*time.Minute)
+
+	go func() {
+		for range time.Tick(refreshEvery) {
+			if err := index.reload(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// invalidation is the payload the urls_changed trigger broadcasts for every
+// row change, so each replica can update its index and caches within
+// milliseconds of a write on any other replica.
+type invalidation struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Status string `json:"status"`
+}
+
+var (
+	invalidationHooks []func(invalidation)
+	reconnectHooks    []func()
+)
+
+// onInvalidate registers fn to run for every URL change event.
+func onInvalidate(fn func(invalidation)) {
+	invalidationHooks = append(invalidationHooks, fn)
+}
+
+// onListenerReconnect registers fn to run after the listener reconnects,
+// when events may have been missed and caches should be rebuilt.
+func onListenerReconnect(fn func()) {
+	reconnectHooks = append(reconnectHooks, fn)
+}
+
+// startInvalidationListener listens for URL changes on the DB_* database
+// and, when the catalog is sharded, on every other shard, so changes reach
+// the index wherever they are written.
+func startInvalidationListener() {
+	listenForChanges("", dbConnString())
+	shards, _ := catalogShards()
+	for name, dsn := range shards {
+		if dsn != "" {
+			listenForChanges(name, dsn)
+		}
+	}
+}
+
+// listenForChanges runs the invalidation hooks for the changes notified on
+// dsn, the database of shard (or "" for the DB_* one).
+func listenForChanges(shard, dsn string) {
+	source := "the database"
+	if shard != "" {
+		source = "shard " + shard
+	}
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Invalidation listener of %s: %v\n", source, err)
+		}
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			sendAlert(Alert{Kind: "db_disconnected", Level: "error", Message: fmt.Sprintf("Lost the connection of the change listener to %s: %v", source, err)})
+		case pq.ListenerEventReconnected:
+			sendAlert(Alert{Kind: "db_reconnected", Level: "info", Message: fmt.Sprintf("The change listener reconnected to %s.", source)})
+		}
+	})
+	if err := listener.Listen("urls_changed"); err != nil {
+		log.Printf("Error listening for URL changes on %s: %v\n", source, err)
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			if n == nil {
+				for _, hook := range reconnectHooks {
+					hook()
+				}
+				continue
+			}
+
+			var ev invalidation
+			if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+				log.Printf("Error decoding invalidation %q: %v\n", n.Extra, err)
+				continue
+			}
+
+			for _, hook := range invalidationHooks {
+				hook(ev)
+			}
+
+			// Hooks re-read the row, which can hit a replica that has not
+			// replayed the write yet; applying the event again once the
+			// replication lag has passed keeps stale reads from sticking.
+			if delay := envDuration("INVALIDATION_REAPPLY_AFTER", 0); delay > 0 {
+				time.AfterFunc(delay, func() {
+					for _, hook := range invalidationHooks {
+						hook(ev)
+					}
+				})
+			}
+		}
+	}()
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Issued keys: besides the free-form keys callers pick themselves, the
+// admin API can issue keys restricted to some scopes and valid for a
+// limited time, e.g. a key that may only call /api/get for 24h for a demo.
+// A request with an issued key outside its scopes gets 403, one with an
+// expired or revoked key 401. Expired keys are kept for API_KEY_RETENTION
+// so they keep being refused, then deleted together with their tier
+// assignment.
+//
+// Rotating a key issues a new secret while the old one keeps working for a
+// grace period (API_KEY_ROTATION_GRACE unless the request says otherwise),
+// so a bot can be redeployed with the new secret without downtime. The
+// tier and favorites move to the new secret. Only the latest previous
+// secret is kept: rotating again during the grace period ends it.
+
+// keyScopes maps each scope to the public paths it allows, without the
+// /api/v2 prefix. Probes and the OpenAPI document need no scope.
+var keyScopes = map[string][]string{
+	"get":       {"/api/get", "/api/v1/get"},
+	"daily":     {"/api/daily"},
+	"media":     {"/api/media/", "/api/thumb/", "/api/qr/", "/watch/"},
+	"list":      {"/api/list", "/api/videos", "/api/videos/", "/api/related/", "/api/hashtags", "/api/music/top"},
+	"playlist":  {"/api/playlist", "/api/playlist/", "/api/collage"},
+	"favorites": {"/api/favorites/"},
+	"submit":    {"/api/new", "/api/submissions/"},
+	"report":    {"/api/report", "/api/takedowns"},
+}
+
+type issuedKey struct {
+	ID     string   `json:"id"`
+	KeyID  string   `json:"key_id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Collection is the collection route (see collectionroutes.go) the key
+	// belongs to; keys without one only work on the main API.
+	Collection string `json:"collection,omitempty"`
+	// NotifyURL and NotifyEmail receive the quota notices of the key (see
+	// quotanotify.go).
+	NotifyURL   string     `json:"notify_url,omitempty"`
+	NotifyEmail string     `json:"notify_email,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// PreviousExpiresAt is when the secret replaced by the last rotation
+	// stops working.
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+	// Key is only returned when the key is issued or rotated.
+	Key string `json:"key,omitempty"`
+	// Signing keys may sign requests instead of sending the key (see
+	// signing.go).
+	Signing bool `json:"signing"`
+
+	hash           string
+	previousHash   string
+	secret         string
+	previousSecret string
+}
+
+var issuedKeys = struct {
+	mu     sync.RWMutex
+	byHash map[string]issuedKey
+	// byID holds the signing keys.
+	byID map[string]issuedKey
+}{byHash: make(map[string]issuedKey), byID: make(map[string]issuedKey)}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating key: %w", err)
+	}
+	return "shoti_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// allows reports whether the scopes of k cover path.
+func (k issuedKey) allows(path string) bool {
+	if len(k.Scopes) == 0 || rateLimitExempt[path] {
+		return true
+	}
+	if rest, ok := strings.CutPrefix(path, "/api/v2/"); ok {
+		path = "/api/" + rest
+	}
+	for _, scope := range k.Scopes {
+		for _, p := range keyScopes[scope] {
+			if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeKeys refuses requests made with an expired issued key, one
+// whose scopes do not cover the path or one issued for another collection
+// route. Keys that were not issued belong to the main API, so they are
+// refused on collection routes. A signed request is checked as if it had
+// sent its key.
+func authorizeKeys(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "" {
+			key, err := verifySignature(r)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			r.Header.Set("X-API-Key", key)
+		}
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			issuedKeys.mu.RLock()
+			k, ok := issuedKeys.byHash[keyHash(key)]
+			issuedKeys.mu.RUnlock()
+			switch {
+			case !ok && routeCollection(r) != "":
+				writeError(w, http.StatusForbidden, "API key is not valid for this collection")
+				return
+			case !ok:
+			case k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt):
+				writeError(w, http.StatusUnauthorized, "API key has expired or was revoked")
+				return
+			case !k.allows(r.URL.Path):
+				writeError(w, http.StatusForbidden, "API key is not allowed to use this endpoint")
+				return
+			case k.Collection != routeCollection(r):
+				writeError(w, http.StatusForbidden, "API key is not valid for this collection")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+const issuedKeyColumns = "id, key_hash, name, scopes, expires_at, created_at, COALESCE(previous_key_hash, ''), previous_expires_at, " +
+	"COALESCE(signing_secret, ''), COALESCE(previous_signing_secret, ''), collection, notify_url, notify_email"
+
+func scanIssuedKey(row rowScanner) (issuedKey, error) {
+	var k issuedKey
+	err := row.Scan(&k.ID, &k.hash, &k.Name, pq.Array(&k.Scopes), &k.ExpiresAt, &k.CreatedAt, &k.previousHash, &k.PreviousExpiresAt,
+		&k.secret, &k.previousSecret, &k.Collection, &k.NotifyURL, &k.NotifyEmail)
+	k.KeyID = k.hash[:min(8, len(k.hash))]
+	k.Signing = k.secret != ""
+	return k, err
+}
+
+// previous returns k as seen through its previous secret, which expires
+// at the end of the grace period or with the key, whichever comes first.
+func (k issuedKey) previous() issuedKey {
+	if k.ExpiresAt == nil || (k.PreviousExpiresAt != nil && k.PreviousExpiresAt.Before(*k.ExpiresAt)) {
+		k.ExpiresAt = k.PreviousExpiresAt
+	}
+	return k
+}
+
+func reloadIssuedKeys() error {
+	rows, err := db.Query("SELECT " + issuedKeyColumns + " FROM api_keys")
+	if err != nil {
+		return fmt.Errorf("error loading API keys: %w", err)
+	}
+	defer rows.Close()
+
+	byHash := make(map[string]issuedKey)
+	byID := make(map[string]issuedKey)
+	for rows.Next() {
+		k, err := scanIssuedKey(rows)
+		if err != nil {
+			return fmt.Errorf("error scanning API keys: %w", err)
+		}
+		byHash[k.hash] = k
+		if k.Signing {
+			byID[k.ID] = k
+		}
+		if k.previousHash != "" {
+			byHash[k.previousHash] = k.previous()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error loading API keys: %w", err)
+	}
+
+	issuedKeys.mu.Lock()
+	issuedKeys.byHash = byHash
+	issuedKeys.byID = byID
+	issuedKeys.mu.Unlock()
+	return nil
+}
+
+// deleteExpiredKeys deletes keys, and previous secrets of rotated keys,
+// that expired more than API_KEY_RETENTION ago.
+func deleteExpiredKeys() error {
+	cutoff := time.Now().Add(-envDuration("API_KEY_RETENTION", 30*24*time.Hour))
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error deleting expired API keys: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+	WITH deleted AS (
+		DELETE FROM api_keys WHERE expires_at < $1 RETURNING key_hash, previous_key_hash
+	), ended AS (
+		UPDATE api_keys SET previous_key_hash = NULL, previous_expires_at = NULL, previous_signing_secret = NULL
+		FROM (
+			SELECT id, previous_key_hash AS hash FROM api_keys
+			WHERE previous_expires_at < $1 AND (expires_at IS NULL OR expires_at >= $1)
+			FOR UPDATE
+		) old
+		WHERE api_keys.id = old.id
+		RETURNING old.hash
+	)
+	SELECT key_hash FROM deleted
+	UNION ALL SELECT previous_key_hash FROM deleted WHERE previous_key_hash IS NOT NULL
+	UNION ALL SELECT hash FROM ended
+	`, cutoff)
+	if err != nil {
+		return fmt.Errorf("error deleting expired API keys: %w", err)
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("error deleting expired API keys: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if len(hashes) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM api_key_tiers WHERE key_hash = ANY($1)", pq.Array(hashes)); err != nil {
+		return fmt.Errorf("error deleting tiers of expired API keys: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error deleting expired API keys: %w", err)
+	}
+	log.Printf("Deleted %d expired API key secrets.\n", len(hashes))
+	return nil
+}
+
+// issueKey handles POST /api/admin/keys with
+// {"name": "demo", "scopes": ["get"], "ttl": "24h", "tier": "partner"}.
+// Every field is optional: no scopes allow every endpoint, no ttl never
+// expires and no tier is free. "signing": true issues a key that may sign
+// requests, "collection": "cats" one for the routes of the cats collection
+// only; "notify_url" and "notify_email" receive its quota notices. The key
+// is only shown in this response.
+func issueKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name        string   `json:"name"`
+		Scopes      []string `json:"scopes"`
+		TTL         string   `json:"ttl"`
+		Tier        string   `json:"tier"`
+		Signing     bool     `json:"signing"`
+		Collection  string   `json:"collection"`
+		NotifyURL   string   `json:"notify_url"`
+		NotifyEmail string   `json:"notify_email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	for _, scope := range body.Scopes {
+		if _, ok := keyScopes[scope]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown scope %q", scope))
+			return
+		}
+	}
+	if body.Tier != "" {
+		if _, ok := tierLimits(body.Tier); !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown tier %q", body.Tier))
+			return
+		}
+	}
+
+	if err := validateKeyNotifications(body.NotifyURL, body.NotifyEmail); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	scopes := append([]string{}, body.Scopes...)
+	slices.Sort(scopes)
+	k := issuedKey{ID: uuid.New().String(), Name: body.Name, Scopes: slices.Compact(scopes), Collection: body.Collection,
+		NotifyURL: body.NotifyURL, NotifyEmail: body.NotifyEmail}
+	if body.TTL != "" {
+		ttl, err := time.ParseDuration(body.TTL)
+		if err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, "ttl must be a positive duration such as 24h")
+			return
+		}
+		expires := time.Now().Add(ttl).UTC()
+		k.ExpiresAt = &expires
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	hash := keyHash(key)
+	k.Key = key
+	k.KeyID = hash[:8]
+	k.Signing = body.Signing
+	var secret sql.NullString
+	if body.Signing {
+		secret = sql.NullString{String: key, Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`
+	INSERT INTO api_keys (id, key_hash, name, scopes, expires_at, signing_secret, collection, notify_url, notify_email)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING created_at
+	`, k.ID, hash, k.Name, pq.Array(k.Scopes), k.ExpiresAt, secret, k.Collection, k.NotifyURL, k.NotifyEmail).Scan(&k.CreatedAt)
+	if err == nil && body.Tier != "" {
+		_, err = tx.Exec("INSERT INTO api_key_tiers (key_hash, tier) VALUES ($1, $2)", hash, body.Tier)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error issuing API key: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	stored := k
+	stored.Key = ""
+	stored.hash = hash
+	stored.secret = secret.String
+	issuedKeys.mu.Lock()
+	issuedKeys.byHash[hash] = stored
+	if stored.Signing {
+		issuedKeys.byID[stored.ID] = stored
+	}
+	issuedKeys.mu.Unlock()
+	if body.Tier != "" {
+		keyTiers.mu.Lock()
+		keyTiers.assigned[hash] = body.Tier
+		keyTiers.mu.Unlock()
+	}
+	writeJSON(w, http.StatusCreated, k)
+}
+
+// listIssuedKeys returns the issued keys, without their secrets.
+func listIssuedKeys() ([]issuedKey, error) {
+	rows, err := db.Query("SELECT " + issuedKeyColumns + " FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []issuedKey{}
+	for rows.Next() {
+		k, err := scanIssuedKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// revokeKey handles DELETE /api/admin/keys/{id}. The key expires at once,
+// so it is refused until the cleanup deletes it.
+func revokeKey(w http.ResponseWriter, id string) {
+	var (
+		hash    string
+		expires time.Time
+	)
+	var previous sql.NullString
+	err := db.QueryRow(`
+	UPDATE api_keys SET expires_at = now(),
+		previous_expires_at = CASE WHEN previous_key_hash IS NOT NULL THEN LEAST(previous_expires_at, now()) END
+	WHERE id = $1 RETURNING key_hash, expires_at, previous_key_hash
+	`, id).Scan(&hash, &expires, &previous)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking API key %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if _, err := db.Exec("DELETE FROM api_key_tiers WHERE key_hash = $1 OR key_hash = $2", hash, previous.String); err != nil {
+		log.Printf("Error deleting tier of revoked key %s: %v\n", id, err)
+	}
+
+	issuedKeys.mu.Lock()
+	for _, h := range []string{hash, previous.String} {
+		if k, ok := issuedKeys.byHash[h]; ok {
+			k.ExpiresAt = &expires
+			issuedKeys.byHash[h] = k
+		}
+	}
+	issuedKeys.mu.Unlock()
+	keyTiers.mu.Lock()
+	delete(keyTiers.assigned, hash)
+	delete(keyTiers.assigned, previous.String)
+	keyTiers.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateKey handles POST /api/admin/keys/{id}/rotate, optionally with
+// {"grace": "48h"}, and returns the key with its new secret.
+func rotateKey(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Grace string `json:"grace"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+	}
+	grace := envDuration("API_KEY_ROTATION_GRACE", 24*time.Hour)
+	if body.Grace != "" {
+		parsed, err := time.ParseDuration(body.Grace)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "grace must be a duration such as 24h")
+			return
+		}
+		grace = parsed
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	k, status, err := rotateKeySecret(id, key, time.Now().Add(grace))
+	if status == http.StatusInternalServerError {
+		log.Printf("Error rotating API key %s: %v\n", id, err)
+		writeError(w, status, "failed")
+		return
+	}
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	if err := reloadIssuedKeys(); err != nil {
+		log.Println(err)
+	}
+	if err := reloadKeyTiers(); err != nil {
+		log.Println(err)
+	}
+	k.Key = key
+	writeJSON(w, http.StatusOK, k)
+}
+
+// rotateKeySecret replaces the secret of key id with key, keeping the old
+// one valid until graceEnd, and moves its tier and favorites along.
+func rotateKeySecret(id, key string, graceEnd time.Time) (issuedKey, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return issuedKey{}, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanIssuedKey(tx.QueryRow("SELECT "+issuedKeyColumns+" FROM api_keys WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return issuedKey{}, http.StatusNotFound, errors.New("API key not found")
+	}
+	if err != nil {
+		return issuedKey{}, http.StatusInternalServerError, err
+	}
+	if current.ExpiresAt != nil && time.Now().After(*current.ExpiresAt) {
+		return issuedKey{}, http.StatusConflict, errors.New("API key has expired or was revoked")
+	}
+
+	hash := keyHash(key)
+	steps := []struct {
+		query string
+		args  []interface{}
+	}{
+		// An earlier previous secret still in its grace period ends now.
+		{"DELETE FROM api_key_tiers WHERE key_hash = $1", []interface{}{current.previousHash}},
+		{"INSERT INTO api_key_tiers (key_hash, tier) SELECT $1, tier FROM api_key_tiers WHERE key_hash = $2", []interface{}{hash, current.hash}},
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step.query, step.args...); err != nil {
+			return issuedKey{}, http.StatusInternalServerError, err
+		}
+	}
+
+	// Favorites live in the shard of their video; those of other databases
+	// move in transactions committed right after the key's.
+	var shardTxs []*sql.Tx
+	for _, conn := range catalog.DBs() {
+		stx := tx
+		if conn != db {
+			if stx, err = conn.Begin(); err != nil {
+				return issuedKey{}, http.StatusInternalServerError, err
+			}
+			defer stx.Rollback()
+			shardTxs = append(shardTxs, stx)
+		}
+		_, err := stx.Exec("UPDATE favorites SET api_key = $1 WHERE api_key = $2", hash, current.hash)
+		if err != nil {
+			return issuedKey{}, http.StatusInternalServerError, err
+		}
+	}
+
+	k, err := scanIssuedKey(tx.QueryRow(`
+	UPDATE api_keys SET previous_key_hash = key_hash, previous_expires_at = $2, key_hash = $3,
+		previous_signing_secret = signing_secret,
+		signing_secret = CASE WHEN signing_secret IS NOT NULL THEN $4 END
+	WHERE id = $1 RETURNING `+issuedKeyColumns, id, graceEnd, hash, key))
+	if err != nil {
+		return issuedKey{}, http.StatusInternalServerError, err
+	}
+	if err := tx.Commit(); err != nil {
+		return issuedKey{}, http.StatusInternalServerError, err
+	}
+	for _, stx := range shardTxs {
+		if err := stx.Commit(); err != nil {
+			log.Printf("Error moving favorites of API key %s to its new secret: %v\n", id, err)
+		}
+	}
+	return k, http.StatusOK, nil
+}
+
+func init() {
+	schedule("api-keys", "API_KEYS_REFRESH_INTERVAL", time.Minute, reloadIssuedKeys)
+	schedule("expire-api-keys", "", time.Hour, deleteExpiredKeys).LeaderOnly = true
+}
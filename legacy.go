@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Legacy API: /api/v1/get answers in the shape of the Node.js shoti API
+// that most bots were written against, so they can move to this server by
+// changing only the base URL. Like that API it takes GET or POST, with the
+// API key in a JSON body as {"apikey": "..."} or in X-API-Key, and puts the
+// video in data (and, for the clients that read it there, result). It
+// supports the same query parameters as /api/get.
+
+type legacyAPIKey struct{}
+
+// legacyAPI reports whether r came in on the legacy route.
+func legacyAPI(r *http.Request) bool {
+	legacy, _ := r.Context().Value(legacyAPIKey{}).(bool)
+	return legacy
+}
+
+type legacyVideoResponse struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    legacyVideo `json:"data"`
+	Result  legacyVideo `json:"result"`
+}
+
+type legacyVideo struct {
+	Region   string `json:"region"`
+	URL      string `json:"url"`
+	Cover    string `json:"cover"`
+	Title    string `json:"title"`
+	Duration string `json:"duration"`
+	User     struct {
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+		UserID   string `json:"userID"`
+	} `json:"user"`
+}
+
+func newLegacyVideoResponse(v1 VideoDataResponse) legacyVideoResponse {
+	v := legacyVideo{
+		Region:   v1.Data.Region,
+		URL:      v1.Data.URL,
+		Cover:    v1.Data.Cover,
+		Title:    v1.Data.Title,
+		Duration: v1.Data.Duration,
+	}
+	v.User.Username = v1.Data.User.Username
+	v.User.Nickname = v1.Data.User.Nickname
+	v.User.UserID = v1.Data.User.UserID
+	return legacyVideoResponse{Code: http.StatusOK, Message: "success", Data: v, Result: v}
+}
+
+func legacyGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	getRandomVideo(w, r.WithContext(context.WithValue(r.Context(), legacyAPIKey{}, true)))
+}
+
+// legacyKeys moves the apikey of legacy POST bodies to X-API-Key before
+// the key is checked, leaving the body for the handler to read.
+func legacyKeys(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/v1/get" && r.Header.Get("X-API-Key") == "" {
+			raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err == nil {
+				var body struct {
+					APIKey string `json:"apikey"`
+				}
+				if json.Unmarshal(raw, &body) == nil && body.APIKey != "" {
+					r.Header.Set("X-API-Key", body.APIKey)
+				}
+				r.Body = io.NopCloser(bytes.NewReader(raw))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Lifecycle for orchestrated deployments such as Kubernetes:
+//
+//   - /livez answers as long as the process serves HTTP, /startupz once
+//     startup has finished, and /readyz while the replica can take traffic
+//     (not draining and the database answers).
+//   - On SIGTERM or SIGINT /readyz starts failing, and after DRAIN_DELAY
+//     (5s, long enough for load balancers to notice) the server stops
+//     accepting requests, waits up to SHUTDOWN_TIMEOUT for in-flight
+//     requests and background work, flushes pending CDN purges and
+//     releases the leader lock so another replica takes over the shared
+//     jobs right away.
+
+var (
+	started  atomic.Bool
+	draining atomic.Bool
+
+	backgroundTasks sync.WaitGroup
+)
+
+// background runs fn in a goroutine that shutdown waits for.
+func background(fn func()) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		fn()
+	}()
+}
+
+func livez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, statusResponse{Code: 200, Msg: "alive"})
+}
+
+func startupz(w http.ResponseWriter, r *http.Request) {
+	if !started.Load() {
+		writeError(w, http.StatusServiceUnavailable, "starting")
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Code: 200, Msg: "started"})
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, "draining")
+		return
+	}
+	if degraded.Load() {
+		// Serving from the snapshot is the point of degraded mode.
+		writeJSON(w, http.StatusOK, statusResponse{Code: 200, Msg: "degraded"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "database unavailable")
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Code: 200, Msg: "ready"})
+}
+
+// serve runs the public server until SIGTERM or SIGINT, then drains it.
+func serve(addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	started.Store(true)
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	drainDelay := envDuration("DRAIN_DELAY", 5*time.Second)
+	log.Printf("Shutting down, draining for %s...\n", drainDelay)
+	draining.Store(true)
+	time.Sleep(drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v\n", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		log.Println("Gave up waiting for background work.")
+	}
+
+	if err := flushCDNPurges(); err != nil {
+		log.Println(err)
+	}
+	if err := flushServeEvents(); err != nil {
+		log.Println(err)
+	}
+	closeEventBus()
+	releaseLeadership()
+	log.Println("Shutdown complete.")
+}
+
+// leaderLockID is the Postgres advisory lock held by the leader replica.
+const leaderLockID = 0x73686f7469
+
+var leader struct {
+	mu      sync.Mutex
+	conn    *sql.Conn
+	stopped bool
+}
+
+func isLeader() bool {
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+	return leader.conn != nil
+}
+
+// startLeaderElection tries to take the leader lock every
+// LEADER_RETRY_INTERVAL on a dedicated connection. The lock is held for as
+// long as that connection lives, so a crashed leader is replaced as soon as
+// Postgres notices the connection dropped.
+func startLeaderElection() {
+	retry := envDuration("LEADER_RETRY_INTERVAL", 10*time.Second)
+
+	campaign := func() {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		if leader.stopped {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if leader.conn != nil {
+			if err := leader.conn.PingContext(ctx); err != nil {
+				log.Printf("Lost leadership: %v\n", err)
+				leader.conn.Close()
+				leader.conn = nil
+			}
+			return
+		}
+
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return
+		}
+		var acquired bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockID).Scan(&acquired)
+		if err != nil || !acquired {
+			conn.Close()
+			return
+		}
+		leader.conn = conn
+		log.Println("This replica is now the leader for shared jobs.")
+	}
+
+	campaign()
+	go func() {
+		for range time.Tick(retry) {
+			campaign()
+		}
+	}()
+}
+
+func releaseLeadership() {
+	leader.mu.Lock()
+	defer leader.mu.Unlock()
+
+	leader.stopped = true
+	if leader.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := leader.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", leaderLockID); err != nil {
+		log.Printf("Error releasing leader lock: %v\n", err)
+	}
+	leader.conn.Close()
+	leader.conn = nil
+	log.Println("Released leadership.")
+}
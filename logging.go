@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// requestLogger writes one JSON object per line, without the timestamp
+// prefix of the standard logger.
+var requestLogger = log.New(os.Stdout, "", 0)
+
+type requestLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	LatencyMS  float64 `json:"latency_ms"`
+	UpstreamMS float64 `json:"upstream_ms,omitempty"`
+	KeyID      string  `json:"key_id,omitempty"`
+	Region     string  `json:"region,omitempty"`
+	Collection string  `json:"collection,omitempty"`
+}
+
+type requestTiming struct {
+	upstream time.Duration
+}
+
+type requestTimingKey struct{}
+
+// addUpstreamTime adds d to the time r spent waiting for video metadata,
+// reported as upstream_ms in the request log.
+func addUpstreamTime(r *http.Request, d time.Duration) {
+	if t, ok := r.Context().Value(requestTimingKey{}).(*requestTiming); ok {
+		t.upstream += d
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// keyID identifies the API key of r in logs without exposing it.
+func keyID(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// logRequests logs every request handled by h. Successful requests are
+// sampled at LOG_SAMPLE_RATE; errors (status >= 400) are always logged.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		timing := &requestTiming{}
+		sr := &statusRecorder{ResponseWriter: w}
+
+		h.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), requestTimingKey{}, timing)))
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		if sr.status < 400 && rand.Float64() >= envFloat("LOG_SAMPLE_RATE", 1) {
+			return
+		}
+
+		entry := requestLogEntry{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     sr.status,
+			LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+			UpstreamMS: float64(timing.upstream.Microseconds()) / 1000,
+			KeyID:      keyID(r),
+			Region:     currentRegion(),
+			Collection: routeCollection(r),
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Error encoding request log: %v\n", err)
+			return
+		}
+		requestLogger.Println(string(line))
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Email: with SMTP_ADDR (host:port) set, mail is sent through that server
+// from SMTP_FROM, authenticating with SMTP_USERNAME and SMTP_PASSWORD when
+// set. The connection is upgraded with STARTTLS when the server offers it;
+// credentials are only sent over TLS or to localhost.
+
+func mailEnabled() bool {
+	return os.Getenv("SMTP_ADDR") != "" && os.Getenv("SMTP_FROM") != ""
+}
+
+// sendMail sends a plain text message to the recipients.
+func sendMail(to []string, subject, body string) error {
+	addr := os.Getenv("SMTP_ADDR")
+	from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_ADDR: %w", err)
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		auth = smtp.PlainAuth("", user, secret("SMTP_PASSWORD"), host)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("error generating message id: %w", err)
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	if err := smtp.SendMail(addr, auth, from.Address, to, msg.Bytes()); err != nil {
+		return fmt.Errorf("error sending mail through %s: %w", addr, err)
+	}
+	return nil
+}
@@ -3,55 +3,18 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
+	"github.com/libyzxy0/shoti-srv/store"
 )
 
-type VideoInfo struct {
-	Code    int    `json:"code"`
-	Msg     string `json:"msg"`
-	Data    struct {
-		ID               string `json:"id"`
-		Region           string `json:"region"`
-		Title            string `json:"title"`
-		Cover            string `json:"cover"`
-		AI_Dynamic_Cover string `json:"ai_dynamic_cover"`
-		Origin_Cover     string `json:"origin_cover"`
-		Duration         int    `json:"duration"`
-		Play             string `json:"play"`
-		WMPlay           string `json:"wmplay"`
-		Size             int    `json:"size"`
-		WMSize           int    `json:"wm_size"`
-		Music            struct {
-			ID    string `json:"id"`
-			Title string `json:"title"`
-			Play  string `json:"play"`
-			Cover string `json:"cover"`
-		} `json:"music_info"`
-		PlayCount    int `json:"play_count"`
-		DiggCount    int `json:"digg_count"`
-		CommentCount int `json:"comment_count"`
-		ShareCount   int `json:"share_count"`
-		DownloadCount int `json:"download_count"`
-		CollectCount int `json:"collect_count"`
-		CreateTime   int64 `json:"create_time"`
-		Author struct {
-			ID       string `json:"id"`
-			UniqueID string `json:"unique_id"`
-			Nickname string `json:"nickname"`
-			Avatar   string `json:"avatar"`
-		} `json:"author"`
-	} `json:"data"`
-}
-
 type VideoDataResponse struct {
 	Code    int    `json:"code"`
 	Msg     string `json:"msg"`
@@ -61,6 +24,9 @@ type VideoDataResponse struct {
 		Cover           string `json:"cover"`
 		Title           string `json:"title"`
 		Duration        string `json:"duration"`
+		VideoID         string `json:"video_id"`
+		ServeID         string `json:"serve_id,omitempty"`
+		Subtitles       []VideoSubtitle `json:"subtitles,omitempty"`
 		User            struct {
 			Username string `json:"username"`
 			Nickname string `json:"nickname"`
@@ -72,253 +38,581 @@ type VideoDataResponse struct {
 type URL struct {
 	ID  string `json:"id"`
 	URL string `json:"url"`
+	// Collection is set for URLs added through a collection route.
+	Collection string `json:"collection,omitempty"`
+}
+
+// urlResponse and urlListResponse are the v2 bodies of /api/new and
+// /api/list, which v1 returns without the envelope.
+type urlResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data URL    `json:"data"`
+}
+
+type urlListResponse struct {
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+	Data       []URL  `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 var db *sql.DB
 
 func initDB() {
-	if _, exists := os.LookupEnv("RAILWAY_ENVIRONMENT"); !exists {
-		err := godotenv.Load()
-		if err != nil {
-			log.Fatal("Error loading .env file:", err)
-		}
+	if err := loadDotenv(); err != nil {
+		log.Fatal("Error loading .env file:", err)
 	}
 
-	connStr := fmt.Sprintf(
-		"user=%s password=%s host=%s dbname=%s sslmode=%s",
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_NAME"),
-		os.Getenv("DB_SSLMODE"),
-	)
-
-	var err error
-	db, err = sql.Open("postgres", connStr)
+	err := loadVaultSecrets()
 	if err != nil {
+		log.Fatal("Error loading secrets:", err)
+	}
+
+	if err := validateConfig(); err != nil {
 		log.Fatal(err)
 	}
 
+	db = sql.OpenDB(rotatingConnector{})
+	onSecretsReload = append(onSecretsReload, resetDBConnections)
+	watchSecretReload()
+
 	err = db.Ping()
 	if err != nil {
+		if startDegraded(err) {
+			return
+		}
 		log.Fatal("Unable to connect to the database:", err)
 	}
 
 	fmt.Println("Connected to the database.")
 
-	/* setupSchema() */
-}
-/*
-func setupSchema() {
-	query := `
-	CREATE TABLE IF NOT EXISTS urls (
-		id UUID PRIMARY KEY,
-		url TEXT NOT NULL
-	);
-	`
-
-	_, err := db.Exec(query)
+	err = store.Migrate(db)
 	if err != nil {
 		log.Fatal("Error setting up database schema:", err)
 	}
-	fmt.Println("Database schema set up successfully.")
-}
-*/
 
-func getRandomURL() (string, error) {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&count)
+	err = prepareStatements()
 	if err != nil {
-		return "", fmt.Errorf("error getting URL count: %w", err)
+		log.Fatal("Error preparing statements:", err)
 	}
+}
 
-	if count == 0 {
-		return "", fmt.Errorf("no URLs found in the database")
+func resolveVideo(url string) (*Video, error) {
+	if resolve := externalResolver(); resolve != nil {
+		video, err := resolve(url)
+		if err == nil || os.Getenv("RESOLVER_FALLBACK") != "tikwm" {
+			return video, err
+		}
+		log.Printf("External resolver failed for %s, falling back to tikwm: %v\n", url, err)
 	}
 
-	rand.Seed(time.Now().UnixNano())
-	randomIndex := rand.Intn(count) + 1
+	// A rate-limited request waits its turn in the upstream queue and
+	// tries once more.
+	for attempt := 0; ; attempt++ {
+		if err := waitForUpstreamQuota(); err != nil {
+			return nil, err
+		}
+		video, err := resolveViaTikwm(url)
+		if pe, ok := err.(*providerError); ok && pe.Kind == providerRateLimited {
+			noteUpstreamRateLimited()
+			if attempt == 0 {
+				continue
+			}
+		}
+		return video, err
+	}
+}
 
-	var url string
-	query := fmt.Sprintf("SELECT url FROM urls LIMIT 1 OFFSET %d", randomIndex-1)
-	err = db.QueryRow(query).Scan(&url)
-	if err != nil {
-		return "", fmt.Errorf("error retrieving random URL: %w", err)
+func resolveViaTikwm(url string) (*Video, error) {
+	key := acquireUpstreamKey()
+
+	video, err := tikwmResolver(key).Resolve(url)
+	if pe, ok := err.(*providerError); ok {
+		key.recordFailure(pe.Kind == providerRateLimited)
+	} else if err != nil {
+		key.recordFailure(false)
 	}
+	return video, err
+}
 
-	return url, nil
+func newVideoDataResponse(video *Video) VideoDataResponse {
+	var responseData VideoDataResponse
+	responseData.Code = 200
+	responseData.Msg = "success"
+	responseData.Data.Region = video.Region
+	responseData.Data.URL = video.PlayURL
+	responseData.Data.Cover = video.Cover
+	responseData.Data.Title = video.Title
+	responseData.Data.Duration = fmt.Sprintf("%ds", video.Duration)
+	responseData.Data.VideoID = video.ID
+	responseData.Data.User.Username = video.Author.Username
+	responseData.Data.User.Nickname = video.Author.Nickname
+	responseData.Data.User.UserID = video.Author.ID
+	// Copied so rewriting the URLs leaves the cached video alone.
+	responseData.Data.Subtitles = append([]VideoSubtitle(nil), video.Subtitles...)
+	return responseData
 }
 
-func getVideoInfo(url string) (*VideoInfo, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://tikwm.com/api?url=%s", url), nil)
+type statusResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	// Error is a stable machine-readable code for failures clients may
+	// want to handle specifically; Hint suggests what to do about them.
+	Error string `json:"error,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(localizeEnvelope(w, v))
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, statusResponse{Code: status, Msg: msg})
+}
+
+// httpError is returned by request parsing helpers to tell the handler
+// which status and message to respond with.
+type httpError struct {
+	Status int
+	Msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.Msg
+}
+
+// writeCatalogEmpty answers a request that found no active URLs at all.
+// That is an operator-side condition (a fresh deploy, a failed import)
+// rather than a server fault, so clients get a retriable 503.
+func writeCatalogEmpty(w http.ResponseWriter) {
+	emptyCatalogResponses.Add(1)
+	w.Header().Set("Retry-After", "60")
+	writeJSON(w, http.StatusServiceUnavailable, statusResponse{
+		Code:  http.StatusServiceUnavailable,
+		Msg:   "the catalog is empty",
+		Error: "catalog_empty",
+		Hint:  "No active URLs are in the catalog yet. Add some with /api/new or the admin API and retry.",
+	})
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	if he, ok := err.(*httpError); ok {
+		writeError(w, he.Status, he.Msg)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "failed")
+}
+
+var errContentRejected = errors.New("video rejected by a content filter")
+
+// serveVideo resolves entry and writes the video response. It returns an
+// error without writing anything when the video could not be resolved or
+// is rejected by the profanity filter or a plugin, so the caller can try
+// another.
+func serveVideo(w http.ResponseWriter, r *http.Request, entry catalogEntry) error {
+	start := time.Now()
+	video, err := videoCache.get(entry.URL)
+	addUpstreamTime(r, time.Since(start))
+	captureUpstream(r, entry.URL, time.Since(start), video, err)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+		log.Printf("Error resolving %s: %v\n", entry.URL, err)
+		return err
+	}
+	if rejectsTitle(entry.Collection, video.Title) || rejectedByPlugins(entry.Collection, video) || rejectedByPolicy(r, entry, video) {
+		return errContentRejected
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	served := writeVideoResponse(w, r, entry, video)
+	if degraded.Load() {
+		emitEvent(served.Type, served)
+		return nil
+	}
+	background(func() {
+		recordResolved(entry.ID, video)
+		recordServed(entry.ID, served)
+	})
+	return nil
+}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching video info: %w", err)
+// writeVideoResponse writes video as served from entry and returns the
+// video.served event, which the caller emits.
+func writeVideoResponse(w http.ResponseWriter, r *http.Request, entry catalogEntry, video *Video) serveEvent {
+	response := newVideoDataResponse(video)
+	response.Data.ServeID = newServeID(entry.ID, time.Now())
+	response.Data.Title = sanitizeTitle(maskTitle(entry.Collection, response.Data.Title), titlePolicyFor(r))
+	w.Header().Set("X-Serve-ID", response.Data.ServeID)
+	id := publicID(entry, video)
+	if mediaProxyEnabled() {
+		response.Data.URL = mediaURL(r, id, "video")
+		response.Data.Cover = mediaURL(r, id, "cover")
+		for i, track := range response.Data.Subtitles {
+			response.Data.Subtitles[i].URL = mediaURL(r, id, subtitleKind(track.Language))
+		}
+	}
+	if r.URL.Query().Get("quality") == "discord" && transcodingEnabled() {
+		response.Data.URL = mediaURL(r, id, "video") + "?quality=discord"
 	}
-	defer response.Body.Close()
+	served := newServeEvent(r, entry, video, response.Data.ServeID)
 
-	var videoInfo VideoInfo
-	err = json.NewDecoder(response.Body).Decode(&videoInfo)
+	if writeTemplatedResponse(w, r, entry, video, response) {
+		return served
+	}
+	if apiVersion(r) >= 2 {
+		writeJSON(w, http.StatusOK, newVideoResponseV2(response, entry, video))
+		return served
+	}
+	if legacyAPI(r) {
+		writeJSON(w, http.StatusOK, newLegacyVideoResponse(response))
+		return served
+	}
+
+	writeJSON(w, http.StatusOK, response)
+	return served
+}
+
+func getRandomVideo(w http.ResponseWriter, r *http.Request) {
+	var (
+		randomURL  catalogEntry
+		err        error
+		resolveErr error
+		attempts   int
+	)
+
+	params, err := parseSelectionParams(r)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding video info: %w", err)
+		writeHTTPError(w, err)
+		return
+	}
+	pick := newPicker(params)
+	if params.DryRun {
+		writeDryRun(w, pick)
+		return
+	}
+
+	maxAttempts := 3
+
+	for attempts < maxAttempts {
+		var strategy string
+		randomURL, strategy, err = pick()
+		if err == errNoFavorites || err == errNoMatches {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err == errNoURLs {
+			writeCatalogEmpty(w)
+			return
+		}
+		if err != nil {
+			attempts++
+			continue
+		}
+
+		err = serveVideo(w, r, randomURL)
+		if err == nil {
+			servesByStrategy.Add(strategy, 1)
+			if params.Seen != nil {
+				params.Seen.add(randomURL.ID)
+			}
+			return
+		}
+		if err != errContentRejected {
+			resolveErr = err
+		}
+		attempts++
 	}
 
-	if videoInfo.Code != 0 {
-		return nil, fmt.Errorf("API error: %s", videoInfo.Msg)
+	if resolveErr != nil {
+		abuse.recordError("upstream")
+		writeUpstreamError(w, resolveErr)
+		return
 	}
+	writeError(w, http.StatusBadRequest, "failed")
+}
 
-	return &videoInfo, nil
+type dryRunResponse struct {
+	Code int          `json:"code"`
+	Msg  string       `json:"msg"`
+	Data dryRunResult `json:"data"`
 }
 
-func getRandomVideo(w http.ResponseWriter, r *http.Request) {
-    var (
-        randomURL string
-        err      error
-        attempts int
-    )
-
-    maxAttempts := 3
-
-    for attempts < maxAttempts {
-        randomURL, err = getRandomURL()
-        if err!= nil {
-            attempts++
-            continue
-        }
-
-        videoInfo, err := getVideoInfo(randomURL)
-        if err!= nil {
-            attempts++
-            continue 
-        }
-
-        responseData := VideoDataResponse{
-            Code:    200,
-            Msg:     "success",
-            Data: struct {
-                Region    string `json:"region"`
-                URL       string `json:"url"`
-                Cover     string `json:"cover"`
-                Title     string `json:"title"`
-                Duration  string `json:"duration"`
-                User      struct {
-                    Username string `json:"username"`
-                    Nickname string `json:"nickname"`
-                    UserID   string `json:"userID"`
-                } `json:"user"`
-            }{
-                Region:   videoInfo.Data.Region,
-                URL:      "https://www.tikwm.com/video/media/hdplay/" + videoInfo.Data.ID + ".mp4",
-                Cover:    videoInfo.Data.Cover,
-                Title:    videoInfo.Data.Title,
-                Duration: fmt.Sprintf("%ds", videoInfo.Data.Duration),
-                User: struct {
-                    Username string `json:"username"`
-                    Nickname string `json:"nickname"`
-                    UserID   string `json:"userID"`
-                }{
-                    Username: videoInfo.Data.Author.UniqueID,
-                    Nickname: videoInfo.Data.Author.Nickname,
-                    UserID:   videoInfo.Data.Author.ID,
-                },
-            },
-        }
-
-        w.Header().Set("Content-Type", "application/json")
-        encoder := json.NewEncoder(w)
-        encoder.SetIndent("", "  ")
-        encoder.Encode(responseData)
-        return
-    }
-
-    errorResponse := struct {
-        Code int    `json:"code"`
-        Msg  string `json:"msg"`
-    }{
-        Code: 400,
-        Msg:  "failed",
-    }
-
-    w.WriteHeader(http.StatusBadRequest)
-    w.Header().Set("Content-Type", "application/json")
-
-    encoder := json.NewEncoder(w)
-    encoder.SetIndent("", "  ")
-    encoder.Encode(errorResponse)
+// dryRunResult is what /api/get?dry_run=true would have served.
+type dryRunResult struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Collection string `json:"collection"`
+	Strategy   string `json:"strategy"`
+	// Cached is whether the metadata would be served without an upstream
+	// lookup.
+	Cached   bool       `json:"cached"`
+	CachedAt *time.Time `json:"cached_at,omitempty"`
+}
+
+// writeDryRun writes the entry pick would serve, without resolving it or
+// counting a serve, so selection filters can be tried out for free.
+func writeDryRun(w http.ResponseWriter, pick picker) {
+	entry, strategy, err := pick()
+	switch err {
+	case nil:
+	case errNoFavorites, errNoMatches:
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errNoURLs:
+		writeCatalogEmpty(w)
+		return
+	default:
+		log.Printf("Error selecting a video: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	result := dryRunResult{ID: entry.ID, URL: entry.URL, Collection: entry.Collection, Strategy: strategy}
+	if at, ok := videoCache.cachedAt(entry.URL); ok {
+		result.Cached = true
+		result.CachedAt = &at
+	}
+	writeJSON(w, http.StatusOK, dryRunResponse{Code: 200, Msg: "success", Data: result})
+}
+
+// collection is the collection url is added to, "default" when unset.
+func (url URL) collection() string {
+	if url.Collection == "" {
+		return "default"
+	}
+	return url.Collection
+}
+
+// insertURL adds a submitted URL to its collection, doing nothing when its
+// id exists already, so submissions can be retried.
+func insertURL(url URL, submitter string) error {
+	if catalog.Sharded() {
+		// The outbox cannot span databases, so the event is emitted
+		// directly.
+		added, err := catalog.Insert(url.ID, url.URL, url.collection(), submitter)
+		if added {
+			emitEvent("url.added", url)
+		}
+		return err
+	}
+	_, err := execWithEvent("INSERT INTO urls (id, url, submitted_by, collection_id) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING", "url.added", url, url.ID, url.URL, submitter, url.collection())
+	return err
 }
 
 func addURL(w http.ResponseWriter, r *http.Request) {
 	var url URL
 
+	submitter := submitterID(r)
+	throttleKeys := abuseKeys(r)
+	if until, throttled := abuse.throttledUntil(throttleKeys...); throttled {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(time.Until(until).Seconds())+1))
+		writeCompatError(w, r, http.StatusTooManyRequests, "Too many submissions, try again later")
+		return
+	}
+
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		writeCompatError(w, r, http.StatusBadRequest, "Content-Type must be application/json")
 		return
 	}
 
+	if captchaEnabled() {
+		err := verifyCaptcha(r.Header.Get("X-Captcha-Token"), clientIP(r))
+		if err != nil {
+			log.Printf("Captcha verification failed: %v\n", err)
+			writeCompatError(w, r, http.StatusForbidden, "Captcha verification failed")
+			return
+		}
+	}
+
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&url)
 	if err != nil {
 		if err.Error() == "EOF" {
-			http.Error(w, "Empty request body", http.StatusBadRequest)
+			writeCompatError(w, r, http.StatusBadRequest, "Empty request body")
 		} else {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			writeCompatError(w, r, http.StatusBadRequest, "Invalid request payload")
 		}
 		return
 	}
 
+	abuse.recordAdd(throttleKeys, url.URL)
+
 	url.ID = uuid.New().String()
+	url.Collection = routeCollection(r)
 
-	query := "INSERT INTO urls (id, url) VALUES ($1, $2)"
-	_, err = db.Exec(query, url.ID, url.URL)
-	if err != nil {
-		http.Error(w, "Error adding URL to database", http.StatusInternalServerError)
+	if prefersAsync(r) {
+		acceptSubmission(w, r, url, submitter)
 		return
 	}
 
+	if err := insertURL(url, submitter); err != nil {
+		abuse.recordError("db")
+		writeCompatError(w, r, http.StatusInternalServerError, "Error adding URL to database")
+		return
+	}
+
+	background(func() { fingerprintURL(url.ID, url.URL) })
+
+	if apiVersion(r) >= 2 {
+		writeJSON(w, http.StatusCreated, urlResponse{Code: http.StatusCreated, Msg: "success", Data: url})
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(url)
 }
 
+// getURLs lists every URL (of the route's collection on a collection route),
+// or with limit (and cursor) one page of them in (created_at, id) order; a
+// full page comes with the cursor of the next one in X-Next-Cursor, and in
+// next_cursor in v2.
 func getURLs(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, url FROM urls")
+	query := r.URL.Query()
+	var (
+		listed []store.Listed
+		err    error
+		next   string
+	)
+	paged := query.Get("limit") != "" || query.Get("cursor") != ""
+	limit, limitErr := queryInt(query.Get("limit"), 1000, 1, 1000)
+	if limitErr != nil {
+		writeCompatError(w, r, http.StatusBadRequest, "limit must be between 1 and 1000")
+		return
+	}
+	if paged {
+		cursor := pageCursor{CreatedAt: time.Unix(0, 0), ID: uuid.Nil.String()}
+		if v := query.Get("cursor"); v != "" {
+			if cursor, err = decodeCursor(v); err != nil {
+				writeCompatError(w, r, http.StatusBadRequest, "invalid cursor")
+				return
+			}
+		}
+		listed, err = catalog.List(routeCollection(r), cursor.CreatedAt, cursor.ID, limit)
+	} else {
+		listed, err = catalog.List(routeCollection(r), time.Time{}, "", 0)
+	}
 	if err != nil {
-		http.Error(w, "Error retrieving URLs from database", http.StatusInternalServerError)
+		log.Println(err)
+		writeCompatError(w, r, http.StatusInternalServerError, "Error retrieving URLs from database")
 		return
 	}
-	defer rows.Close()
 
 	var urls []URL
-	for rows.Next() {
-		var url URL
-		if err := rows.Scan(&url.ID, &url.URL); err != nil {
-			http.Error(w, "Error scanning URL from database", http.StatusInternalServerError)
-			return
-		}
-		urls = append(urls, url)
+	for _, u := range listed {
+		urls = append(urls, URL{ID: u.ID, URL: u.URL})
+	}
+	if paged && len(urls) == limit {
+		next = encodeCursor(listed[len(listed)-1].AddedAt, urls[len(urls)-1].ID)
+		w.Header().Set("X-Next-Cursor", next)
 	}
 
+	if apiVersion(r) >= 2 {
+		if urls == nil {
+			urls = []URL{}
+		}
+		writeJSON(w, http.StatusOK, urlListResponse{Code: 200, Msg: "success", Data: urls, NextCursor: next})
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(urls)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	initDB()
+	initNotifiers()
+	initTimescale()
+	initGrowthExporters()
+	initEventBus()
+	if err := loadPlugins(); err != nil {
+		log.Fatal(err)
+	}
+	initMediaCache()
+	initAbuseDetector()
+
+	if err := loadResponseTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadTitlePolicies(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadProfanityFilters(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadSelectionStrategies(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadKeyTiers(); err != nil {
+		log.Fatal(err)
+	}
+
+	if degraded.Load() {
+		log.Println("Database unavailable; serving read-only from the catalog snapshot.")
+	} else {
+		startURLIndex()
+		if err := reloadKeyTiers(); err != nil {
+			log.Println(err)
+		}
+		if err := reloadIssuedKeys(); err != nil {
+			log.Println(err)
+		}
+		onInvalidate(purgeRemovedContent)
+		onInvalidate(videoCache.evictChanged)
+		onInvalidate(forgetDailyPick)
+		startInvalidationListener()
+		startLeaderElection()
+		startScheduler()
+	}
 
-	http.HandleFunc("/api/new", addURL)
-	http.HandleFunc("/api/list", getURLs)
-	http.HandleFunc("/api/get", getRandomVideo)
+	startAdminServer()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", noStore(getStatus))
+	mux.HandleFunc("/livez", noStore(livez))
+	mux.HandleFunc("/readyz", noStore(readyz))
+	mux.HandleFunc("/startupz", noStore(startupz))
+	mux.HandleFunc("/openapi.json", cacheable(serveOpenAPI))
+	mux.HandleFunc("/.well-known/jwks.json", cacheable(serveJWKS))
+	mux.HandleFunc("/api/new", addURL)
+	mux.HandleFunc("/api/submissions/", noStore(getSubmission))
+	mux.HandleFunc("/api/list", cacheable(getURLs, "catalog"))
+	mux.HandleFunc("/api/videos", cacheable(listVideos, "catalog"))
+	mux.HandleFunc("/api/videos/", cacheable(videoHistory))
+	mux.HandleFunc("/api/related/", noStore(getRelated))
+	mux.HandleFunc("/api/get", noStore(signed(getRandomVideo)))
+	mux.HandleFunc("/api/v1/get", noStore(signed(legacyGet)))
+	mux.HandleFunc("/api/media/", serveMedia)
+	mux.HandleFunc("/api/thumb/", serveThumb)
+	mux.HandleFunc("/watch/", cacheable(watchVideo))
+	mux.HandleFunc("/api/qr/", cacheable(serveQR))
+	mux.HandleFunc("/api/report", noStore(reportVideo))
+	mux.HandleFunc("/api/takedowns", noStore(submitTakedown))
+	mux.HandleFunc("/api/playlist", noStore(createPlaylist))
+	mux.HandleFunc("/api/playlist/", noStore(playlistNext))
+	mux.HandleFunc("/api/collage", cacheable(serveCollage))
+	mux.HandleFunc("/api/favorites/", noStore(favorite))
+	mux.HandleFunc("/api/daily", cacheable(dailyVideo, "daily"))
+	mux.HandleFunc("/api/hashtags", cacheable(getHashtags, "catalog", "hashtags"))
+	mux.HandleFunc("/api/music/top", cacheable(getTopMusic, "catalog", "music"))
+	mux.HandleFunc("/api/v2/", apiV2(mux))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	log.Printf("Server starting on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	serve(":"+port, routeCollections(legacyKeys(logRequests(localize(readOnly(authorizeKeys(captureDebug(rateLimit(mux)))))))))
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media proxy: with MEDIA_PROXY=true, served responses point at
+// /api/media/{url_id}/{video|cover} on this server instead of the upstream
+// CDN, whose links expire and which bills every download. Payloads are
+// cached on disk under MEDIA_CACHE_DIR up to MEDIA_CACHE_MAX_BYTES.
+
+var mediaCache *diskCache
+
+// mediaClient fetches media from the upstream CDN. It has no overall
+// timeout, since large payloads stream for as long as the client reads
+// them, but gives up on upstreams that do not connect or answer.
+var mediaClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = 15 * time.Second
+	return &http.Client{Transport: transport}
+}()
+
+func initMediaCache() {
+	dir := os.Getenv("MEDIA_CACHE_DIR")
+	if dir == "" {
+		return
+	}
+	cache, err := openDiskCache(dir, int64(envInt("MEDIA_CACHE_MAX_BYTES", 10<<30)))
+	if err != nil {
+		log.Printf("Media cache disabled: %v\n", err)
+		return
+	}
+	mediaCache = cache
+	log.Printf("Media cache at %s holds %d bytes.\n", dir, cache.size)
+}
+
+func mediaProxyEnabled() bool {
+	return os.Getenv("MEDIA_PROXY") == "true"
+}
+
+// publicBaseURL is MEDIA_BASE_URL or, when unset, the scheme and host the
+// request came in on.
+func publicBaseURL(r *http.Request) string {
+	if base := os.Getenv("MEDIA_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func mediaURL(r *http.Request, id, kind string) string {
+	return publicBaseURL(r) + "/api/media/" + id + "/" + kind
+}
+
+// subtitleKind is the media kind of the caption track in language.
+func subtitleKind(language string) string {
+	return "subtitles/" + url.PathEscape(language)
+}
+
+// mediaSource returns the upstream URL of kind and, for caption tracks
+// whose hosts rarely label them, the content type to serve them with.
+func mediaSource(video *Video, kind string) (source, contentType string) {
+	switch kind {
+	case "video":
+		return video.PlayURL, ""
+	case "cover":
+		return video.Cover, ""
+	}
+	for _, track := range video.Subtitles {
+		if subtitleKind(track.Language) == kind {
+			return track.URL, subtitleContentTypes[track.Format]
+		}
+	}
+	return "", ""
+}
+
+var subtitleContentTypes = map[string]string{
+	"webvtt": "text/vtt; charset=utf-8",
+	"srt":    "application/x-subrip; charset=utf-8",
+}
+
+// serveMedia handles GET and HEAD /api/media/{url_id}/{video|cover} and
+// /api/media/{url_id}/subtitles/{language}, including Range requests.
+// Videos accept ?quality=discord for the transcoded rendition (see
+// transcode.go).
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/media/"), "/"), "/")
+	var id, kind string
+	switch {
+	case len(parts) == 2 && (parts[1] == "video" || parts[1] == "cover"):
+		id, kind = parts[0], parts[1]
+	case len(parts) == 3 && parts[1] == "subtitles" && parts[2] != "":
+		id, kind = parts[0], subtitleKind(parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	quality := r.URL.Query().Get("quality")
+	if quality == "original" {
+		quality = ""
+	}
+	if quality != "" && (kind != "video" || quality != "discord") {
+		writeError(w, http.StatusBadRequest, "quality must be original or discord (videos only)")
+		return
+	}
+	if quality != "" && !transcodingEnabled() {
+		writeError(w, http.StatusNotImplemented, "transcoding is not available")
+		return
+	}
+
+	key := requestKey(r)
+	_, limits := limitsFor(r)
+	if until, exhausted := mediaQuotaExhausted(key, limits.MediaBytes); exhausted {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "media bandwidth quota exhausted")
+		return
+	}
+	w = newMeteredWriter(w, key, limits.MediaBytes)
+
+	entry, err := entryByPublicID(id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "video not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	// Caches and surrogate keys stay keyed by the internal id, which
+	// both kinds of links resolve to.
+	urlID := entry.ID
+
+	video, err := videoCache.get(entry.URL)
+	if err != nil {
+		log.Printf("Error resolving %s: %v\n", entry.URL, err)
+		writeUpstreamError(w, err)
+		return
+	}
+	source, contentType := mediaSource(video, kind)
+	if source == "" {
+		writeError(w, http.StatusNotFound, "no such media for this video")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	addSurrogateKeys(w, videoSurrogateKey(urlID))
+
+	if quality != "" {
+		serveTranscoded(w, r, urlID, video, source)
+		return
+	}
+
+	if mediaCache == nil {
+		if err := streamUpstreamMedia(w, r, source, contentType); err != nil {
+			log.Printf("Error proxying %s: %v\n", source, err)
+		}
+		return
+	}
+
+	f, cached, hit, err := mediaCache.open(urlID+"/"+kind, func(dst io.Writer) (string, error) {
+		upstreamType, err := fetchMedia(dst, source)
+		if contentType != "" {
+			return contentType, err
+		}
+		return upstreamType, err
+	})
+	if err != nil {
+		log.Printf("Error fetching %s: %v\n", source, err)
+		writeError(w, http.StatusBadGateway, "failed to fetch media")
+		return
+	}
+	defer f.Close()
+
+	serveMediaFile(w, r, f, cached, hit)
+}
+
+// serveMediaFile writes a cached payload. ServeContent answers Range and
+// If-Range requests from the file, so players can seek and resume; the
+// ETag keeps a resumed download from mixing two different payloads.
+func serveMediaFile(w http.ResponseWriter, r *http.Request, f *os.File, cached diskCacheEntry, hit bool) {
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	w.Header().Set("X-Cache", map[bool]string{true: "HIT", false: "MISS"}[hit])
+	w.Header().Set("Content-Type", cached.ContentType)
+	w.Header().Set("ETag", `"`+cached.SHA256+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// mediaRequest fetches source, forwarding the headers in forward that are
+// set (such as Range). When a Range is forwarded, an upstream 416 is
+// returned too, for the caller to pass on.
+func mediaRequest(source string, forward http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	for name, values := range forward {
+		req.Header[name] = values
+	}
+
+	response, err := mediaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	unsatisfiable := response.StatusCode == http.StatusRequestedRangeNotSatisfiable && forward.Get("Range") != ""
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent && !unsatisfiable {
+		response.Body.Close()
+		return nil, fmt.Errorf("upstream responded with status %d", response.StatusCode)
+	}
+	return response, nil
+}
+
+// fetchMedia copies source into dst, refusing payloads over
+// MEDIA_MAX_BYTES.
+func fetchMedia(dst io.Writer, source string) (string, error) {
+	response, err := mediaRequest(source, nil)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	limit := int64(envInt("MEDIA_MAX_BYTES", 100<<20))
+	n, err := io.Copy(dst, io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if n > limit {
+		return "", fmt.Errorf("media larger than %d bytes", limit)
+	}
+	return response.Header.Get("Content-Type"), nil
+}
+
+// streamUpstreamMedia proxies source without caching, passing the range
+// headers of r upstream and the partial content or unsatisfiable range
+// response back. A non-empty contentType replaces the upstream one.
+func streamUpstreamMedia(w http.ResponseWriter, r *http.Request, source, contentType string) error {
+	forward := http.Header{}
+	for _, name := range []string{"Range", "If-Range"} {
+		if value := r.Header.Get(name); value != "" {
+			forward.Set(name, value)
+		}
+	}
+
+	response, err := mediaRequest(source, forward)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "failed to fetch media")
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The Content-Range tells the client the size it may ask for;
+		// the answer depends on the range, so it is not cached.
+		w.Header().Set("Cache-Control", "no-store")
+		if value := response.Header.Get("Content-Range"); value != "" {
+			w.Header().Set("Content-Range", value)
+		}
+		w.WriteHeader(response.StatusCode)
+		return nil
+	}
+
+	for _, name := range []string{"Content-Type", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if value := response.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if response.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+	}
+	w.WriteHeader(response.StatusCode)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = io.Copy(w, response.Body)
+	return err
+}
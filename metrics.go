@@ -0,0 +1,16 @@
+package main
+
+import "expvar"
+
+// Counters are published through expvar at /debug/vars on the admin
+// listener.
+var (
+	servesByStrategy = expvar.NewMap("serves_by_strategy")
+	// catalogEmpty is 1 while the URL index holds no active URLs.
+	catalogEmpty = expvar.NewInt("catalog_empty")
+	// catalogBelowMinimum is 1 while the index holds fewer active URLs
+	// than CATALOG_MIN_ACTIVE.
+	catalogBelowMinimum   = expvar.NewInt("catalog_below_minimum")
+	retentionRunsPaused   = expvar.NewInt("retention_runs_paused")
+	emptyCatalogResponses = expvar.NewInt("empty_catalog_responses")
+)
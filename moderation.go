@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Moderation backlog: with MODERATION_BACKLOG_ALERT set, the leader counts
+// what waits for a moderator (reported videos, pending takedowns,
+// suggestions and duplicate candidates) every
+// MODERATION_BACKLOG_CHECK_INTERVAL, and alerts once when the count goes
+// over it and once when it is back under.
+
+// moderationBacklogHigh is whether the last check was over the threshold.
+// Only the leader checks, one check at a time.
+var moderationBacklogHigh bool
+
+const moderationBacklogQuery = `
+SELECT
+	(SELECT COUNT(DISTINCT url_id) FROM reports WHERE status = 'open'),
+	(SELECT COUNT(*) FROM takedowns WHERE status = 'pending'),
+	(SELECT COUNT(*) FROM url_suggestions WHERE status = 'pending'),
+	(SELECT COUNT(*) FROM duplicate_candidates WHERE status = 'pending')
+`
+
+func checkModerationBacklog() error {
+	threshold := envInt("MODERATION_BACKLOG_ALERT", 0)
+	if threshold <= 0 {
+		return nil
+	}
+	// Reports, takedowns and duplicates live in the shard of their video.
+	var reports, takedowns, suggestions, duplicates int
+	for _, conn := range catalog.DBs() {
+		var r, t, s, d int
+		if err := conn.QueryRow(moderationBacklogQuery).Scan(&r, &t, &s, &d); err != nil {
+			return fmt.Errorf("error counting the moderation backlog: %w", err)
+		}
+		reports, takedowns, suggestions, duplicates = reports+r, takedowns+t, suggestions+s, duplicates+d
+	}
+	total := reports + takedowns + suggestions + duplicates
+	tags := map[string]string{
+		"reports":     fmt.Sprint(reports),
+		"takedowns":   fmt.Sprint(takedowns),
+		"suggestions": fmt.Sprint(suggestions),
+		"duplicates":  fmt.Sprint(duplicates),
+	}
+
+	switch {
+	case total > threshold && !moderationBacklogHigh:
+		sendAlert(Alert{
+			Kind:    "moderation_backlog",
+			Message: fmt.Sprintf("%d items are waiting for moderation, over the limit of %d.", total, threshold),
+			Tags:    tags,
+		})
+	case total <= threshold && moderationBacklogHigh:
+		sendAlert(Alert{
+			Kind:    "moderation_backlog_cleared",
+			Level:   "info",
+			Message: fmt.Sprintf("The moderation backlog is down to %d items.", total),
+			Tags:    tags,
+		})
+	}
+	moderationBacklogHigh = total > threshold
+	return nil
+}
+
+func init() {
+	schedule("moderation-backlog", "MODERATION_BACKLOG_CHECK_INTERVAL", 5*time.Minute, checkModerationBacklog).LeaderOnly = true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type musicCount struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Count int    `json:"count"`
+}
+
+type musicResponse struct {
+	Code int          `json:"code"`
+	Msg  string       `json:"msg"`
+	Data []musicCount `json:"data"`
+}
+
+// getTopMusic handles GET /api/music/top, listing the sounds used by the
+// most active videos (of the route's collection on a collection route). Use
+// the returned id with /api/get?music_id=.
+func getTopMusic(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	// As for hashtags, a limit only applies in the database when there is
+	// one.
+	collection := routeCollection(r)
+	conns := collectionDBs(collection)
+	var shardLimit interface{}
+	if len(conns) == 1 {
+		shardLimit = limit
+	}
+	counts := make(map[string]*musicCount)
+	for _, conn := range conns {
+		if err := countMusic(conn, collection, shardLimit, counts); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+	}
+
+	response := musicResponse{Code: 200, Msg: "success", Data: []musicCount{}}
+	for _, c := range counts {
+		response.Data = append(response.Data, *c)
+	}
+	sort.Slice(response.Data, func(i, j int) bool {
+		a, b := response.Data[i], response.Data[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.ID < b.ID
+	})
+	response.Data = response.Data[:min(limit, len(response.Data))]
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// countMusic adds the counts of the sounds of active videos in conn to
+// counts, only the top limit of them unless limit is nil.
+func countMusic(conn *sql.DB, collection string, limit interface{}, counts map[string]*musicCount) error {
+	rows, err := conn.Query(`
+	SELECT music_id, COALESCE(MAX(music_title), ''), COUNT(*) FROM urls
+	WHERE status = 'active' AND music_id IS NOT NULL AND ($2 = '' OR collection_id = $2)
+	GROUP BY music_id
+	ORDER BY COUNT(*) DESC, music_id
+	LIMIT $1
+	`, limit, collection)
+	if err != nil {
+		return fmt.Errorf("error retrieving top music: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c musicCount
+		if err := rows.Scan(&c.ID, &c.Title, &c.Count); err != nil {
+			return fmt.Errorf("error scanning music: %w", err)
+		}
+		if seen, ok := counts[c.ID]; ok {
+			seen.Count += c.Count
+			seen.Title = max(seen.Title, c.Title)
+			continue
+		}
+		counts[c.ID] = &c
+	}
+	return rows.Err()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// No-repeat sessions: passing ?session=<id> to /api/get makes the server
+// avoid videos already served to that session. Each session is backed by a
+// rotating Bloom filter instead of an exact set, so memory per session is
+// fixed (about NOREPEAT_CAPACITY * 1.8 bytes per generation at the default
+// 0.1% false-positive rate) however large the catalog or long the session,
+// and at most NOREPEAT_MAX_SESSIONS sessions are tracked at once, the least
+// recently used making way for new ones.
+var noRepeat = struct {
+	mu       sync.Mutex
+	lru      *list.List // of *noRepeatEntry, most recently used first
+	sessions map[string]*list.Element
+}{lru: list.New(), sessions: make(map[string]*list.Element)}
+
+type noRepeatEntry struct {
+	key  string
+	seen *rotatingBloom
+}
+
+func noRepeatSession(r *http.Request) *rotatingBloom {
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		return nil
+	}
+	key := requestKey(r) + ":" + session
+
+	noRepeat.mu.Lock()
+	defer noRepeat.mu.Unlock()
+
+	if el, ok := noRepeat.sessions[key]; ok {
+		noRepeat.lru.MoveToFront(el)
+		return el.Value.(*noRepeatEntry).seen
+	}
+	seen := newRotatingBloom(envInt("NOREPEAT_CAPACITY", 10000), 0.001)
+	noRepeat.sessions[key] = noRepeat.lru.PushFront(&noRepeatEntry{key: key, seen: seen})
+	for noRepeat.lru.Len() > max(1, envInt("NOREPEAT_MAX_SESSIONS", 10000)) {
+		oldest := noRepeat.lru.Remove(noRepeat.lru.Back()).(*noRepeatEntry)
+		delete(noRepeat.sessions, oldest.key)
+	}
+	return seen
+}
+
+// rotateNoRepeatSessions ages every session's filter by one generation and
+// drops sessions idle for two windows.
+func rotateNoRepeatSessions() error {
+	window := envDuration("NOREPEAT_WINDOW", 24*time.Hour)
+
+	noRepeat.mu.Lock()
+	defer noRepeat.mu.Unlock()
+
+	now := time.Now()
+	for key, el := range noRepeat.sessions {
+		seen := el.Value.(*noRepeatEntry).seen
+		seen.mu.RLock()
+		idle := now.Sub(seen.usedAt)
+		due := now.Sub(seen.rotatedAt) >= window
+		seen.mu.RUnlock()
+
+		if idle >= 2*window {
+			noRepeat.lru.Remove(el)
+			delete(noRepeat.sessions, key)
+		} else if due {
+			seen.rotate()
+		}
+	}
+	return nil
+}
+
+func init() {
+	schedule("rotate-norepeat", "", 10*time.Minute, rotateNoRepeatSessions)
+}
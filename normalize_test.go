@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// normalized is what a golden file records for one recorded provider
+// response: the Video it normalizes to and the API response built from it,
+// or the error when the response is rejected.
+type normalized struct {
+	Video    *Video             `json:"video,omitempty"`
+	Response *VideoDataResponse `json:"response,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// TestProviderGolden decodes every recorded response under
+// testdata/providers/<provider>/ and compares the result with the matching
+// .golden file. Run with -update after an intentional change.
+func TestProviderGolden(t *testing.T) {
+	for provider, decode := range providerDecoders {
+		inputs, err := filepath.Glob(filepath.Join("testdata", "providers", provider, "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inputs) == 0 {
+			t.Errorf("no recorded responses for provider %s", provider)
+		}
+
+		for _, input := range inputs {
+			name := provider + "/" + strings.TrimSuffix(filepath.Base(input), ".json")
+			t.Run(name, func(t *testing.T) {
+				raw, err := os.ReadFile(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got normalized
+				video, err := decode(raw)
+				if err != nil {
+					got.Error = err.Error()
+				} else {
+					response := newVideoDataResponse(video)
+					got.Video = video
+					got.Response = &response
+				}
+
+				gotJSON, err := json.MarshalIndent(got, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotJSON = append(gotJSON, '\n')
+
+				golden := strings.TrimSuffix(input, ".json") + ".golden"
+				if *update {
+					if err := os.WriteFile(golden, gotJSON, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run go test -update to create it)", err)
+				}
+				if !bytes.Equal(gotJSON, want) {
+					t.Errorf("normalized output differs from %s:\ngot:\n%s\nwant:\n%s", golden, gotJSON, want)
+				}
+			})
+		}
+	}
+}
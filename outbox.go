@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// With EVENT_OUTBOX=true, events caused by a database change (url.added,
+// url.approved and video.served from /api/get) are written to the outbox
+// table in the same transaction as the change, instead of being queued in
+// memory after it. The leader relays the outbox every OUTBOX_INTERVAL to the serve webhooks
+// and the event bus, and deletes the rows only once every destination has
+// accepted them, so a crash can neither lose an event nor emit one for a
+// change that was rolled back. Delivery is at least once: a batch that
+// failed for one destination is retried for all of them, so consumers
+// should deduplicate on the event id (serve_id for serve webhooks).
+
+var outboxRelayed = expvar.NewInt("outbox_relayed")
+
+func outboxEnabled() bool {
+	return os.Getenv("EVENT_OUTBOX") == "true" && !degraded.Load()
+}
+
+// emitEvent queues an event in memory for the serve webhooks and the event
+// bus.
+func emitEvent(eventType string, data interface{}) {
+	if ev, ok := data.(serveEvent); ok {
+		recordServeEvent(ev)
+	}
+	publishEvent(eventType, data)
+}
+
+func writeOutbox(tx *sql.Tx, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error encoding %s event: %w", eventType, err)
+	}
+	if _, err := tx.Exec("INSERT INTO outbox (event_type, payload) VALUES ($1, $2)", eventType, payload); err != nil {
+		return fmt.Errorf("error writing %s event to the outbox: %w", eventType, err)
+	}
+	return nil
+}
+
+// execWithEvent runs query and, when it changes a row, emits an event of
+// eventType: through the outbox in the same transaction when it is
+// enabled, in memory once the change is made otherwise.
+func execWithEvent(query string, eventType string, data interface{}, args ...interface{}) (sql.Result, error) {
+	if !outboxEnabled() {
+		result, err := db.Exec(query, args...)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n > 0 {
+				emitEvent(eventType, data)
+			}
+		}
+		return result, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		if err := writeOutbox(tx, eventType, data); err != nil {
+			return nil, err
+		}
+	}
+	return result, tx.Commit()
+}
+
+type outboxEvent struct {
+	ID      int64
+	Type    string
+	Payload json.RawMessage
+	Time    time.Time
+}
+
+// relayOutbox delivers the oldest outbox events and deletes them. The rows
+// stay locked while they are delivered, so a replica that has just taken
+// over as leader skips them instead of sending them twice.
+func relayOutbox() error {
+	if !outboxEnabled() {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting outbox relay: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+	SELECT id, event_type, payload, created_at FROM outbox
+	ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+	`, envInt("OUTBOX_BATCH", 1000))
+	if err != nil {
+		return fmt.Errorf("error reading the outbox: %w", err)
+	}
+	var (
+		events []outboxEvent
+		ids    []int64
+	)
+	for rows.Next() {
+		var ev outboxEvent
+		if err := rows.Scan(&ev.ID, &ev.Type, &ev.Payload, &ev.Time); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning the outbox: %w", err)
+		}
+		events = append(events, ev)
+		ids = append(ids, ev.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading the outbox: %w", err)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := deliverOutbox(events); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM outbox WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return fmt.Errorf("error deleting relayed events: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error deleting relayed events: %w", err)
+	}
+	outboxRelayed.Add(int64(len(events)))
+	return nil
+}
+
+func deliverOutbox(events []outboxEvent) error {
+	if targets := serveWebhookURLs(); len(targets) > 0 {
+		var served []serveEvent
+		for _, ev := range events {
+			if ev.Type != "video.served" {
+				continue
+			}
+			var s serveEvent
+			if err := json.Unmarshal(ev.Payload, &s); err != nil {
+				log.Printf("Error decoding outbox event %d: %v\n", ev.ID, err)
+				continue
+			}
+			served = append(served, s)
+		}
+
+		size := envInt("SERVE_WEBHOOK_BATCH", 1000)
+		for _, target := range targets {
+			for start := 0; start < len(served); start += size {
+				batch := served[start:min(start+size, len(served))]
+				if err := deliverServeEvents(target, batch); err != nil {
+					return fmt.Errorf("error relaying %d serve events: %w", len(batch), err)
+				}
+				serveWebhookDelivered.Add(int64(len(batch)))
+			}
+		}
+	}
+
+	if eventBus.publisher != nil {
+		for _, ev := range events {
+			payload, err := json.Marshal(domainEvent{
+				ID:       strconv.FormatInt(ev.ID, 10),
+				Type:     ev.Type,
+				Time:     ev.Time.UTC(),
+				Region:   currentRegion(),
+				Instance: instanceName(),
+				Data:     ev.Payload,
+			})
+			if err != nil {
+				return fmt.Errorf("error encoding %s event: %w", ev.Type, err)
+			}
+			if err := eventBus.publisher.Publish(ev.Type, payload); err != nil {
+				return fmt.Errorf("error relaying %s event: %w", ev.Type, err)
+			}
+			eventsPublished.Add(ev.Type, 1)
+		}
+	}
+	return nil
+}
+
+func init() {
+	schedule("outbox", "OUTBOX_INTERVAL", time.Second, relayOutbox).LeaderOnly = true
+}
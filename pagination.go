@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Keyset pagination: a cursor is the (created_at, id) of the last row of a
+// page, and the next page starts right after it. Unlike OFFSET, rows added
+// or removed meanwhile do not shift later pages, and every page costs the
+// same index range scan however deep it is. Cursors are opaque to clients.
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+type pageCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func encodeCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	at, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return pageCursor{}, errInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	return pageCursor{CreatedAt: createdAt, ID: id}, nil
+}
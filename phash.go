@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var coverClient = &http.Client{Timeout: 15 * time.Second}
+
+// differenceHash computes a 64-bit dHash: the image is reduced to a 9x8
+// grayscale grid and each bit records whether a cell is brighter than its
+// right-hand neighbour. Re-encodes, resizes and small crops of the same
+// frame land within a few bits of each other.
+func differenceHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+
+	var grid [h][w]float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			y0 := b.Min.Y + y*b.Dy()/h
+			y1 := b.Min.Y + (y+1)*b.Dy()/h
+
+			var sum float64
+			var n int
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, bl, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			if n > 0 {
+				grid[y][x] = sum / float64(n)
+			}
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func coverHash(coverURL string) (uint64, error) {
+	response, err := coverClient.Get(coverURL)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching cover: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("cover responded with status %d", response.StatusCode)
+	}
+
+	img, _, err := image.Decode(io.LimitReader(response.Body, 10<<20))
+	if err != nil {
+		return 0, fmt.Errorf("error decoding cover: %w", err)
+	}
+
+	return differenceHash(img), nil
+}
+
+// fingerprintURL resolves a newly added URL, stores its metadata and cover
+// hash, and flags existing videos whose covers are within PHASH_THRESHOLD
+// bits as likely duplicates for moderator review. Candidates reference both
+// URLs, so on a sharded catalog a URL is compared with those of its shard.
+func fingerprintURL(id, rawURL string) {
+	info, err := resolveVideo(rawURL)
+	if err != nil {
+		log.Printf("Error resolving new URL %s: %v\n", rawURL, err)
+		return
+	}
+	recordResolved(id, info)
+
+	hash, err := coverHash(info.Cover)
+	if err != nil {
+		log.Printf("Error hashing cover of %s: %v\n", rawURL, err)
+		return
+	}
+
+	conn, err := catalog.DB(id)
+	if err != nil {
+		log.Printf("Error locating %s: %v\n", rawURL, err)
+		return
+	}
+	_, err = conn.Exec("UPDATE urls SET cover_phash = $2 WHERE id = $1", id, int64(hash))
+	if err != nil {
+		log.Printf("Error storing cover hash of %s: %v\n", rawURL, err)
+		return
+	}
+
+	threshold := envInt("PHASH_THRESHOLD", 6)
+
+	rows, err := conn.Query("SELECT id, cover_phash FROM urls WHERE cover_phash IS NOT NULL AND id <> $1", id)
+	if err != nil {
+		log.Printf("Error loading cover hashes: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	type match struct {
+		id       string
+		distance int
+	}
+	var matches []match
+	for rows.Next() {
+		var (
+			otherID string
+			other   int64
+		)
+		if err := rows.Scan(&otherID, &other); err != nil {
+			log.Printf("Error scanning cover hash: %v\n", err)
+			return
+		}
+		if d := bits.OnesCount64(hash ^ uint64(other)); d <= threshold {
+			matches = append(matches, match{otherID, d})
+		}
+	}
+	rows.Close()
+
+	for _, m := range matches {
+		_, err := conn.Exec(
+			"INSERT INTO duplicate_candidates (id, url_id, duplicate_of, distance) VALUES ($1, $2, $3, $4)",
+			uuid.New().String(), id, m.id, m.distance,
+		)
+		if err != nil {
+			log.Printf("Error flagging duplicate of %s: %v\n", rawURL, err)
+		}
+	}
+	if len(matches) > 0 {
+		log.Printf("Flagged %s as a possible duplicate of %d video(s).\n", rawURL, len(matches))
+	}
+}
+
+type duplicateCandidate struct {
+	ID          string    `json:"id"`
+	URLID       string    `json:"url_id"`
+	URL         string    `json:"url"`
+	DuplicateOf string    `json:"duplicate_of"`
+	OriginalURL string    `json:"original_url"`
+	Distance    int       `json:"distance"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// listDuplicates handles GET /api/admin/duplicates, the pending review queue.
+func listDuplicates(w http.ResponseWriter, r *http.Request) {
+	candidates := []duplicateCandidate{}
+	for _, conn := range catalog.DBs() {
+		pending, err := pendingDuplicates(conn)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		candidates = append(candidates, pending...)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].CreatedAt.Before(candidates[j].CreatedAt) })
+
+	writeJSON(w, http.StatusOK, candidates)
+}
+
+// pendingDuplicates returns the pending duplicate candidates in conn.
+func pendingDuplicates(conn *sql.DB) ([]duplicateCandidate, error) {
+	rows, err := conn.Query(`
+	SELECT d.id, d.url_id, u.url, d.duplicate_of, o.url, d.distance, d.created_at
+	FROM duplicate_candidates d
+	JOIN urls u ON u.id = d.url_id
+	JOIN urls o ON o.id = d.duplicate_of
+	WHERE d.status = 'pending'
+	ORDER BY d.created_at
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving duplicates: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []duplicateCandidate
+	for rows.Next() {
+		var c duplicateCandidate
+		if err := rows.Scan(&c.ID, &c.URLID, &c.URL, &c.DuplicateOf, &c.OriginalURL, &c.Distance, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning duplicate: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// reviewDuplicate handles POST /api/admin/duplicates/{id}/dismiss and
+// POST /api/admin/duplicates/{id}/block; blocking removes the newer URL
+// from rotation.
+func reviewDuplicate(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/duplicates/"), "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 || (parts[1] != "dismiss" && parts[1] != "block") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	status := "dismissed"
+	if parts[1] == "block" {
+		status = "blocked"
+	}
+
+	// Candidates live in the shard of their URLs.
+	var conn *sql.DB
+	for _, shardDB := range catalog.DBs() {
+		var found bool
+		err := shardDB.QueryRow("SELECT true FROM duplicate_candidates WHERE id = $1", parts[0]).Scan(&found)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		conn = shardDB
+		break
+	}
+	if conn == nil {
+		writeError(w, http.StatusNotFound, "pending duplicate not found")
+		return
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer tx.Rollback()
+
+	var urlID string
+	err = tx.QueryRow(
+		"UPDATE duplicate_candidates SET status = $2 WHERE id = $1 AND status = 'pending' RETURNING url_id",
+		parts[0], status,
+	).Scan(&urlID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "pending duplicate not found")
+		return
+	}
+
+	if status == "blocked" {
+		if _, err := tx.Exec("UPDATE urls SET status = 'blocked' WHERE id = $1", urlID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type playlistRequest struct {
+	Size int `json:"size"`
+}
+
+type playlistResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		ID   string `json:"id"`
+		Size int    `json:"size"`
+		Next string `json:"next"`
+	} `json:"data"`
+}
+
+// createPlaylist handles POST /api/playlist. It fixes an ordered,
+// non-repeating selection of videos up front so queue-based bots can step
+// through it with GET /api/playlist/{id}/next.
+func createPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	req := playlistRequest{Size: 10}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+
+	maxSize := envInt("PLAYLIST_MAX_SIZE", 100)
+	if req.Size < 1 || req.Size > maxSize {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d", maxSize))
+		return
+	}
+
+	entries, err := sampleEntries(req.Size)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if len(entries) == 0 {
+		writeCatalogEmpty(w)
+		return
+	}
+
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+
+	id := uuid.New().String()
+	_, err = db.Exec("INSERT INTO playlists (id, url_ids) VALUES ($1, $2)", id, pq.Array(ids))
+	if err != nil {
+		log.Printf("Error creating playlist: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	var response playlistResponse
+	response.Code = 200
+	response.Msg = "success"
+	response.Data.ID = id
+	response.Data.Size = len(ids)
+	response.Data.Next = "/api/playlist/" + id + "/next"
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// playlistNext handles GET /api/playlist/{id}/next, advancing the
+// playlist atomically so concurrent callers never receive the same item.
+// Items whose URL was removed or no longer resolves are skipped.
+func playlistNext(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/playlist/"), "/"), "/")
+	if len(parts) != 2 || (parts[1] != "next" && parts[1] != "collage") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid playlist id")
+		return
+	}
+	if parts[1] == "collage" {
+		// A playlist never changes, so neither does its collage.
+		cacheable(func(w http.ResponseWriter, r *http.Request) { playlistCollage(w, r, parts[0]) })(w, r)
+		return
+	}
+
+	var resolveErr error
+	for attempts := 0; attempts < 3; attempts++ {
+		var urlID string
+		err := db.QueryRow(`
+		UPDATE playlists SET position = position + 1
+		WHERE id = $1 AND position < cardinality(url_ids)
+		RETURNING url_ids[position]
+		`, parts[0]).Scan(&urlID)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "playlist finished or not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Error advancing playlist: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+
+		entry, err := activeEntryByID(urlID)
+		if err != nil || slices.Contains(entry.Restricted, requestCountry(r)) {
+			continue
+		}
+
+		err = serveVideo(w, r, entry)
+		if err == nil {
+			return
+		}
+		if err != errContentRejected {
+			resolveErr = err
+		}
+	}
+
+	if resolveErr != nil {
+		writeUpstreamError(w, resolveErr)
+		return
+	}
+	writeError(w, http.StatusBadRequest, "failed")
+}
+
+// expirePlaylists deletes playlists older than PLAYLIST_TTL.
+func expirePlaylists() error {
+	ttl := envDuration("PLAYLIST_TTL", 24*time.Hour)
+	_, err := db.Exec("DELETE FROM playlists WHERE created_at < $1", time.Now().Add(-ttl))
+	if err != nil {
+		return fmt.Errorf("error expiring playlists: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	schedule("expire-playlists", "", time.Hour, expirePlaylists).LeaderOnly = true
+}
@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+// ErrTimeout is returned by calls the plugin does not answer in time.
+var ErrTimeout = errors.New("plugin did not answer in time")
+
+// Client is the server's side of a running plugin. It is safe for
+// concurrent use.
+type Client struct {
+	args    []string
+	stderr  io.Writer
+	timeout time.Duration
+
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	rpc  *rpc.Client
+	info Info
+}
+
+// Start runs the plugin command args, whose stderr is copied to stderr, and
+// asks it what it offers. Every call, the handshake included, fails with
+// ErrTimeout when the plugin takes longer than timeout to answer, and the
+// plugin is then killed and restarted, as it may be stuck for good.
+func Start(args []string, stderr io.Writer, timeout time.Duration) (*Client, error) {
+	if len(args) == 0 {
+		return nil, errors.New("plugin command is empty")
+	}
+	c := &Client{args: args, stderr: stderr, timeout: timeout}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// start runs the plugin process. It must be called with c.mu held.
+func (c *Client) start() error {
+	cmd := exec.Command(c.args[0], c.args[1:]...)
+	cmd.Env = append(os.Environ(), cookieEnv+"="+cookieValue)
+	cmd.Stderr = c.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting plugin %s: %w", c.args[0], err)
+	}
+
+	client := rpc.NewClient(pipe{stdout, stdin})
+	var info Info
+	if err := c.callWithin(client, "Info", 0, &info); err != nil {
+		client.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("error handshaking with plugin %s: %w", c.args[0], err)
+	}
+	if info.Version != ProtocolVersion {
+		client.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("plugin %s speaks protocol %d, not %d; rebuild it against this version", c.args[0], info.Version, ProtocolVersion)
+	}
+
+	c.cmd, c.rpc, c.info = cmd, client, info
+	go cmd.Wait()
+	return nil
+}
+
+// pipe joins the plugin's stdout and stdin into one connection.
+type pipe struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (p pipe) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p pipe) Close() error                { return errors.Join(p.ReadCloser.Close(), p.w.Close()) }
+
+// Info returns what the plugin offers.
+func (c *Client) Info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// String returns the plugin's command.
+func (c *Client) String() string {
+	return c.args[0]
+}
+
+// call calls method, restarting the plugin once if it went away. A plugin
+// that times out is restarted for the next call instead.
+func (c *Client) call(method string, args, reply interface{}) error {
+	c.mu.Lock()
+	client := c.rpc
+	c.mu.Unlock()
+
+	err := c.callWithin(client, method, args, reply)
+	if errors.Is(err, ErrTimeout) {
+		if rerr := c.restart(client); rerr != nil {
+			return fmt.Errorf("%w; %v", err, rerr)
+		}
+		return err
+	}
+	if err != rpc.ErrShutdown && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	if err := c.restart(client); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	client = c.rpc
+	c.mu.Unlock()
+	return c.callWithin(client, method, args, reply)
+}
+
+// callWithin calls method on client, giving up after c.timeout. The answer
+// is decoded into a reply of its own, copied to reply once complete, so an
+// answer arriving after the timeout cannot race with the caller.
+func (c *Client) callWithin(client *rpc.Client, method string, args, reply interface{}) error {
+	answer := reflect.New(reflect.TypeOf(reply).Elem())
+	call := client.Go("Plugin."+method, args, answer.Interface(), make(chan *rpc.Call, 1))
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		reflect.ValueOf(reply).Elem().Set(answer.Elem())
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: %s after %s", ErrTimeout, method, c.timeout)
+	}
+}
+
+// restart kills the plugin and starts it again, unless client is no longer
+// its connection because another call restarted it already.
+func (c *Client) restart(client *rpc.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rpc != client {
+		return nil
+	}
+	client.Close()
+	c.cmd.Process.Kill()
+	return c.start()
+}
+
+// Resolve resolves url with the plugin's Resolver.
+func (c *Client) Resolve(url string) (*resolver.Video, error) {
+	var reply ResolveReply
+	if err := c.call("Resolve", url, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	return reply.Video, nil
+}
+
+// Pick picks among candidates with the plugin's Selector, returning -1 for
+// none.
+func (c *Client) Pick(candidates []selector.Entry) (int, error) {
+	index := -1
+	err := c.call("Pick", candidates, &index)
+	if err == nil && index >= len(candidates) {
+		err = fmt.Errorf("plugin picked candidate %d of %d", index, len(candidates))
+	}
+	return index, err
+}
+
+// Check vets video with the plugin's ContentFilter.
+func (c *Client) Check(collection string, video *resolver.Video) (string, error) {
+	var reason string
+	err := c.call("Check", CheckArgs{Collection: collection, Video: video}, &reason)
+	return reason, err
+}
+
+// Notify delivers alert with the plugin's Notifier.
+func (c *Client) Notify(alert Alert) error {
+	var ok bool
+	return c.call("Notify", alert, &ok)
+}
+
+// Close stops the plugin.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.rpc.Close()
+	c.cmd.Process.Kill()
+	return err
+}
@@ -0,0 +1,190 @@
+// Package plugin runs shoti-srv extensions as separate executables, so
+// operators can add a resolver, a selection strategy, a content filter or
+// an alert notifier without forking the server. A plugin is a Go program
+// that implements any of the extension points and hands them to Serve:
+//
+//	func main() {
+//		plugin.Serve(plugin.Plugins{Resolver: myResolver{}})
+//	}
+//
+// The server starts every executable listed in PLUGINS and talks to it with
+// net/rpc over the plugin's stdin and stdout; whatever the plugin writes to
+// stderr ends up in the server log. A plugin that crashes is restarted on
+// the next call, and one that does not answer within the server's
+// PLUGIN_TIMEOUT is killed and restarted.
+//
+// This is the handshake, process management and RPC of hashicorp/go-plugin
+// cut down to what the extension points need, without its dependency on
+// gRPC and yamux: plugins are written against this package either way,
+// and its protocol is versioned by ProtocolVersion.
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+// ProtocolVersion changes whenever the RPC protocol does; the server only
+// talks to plugins built for the same version.
+const ProtocolVersion = 1
+
+// The server sets cookieEnv so a plugin run by hand can tell it is not
+// talking to shoti-srv.
+const (
+	cookieEnv   = "SHOTI_PLUGIN_COOKIE"
+	cookieValue = "8f0c1d5e-shoti-srv-plugin"
+)
+
+// Resolver resolves URLs instead of the built-in resolvers.
+type Resolver interface {
+	Resolve(url string) (*resolver.Video, error)
+}
+
+// Selector is a selection strategy usable as SELECTION_STRATEGY or in
+// SELECTION_STRATEGIES under its Name. Pick is given the entries that
+// passed the request's filters and returns the index of the chosen one, or
+// -1 to pick none.
+type Selector interface {
+	Name() string
+	Pick(candidates []selector.Entry) (int, error)
+}
+
+// ContentFilter vets a resolved video before it is served. Check returns
+// why the video must not be served in collection, or "" to allow it;
+// rejected videos are skipped like those rejected by the profanity filter.
+type ContentFilter interface {
+	Check(collection string, video *resolver.Video) (string, error)
+}
+
+// Notifier delivers operational alerts.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// Alert is an operational alert of the server.
+type Alert struct {
+	Kind    string
+	Message string
+	Level   string
+	Tags    map[string]string
+	Time    time.Time
+}
+
+// Plugins are the extension points a plugin implements; nil ones are not
+// offered.
+type Plugins struct {
+	Resolver      Resolver
+	Selector      Selector
+	ContentFilter ContentFilter
+	Notifier      Notifier
+}
+
+// Info describes what a plugin offers.
+type Info struct {
+	Version       int
+	Resolver      bool
+	Selector      string
+	ContentFilter bool
+	Notifier      bool
+}
+
+// Serve serves p to the server that started this process until the server
+// goes away. It exits when the process was not started by shoti-srv.
+func Serve(p Plugins) {
+	if os.Getenv(cookieEnv) != cookieValue {
+		fmt.Fprintln(os.Stderr, "This is a shoti-srv plugin; list it in the server's PLUGINS setting instead of running it directly.")
+		os.Exit(1)
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &service{p}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	server.ServeConn(stdio{})
+}
+
+// stdio is the connection of a plugin to the server.
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error                { return errors.Join(os.Stdin.Close(), os.Stdout.Close()) }
+
+// service exposes Plugins over RPC.
+type service struct {
+	p Plugins
+}
+
+var errNotOffered = errors.New("the plugin does not offer this extension point")
+
+func (s *service) Info(_ int, info *Info) error {
+	*info = Info{
+		Version:       ProtocolVersion,
+		Resolver:      s.p.Resolver != nil,
+		ContentFilter: s.p.ContentFilter != nil,
+		Notifier:      s.p.Notifier != nil,
+	}
+	if s.p.Selector != nil {
+		info.Selector = s.p.Selector.Name()
+	}
+	return nil
+}
+
+// ResolveReply carries provider errors separately so their kind survives
+// the trip.
+type ResolveReply struct {
+	Video *resolver.Video
+	Error *resolver.Error
+}
+
+func (s *service) Resolve(url string, reply *ResolveReply) error {
+	if s.p.Resolver == nil {
+		return errNotOffered
+	}
+	video, err := s.p.Resolver.Resolve(url)
+	var pe *resolver.Error
+	if errors.As(err, &pe) {
+		reply.Error = pe
+		return nil
+	}
+	reply.Video = video
+	return err
+}
+
+func (s *service) Pick(candidates []selector.Entry, index *int) error {
+	if s.p.Selector == nil {
+		return errNotOffered
+	}
+	var err error
+	*index, err = s.p.Selector.Pick(candidates)
+	return err
+}
+
+// CheckArgs are the arguments of ContentFilter.Check.
+type CheckArgs struct {
+	Collection string
+	Video      *resolver.Video
+}
+
+func (s *service) Check(args CheckArgs, reason *string) error {
+	if s.p.ContentFilter == nil {
+		return errNotOffered
+	}
+	var err error
+	*reason, err = s.p.ContentFilter.Check(args.Collection, args.Video)
+	return err
+}
+
+func (s *service) Notify(alert Alert, _ *bool) error {
+	if s.p.Notifier == nil {
+		return errNotOffered
+	}
+	return s.p.Notifier.Notify(alert)
+}
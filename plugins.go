@@ -0,0 +1,129 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/plugin"
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+// PLUGINS lists plugin executables (see the plugin package), separated by
+// commas, each with its arguments separated by spaces. A plugin's resolver
+// replaces RESOLVER_URL and RESOLVER_COMMAND (the first plugin offering one
+// wins), its selector becomes a strategy named as the plugin chooses, its
+// content filter vets every video before it is served and its notifier
+// receives every alert. Calls taking longer than PLUGIN_TIMEOUT fail.
+//
+// Content filters fail closed like the policy (see policy.go): a filter
+// that fails or times out rejects the video, since letting it through
+// would serve what the filter was installed to keep out.
+
+var (
+	plugins            []*plugin.Client
+	pluginResolver     *plugin.Client
+	contentFilters     []*plugin.Client
+	pluginFilterErrors = expvar.NewInt("plugin_filter_errors")
+)
+
+func loadPlugins() error {
+	for _, command := range strings.Split(os.Getenv("PLUGINS"), ",") {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			continue
+		}
+		p, err := plugin.Start(args, log.Writer(), envDuration("PLUGIN_TIMEOUT", 5*time.Second))
+		if err != nil {
+			return err
+		}
+		plugins = append(plugins, p)
+
+		info := p.Info()
+		var offers []string
+		if info.Resolver && pluginResolver == nil {
+			pluginResolver = p
+			offers = append(offers, "resolver")
+		}
+		if info.Selector != "" {
+			if _, exists := selectors[info.Selector]; exists {
+				return fmt.Errorf("plugin %s: selection strategy %q already exists", p, info.Selector)
+			}
+			selectors[info.Selector] = pluginSelector{name: info.Selector, plugin: p}
+			offers = append(offers, "selector "+info.Selector)
+		}
+		if info.ContentFilter {
+			contentFilters = append(contentFilters, p)
+			offers = append(offers, "content filter")
+		}
+		if info.Notifier {
+			notifiers = append(notifiers, pluginNotifier{p})
+			offers = append(offers, "notifier")
+		}
+		log.Printf("Loaded plugin %s offering %s.\n", p, strings.Join(offers, ", "))
+	}
+	return nil
+}
+
+// pluginSelector asks a plugin to pick among the matching entries. It falls
+// back to a uniform pick when the plugin fails, so a broken plugin degrades
+// selection rather than failing every request. As a remoteSelector it is
+// given a copy of the matching entries and runs without the index's lock,
+// so a slow plugin delays only its own requests.
+type pluginSelector struct {
+	name   string
+	plugin *plugin.Client
+}
+
+func (s pluginSelector) Name() string { return s.name }
+
+func (pluginSelector) remote() {}
+
+func (s pluginSelector) Select(entries []catalogEntry, match func(catalogEntry) bool) (catalogEntry, bool) {
+	candidates := entries
+	if match != nil {
+		candidates = selector.Filter(append([]catalogEntry(nil), entries...), match)
+	}
+	if len(candidates) == 0 {
+		return catalogEntry{}, false
+	}
+
+	i, err := s.plugin.Pick(candidates)
+	if err != nil {
+		log.Printf("Error picking with plugin %s: %v\n", s.plugin, err)
+		return selector.Uniform{}.Select(candidates, nil)
+	}
+	if i < 0 {
+		return catalogEntry{}, false
+	}
+	return candidates[i], true
+}
+
+// rejectedByPlugins reports whether a plugin content filter rejects video
+// in collection. A filter that fails rejects the video.
+func rejectedByPlugins(collection string, video *Video) bool {
+	for _, p := range contentFilters {
+		reason, err := p.Check(collection, video)
+		if err != nil {
+			pluginFilterErrors.Add(1)
+			log.Printf("Error checking %s with plugin %s, rejecting it: %v\n", video.ID, p, err)
+			return true
+		}
+		if reason != "" {
+			log.Printf("Plugin %s rejected %s: %s\n", p, video.ID, reason)
+			return true
+		}
+	}
+	return false
+}
+
+type pluginNotifier struct {
+	plugin *plugin.Client
+}
+
+func (n pluginNotifier) Notify(alert Alert) error {
+	return n.plugin.Notify(plugin.Alert{Kind: alert.Kind, Message: alert.Message, Level: alert.Level, Tags: alert.Tags, Time: alert.Time})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.starlark.net/lib/json"
+	starlarktime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// POLICY_FILE holds a serve-time policy for rules the settings cannot
+// express, written in Starlark (a Python dialect made for embedding, with
+// no access to the file system or network). It defines
+// policy(request, video), called for every video about to be served: a
+// string rejects the video and is logged as the reason, anything falsy
+// serves it, and a rejected video is skipped like one rejected by the
+// profanity filter. For example, to keep short videos away from one key
+// during office hours:
+//
+//	def policy(request, video):
+//	    if request.key == "bot-key" and video.duration < 5 and in_window(request.now, "09:00", "17:00"):
+//	        return "too short for office hours"
+//
+// request has key (the caller's API key when it is an issued or
+// tier-assigned one, "" otherwise), collection, country, query (the first
+// value of each query parameter) and now, a time in POLICY_TIMEZONE (UTC
+// by default). video has the fields of the served video plus its url,
+// collection, hashtags and weight. The json and time modules are
+// predeclared.
+//
+// The file is re-read when it changes, every POLICY_RELOAD_INTERVAL; a
+// policy that fails to load keeps the previous one in force. A call that
+// fails, including one running past POLICY_MAX_STEPS, rejects the video:
+// a broken rule must not let through what it was written to keep out.
+
+var policyPredeclared = starlark.StringDict{
+	"json":      json.Module,
+	"time":      starlarktime.Module,
+	"in_window": starlark.NewBuiltin("in_window", policyInWindow),
+}
+
+// policyInWindow implements in_window(t, from, to), whether t's time of day
+// is within from and to, as "15:04"; windows may wrap past midnight.
+func policyInWindow(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var t starlarktime.Time
+	var from, to string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 3, &t, &from, &to); err != nil {
+		return nil, err
+	}
+	start, err := time.Parse("15:04", from)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	end, err := time.Parse("15:04", to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	now := time.Time(t)
+	minute := now.Hour()*60 + now.Minute()
+	lo, hi := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if lo <= hi {
+		return starlark.Bool(minute >= lo && minute < hi), nil
+	}
+	return starlark.Bool(minute >= lo || minute < hi), nil
+}
+
+var (
+	policy struct {
+		mu       sync.RWMutex
+		fn       starlark.Callable
+		modified time.Time
+		location *time.Location
+	}
+	policyRejections = expvar.NewInt("policy_rejections")
+	policyErrors     = expvar.NewInt("policy_errors")
+)
+
+// loadPolicy (re)reads POLICY_FILE when it changed since the last load.
+func loadPolicy() error {
+	path := os.Getenv("POLICY_FILE")
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error reading policy: %w", err)
+	}
+
+	policy.mu.RLock()
+	unchanged := info.ModTime().Equal(policy.modified)
+	policy.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading policy: %w", err)
+	}
+	thread := &starlark.Thread{Name: "policy-load", Print: policyPrint}
+	thread.SetMaxExecutionSteps(uint64(envInt("POLICY_MAX_STEPS", 100000)))
+	// The globals are frozen once the file has run, so policy can be
+	// called from many requests at once.
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, source, policyPredeclared)
+	if err != nil {
+		return fmt.Errorf("error loading policy: %w", err)
+	}
+	fn, ok := globals["policy"].(starlark.Callable)
+	if !ok {
+		return fmt.Errorf("error loading policy: %s does not define policy(request, video)", path)
+	}
+	location := time.UTC
+	if name := os.Getenv("POLICY_TIMEZONE"); name != "" {
+		if location, err = time.LoadLocation(name); err != nil {
+			return fmt.Errorf("invalid POLICY_TIMEZONE: %w", err)
+		}
+	}
+
+	policy.mu.Lock()
+	loaded := policy.fn != nil
+	policy.fn, policy.modified, policy.location = fn, info.ModTime(), location
+	policy.mu.Unlock()
+	if loaded {
+		log.Printf("Reloaded policy from %s.\n", path)
+	}
+	return nil
+}
+
+// policyPrint sends print() in the policy to the log.
+func policyPrint(_ *starlark.Thread, msg string) {
+	log.Printf("Policy: %s\n", msg)
+}
+
+// rejectedByPolicy reports whether the policy rejects serving video from
+// entry for r.
+func rejectedByPolicy(r *http.Request, entry catalogEntry, video *Video) bool {
+	policy.mu.RLock()
+	fn, location := policy.fn, policy.location
+	policy.mu.RUnlock()
+	if fn == nil {
+		return false
+	}
+
+	thread := &starlark.Thread{Name: "policy", Print: policyPrint}
+	thread.SetMaxExecutionSteps(uint64(envInt("POLICY_MAX_STEPS", 100000)))
+	result, err := starlark.Call(thread, fn, starlark.Tuple{
+		policyRequest(r, entry, location),
+		policyVideo(entry, video),
+	}, nil)
+
+	var reason string
+	switch v := result.(type) {
+	case nil:
+	case starlark.String:
+		reason = string(v)
+	default:
+		if v.Truth() {
+			err = fmt.Errorf("policy returned %s, not a string or None", v.Type())
+		}
+	}
+	if err != nil {
+		policyErrors.Add(1)
+		log.Printf("Error executing policy for %s, rejecting it: %v\n", entry.ID, err)
+		return true
+	}
+	if reason == "" {
+		return false
+	}
+	policyRejections.Add(1)
+	log.Printf("Policy rejected %s: %s\n", entry.ID, reason)
+	return true
+}
+
+func policyRequest(r *http.Request, entry catalogEntry, location *time.Location) starlark.Value {
+	query := starlark.NewDict(len(r.URL.Query()))
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query.SetKey(starlark.String(name), starlark.String(values[0]))
+		}
+	}
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"key":        starlark.String(verifiedKey(r)),
+		"collection": starlark.String(entry.Collection),
+		"country":    starlark.String(requestCountry(r)),
+		"query":      query,
+		"now":        starlarktime.Time(time.Now().In(location)),
+	})
+}
+
+func policyVideo(entry catalogEntry, video *Video) starlark.Value {
+	hashtags := make([]starlark.Value, len(entry.Hashtags))
+	for i, tag := range entry.Hashtags {
+		hashtags[i] = starlark.String(tag)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("video"), starlark.StringDict{
+		"id":         starlark.String(entry.ID),
+		"url":        starlark.String(entry.URL),
+		"collection": starlark.String(entry.Collection),
+		"video_id":   starlark.String(video.ID),
+		"provider":   starlark.String(video.Provider),
+		"region":     starlark.String(video.Region),
+		"title":      starlark.String(video.Title),
+		"duration":   starlark.MakeInt(video.Duration),
+		"created_at": starlark.MakeInt64(video.CreatedAt),
+		"hashtags":   starlark.NewList(hashtags),
+		"weight":     starlark.Float(entry.Weight),
+		"author": starlarkstruct.FromStringDict(starlark.String("author"), starlark.StringDict{
+			"id":       starlark.String(video.Author.ID),
+			"username": starlark.String(video.Author.Username),
+			"nickname": starlark.String(video.Author.Nickname),
+		}),
+		"music": starlarkstruct.FromStringDict(starlark.String("music"), starlark.StringDict{
+			"id":    starlark.String(video.Music.ID),
+			"title": starlark.String(video.Music.Title),
+		}),
+		"stats": starlarkstruct.FromStringDict(starlark.String("stats"), starlark.StringDict{
+			"plays":    starlark.MakeInt64(video.Stats.Plays),
+			"likes":    starlark.MakeInt64(video.Stats.Likes),
+			"comments": starlark.MakeInt64(video.Stats.Comments),
+			"shares":   starlark.MakeInt64(video.Stats.Shares),
+		}),
+	})
+}
+
+func init() {
+	schedule("policy-reload", "POLICY_RELOAD_INTERVAL", 10*time.Second, loadPolicy)
+}
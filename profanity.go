@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// PROFANITY_FILE enables a wordlist filter on served titles, for example:
+//
+//	{
+//	  "default": {"mode": "mask", "words": ["damn"]},
+//	  "collections": {"kids": {"mode": "reject", "words_file": "/etc/shoti/kids.txt"}}
+//	}
+//
+// "mask" replaces listed words with asterisks; "reject" skips videos whose
+// title contains one and picks another (the daily video, which cannot be
+// re-picked, is masked instead). Words match case-insensitively as whole
+// words. words_file holds one word per line; # starts a comment. A
+// collection's filter replaces the default filter.
+type profanityFilter struct {
+	Mode      string   `json:"mode"`
+	Words     []string `json:"words"`
+	WordsFile string   `json:"words_file"`
+
+	words map[string]bool
+}
+
+type profanityConfig struct {
+	Default     *profanityFilter            `json:"default"`
+	Collections map[string]*profanityFilter `json:"collections"`
+}
+
+var (
+	profanityFilters profanityConfig
+	profanityHits    = expvar.NewMap("profanity_hits")
+)
+
+func loadProfanityFilters() error {
+	path := os.Getenv("PROFANITY_FILE")
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading profanity filters: %w", err)
+	}
+	var config profanityConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("error decoding profanity filters: %w", err)
+	}
+
+	if config.Default != nil {
+		if err := config.Default.load("default"); err != nil {
+			return err
+		}
+	}
+	for name, f := range config.Collections {
+		if err := f.load("collection " + name); err != nil {
+			return err
+		}
+	}
+
+	profanityFilters = config
+	return nil
+}
+
+func (f *profanityFilter) load(name string) error {
+	if f.Mode == "" {
+		f.Mode = "mask"
+	}
+	if f.Mode != "mask" && f.Mode != "reject" {
+		return fmt.Errorf("profanity filter %s: mode must be mask or reject, not %q", name, f.Mode)
+	}
+
+	words := f.Words
+	if f.WordsFile != "" {
+		file, err := os.Open(f.WordsFile)
+		if err != nil {
+			return fmt.Errorf("error reading wordlist of %s: %w", name, err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			words = append(words, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading wordlist of %s: %w", name, err)
+		}
+	}
+
+	f.words = make(map[string]bool, len(words))
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			f.words[word] = true
+		}
+	}
+	return nil
+}
+
+func profanityFilterFor(collection string) *profanityFilter {
+	if f, ok := profanityFilters.Collections[collection]; ok {
+		return f
+	}
+	return profanityFilters.Default
+}
+
+// rejectsTitle reports whether the filter of collection skips title.
+func rejectsTitle(collection, title string) bool {
+	f := profanityFilterFor(collection)
+	if f == nil || f.Mode != "reject" {
+		return false
+	}
+	_, found := f.mask(title)
+	if found {
+		profanityHits.Add("rejected", 1)
+	}
+	return found
+}
+
+// maskTitle masks the listed words of the filter of collection in title.
+func maskTitle(collection, title string) string {
+	f := profanityFilterFor(collection)
+	if f == nil {
+		return title
+	}
+	masked, found := f.mask(title)
+	if found {
+		profanityHits.Add("masked", 1)
+	}
+	return masked
+}
+
+// mask replaces every listed word in title with asterisks and reports
+// whether there was any.
+func (f *profanityFilter) mask(title string) (string, bool) {
+	var (
+		b     strings.Builder
+		found bool
+	)
+	word := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+	runes := []rune(title)
+	for i := 0; i < len(runes); {
+		if !word(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && word(runes[j]) {
+			j++
+		}
+		if f.words[strings.ToLower(string(runes[i:j]))] {
+			b.WriteString(strings.Repeat("*", j-i))
+			found = true
+		} else {
+			b.WriteString(string(runes[i:j]))
+		}
+		i = j
+	}
+	return b.String(), found
+}
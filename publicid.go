@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Public ids: links handed out by the API (media, /watch/{id} and
+// /api/thumb/{id}) name videos by their TikTok video id rather than the
+// URL's internal UUID, so they stay valid when the catalog is re-imported
+// or moved to another instance, where the same video gets a new UUID.
+// Links with UUIDs made before keep working.
+
+var tiktokVideoIDPattern = regexp.MustCompile(`/video/(\d+)`)
+
+// publicID returns the id links to entry use: the id of its resolved video
+// (when known), the video id in its URL, or its UUID as a last resort.
+func publicID(entry catalogEntry, video *Video) string {
+	if video != nil && video.ID != "" {
+		return video.ID
+	}
+	if entry.VideoID != "" {
+		return entry.VideoID
+	}
+	if m := tiktokVideoIDPattern.FindStringSubmatch(entry.URL); m != nil {
+		return m[1]
+	}
+	return entry.ID
+}
+
+// entryByPublicID returns the active entry a public id or UUID names, or
+// sql.ErrNoRows.
+func entryByPublicID(id string) (catalogEntry, error) {
+	if _, err := uuid.Parse(id); err == nil {
+		return activeEntryByID(id)
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return catalogEntry{}, sql.ErrNoRows
+		}
+	}
+
+	// The index also knows videos whose id is only in their URL so far,
+	// such as one served moments ago whose resolution is still being
+	// recorded.
+	e, found, loaded := index.find(func(e catalogEntry) bool {
+		if e.VideoID != "" {
+			return e.VideoID == id
+		}
+		return strings.Contains(e.URL, "/video/"+id) && publicID(e, nil) == id
+	})
+	if found {
+		return e, nil
+	}
+	if loaded || degraded.Load() {
+		return catalogEntry{}, sql.ErrNoRows
+	}
+	return catalog.EntryByVideo(id)
+}
+
+// watchVideo redirects /watch/{id} to the video on TikTok.
+func watchVideo(w http.ResponseWriter, r *http.Request) {
+	entry, ok := publicIDEntry(w, r, "/watch/")
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, entry.URL, http.StatusFound)
+}
+
+// serveThumb serves the cover of /api/thumb/{id}: through the media proxy
+// when enabled, by redirecting to the upstream cover otherwise.
+func serveThumb(w http.ResponseWriter, r *http.Request) {
+	if mediaProxyEnabled() {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/thumb/"), "/")
+		r.URL.Path = "/api/media/" + id + "/cover"
+		serveMedia(w, r)
+		return
+	}
+	entry, ok := publicIDEntry(w, r, "/api/thumb/")
+	if !ok {
+		return
+	}
+	video, err := videoCache.get(entry.URL)
+	if err != nil {
+		log.Printf("Error resolving %s: %v\n", entry.URL, err)
+		writeUpstreamError(w, err)
+		return
+	}
+	if video.Cover == "" {
+		writeError(w, http.StatusNotFound, "no such media for this video")
+		return
+	}
+	http.Redirect(w, r, video.Cover, http.StatusFound)
+}
+
+// publicIDEntry looks up the entry named by the id after prefix in the
+// request path, writing the error response when there is none.
+func publicIDEntry(w http.ResponseWriter, r *http.Request, prefix string) (catalogEntry, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return catalogEntry{}, false
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return catalogEntry{}, false
+	}
+	entry, err := entryByPublicID(id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "video not found")
+		return catalogEntry{}, false
+	}
+	if err != nil {
+		log.Printf("Error looking up %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return catalogEntry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// purgeRequest identifies whose data to delete: everything tied to an API
+// key, or only one end user's favorites when User is also given.
+// Submissions are deleted unless KeepSubmissions is set, in which case they
+// stay in the catalog with the submitter removed.
+type purgeRequest struct {
+	APIKey          string `json:"api_key"`
+	User            string `json:"user"`
+	KeepSubmissions bool   `json:"keep_submissions"`
+}
+
+// purgeResult counts the rows removed per kind of data; it is also what the
+// tombstone records.
+type purgeResult struct {
+	TombstoneID           string `json:"tombstone_id"`
+	Favorites             int64  `json:"favorites"`
+	Reports               int64  `json:"reports"`
+	Submissions           int64  `json:"submissions"`
+	AnonymizedSubmissions int64  `json:"anonymized_submissions"`
+	// Jobs are the asynchronous submissions (see submissions.go) the
+	// subject made, deleted or anonymized like the URLs they added.
+	Jobs           int64 `json:"jobs"`
+	AnonymizedJobs int64 `json:"anonymized_jobs"`
+}
+
+var errNoSubject = errors.New("api_key is required")
+
+// purgeSubject deletes the subject's data and leaves a tombstone holding
+// only a hash of the subject, so a deletion can be proven later (and
+// backups restored afterwards can be re-purged) without keeping the
+// identifier itself. Favorites, reports and submitted URLs live in the
+// shard of their URL, so each shard is purged in its own transaction and
+// the tombstone is recorded once all have committed; a purge that fails
+// part way can simply be run again.
+func purgeSubject(req purgeRequest) (purgeResult, error) {
+	var result purgeResult
+	if req.APIKey == "" {
+		return result, errNoSubject
+	}
+
+	for _, conn := range catalog.DBs() {
+		counts, err := purgeShard(conn, req)
+		if err != nil {
+			return result, err
+		}
+		result.Favorites += counts.Favorites
+		result.Reports += counts.Reports
+		result.Submissions += counts.Submissions
+		result.AnonymizedSubmissions += counts.AnonymizedSubmissions
+	}
+	if err := purgeJobs(req, &result); err != nil {
+		return result, err
+	}
+
+	result.TombstoneID = uuid.New().String()
+	deleted, _ := json.Marshal(result)
+	_, err := db.Exec(
+		"INSERT INTO deletion_tombstones (id, subject_hash, deleted) VALUES ($1, $2, $3)",
+		result.TombstoneID, subjectHash(req), deleted,
+	)
+	if err != nil {
+		return result, fmt.Errorf("error recording tombstone: %w", err)
+	}
+	return result, nil
+}
+
+// purgeShard deletes the subject's data in conn in one transaction and
+// returns what it deleted.
+func purgeShard(conn *sql.DB, req purgeRequest) (purgeResult, error) {
+	var result purgeResult
+	submitter := keySubmitterID(req.APIKey)
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	exec := func(target *int64, query string, args ...interface{}) error {
+		if err != nil {
+			return err
+		}
+		res, execErr := tx.Exec(query, args...)
+		if execErr != nil {
+			err = fmt.Errorf("error purging subject data: %w", execErr)
+			return err
+		}
+		*target, _ = res.RowsAffected()
+		return nil
+	}
+
+	if req.User != "" {
+		exec(&result.Favorites, "DELETE FROM favorites WHERE api_key = $1 AND user_id = $2", keyHash(req.APIKey), req.User)
+	} else {
+		exec(&result.Favorites, "DELETE FROM favorites WHERE api_key = $1", keyHash(req.APIKey))
+		exec(&result.Reports, "DELETE FROM reports WHERE reporter = $1", submitter)
+		if req.KeepSubmissions {
+			exec(&result.AnonymizedSubmissions, "UPDATE urls SET submitted_by = NULL WHERE submitted_by = $1", submitter)
+		} else {
+			exec(&result.Submissions, "DELETE FROM urls WHERE submitted_by = $1", submitter)
+		}
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// purgeJobs deletes the asynchronous submissions of the subject, which are
+// kept in the DB_* database, or removes the submitter from them.
+func purgeJobs(req purgeRequest, result *purgeResult) error {
+	if req.User != "" {
+		return nil
+	}
+	submitter := keySubmitterID(req.APIKey)
+	query, target := "DELETE FROM submissions WHERE submitted_by = $1", &result.Jobs
+	if req.KeepSubmissions {
+		query, target = "UPDATE submissions SET submitted_by = '' WHERE submitted_by = $1", &result.AnonymizedJobs
+	}
+	res, err := db.Exec(query, submitter)
+	if err != nil {
+		return fmt.Errorf("error purging subject data: %w", err)
+	}
+	*target, _ = res.RowsAffected()
+	return nil
+}
+
+func subjectHash(req purgeRequest) string {
+	sum := sha256.Sum256([]byte(req.APIKey + "\x00" + req.User))
+	return hex.EncodeToString(sum[:])
+}
+
+// adminPurgeSubject handles POST /api/admin/purge for data deletion
+// requests.
+func adminPurgeSubject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+
+	result, err := purgeSubject(req)
+	if err == errNoSubject {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	log.Printf("Purged data for a subject, tombstone %s.\n", result.TombstoneID)
+	writeJSON(w, http.StatusOK, result)
+}
+
+func purgeCommand(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	var req purgeRequest
+	fs.StringVar(&req.APIKey, "api-key", "", "API key whose data is deleted")
+	fs.StringVar(&req.User, "user", "", "only delete this end user's favorites under the key")
+	fs.BoolVar(&req.KeepSubmissions, "keep-submissions", false, "keep submitted URLs, removing only the submitter")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	initDB()
+
+	result, err := purgeSubject(req)
+	if err != nil {
+		return err
+	}
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func init() {
+	commands["purge"] = command{
+		Summary: "delete all data tied to an API key or end user",
+		Run:     purgeCommand,
+	}
+}
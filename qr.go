@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// QR codes: GET /api/qr/{id} answers a PNG QR code of the /watch/ link of
+// a video, for stream overlays and print. scale sets the pixels per module
+// (8 by default) and level the error correction, L, M (the default), Q or
+// H; higher levels survive more damage, such as a logo over the code. The
+// most recent QR_CACHE_SIZE images are kept in memory; they never change,
+// so CDNs may keep them too.
+
+const qrQuietZone = 4
+
+type qrCacheEntry struct {
+	key string
+	png []byte
+}
+
+var qrCache = struct {
+	mu      sync.Mutex
+	lru     *list.List // of *qrCacheEntry, most recently used first
+	entries map[string]*list.Element
+}{lru: list.New(), entries: make(map[string]*list.Element)}
+
+// serveQR handles GET /api/qr/{id}.
+func serveQR(w http.ResponseWriter, r *http.Request) {
+	entry, ok := publicIDEntry(w, r, "/api/qr/")
+	if !ok {
+		return
+	}
+	scale, err := queryInt(r.URL.Query().Get("scale"), 8, 1, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "scale must be between 1 and 32")
+		return
+	}
+	name := r.URL.Query().Get("level")
+	if name == "" {
+		name = "M"
+	}
+	level, ok := qrLevelNames[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "level must be L, M, Q or H")
+		return
+	}
+
+	link := publicBaseURL(r) + "/watch/" + publicID(entry, nil)
+	key := strconv.Itoa(scale) + " " + name + " " + link
+	body, ok := cachedQR(key)
+	if !ok {
+		if body, err = renderQR(link, level, scale); err != nil {
+			log.Printf("Error rendering QR code of %s: %v\n", link, err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		cacheQR(key, body)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+var qrLevelNames = map[string]qrLevel{"L": qrLevelL, "M": qrLevelM, "Q": qrLevelQ, "H": qrLevelH}
+
+// renderQR encodes text as a PNG QR code at level with scale pixels per
+// module.
+func renderQR(text string, level qrLevel, scale int) ([]byte, error) {
+	q, err := encodeQR(text, level)
+	if err != nil {
+		return nil, err
+	}
+	side := (q.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				row := img.Pix[((y+qrQuietZone)*scale+dy)*img.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					row[(x+qrQuietZone)*scale+dx] = 1
+				}
+			}
+		}
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func cachedQR(key string) ([]byte, bool) {
+	qrCache.mu.Lock()
+	defer qrCache.mu.Unlock()
+	el, ok := qrCache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	qrCache.lru.MoveToFront(el)
+	return el.Value.(*qrCacheEntry).png, true
+}
+
+func cacheQR(key string, body []byte) {
+	qrCache.mu.Lock()
+	defer qrCache.mu.Unlock()
+	if _, ok := qrCache.entries[key]; ok {
+		return
+	}
+	qrCache.entries[key] = qrCache.lru.PushFront(&qrCacheEntry{key: key, png: body})
+	for qrCache.lru.Len() > envInt("QR_CACHE_SIZE", 1000) {
+		oldest := qrCache.lru.Remove(qrCache.lru.Back()).(*qrCacheEntry)
+		delete(qrCache.entries, oldest.key)
+	}
+}
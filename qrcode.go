@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+)
+
+// A QR code encoder for the short links /api/qr serves: byte mode, any
+// error correction level, versions 1 to 10 (up to 271 bytes at level L),
+// following ISO/IEC 18004. The mask is chosen by the standard's penalty
+// rules.
+
+// qrLevel is an error correction level; L, M, Q and H recover about 7%,
+// 15%, 25% and 30% of the codewords.
+type qrLevel int
+
+const (
+	qrLevelL qrLevel = iota
+	qrLevelM
+	qrLevelQ
+	qrLevelH
+)
+
+// qrFormatLevels are the bits of each level in the format information.
+var qrFormatLevels = [...]int{qrLevelL: 0b01, qrLevelM: 0b00, qrLevelQ: 0b11, qrLevelH: 0b10}
+
+// qrVersion is the layout and error correction of a version at a level.
+type qrVersion struct {
+	codewords int   // raw codewords, data and error correction
+	ecc       int   // error correction codewords per block
+	blocks    int   // Reed-Solomon blocks
+	align     []int // alignment pattern centers
+}
+
+// qrVersions are the raw codewords and alignment patterns of each version,
+// and qrECC and qrBlocks its error correction per level.
+var qrVersions = []struct {
+	codewords int
+	align     []int
+}{
+	1:  {26, nil},
+	2:  {44, []int{6, 18}},
+	3:  {70, []int{6, 22}},
+	4:  {100, []int{6, 26}},
+	5:  {134, []int{6, 30}},
+	6:  {172, []int{6, 34}},
+	7:  {196, []int{6, 22, 38}},
+	8:  {242, []int{6, 24, 42}},
+	9:  {292, []int{6, 26, 46}},
+	10: {346, []int{6, 28, 50}},
+}
+
+var (
+	qrECC = [...][11]int{
+		qrLevelL: {0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18},
+		qrLevelM: {0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26},
+		qrLevelQ: {0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24},
+		qrLevelH: {0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28},
+	}
+	qrBlocks = [...][11]int{
+		qrLevelL: {0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4},
+		qrLevelM: {0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5},
+		qrLevelQ: {0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8},
+		qrLevelH: {0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8},
+	}
+)
+
+// qrVersionAt returns the layout of version at level.
+func qrVersionAt(version int, level qrLevel) qrVersion {
+	return qrVersion{
+		codewords: qrVersions[version].codewords,
+		ecc:       qrECC[level][version],
+		blocks:    qrBlocks[level][version],
+		align:     qrVersions[version].align,
+	}
+}
+
+var errQRTooLong = errors.New("text too long for a QR code")
+
+// qrCode is a square of modules, true for dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR returns the smallest QR code holding text at level.
+func encodeQR(text string, level qrLevel) (*qrCode, error) {
+	q, err := unmaskedQR(text, level)
+	if err != nil {
+		return nil, err
+	}
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(level, best)
+	return q, nil
+}
+
+// unmaskedQR returns the smallest QR code holding text at level, with its
+// data not masked yet.
+func unmaskedQR(text string, level qrLevel) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		if 4+qrCountBits(v)+8*len(data) <= 8*qrVersionAt(v, level).dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	info := qrVersionAt(version, level)
+
+	// Byte mode, the length, the data, a terminator and padding.
+	var bits qrBits
+	bits.append(0b0100, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * info.dataCodewords()
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	q := &qrCode{size: version*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(info.interleave(codewords))
+	return q, nil
+}
+
+func (v qrVersion) dataCodewords() int {
+	return v.codewords - v.ecc*v.blocks
+}
+
+// qrCountBits is the width of the length field of byte mode.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+// interleave splits data into blocks, adds their error correction and
+// interleaves them. The first blocks may be one codeword shorter.
+func (v qrVersion) interleave(data []byte) []byte {
+	short := v.blocks - v.codewords%v.blocks
+	shortLen := v.codewords / v.blocks
+	divisor := reedSolomonDivisor(v.ecc)
+
+	blocks := make([][]byte, v.blocks)
+	k := 0
+	for i := range blocks {
+		n := shortLen - v.ecc
+		if i >= short {
+			n++
+		}
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+		ecc := reedSolomonRemainder(block, divisor)
+		if i < short {
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	var out []byte
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			// Skip the padding of short blocks.
+			if i != shortLen-v.ecc || j >= short {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+func reedSolomonDivisor(degree int) []byte {
+	divisor := make([]byte, degree)
+	divisor[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range divisor {
+			divisor[j] = gfMultiply(divisor[j], root)
+			if j+1 < degree {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+	return divisor
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	remainder := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[len(remainder)-1] = 0
+		for i, d := range divisor {
+			remainder[i] ^= gfMultiply(d, factor)
+		}
+	}
+	return remainder
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	align := qrVersions[version].align
+	last := len(align) - 1
+	for i, cx := range align {
+		for j, cy := range align {
+			// The corners with finder patterns get none.
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas; the bits are drawn with the mask.
+	q.drawFormatBits(qrLevelM, 0)
+
+	if version >= 7 {
+		bits := qrVersionBits(version)
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormatBits draws the error correction level and mask, twice.
+func (q *qrCode) drawFormatBits(level qrLevel, mask int) {
+	bits := qrFormatBits(level, mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// qrFormatBits returns the 15 format bits of level and mask: 5 data bits
+// and a BCH(15,5) code, masked with 0x5412.
+func qrFormatBits(level qrLevel, mask int) int {
+	data := qrFormatLevels[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// qrVersionBits returns the 18 version bits of versions 7 and up: 6 data
+// bits and a BCH(18,6) code.
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+// drawCodewords fills the non-function modules in the zigzag order of the
+// standard, two columns at a time from the bottom right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by mask; applying it twice
+// undoes it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read: long runs of one color,
+// 2×2 blocks, patterns that look like finders and an unbalanced count of
+// dark modules.
+func (q *qrCode) penalty() int {
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+
+	penalty := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// A finder-like 1:1:3:1:1 pattern with four light modules
+			// on either side; outside the code counts as light.
+			light := func(x int) bool { return x < 0 || x >= q.size || !at(x, y, transpose) }
+			for x := 0; x+len(finder) <= q.size; x++ {
+				match := true
+				for i, dark := range finder {
+					if at(x+i, y, transpose) != dark {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				before, after := true, true
+				for i := 1; i <= 4; i++ {
+					before = before && light(x-i)
+					after = after && light(x+len(finder)-1+i)
+				}
+				if before || after {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	penalty += 10 * (abs(dark*20-total*10) / total)
+	return penalty
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
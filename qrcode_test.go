@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestQRKnownAnswers compares codes with the module matrices under
+// testdata/qr, made by an independent encoder (github.com/boombuler/barcode)
+// and named after their version, level and mask. Encoders may pick
+// different masks, so each code is masked like its reference.
+func TestQRKnownAnswers(t *testing.T) {
+	links := func(host string, n int) string { return strings.Repeat("https://"+host+".example/watch/x", n) }
+	cases := []struct {
+		text    string
+		level   qrLevel
+		version int
+		mask    int
+		golden  string
+	}{
+		{"shoti.example", qrLevelL, 1, 7, "v1-L-mask7.txt"},
+		{links("a", 3), qrLevelL, 4, 7, "v4-L-mask7.txt"},
+		{links("a", 8), qrLevelL, 9, 2, "v9-L-mask2.txt"},
+		{"https://shoti.example/w", qrLevelM, 2, 6, "v2-M-mask6.txt"},
+		{"https://shoti.example/watch/abc", qrLevelM, 3, 0, "v3-M-mask0.txt"},
+		{links("a", 3), qrLevelM, 5, 2, "v5-M-mask2.txt"},
+		{strings.Repeat("https://b.example/watch/y", 4) + "0123456789abcde", qrLevelM, 7, 6, "v7-M-mask6.txt"},
+		{links("a", 8), qrLevelM, 10, 1, "v10-M-mask1.txt"},
+		{"https://shoti.example/w", qrLevelQ, 3, 6, "v3-Q-mask6.txt"},
+		{links("a", 4), qrLevelQ, 8, 0, "v8-Q-mask0.txt"},
+		{links("a", 6), qrLevelQ, 10, 2, "v10-Q-mask2.txt"},
+		{"shoti.example", qrLevelH, 2, 7, "v2-H-mask7.txt"},
+		{"https://shoti.example/watch/0123456789abcdef0123", qrLevelH, 6, 2, "v6-H-mask2.txt"},
+		{links("a", 4), qrLevelH, 10, 0, "v10-H-mask0.txt"},
+	}
+	for _, c := range cases {
+		t.Run(strings.TrimSuffix(c.golden, ".txt"), func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", "qr", c.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Fields(string(raw))
+
+			q, err := unmaskedQR(c.text, c.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.size != c.version*4+17 {
+				t.Fatalf("got version %d, want %d", (q.size-17)/4, c.version)
+			}
+			q.applyMask(c.mask)
+			q.drawFormatBits(c.level, c.mask)
+
+			for y, row := range want {
+				var got strings.Builder
+				for x := 0; x < q.size; x++ {
+					if q.modules[y][x] {
+						got.WriteByte('#')
+					} else {
+						got.WriteByte('.')
+					}
+				}
+				if got.String() != row {
+					t.Errorf("row %d:\ngot  %s\nwant %s", y, got.String(), row)
+				}
+			}
+		})
+	}
+}
+
+// TestQRFormatBits checks the format information of every level and mask
+// against table C.1 of ISO/IEC 18004.
+func TestQRFormatBits(t *testing.T) {
+	table := map[qrLevel][8]string{
+		qrLevelL: {"111011111000100", "111001011110011", "111110110101010", "111100010011101", "110011000101111", "110001100011000", "110110001000001", "110100101110110"},
+		qrLevelM: {"101010000010010", "101000100100101", "101111001111100", "101101101001011", "100010111111001", "100000011001110", "100111110010111", "100101010100000"},
+		qrLevelQ: {"011010101011111", "011000001101000", "011111100110001", "011101000000110", "010010010110100", "010000110000011", "010111011011010", "010101111101101"},
+		qrLevelH: {"001011010001001", "001001110111110", "001110011100111", "001100111010000", "000011101100010", "000001001010101", "000110100001100", "000100000111011"},
+	}
+	for level, masks := range table {
+		for mask, want := range masks {
+			if got := strconv.FormatInt(int64(qrFormatBits(level, mask)), 2); leftPad(got, 15) != want {
+				t.Errorf("format bits of level %d, mask %d: got %s, want %s", level, mask, leftPad(got, 15), want)
+			}
+		}
+	}
+}
+
+// TestQRVersionBits checks the version information against table D.1 of
+// ISO/IEC 18004.
+func TestQRVersionBits(t *testing.T) {
+	table := map[int]string{
+		7:  "000111110010010100",
+		8:  "001000010110111100",
+		9:  "001001101010011001",
+		10: "001010010011010011",
+	}
+	for version, want := range table {
+		if got := leftPad(strconv.FormatInt(int64(qrVersionBits(version)), 2), 18); got != want {
+			t.Errorf("version bits of version %d: got %s, want %s", version, got, want)
+		}
+	}
+}
+
+func TestQRTooLong(t *testing.T) {
+	// Version 10 holds 271 bytes at level L and 119 at level H.
+	if _, err := encodeQR(strings.Repeat("x", 271), qrLevelL); err != nil {
+		t.Errorf("271 bytes at level L: %v", err)
+	}
+	if _, err := encodeQR(strings.Repeat("x", 272), qrLevelL); err != errQRTooLong {
+		t.Errorf("272 bytes at level L: got %v, want errQRTooLong", err)
+	}
+	if _, err := encodeQR(strings.Repeat("x", 120), qrLevelH); err != errQRTooLong {
+		t.Errorf("120 bytes at level H: got %v, want errQRTooLong", err)
+	}
+}
+
+func leftPad(s string, n int) string {
+	return strings.Repeat("0", max(0, n-len(s))) + s
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota notices: issued keys with a notify_url or notify_email hear about
+// their quotas before they get 429s. When a key has used
+// QUOTA_WARNING_PERCENT of its request or media quota in a window it gets
+// a quota.warning, when it has used all of it a quota.exhausted, and when
+// an exhausted window ends a quota.reset. Webhooks get the notice as JSON,
+// signed like serve webhooks in X-Shoti-Signature with
+// QUOTA_WEBHOOK_SECRET; emails go through SMTP (see mail.go).
+//
+// Usage is counted per replica, so notices are too. The same notice is
+// sent to a key at most once per QUOTA_NOTIFY_COOLDOWN, so keys with short
+// windows are not flooded.
+
+var quotaNoticesSent = expvar.NewMap("quota_notices_sent")
+
+type quotaNotice struct {
+	Type    string    `json:"type"`
+	KeyID   string    `json:"key_id"`
+	KeyName string    `json:"key_name,omitempty"`
+	Quota   string    `json:"quota"`
+	Used    int64     `json:"used"`
+	Limit   int64     `json:"limit"`
+	ResetAt time.Time `json:"reset_at"`
+	Time    time.Time `json:"time"`
+
+	owner issuedKey
+}
+
+// quotaWindow is what has been noticed of a window of a quota.
+type quotaWindow struct {
+	owner   issuedKey
+	quota   string
+	limit   int64
+	resetAt time.Time
+	// percent is the highest threshold noticed: 0, the warning or 100.
+	percent int64
+}
+
+var quotaNotices = struct {
+	mu      sync.Mutex
+	windows map[string]*quotaWindow
+	sent    map[string]time.Time
+}{windows: make(map[string]*quotaWindow), sent: make(map[string]time.Time)}
+
+var quotaNotifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// quotaOwner returns the issued key behind a requestKey, if it has
+// somewhere to send notices.
+func quotaOwner(key string) (issuedKey, bool) {
+	secret, ok := strings.CutPrefix(key, "key:")
+	if !ok {
+		return issuedKey{}, false
+	}
+	issuedKeys.mu.RLock()
+	k, ok := issuedKeys.byHash[keyHash(secret)]
+	issuedKeys.mu.RUnlock()
+	return k, ok && (k.NotifyURL != "" || k.NotifyEmail != "")
+}
+
+// noteQuotaUsage notes that key has used used of the limit of quota in
+// the window of bucket ending at resetAt, sending the notices it is due.
+func noteQuotaUsage(bucket, key, quota string, used, limit int64, resetAt time.Time) {
+	if limit <= 0 {
+		return
+	}
+	owner, ok := quotaOwner(key)
+	if !ok {
+		return
+	}
+	var percent int64
+	switch {
+	case used >= limit:
+		percent = 100
+	case used*100 >= limit*int64(envInt("QUOTA_WARNING_PERCENT", 80)):
+		percent = int64(envInt("QUOTA_WARNING_PERCENT", 80))
+	}
+
+	var notices []quotaNotice
+	id := quota + "|" + bucket
+	quotaNotices.mu.Lock()
+	w := quotaNotices.windows[id]
+	if w == nil || !w.resetAt.Equal(resetAt) {
+		// The window before may have ended before the sweep saw it.
+		if w != nil && w.percent == 100 {
+			notices = append(notices, w.notice("quota.reset", 0, w.resetAt))
+		}
+		w = &quotaWindow{owner: owner, quota: quota, limit: limit, resetAt: resetAt}
+		quotaNotices.windows[id] = w
+	}
+	if percent > w.percent {
+		w.percent = percent
+		kind := "quota.warning"
+		if percent == 100 {
+			kind = "quota.exhausted"
+		}
+		notices = append(notices, w.notice(kind, used, resetAt))
+	}
+	notices = dueQuotaNotices(notices)
+	quotaNotices.mu.Unlock()
+
+	for _, n := range notices {
+		sendQuotaNotice(n)
+	}
+}
+
+func (w *quotaWindow) notice(kind string, used int64, resetAt time.Time) quotaNotice {
+	return quotaNotice{
+		Type:    kind,
+		KeyID:   w.owner.KeyID,
+		KeyName: w.owner.Name,
+		Quota:   w.quota,
+		Used:    used,
+		Limit:   w.limit,
+		ResetAt: resetAt,
+		Time:    time.Now().UTC(),
+		owner:   w.owner,
+	}
+}
+
+// dueQuotaNotices drops the notices sent to the same key within the
+// cooldown and records the others as sent. quotaNotices.mu must be held.
+func dueQuotaNotices(notices []quotaNotice) []quotaNotice {
+	cooldown := envDuration("QUOTA_NOTIFY_COOLDOWN", time.Hour)
+	due := notices[:0]
+	for _, n := range notices {
+		id := n.KeyID + "|" + n.Quota + "|" + n.Type
+		if last, ok := quotaNotices.sent[id]; ok && time.Since(last) < cooldown {
+			continue
+		}
+		quotaNotices.sent[id] = time.Now()
+		due = append(due, n)
+	}
+	return due
+}
+
+// sweepQuotaNotices sends the resets of exhausted windows that have ended
+// and forgets them.
+func sweepQuotaNotices() error {
+	var resets []quotaNotice
+	quotaNotices.mu.Lock()
+	for id, w := range quotaNotices.windows {
+		if time.Now().Before(w.resetAt) {
+			continue
+		}
+		if w.percent == 100 {
+			resets = append(resets, dueQuotaNotices([]quotaNotice{w.notice("quota.reset", 0, w.resetAt)})...)
+		}
+		delete(quotaNotices.windows, id)
+	}
+	cooldown := envDuration("QUOTA_NOTIFY_COOLDOWN", time.Hour)
+	for id, last := range quotaNotices.sent {
+		if time.Since(last) >= cooldown {
+			delete(quotaNotices.sent, id)
+		}
+	}
+	quotaNotices.mu.Unlock()
+
+	for _, n := range resets {
+		sendQuotaNotice(n)
+	}
+	return nil
+}
+
+// sendQuotaNotice delivers n to the webhook and email address of its key
+// in the background.
+func sendQuotaNotice(n quotaNotice) {
+	owner := n.owner
+	quotaNoticesSent.Add(n.Type, 1)
+	if owner.NotifyURL != "" {
+		background(func() {
+			if err := postQuotaNotice(owner.NotifyURL, n); err != nil {
+				log.Printf("Error delivering %s to key %s: %v\n", n.Type, n.KeyID, err)
+			}
+		})
+	}
+	if owner.NotifyEmail != "" && mailEnabled() {
+		background(func() {
+			subject, body := quotaNoticeMail(n)
+			if err := sendMail([]string{owner.NotifyEmail}, subject, body); err != nil {
+				log.Printf("Error emailing %s to key %s: %v\n", n.Type, n.KeyID, err)
+			}
+		})
+	}
+}
+
+func postQuotaNotice(target string, n quotaNotice) error {
+	headers := map[string]string{}
+	if key := secret("QUOTA_WEBHOOK_SECRET"); key != "" {
+		body, err := json.Marshal(n)
+		if err != nil {
+			return fmt.Errorf("error encoding notice: %w", err)
+		}
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(body)
+		headers["X-Shoti-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return postJSON(quotaNotifyClient, target, n, headers)
+}
+
+// quotaNoticeMail returns the subject and body of the email of n.
+func quotaNoticeMail(n quotaNotice) (string, string) {
+	name := n.KeyName
+	if name == "" {
+		name = n.KeyID
+	}
+	what := map[string]string{"requests": "request quota", "media_bytes": "media bandwidth quota"}[n.Quota]
+	reset := n.ResetAt.UTC().Format(time.RFC1123)
+
+	switch n.Type {
+	case "quota.reset":
+		return fmt.Sprintf("API key %s: %s reset", name, what),
+			fmt.Sprintf("The %s of API key %s (%s) was reset at %s; requests are accepted again.\n", what, name, n.KeyID, reset)
+	case "quota.exhausted":
+		return fmt.Sprintf("API key %s: %s used up", name, what),
+			fmt.Sprintf("API key %s (%s) has used all of its %s (%d of %d). Requests get 429 Too Many Requests until it resets at %s.\n",
+				name, n.KeyID, what, n.Used, n.Limit, reset)
+	default:
+		return fmt.Sprintf("API key %s: %d%% of %s used", name, n.Used*100/n.Limit, what),
+			fmt.Sprintf("API key %s (%s) has used %d of its %s of %d. It resets at %s.\n",
+				name, n.KeyID, n.Used, what, n.Limit, reset)
+	}
+}
+
+// validateKeyNotifications checks the notice destinations of a key.
+func validateKeyNotifications(notifyURL, notifyEmail string) error {
+	if notifyURL != "" {
+		u, err := neturl.Parse(notifyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("notify_url must be an http or https URL")
+		}
+	}
+	if notifyEmail != "" {
+		if _, err := mail.ParseAddress(notifyEmail); err != nil {
+			return errors.New("notify_email is not a valid address")
+		}
+	}
+	return nil
+}
+
+// updateKeyNotifications handles PATCH /api/admin/keys/{id} with
+// {"notify_url": "...", "notify_email": "..."}; "" stops the notices and
+// fields left out are unchanged.
+func updateKeyNotifications(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		NotifyURL   *string `json:"notify_url"`
+		NotifyEmail *string `json:"notify_email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	var notifyURL, notifyEmail sql.NullString
+	if body.NotifyURL != nil {
+		notifyURL = sql.NullString{String: *body.NotifyURL, Valid: true}
+	}
+	if body.NotifyEmail != nil {
+		notifyEmail = sql.NullString{String: *body.NotifyEmail, Valid: true}
+	}
+	if err := validateKeyNotifications(notifyURL.String, notifyEmail.String); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	k, err := scanIssuedKey(db.QueryRow(`
+	UPDATE api_keys SET notify_url = COALESCE($2, notify_url), notify_email = COALESCE($3, notify_email)
+	WHERE id = $1 RETURNING `+issuedKeyColumns, id, notifyURL, notifyEmail))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating API key %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if err := reloadIssuedKeys(); err != nil {
+		log.Println(err)
+	}
+	writeJSON(w, http.StatusOK, k)
+}
+
+func init() {
+	schedule("quota-notices", "", time.Minute, sweepQuotaNotices)
+}
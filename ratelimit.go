@@ -0,0 +1,103 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request rate limit: each caller (issued or tier-assigned API key, or the
+// client IP otherwise; see requestKey) may make
+// the requests of its tier (see tiers.go; RATE_LIMIT for the free tier) per
+// RATE_LIMIT_WINDOW to the public API, counted per replica in fixed
+// windows. Every counted response carries X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset (Unix time at which the
+// window resets) so clients can slow down before they get 429s. Tiers
+// without a request limit get no headers.
+
+var rateLimited = expvar.NewMap("rate_limited")
+
+type rateWindow struct {
+	start    time.Time
+	requests int
+}
+
+var rateUsage = struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}{windows: make(map[string]*rateWindow)}
+
+// rateLimitExempt are probes and documents that must keep answering.
+var rateLimitExempt = map[string]bool{"/livez": true, "/readyz": true, "/startupz": true, "/openapi.json": true, "/.well-known/jwks.json": true}
+
+// takeRequest counts a request of key and returns what is left of its
+// window. ok is false when the limit was already reached.
+func takeRequest(key string, limit int, window time.Duration) (remaining int, reset time.Time, ok bool) {
+	rateUsage.mu.Lock()
+	defer rateUsage.mu.Unlock()
+
+	u, exists := rateUsage.windows[key]
+	if !exists || time.Since(u.start) >= window {
+		u = &rateWindow{start: time.Now()}
+		rateUsage.windows[key] = u
+	}
+	reset = u.start.Add(window)
+	if u.requests >= limit {
+		return 0, reset, false
+	}
+	u.requests++
+	return limit - u.requests, reset, true
+}
+
+// rateLimit enforces the caller's request limit on h and sets the
+// X-RateLimit headers.
+func rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		tier, limits := limitsFor(r)
+		limit := limits.Requests
+		if limit <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		bucket := requestKey(r)
+		if collection := routeCollection(r); collection != "" {
+			bucket = "collection:" + collection + ":" + bucket
+		}
+		remaining, reset, ok := takeRequest(bucket, limit, envDuration("RATE_LIMIT_WINDOW", time.Minute))
+		noteQuotaUsage(bucket, requestKey(r), "requests", int64(limit-remaining), int64(limit), reset)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if !ok {
+			rateLimited.Add(tier, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			writeError(w, http.StatusTooManyRequests, "too many requests, try again later")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sweepRateUsage forgets windows that have ended.
+func sweepRateUsage() error {
+	window := envDuration("RATE_LIMIT_WINDOW", time.Minute)
+	rateUsage.mu.Lock()
+	defer rateUsage.mu.Unlock()
+	for key, u := range rateUsage.windows {
+		if time.Since(u.start) >= window {
+			delete(rateUsage.windows, key)
+		}
+	}
+	return nil
+}
+
+func init() {
+	schedule("rate-usage-sweep", "", 10*time.Minute, sweepRateUsage)
+}
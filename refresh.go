@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// fieldChange is one entry of the diff returned by a refresh, keyed by the
+// dotted JSON path of the Video field.
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+type refreshResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		Video   *Video        `json:"video"`
+		Changes []fieldChange `json:"changes"`
+	} `json:"data"`
+}
+
+// adminRefreshVideo handles POST /api/admin/videos/{id}/refresh. It
+// re-resolves the URL from the upstream regardless of the metadata cache,
+// stores the result and returns what changed compared with the previously
+// cached metadata, or with the stored columns when nothing was cached.
+func adminRefreshVideo(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/videos/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "refresh" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := parts[0]
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid URL id")
+		return
+	}
+
+	previous, url, err := storedVideo(id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "URL not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading video %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if cached := videoCache.peek(url); cached != nil {
+		previous = cached
+	}
+
+	video, err := videoCache.fetch(url)
+	if err != nil {
+		log.Printf("Error refreshing %s: %v\n", url, err)
+		writeUpstreamError(w, err)
+		return
+	}
+	recordResolved(id, video)
+	purgeSurrogateKeys(videoSurrogateKey(id))
+
+	var response refreshResponse
+	response.Code = 200
+	response.Msg = "success"
+	response.Data.Video = video
+	response.Data.Changes = diffVideos(previous, video)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// storedVideo rebuilds what the database knows about a URL as a Video.
+// Fields that are not stored, such as the play URL, are left empty.
+func storedVideo(id string) (*Video, string, error) {
+	var (
+		v   Video
+		url string
+	)
+	conn, err := catalog.DB(id)
+	if err != nil {
+		return nil, "", err
+	}
+	err = conn.QueryRow(`
+	SELECT url, COALESCE(video_id, ''), COALESCE(title, ''), COALESCE(duration, 0), COALESCE(region, ''),
+		COALESCE(author_id, ''), COALESCE(author_username, ''), COALESCE(author_nickname, ''),
+		COALESCE(music_id, ''), COALESCE(music_title, ''), play_count, digg_count, comment_count, share_count
+	FROM urls WHERE id = $1
+	`, id).Scan(&url, &v.ID, &v.Title, &v.Duration, &v.Region,
+		&v.Author.ID, &v.Author.Username, &v.Author.Nickname,
+		&v.Music.ID, &v.Music.Title, &v.Stats.Plays, &v.Stats.Likes, &v.Stats.Comments, &v.Stats.Shares)
+	return &v, url, err
+}
+
+// diffVideos lists the fields that differ between old and new, comparing
+// their JSON forms so the paths match what API clients see.
+func diffVideos(old, new *Video) []fieldChange {
+	before, after := flattenJSON(old), flattenJSON(new)
+
+	changes := []fieldChange{}
+	for field, value := range after {
+		if !reflect.DeepEqual(before[field], value) {
+			changes = append(changes, fieldChange{Field: field, Old: before[field], New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func flattenJSON(v interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return flat
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return flat
+	}
+
+	var walk func(prefix string, node map[string]interface{})
+	walk = func(prefix string, node map[string]interface{}) {
+		for k, v := range node {
+			if child, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", child)
+				continue
+			}
+			flat[prefix+k] = v
+		}
+	}
+	walk("", tree)
+	return flat
+}
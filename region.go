@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Running replicas in several regions:
+//
+//   - Set REGION on every replica (e.g. "sin", "iad"). Settings read with
+//     regionEnv can be overridden for one region by suffixing the region,
+//     upper-cased: RESOLVER_URL_SIN wins over RESOLVER_URL on REGION=sin,
+//     so each region can use the nearest resolver or tikwm endpoint.
+//   - DB_HOST must accept writes (the primary, or a distributed Postgres
+//     node), since LISTEN/NOTIFY only reaches sessions on the writer. When
+//     reads there may lag the write that triggered a notification, set
+//     INVALIDATION_REAPPLY_AFTER to the worst expected replication lag.
+//   - Every replica records a heartbeat each HEARTBEAT_INTERVAL; /status
+//     reports each region as healthy while one of its replicas has checked
+//     in within three intervals.
+
+func currentRegion() string {
+	if region := os.Getenv("REGION"); region != "" {
+		return region
+	}
+	return "default"
+}
+
+// regionEnv returns NAME_<REGION> when set, else NAME.
+func regionEnv(name string) string {
+	if region := os.Getenv("REGION"); region != "" {
+		if value := os.Getenv(name + "_" + strings.ToUpper(region)); value != "" {
+			return value
+		}
+	}
+	return os.Getenv(name)
+}
+
+type upstreamCounters struct {
+	mu        sync.Mutex
+	ok        int64
+	failed    int64
+	lastError string
+	// streak counts the failures in a row, rate limits aside; down is set
+	// once it reaches UPSTREAM_DOWN_AFTER and upstream_down was raised.
+	streak int
+	down   bool
+}
+
+// upstreamHealth counts this replica's resolves by outcome.
+var upstreamHealth = &upstreamCounters{}
+
+// record counts the outcome of a resolve, alerting when the upstream goes
+// down or recovers. A URL the provider cannot parse says nothing about the
+// health of the upstream, so it counts as a success.
+func (c *upstreamCounters) record(err error) {
+	var pe *providerError
+	if errors.As(err, &pe) && pe.Kind == providerInvalidURL {
+		err = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.failed++
+		c.lastError = err.Error()
+		if errors.As(err, &pe) && pe.Kind == providerRateLimited {
+			return
+		}
+		c.streak++
+		if threshold := envInt("UPSTREAM_DOWN_AFTER", 10); threshold > 0 && c.streak >= threshold && !c.down {
+			c.down = true
+			sendAlert(Alert{
+				Kind:    "upstream_down",
+				Level:   "error",
+				Message: fmt.Sprintf("The last %d resolves failed, most recently with: %v", c.streak, err),
+			})
+		}
+		return
+	}
+	c.ok++
+	if c.down {
+		sendAlert(Alert{Kind: "upstream_recovered", Level: "info", Message: "Resolves are succeeding again."})
+	}
+	c.streak, c.down = 0, false
+}
+
+func (c *upstreamCounters) snapshot() (ok, failed int64, lastError string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ok, c.failed, c.lastError
+}
+
+func instanceName() string {
+	if name := os.Getenv("INSTANCE_NAME"); name != "" {
+		return name
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+func writeHeartbeat() error {
+	ok, failed, lastError := upstreamHealth.snapshot()
+	_, err := db.Exec(`
+	INSERT INTO region_heartbeats (region, instance, seen_at, index_size, upstream_ok, upstream_failed, last_upstream_error)
+	VALUES ($1, $2, now(), $3, $4, $5, NULLIF($6, ''))
+	ON CONFLICT (region, instance) DO UPDATE SET
+		seen_at = now(), index_size = $3, upstream_ok = $4, upstream_failed = $5, last_upstream_error = NULLIF($6, '')
+	`, currentRegion(), instanceName(), index.size(), ok, failed, lastError)
+	if err != nil {
+		return fmt.Errorf("error writing heartbeat: %w", err)
+	}
+
+	// Replicas that have been gone for a day are forgotten.
+	_, err = db.Exec("DELETE FROM region_heartbeats WHERE seen_at < now() - interval '1 day'")
+	if err != nil {
+		return fmt.Errorf("error pruning heartbeats: %w", err)
+	}
+	return nil
+}
+
+type instanceStatus struct {
+	Instance          string    `json:"instance"`
+	SeenAt            time.Time `json:"seen_at"`
+	IndexSize         int       `json:"index_size"`
+	UpstreamOK        int64     `json:"upstream_ok"`
+	UpstreamFailed    int64     `json:"upstream_failed"`
+	LastUpstreamError string    `json:"last_upstream_error,omitempty"`
+}
+
+type regionStatus struct {
+	Region    string           `json:"region"`
+	Healthy   bool             `json:"healthy"`
+	Instances []instanceStatus `json:"instances"`
+}
+
+type statusPage struct {
+	Code int            `json:"code"`
+	Msg  string         `json:"msg"`
+	Data statusPageData `json:"data"`
+}
+
+type statusPageData struct {
+	Region   string         `json:"region"`
+	Instance string         `json:"instance"`
+	Database string         `json:"database"`
+	Regions  []regionStatus `json:"regions"`
+}
+
+// getStatus handles GET /status: this replica's region and the health of
+// every region, as seen through the heartbeats in the shared database.
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	data := statusPageData{Region: currentRegion(), Instance: instanceName(), Database: "ok", Regions: []regionStatus{}}
+
+	rows, err := db.Query(`
+	SELECT region, instance, seen_at, index_size, upstream_ok, upstream_failed, COALESCE(last_upstream_error, '')
+	FROM region_heartbeats
+	ORDER BY region, instance
+	`)
+	if err != nil {
+		log.Printf("Error reading heartbeats: %v\n", err)
+		data.Database = "unavailable"
+		writeJSON(w, http.StatusServiceUnavailable, statusPage{http.StatusServiceUnavailable, "database unavailable", data})
+		return
+	}
+	defer rows.Close()
+
+	stale := 3 * envDuration("HEARTBEAT_INTERVAL", 15*time.Second)
+	for rows.Next() {
+		var (
+			region string
+			inst   instanceStatus
+		)
+		err := rows.Scan(&region, &inst.Instance, &inst.SeenAt, &inst.IndexSize, &inst.UpstreamOK, &inst.UpstreamFailed, &inst.LastUpstreamError)
+		if err != nil {
+			log.Printf("Error scanning heartbeat: %v\n", err)
+			continue
+		}
+		if n := len(data.Regions); n == 0 || data.Regions[n-1].Region != region {
+			data.Regions = append(data.Regions, regionStatus{Region: region})
+		}
+		rs := &data.Regions[len(data.Regions)-1]
+		rs.Instances = append(rs.Instances, inst)
+		if time.Since(inst.SeenAt) < stale {
+			rs.Healthy = true
+		}
+	}
+
+	writeJSON(w, http.StatusOK, statusPage{200, "success", data})
+}
+
+func init() {
+	schedule("heartbeat", "HEARTBEAT_INTERVAL", 15*time.Second, writeHeartbeat)
+}
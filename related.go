@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// relatedVideo is an active video sharing something with the requested
+// one. Score is 3 for the same author, 2 for the same music and 1 per
+// shared hashtag; related videos are ordered by score, then likes.
+type relatedVideo struct {
+	videoListing
+	SameAuthor     bool `json:"same_author"`
+	SameMusic      bool `json:"same_music"`
+	SharedHashtags int  `json:"shared_hashtags"`
+	Score          int  `json:"score"`
+}
+
+type relatedResponse struct {
+	Code int            `json:"code"`
+	Msg  string         `json:"msg"`
+	Data []relatedVideo `json:"data"`
+}
+
+// getRelated handles GET /api/related/{video_id}, where video_id is the
+// upstream video id or the URL id, returning up to limit (default 10)
+// videos by the same author, with the same music or sharing hashtags, for
+// "more like this" features. On a collection route both the video and the
+// related ones must be of its collection. Videos restricted in the caller's
+// country are left out, which is why the response is not cacheable.
+func getRelated(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/related/"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	limit, err := queryInt(r.URL.Query().Get("limit"), 10, 1, 50)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "limit must be between 1 and 50")
+		return
+	}
+
+	collection := routeCollection(r)
+	src, err := findRelatedSource(id, collection)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "video not found in the catalog")
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up video %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	// Related videos may be on any shard, so each returns its best and
+	// the best of all are kept.
+	response := relatedResponse{Code: 200, Msg: "success", Data: []relatedVideo{}}
+	conns := catalog.DBs()
+	if collection != "" {
+		conns = []*sql.DB{collectionDB(collection)}
+	}
+	for _, conn := range conns {
+		related, err := relatedOn(conn, src, collection, limit, requestCountry(r))
+		if err != nil {
+			log.Printf("Error finding videos related to %s: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		response.Data = append(response.Data, related...)
+	}
+	sort.Slice(response.Data, func(i, j int) bool {
+		a, b := response.Data[i], response.Data[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Stats.Likes != b.Stats.Likes {
+			return a.Stats.Likes > b.Stats.Likes
+		}
+		return a.ID < b.ID
+	})
+	response.Data = response.Data[:min(limit, len(response.Data))]
+
+	policy := titlePolicyFor(r)
+	for i := range response.Data {
+		v := &response.Data[i]
+		v.Title = sanitizeTitle(maskTitle(v.Collection, v.Title), policy)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// relatedSource is what videos are related to.
+type relatedSource struct {
+	ID       string
+	Author   sql.NullString
+	Music    sql.NullString
+	Hashtags []string
+}
+
+// findRelatedSource returns the URL with the upstream video id or URL id
+// id in collection ("" for any), preferring an active one and then the
+// oldest, on any shard.
+func findRelatedSource(id, collection string) (relatedSource, error) {
+	var (
+		best       relatedSource
+		bestActive bool
+		bestAdded  time.Time
+		found      bool
+	)
+	for _, conn := range catalog.DBs() {
+		var (
+			src    relatedSource
+			active bool
+			added  time.Time
+		)
+		err := conn.QueryRow(`
+		SELECT id, NULLIF(author_username, ''), NULLIF(music_id, ''),
+			ARRAY(SELECT tag FROM hashtags WHERE hashtags.url_id = urls.id), status = 'active', created_at
+		FROM urls WHERE (video_id = $1 OR id::text = $1) AND ($2 = '' OR collection_id = $2)
+		ORDER BY status = 'active' DESC, created_at
+		LIMIT 1
+		`, id, collection).Scan(&src.ID, &src.Author, &src.Music, pq.Array(&src.Hashtags), &active, &added)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return src, err
+		}
+		if !found || (active && !bestActive) || (active == bestActive && added.Before(bestAdded)) {
+			best, bestActive, bestAdded, found = src, active, added, true
+		}
+	}
+	if !found {
+		return best, sql.ErrNoRows
+	}
+	return best, nil
+}
+
+// relatedOn returns up to limit active videos of collection ("" for any) in
+// conn related to src and not restricted in country, best first.
+func relatedOn(conn *sql.DB, src relatedSource, collection string, limit int, country string) ([]relatedVideo, error) {
+	rows, err := conn.Query(`
+	WITH scored AS (
+		SELECT urls.*,
+			COALESCE(author_username = $1, false) AS same_author,
+			COALESCE(music_id = $2, false) AS same_music,
+			(SELECT count(*) FROM hashtags h WHERE h.url_id = urls.id AND h.tag = ANY($3)) AS shared_tags
+		FROM urls
+		WHERE status = 'active' AND id <> $4 AND NOT ($5 = ANY(restricted_countries))
+			AND ($7 = '' OR collection_id = $7)
+	)
+	SELECT `+videoListingColumns+`, same_author, same_music, shared_tags
+	FROM scored
+	WHERE same_author OR same_music OR shared_tags > 0
+	ORDER BY same_author::int * 3 + same_music::int * 2 + shared_tags DESC, digg_count DESC, id
+	LIMIT $6
+	`, src.Author, src.Music, pq.Array(src.Hashtags), src.ID, country, limit, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var related []relatedVideo
+	for rows.Next() {
+		var v relatedVideo
+		v.videoListing, err = scanVideoListing(rows, &v.SameAuthor, &v.SameMusic, &v.SharedHashtags)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning related video: %w", err)
+		}
+		v.Score = v.SharedHashtags
+		if v.SameAuthor {
+			v.Score += 3
+		}
+		if v.SameMusic {
+			v.Score += 2
+		}
+		related = append(related, v)
+	}
+	return related, rows.Err()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	neturl "net/url"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// Prometheus remote write (version 0.1.0) of growth exports: a WriteRequest
+// protobuf in snappy block format. Both are encoded by hand rather than
+// pulling in their libraries; the snappy blocks are stored as literals,
+// which every decoder accepts, at the cost of compression.
+
+// remoteWriteBatch is the number of videos written per request, five
+// series each.
+const remoteWriteBatch = 2000
+
+type remoteWriteExporter struct {
+	url   string
+	token string
+}
+
+func (e *remoteWriteExporter) Export(at time.Time, videos []store.Engagement) error {
+	ms := at.UnixMilli()
+	for start := 0; start < len(videos); start += remoteWriteBatch {
+		var request protoBuffer
+		for _, v := range videos[start:min(start+remoteWriteBatch, len(videos))] {
+			for _, metric := range []struct {
+				name  string
+				value int64
+			}{
+				{"shoti_video_comments", v.Stats.Comments},
+				{"shoti_video_likes", v.Stats.Likes},
+				{"shoti_video_plays", v.Stats.Plays},
+				{"shoti_video_serves", v.Serves},
+				{"shoti_video_shares", v.Stats.Shares},
+			} {
+				// Labels sorted by name, as receivers require.
+				var series protoBuffer
+				series.message(1, label("__name__", metric.name))
+				series.message(1, label("collection", v.Collection))
+				series.message(1, label("id", v.ID))
+				if v.VideoID != "" {
+					series.message(1, label("video_id", v.VideoID))
+				}
+				var sample protoBuffer
+				sample.double(1, float64(metric.value))
+				sample.varint(2, uint64(ms))
+				series.message(2, sample)
+				request.message(1, series)
+			}
+		}
+		if err := e.write(snappyLiteral(request)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *remoteWriteExporter) write(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	} else if u, err := neturl.Parse(e.url); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+	response, err := growthExportClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %w", req.URL.Host, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", req.URL.Host, response.StatusCode)
+	}
+	return nil
+}
+
+func label(name, value string) protoBuffer {
+	var b protoBuffer
+	b.bytes(1, []byte(name))
+	b.bytes(2, []byte(value))
+	return b
+}
+
+// protoBuffer appends protobuf fields.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field<<3|wireType))
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.tag(field, 0)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	b.tag(field, 1)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.bytes(field, m)
+}
+
+// snappyLiteral encodes data as a snappy block of literals of up to 64 KiB.
+func snappyLiteral(data []byte) []byte {
+	out := binary.AppendUvarint(make([]byte, 0, len(data)+len(data)/65536*3+16), uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 65536)
+		switch {
+		case n <= 60:
+			out = append(out, byte(n-1)<<2)
+		case n <= 256:
+			out = append(out, 60<<2, byte(n-1))
+		default:
+			out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Every video response carries a serve id (the serve_id field and the
+// X-Serve-ID header) that end users quote when reporting it. It is
+// "<url id>.<unix time>.<signature>", signed with SERVE_ID_SECRET so reports
+// need no per-serve storage and cannot name videos that were never served.
+var serveIDKey struct {
+	once sync.Once
+	key  []byte
+}
+
+func serveIDSecret() []byte {
+	serveIDKey.once.Do(func() {
+		if s := secret("SERVE_ID_SECRET"); s != "" {
+			serveIDKey.key = []byte(s)
+			return
+		}
+		log.Println("SERVE_ID_SECRET not set, serve ids will only be accepted by this process.")
+		serveIDKey.key = make([]byte, 32)
+		rand.Read(serveIDKey.key)
+	})
+	return serveIDKey.key
+}
+
+func serveIDSignature(payload string) string {
+	mac := hmac.New(sha256.New, serveIDSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func newServeID(urlID string, servedAt time.Time) string {
+	payload := urlID + "." + strconv.FormatInt(servedAt.Unix(), 10)
+	return payload + "." + serveIDSignature(payload)
+}
+
+var errInvalidServeID = errors.New("invalid serve_id")
+
+func parseServeID(serveID string) (string, time.Time, error) {
+	parts := strings.Split(serveID, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errInvalidServeID
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(serveIDSignature(payload))) {
+		return "", time.Time{}, errInvalidServeID
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, errInvalidServeID
+	}
+	return parts[0], time.Unix(unix, 0), nil
+}
+
+type reportRequest struct {
+	ServeID string `json:"serve_id"`
+	Reason  string `json:"reason"`
+}
+
+// reportVideo handles POST /api/report. Each requester (API key or client
+// IP, see submitterID) can hold one open report per video, for up
+// to REPORT_WINDOW after it was served; once reports from
+// REPORT_SUSPEND_THRESHOLD client IPs are open for a video it is suspended
+// from rotation until a moderator reviews it. Reports from several keys
+// used from one IP count once towards the threshold.
+func reportVideo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	reporter := submitterID(r)
+	if until, throttled := abuse.throttledUntil(abuseKeys(r)...); throttled {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(time.Until(until).Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too many requests, try again later")
+		return
+	}
+
+	var req reportRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Reason) > 500 {
+		writeError(w, http.StatusBadRequest, "reason must be between 1 and 500 characters")
+		return
+	}
+
+	urlID, servedAt, err := parseServeID(req.ServeID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if time.Since(servedAt) > envDuration("REPORT_WINDOW", 24*time.Hour) {
+		writeError(w, http.StatusBadRequest, "serve_id has expired")
+		return
+	}
+
+	conn, err := catalog.DB(urlID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "video not found in the catalog")
+		return
+	}
+	if err != nil {
+		log.Printf("Error locating reported video %s: %v\n", urlID, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	_, err = conn.Exec(`
+	INSERT INTO reports (id, url_id, reporter, reporter_ip, reason) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (url_id, reporter) WHERE status = 'open' DO UPDATE SET reason = EXCLUDED.reason
+	`, uuid.New().String(), urlID, reporter, clientIP(r), req.Reason)
+	if err != nil {
+		log.Printf("Error recording report: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	threshold := envInt("REPORT_SUSPEND_THRESHOLD", 3)
+	result, err := conn.Exec(`
+	UPDATE urls SET status = 'suspended'
+	WHERE id = $1 AND status = 'active'
+		AND (SELECT COUNT(DISTINCT COALESCE(NULLIF(reporter_ip, ''), reporter)) FROM reports WHERE url_id = $1 AND status = 'open') >= $2
+	`, urlID, threshold)
+	if err != nil {
+		log.Printf("Error suspending reported video %s: %v\n", urlID, err)
+	} else if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Suspended video %s after %d report(s).\n", urlID, threshold)
+		sendAlert(Alert{
+			Kind:    "reports.suspended",
+			Message: fmt.Sprintf("Video %s reached %d open reports and was suspended pending review", urlID, threshold),
+			Tags:    map[string]string{"url_id": urlID},
+		})
+	}
+
+	writeJSON(w, http.StatusAccepted, statusResponse{Code: http.StatusAccepted, Msg: "report received"})
+}
+
+type reportedVideo struct {
+	URLID   string    `json:"url_id"`
+	URL     string    `json:"url"`
+	Status  string    `json:"status"`
+	Reports int       `json:"reports"`
+	Reasons []string  `json:"reasons"`
+	FirstAt time.Time `json:"first_reported_at"`
+	LastAt  time.Time `json:"last_reported_at"`
+}
+
+// listReports handles GET /api/admin/reports, the queue of videos with open
+// reports, suspended ones first, then the most reported and the oldest.
+func listReports(w http.ResponseWriter, r *http.Request) {
+	queue := []reportedVideo{}
+	for _, conn := range catalog.DBs() {
+		videos, err := openReports(conn)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		queue = append(queue, videos...)
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		a, b := queue[i], queue[j]
+		if (a.Status == "suspended") != (b.Status == "suspended") {
+			return a.Status == "suspended"
+		}
+		if a.Reports != b.Reports {
+			return a.Reports > b.Reports
+		}
+		return a.FirstAt.Before(b.FirstAt)
+	})
+
+	writeJSON(w, http.StatusOK, queue)
+}
+
+// openReports returns the videos with open reports in conn.
+func openReports(conn *sql.DB) ([]reportedVideo, error) {
+	rows, err := conn.Query(`
+	SELECT u.id, u.url, u.status, COUNT(*), array_agg(rp.reason ORDER BY rp.created_at), MIN(rp.created_at), MAX(rp.created_at)
+	FROM reports rp
+	JOIN urls u ON u.id = rp.url_id
+	WHERE rp.status = 'open'
+	GROUP BY u.id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving reports: %w", err)
+	}
+	defer rows.Close()
+
+	var videos []reportedVideo
+	for rows.Next() {
+		var v reportedVideo
+		if err := rows.Scan(&v.URLID, &v.URL, &v.Status, &v.Reports, pq.Array(&v.Reasons), &v.FirstAt, &v.LastAt); err != nil {
+			return nil, fmt.Errorf("error scanning report: %w", err)
+		}
+		videos = append(videos, v)
+	}
+	return videos, rows.Err()
+}
+
+// reviewReports handles POST /api/admin/reports/{url_id}/dismiss, which
+// closes the open reports and returns a suspended video to rotation (unless
+// a takedown claim is pending), and POST /api/admin/reports/{url_id}/block,
+// which upholds them and blocks it.
+func reviewReports(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/reports/"), "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 || (parts[1] != "dismiss" && parts[1] != "block") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	reportStatus, urlUpdate := "dismissed", "UPDATE urls SET status = 'active' WHERE id = $1 AND status = 'suspended' AND "+noPendingTakedown
+	if parts[1] == "block" {
+		reportStatus, urlUpdate = "upheld", "UPDATE urls SET status = 'blocked' WHERE id = $1"
+	}
+
+	conn, err := catalog.DB(parts[0])
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "no open reports for this video")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE reports SET status = $2 WHERE url_id = $1 AND status = 'open'", parts[0], reportStatus)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "no open reports for this video")
+		return
+	}
+
+	if _, err := tx.Exec(urlUpdate, parts[0]); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// An external resolver replaces the built-in tikwm lookup so operators can
+// plug in private resolvers without forking. RESOLVER_URL is an HTTP
+// endpoint that receives POST {"url": "..."} (with RESOLVER_TOKEN as a
+// bearer token when set); RESOLVER_COMMAND is an executable run with the URL
+// as its last argument. Either must answer with a Video as JSON, or with
+// {"error": "..."} when the URL cannot be resolved. With
+// RESOLVER_FALLBACK=tikwm a failed external lookup is retried against tikwm.
+// Both settings can be overridden per region (see regionEnv).
+// A plugin resolver (see plugins.go) takes precedence over both, and
+// RESOLVER_FIXTURES, a file written by the seed command, over everything
+// for local development.
+
+type resolveFunc = resolver.Func
+
+func externalResolver() resolveFunc {
+	switch {
+	case os.Getenv("RESOLVER_FIXTURES") != "":
+		return resolveViaFixtures
+	case pluginResolver != nil:
+		return pluginResolver.Resolve
+	case regionEnv("RESOLVER_URL") != "":
+		return resolveViaHTTP
+	case regionEnv("RESOLVER_COMMAND") != "":
+		return resolveViaCommand
+	}
+	return nil
+}
+
+var resolverClient = &http.Client{}
+
+func resolveViaHTTP(url string) (*Video, error) {
+	return resolver.HTTP{
+		URL:     regionEnv("RESOLVER_URL"),
+		Token:   secret("RESOLVER_TOKEN"),
+		Timeout: envDuration("RESOLVER_TIMEOUT", 10*time.Second),
+		Client:  resolverClient,
+	}.Resolve(url)
+}
+
+func resolveViaCommand(url string) (*Video, error) {
+	return resolver.Command{
+		Args:    strings.Fields(regionEnv("RESOLVER_COMMAND")),
+		Timeout: envDuration("RESOLVER_TIMEOUT", 10*time.Second),
+	}.Resolve(url)
+}
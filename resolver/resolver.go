@@ -0,0 +1,210 @@
+// Package resolver turns TikTok URLs into Videos, through tikwm or an
+// external resolver, without the rest of shoti-srv. Resolvers are plain
+// values configured by their fields, so a program embedding the engine can
+// resolve a URL with
+//
+//	video, err := resolver.Tikwm{}.Resolve(url)
+//
+// Failures the provider itself reports are returned as *Error, classified
+// by Kind.
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Func resolves a URL to its video.
+type Func func(url string) (*Video, error)
+
+// DefaultTikwmEndpoint is the public tikwm API.
+const DefaultTikwmEndpoint = "https://tikwm.com/api"
+
+// Tikwm resolves URLs with the tikwm API. The zero value uses the free
+// public endpoint.
+type Tikwm struct {
+	// Endpoint defaults to DefaultTikwmEndpoint.
+	Endpoint string
+	// Key authenticates paid tiers. It is sent as the KeyParam query
+	// parameter ("key" by default), or as the KeyHeader header when that
+	// is set.
+	Key       string
+	KeyParam  string
+	KeyHeader string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Request returns a request for path under the API, such as "/user/posts"
+// ("" for video info), authenticated with the key.
+func (t Tikwm) Request(path string, query url.Values) (*http.Request, error) {
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultTikwmEndpoint
+	}
+	if path != "" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + path
+	}
+
+	if t.Key != "" && t.KeyHeader == "" {
+		param := t.KeyParam
+		if param == "" {
+			param = "key"
+		}
+		query.Set(param, t.Key)
+	}
+
+	req, err := http.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.Key != "" && t.KeyHeader != "" {
+		req.Header.Set(t.KeyHeader, t.Key)
+	}
+	return req, nil
+}
+
+// Resolve fetches the video info of videoURL.
+func (t Tikwm) Resolve(videoURL string) (*Video, error) {
+	req, err := t.Request("", url.Values{"url": {videoURL}})
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching video info: %w", err)
+	}
+	defer response.Body.Close()
+
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading video info: %w", err)
+	}
+	return DecodeTikwm(raw)
+}
+
+// HTTP resolves URLs with an external resolver endpoint, which receives
+// POST {"url": "..."} and answers with a Video as JSON, or with
+// {"error": "..."} when the URL cannot be resolved.
+type HTTP struct {
+	URL string
+	// Token is sent as a bearer token when set.
+	Token   string
+	Timeout time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (h HTTP) Resolve(videoURL string) (*Video, error) {
+	body, err := json.Marshal(map[string]string{"url": videoURL})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(h.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating resolver request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling resolver: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver returned %s", response.Status)
+	}
+
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading resolver response: %w", err)
+	}
+	return DecodeExternal(raw)
+}
+
+// Command resolves URLs by running an executable with the URL as its last
+// argument; it must print what an HTTP resolver answers.
+type Command struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+func (c Command) Resolve(videoURL string) (*Video, error) {
+	if len(c.Args) == 0 {
+		return nil, errors.New("resolver command is empty")
+	}
+
+	ctx, cancel := withTimeout(c.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Args[0], append(c.Args[1:], videoURL)...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running resolver: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return DecodeExternal(out)
+}
+
+// Fixtures resolves URLs from recorded videos, for development and tests
+// without upstream calls.
+type Fixtures map[string]*Video
+
+// LoadFixtures reads fixtures written as a JSON object of URL to Video.
+func LoadFixtures(path string) (Fixtures, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixtures: %w", err)
+	}
+	fixtures := Fixtures{}
+	if err := json.Unmarshal(raw, &fixtures); err != nil {
+		return nil, fmt.Errorf("error decoding fixtures %s: %w", path, err)
+	}
+	return fixtures, nil
+}
+
+func (f Fixtures) Resolve(videoURL string) (*Video, error) {
+	video, ok := f[videoURL]
+	if !ok {
+		return nil, &Error{Provider: "fixtures", Msg: "URL is not in the fixtures", Kind: InvalidURL}
+	}
+	copied := *video
+	return &copied, nil
+}
+
+func withTimeout(d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d)
+}
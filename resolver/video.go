@@ -0,0 +1,216 @@
+package resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Video is the provider-independent model every resolver normalizes to.
+// Everything downstream of resolution (cache, stats, responses, templates)
+// works on Video, so a new provider only needs a decode function here.
+type Video struct {
+	ID        string `json:"id"`
+	Provider  string `json:"provider"`
+	Region    string `json:"region"`
+	Title     string `json:"title"`
+	Cover     string `json:"cover"`
+	PlayURL   string `json:"play_url"`
+	Duration  int    `json:"duration"`
+	CreatedAt int64  `json:"created_at"`
+	Author    Author `json:"author"`
+	Music     Music  `json:"music"`
+	Stats     Stats  `json:"stats"`
+	// Subtitles are the caption tracks the provider offers, if any.
+	Subtitles []Subtitle `json:"subtitles,omitempty"`
+}
+
+type Author struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Nickname string `json:"nickname"`
+	Avatar   string `json:"avatar"`
+}
+
+type Music struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type Subtitle struct {
+	Language string `json:"language"`
+	Format   string `json:"format"`
+	URL      string `json:"url"`
+}
+
+type Stats struct {
+	Plays    int64 `json:"plays"`
+	Likes    int64 `json:"likes"`
+	Comments int64 `json:"comments"`
+	Shares   int64 `json:"shares"`
+}
+
+// Error is an error reported by the provider itself, as opposed to a
+// transport or decoding failure.
+type Error struct {
+	Provider string
+	Msg      string
+	Kind     ErrorKind
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Provider, e.Msg)
+}
+
+// ErrorKind classifies provider errors by what the caller should do about
+// them.
+type ErrorKind int
+
+const (
+	// Failed is any failure not classified below; retrying later may
+	// succeed.
+	Failed ErrorKind = iota
+	// InvalidURL means the provider cannot parse the URL or the
+	// video is gone; retrying will not help.
+	InvalidURL
+	// RateLimited means the provider's request quota is used up
+	// for now.
+	RateLimited
+)
+
+// ClassifyTikwmError maps the msg of a failed tikwm response, such as
+// "Url parsing is failed! Please check url." or "Free Api Limit: 1
+// request/second.", to a kind.
+func ClassifyTikwmError(msg string) ErrorKind {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, "limit"):
+		return RateLimited
+	case strings.Contains(msg, "parsing is failed"), strings.Contains(msg, "check url"),
+		strings.Contains(msg, "not found"), strings.Contains(msg, "deleted"), strings.Contains(msg, "private"):
+		return InvalidURL
+	}
+	return Failed
+}
+
+// tikwmResponse is the raw tikwm API response; DecodeTikwm normalizes it
+// into a Video.
+type tikwmResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		ID               string `json:"id"`
+		Region           string `json:"region"`
+		Title            string `json:"title"`
+		Cover            string `json:"cover"`
+		AI_Dynamic_Cover string `json:"ai_dynamic_cover"`
+		Origin_Cover     string `json:"origin_cover"`
+		Duration         int    `json:"duration"`
+		Play             string `json:"play"`
+		WMPlay           string `json:"wmplay"`
+		Size             int    `json:"size"`
+		WMSize           int    `json:"wm_size"`
+		Music            struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+			Play  string `json:"play"`
+			Cover string `json:"cover"`
+		} `json:"music_info"`
+		PlayCount     int   `json:"play_count"`
+		DiggCount     int   `json:"digg_count"`
+		CommentCount  int   `json:"comment_count"`
+		ShareCount    int   `json:"share_count"`
+		DownloadCount int   `json:"download_count"`
+		CollectCount  int   `json:"collect_count"`
+		CreateTime    int64 `json:"create_time"`
+		Subtitles     []struct {
+			Language string `json:"language_code"`
+			Format   string `json:"format"`
+			URL      string `json:"url"`
+		} `json:"subtitle_infos"`
+		Author struct {
+			ID       string `json:"id"`
+			UniqueID string `json:"unique_id"`
+			Nickname string `json:"nickname"`
+			Avatar   string `json:"avatar"`
+		} `json:"author"`
+	} `json:"data"`
+}
+
+// DecodeTikwm normalizes a tikwm API response.
+func DecodeTikwm(raw []byte) (*Video, error) {
+	var info tikwmResponse
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return nil, fmt.Errorf("error decoding video info: %w", err)
+	}
+	if info.Code != 0 {
+		return nil, &Error{Provider: "tikwm", Msg: info.Msg, Kind: ClassifyTikwmError(info.Msg)}
+	}
+
+	d := info.Data
+	var subtitles []Subtitle
+	for _, track := range d.Subtitles {
+		if track.URL == "" || track.Language == "" {
+			continue
+		}
+		format := strings.ToLower(track.Format)
+		if format == "" {
+			format = "webvtt"
+		}
+		subtitles = append(subtitles, Subtitle{Language: track.Language, Format: format, URL: track.URL})
+	}
+	return &Video{
+		ID:        d.ID,
+		Provider:  "tikwm",
+		Region:    d.Region,
+		Title:     d.Title,
+		Cover:     d.Cover,
+		PlayURL:   "https://www.tikwm.com/video/media/hdplay/" + d.ID + ".mp4",
+		Duration:  d.Duration,
+		CreatedAt: d.CreateTime,
+		Author: Author{
+			ID:       d.Author.ID,
+			Username: d.Author.UniqueID,
+			Nickname: d.Author.Nickname,
+			Avatar:   d.Author.Avatar,
+		},
+		Music: Music{
+			ID:    d.Music.ID,
+			Title: d.Music.Title,
+			URL:   d.Music.Play,
+		},
+		Stats: Stats{
+			Plays:    int64(d.PlayCount),
+			Likes:    int64(d.DiggCount),
+			Comments: int64(d.CommentCount),
+			Shares:   int64(d.ShareCount),
+		},
+		Subtitles: subtitles,
+	}, nil
+}
+
+// DecodeExternal accepts the Video model as-is from an external resolver,
+// which may report failure as {"error": "..."}.
+func DecodeExternal(raw []byte) (*Video, error) {
+	var body struct {
+		Video
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("error decoding resolver output: %w", err)
+	}
+	if body.Error != "" {
+		return nil, &Error{Provider: "external", Msg: body.Error}
+	}
+	if body.ID == "" || body.PlayURL == "" {
+		return nil, errors.New("resolver output is missing id or play_url")
+	}
+
+	video := body.Video
+	if video.Provider == "" {
+		video.Provider = "external"
+	}
+	return &video, nil
+}
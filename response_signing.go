@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Response signing: with RESPONSE_SIGNING_KEY set, /api/get responses carry
+// an X-JWS-Signature header, a JWS with detached payload (RFC 7515,
+// appendix F) over the exact response body, signed with Ed25519. Services
+// relaying the data verify it against the public key published at
+// /.well-known/jwks.json, or with client.WithResponseVerification. The key
+// is an Ed25519 private key in PEM (PKCS #8) or its 32-byte seed in base64;
+// `shoti-srv signing-key` generates one.
+
+var responseSigner struct {
+	mu  sync.Mutex
+	raw string
+	key ed25519.PrivateKey
+	kid string
+}
+
+// signingKey returns the configured key and its id, or nil when responses
+// are not signed. It follows RESPONSE_SIGNING_KEY across secret reloads.
+func signingKey() (ed25519.PrivateKey, string) {
+	raw := secret("RESPONSE_SIGNING_KEY")
+	responseSigner.mu.Lock()
+	defer responseSigner.mu.Unlock()
+	if raw == responseSigner.raw {
+		return responseSigner.key, responseSigner.kid
+	}
+
+	key, err := parseSigningKey(raw)
+	if err != nil {
+		log.Printf("Error reading RESPONSE_SIGNING_KEY, responses will not be signed: %v\n", err)
+	}
+	responseSigner.raw, responseSigner.key, responseSigner.kid = raw, key, ""
+	if key != nil {
+		responseSigner.kid = signingKeyID(key.Public().(ed25519.PublicKey))
+	}
+	return responseSigner.key, responseSigner.kid
+}
+
+func parseSigningKey(raw string) (ed25519.PrivateKey, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if block, _ := pem.Decode([]byte(raw)); block != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 key")
+		}
+		return key, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		seed, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(raw, "="))
+	}
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("expected a PEM key or a base64 %d-byte seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signingKeyID is the JWK thumbprint (RFC 7638) of key.
+func signingKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256([]byte(`{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(key) + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// detachedJWS signs payload, returning "<header>..<signature>".
+func detachedJWS(key ed25519.PrivateKey, kid string, payload []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": kid})
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	input := protected + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input)))
+}
+
+// signatureRecorder holds back the response so its signature can be sent
+// as a header before the body.
+type signatureRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (sr *signatureRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+}
+
+func (sr *signatureRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.body.Write(b)
+}
+
+// signed signs the responses of h when RESPONSE_SIGNING_KEY is set.
+func signed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, kid := signingKey()
+		if key == nil {
+			h(w, r)
+			return
+		}
+
+		sr := &signatureRecorder{ResponseWriter: w}
+		h(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		w.Header().Set("X-JWS-Signature", detachedJWS(key, kid, sr.body.Bytes()))
+		w.WriteHeader(sr.status)
+		w.Write(sr.body.Bytes())
+	}
+}
+
+// serveJWKS publishes the public key verifying signed responses.
+func serveJWKS(w http.ResponseWriter, r *http.Request) {
+	keys := []map[string]string{}
+	if key, kid := signingKey(); key != nil {
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": "EdDSA",
+			"use": "sig",
+			"kid": kid,
+			"x":   base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		})
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func signingKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("signing-key", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	public := key.Public().(ed25519.PublicKey)
+	fmt.Printf("RESPONSE_SIGNING_KEY=%s\n", base64.StdEncoding.EncodeToString(key.Seed()))
+	fmt.Printf("# public key (kid %s): %s\n", signingKeyID(public), base64.StdEncoding.EncodeToString(public))
+	return nil
+}
+
+func init() {
+	commands["signing-key"] = command{Summary: "generate a RESPONSE_SIGNING_KEY", Run: signingKeyCommand}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// retentionPolicy archives a collection's videos once they have been in
+// the catalog longer than MaxAgeDays or served at least MaxServes times.
+// Either limit may be left unset.
+type retentionPolicy struct {
+	CollectionID string `json:"collection_id"`
+	MaxAgeDays   *int   `json:"max_age_days"`
+	MaxServes    *int   `json:"max_serves"`
+}
+
+// applyRetentionPolicies archives what the policies expire, unless that
+// would take the catalog below its guardrail (see guardrails.go).
+func applyRetentionPolicies() error {
+	// The policies are kept in the DB_* database and applied on every
+	// shard, each in a transaction committed once the guardrail allows the
+	// total.
+	var policies string
+	if err := db.QueryRow("SELECT COALESCE(json_agg(p), '[]') FROM retention_policies p").Scan(&policies); err != nil {
+		return fmt.Errorf("error loading retention policies: %w", err)
+	}
+
+	var (
+		txs    []*sql.Tx
+		active int
+		n      int64
+	)
+	defer func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+	}()
+	for _, conn := range catalog.DBs() {
+		tx, err := conn.Begin()
+		if err != nil {
+			return fmt.Errorf("error applying retention policies: %w", err)
+		}
+		txs = append(txs, tx)
+
+		var shardActive int
+		if err := tx.QueryRow("SELECT count(*) FROM urls WHERE status = 'active'").Scan(&shardActive); err != nil {
+			return fmt.Errorf("error counting active URLs: %w", err)
+		}
+		result, err := tx.Exec(`
+		UPDATE urls u SET status = 'archived'
+		FROM json_populate_recordset(NULL::retention_policies, $1) p
+		WHERE p.collection_id = u.collection_id AND u.status = 'active' AND (
+			(p.max_age_days IS NOT NULL AND u.created_at < now() - make_interval(days => p.max_age_days)) OR
+			(p.max_serves IS NOT NULL AND u.serve_count >= p.max_serves)
+		)
+		`, policies)
+		if err != nil {
+			return fmt.Errorf("error applying retention policies: %w", err)
+		}
+		archived, _ := result.RowsAffected()
+		active, n = active+shardActive, n+archived
+	}
+
+	if retentionGuarded(active, int(n)) {
+		// Alert on the first skipped run only; the counter tracks the rest.
+		retentionRunsPaused.Add(1)
+		if !retentionPaused {
+			sendAlert(Alert{
+				Kind:    "retention_paused",
+				Message: fmt.Sprintf("Retention skipped archiving %d of %d active URLs, which would leave fewer than the minimum of %d.", n, active, catalogMinimum()),
+			})
+		}
+		retentionPaused = true
+		return nil
+	}
+	retentionPaused = false
+	for _, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error applying retention policies: %w", err)
+		}
+	}
+	if n > 0 {
+		log.Printf("Retention archived %d video(s).\n", n)
+	}
+	return nil
+}
+
+func init() {
+	schedule("retention", "RETENTION_INTERVAL", time.Hour, applyRetentionPolicies).LeaderOnly = true
+}
+
+// retentionPolicies handles GET /api/admin/retention (list) and
+// PUT/DELETE /api/admin/retention/{collection}.
+func retentionPolicies(w http.ResponseWriter, r *http.Request) {
+	collection := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/retention"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && collection == "":
+		rows, err := db.Query("SELECT collection_id, max_age_days, max_serves FROM retention_policies ORDER BY collection_id")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		defer rows.Close()
+
+		policies := []retentionPolicy{}
+		for rows.Next() {
+			var (
+				p              retentionPolicy
+				maxAge, serves sql.NullInt64
+			)
+			if err := rows.Scan(&p.CollectionID, &maxAge, &serves); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed")
+				return
+			}
+			if maxAge.Valid {
+				n := int(maxAge.Int64)
+				p.MaxAgeDays = &n
+			}
+			if serves.Valid {
+				n := int(serves.Int64)
+				p.MaxServes = &n
+			}
+			policies = append(policies, p)
+		}
+		writeJSON(w, http.StatusOK, policies)
+
+	case r.Method == http.MethodPut && collection != "":
+		var p retentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+		if (p.MaxAgeDays != nil && *p.MaxAgeDays < 1) || (p.MaxServes != nil && *p.MaxServes < 1) {
+			writeError(w, http.StatusBadRequest, "limits must be positive")
+			return
+		}
+		p.CollectionID = collection
+
+		_, err := db.Exec(`
+		INSERT INTO retention_policies (collection_id, max_age_days, max_serves) VALUES ($1, $2, $3)
+		ON CONFLICT (collection_id) DO UPDATE SET max_age_days = $2, max_serves = $3
+		`, p.CollectionID, p.MaxAgeDays, p.MaxServes)
+		if err != nil {
+			log.Printf("Error saving retention policy: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+
+	case r.Method == http.MethodDelete && collection != "":
+		if _, err := db.Exec("DELETE FROM retention_policies WHERE collection_id = $1", collection); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
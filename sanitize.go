@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Served titles are sanitized so they survive chat embeds: invalid UTF-8,
+// control characters and invisible formatting characters (bidi overrides,
+// zero-width spaces) are removed and whitespace is collapsed to single
+// spaces. TITLE_POLICY_FILE adds per-key options on top, for example:
+//
+//	{
+//	  "default": {"max_hashtags": 5},
+//	  "keys": {"discord-bot-key": {"emoji": "strip", "escape_markdown": true}}
+//	}
+//
+// A key's policy replaces the default policy rather than merging with it.
+type titlePolicy struct {
+	// MaxHashtags drops hashtags after the first MaxHashtags; 0 keeps all.
+	MaxHashtags int `json:"max_hashtags"`
+	// Emoji is "keep" (the default) or "strip".
+	Emoji string `json:"emoji"`
+	// Transliterate folds accented Latin letters to ASCII.
+	Transliterate bool `json:"transliterate"`
+	// EscapeMarkdown backslash-escapes Markdown syntax characters.
+	EscapeMarkdown bool `json:"escape_markdown"`
+}
+
+type titlePolicyConfig struct {
+	Default titlePolicy            `json:"default"`
+	Keys    map[string]titlePolicy `json:"keys"`
+}
+
+var titlePolicies titlePolicyConfig
+
+func loadTitlePolicies() error {
+	path := os.Getenv("TITLE_POLICY_FILE")
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading title policies: %w", err)
+	}
+	var config titlePolicyConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("error decoding title policies: %w", err)
+	}
+
+	if err := config.Default.validate("default"); err != nil {
+		return err
+	}
+	for key, p := range config.Keys {
+		if err := p.validate("key " + key); err != nil {
+			return err
+		}
+	}
+
+	titlePolicies = config
+	return nil
+}
+
+func (p titlePolicy) validate(name string) error {
+	if p.Emoji != "" && p.Emoji != "keep" && p.Emoji != "strip" {
+		return fmt.Errorf("title policy %s: emoji must be keep or strip, not %q", name, p.Emoji)
+	}
+	if p.MaxHashtags < 0 {
+		return fmt.Errorf("title policy %s: max_hashtags must not be negative", name)
+	}
+	return nil
+}
+
+func titlePolicyFor(r *http.Request) titlePolicy {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if p, ok := titlePolicies.Keys[key]; ok {
+			return p
+		}
+	}
+	return titlePolicies.Default
+}
+
+// sanitizeTitle applies the baseline cleanup and then p.
+func sanitizeTitle(title string, p titlePolicy) string {
+	title = strings.ToValidUTF8(title, "")
+	stripEmoji := p.Emoji == "strip"
+
+	var b strings.Builder
+	for _, r := range title {
+		switch {
+		case unicode.IsSpace(r):
+			b.WriteRune(' ')
+			continue
+		case unicode.IsControl(r):
+			continue
+		case r == '\u200d':
+			// The zero-width joiner holds emoji sequences together.
+			if stripEmoji {
+				continue
+			}
+		case unicode.Is(unicode.Cf, r):
+			continue
+		case stripEmoji && isEmoji(r):
+			continue
+		}
+		if p.Transliterate {
+			if folded, ok := asciiFold[r]; ok {
+				b.WriteString(folded)
+				continue
+			}
+		}
+		b.WriteRune(r)
+	}
+
+	words := strings.Fields(b.String())
+	if p.MaxHashtags > 0 {
+		kept, tags := words[:0], 0
+		for _, word := range words {
+			if strings.HasPrefix(word, "#") && len(word) > 1 {
+				if tags++; tags > p.MaxHashtags {
+					continue
+				}
+			}
+			kept = append(kept, word)
+		}
+		words = kept
+	}
+	title = strings.Join(words, " ")
+
+	if p.EscapeMarkdown {
+		title = markdownEscaper.Replace(title)
+	}
+	return title
+}
+
+// isEmoji reports whether r is in one of the emoji blocks, or is a
+// modifier that only appears in emoji sequences.
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // pictographs, emoticons, flags, skin tones
+		r >= 0x2600 && r <= 0x27BF,   // miscellaneous symbols, dingbats
+		r >= 0x2B00 && r <= 0x2BFF,   // arrows and stars such as ⭐
+		r >= 0xE0020 && r <= 0xE007F, // tag sequences of subdivision flags
+		r == 0xFE0F, r == 0x20E3:     // emoji presentation, keycap
+		return true
+	}
+	return false
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "~", `\~`,
+	"|", `\|`, ">", `\>`, "[", `\[`, "]", `\]`,
+)
+
+var asciiFold = func() map[rune]string {
+	fold := make(map[rune]string)
+	for ascii, accented := range map[string]string{
+		"a": "àáâãäåāăą", "A": "ÀÁÂÃÄÅĀĂĄ",
+		"c": "çćĉċč", "C": "ÇĆĈĊČ",
+		"d": "ďđ", "D": "ĎĐ",
+		"e": "èéêëēĕėęě", "E": "ÈÉÊËĒĔĖĘĚ",
+		"g": "ĝğġģ", "G": "ĜĞĠĢ",
+		"i": "ìíîïĩīĭįı", "I": "ÌÍÎÏĨĪĬĮİ",
+		"n": "ñńņňŉ", "N": "ÑŃŅŇ",
+		"o": "òóôõöøōŏő", "O": "ÒÓÔÕÖØŌŎŐ",
+		"s": "śŝşš", "S": "ŚŜŞŠ",
+		"t": "ţťŧ", "T": "ŢŤŦ",
+		"u": "ùúûüũūŭůűų", "U": "ÙÚÛÜŨŪŬŮŰŲ",
+		"y": "ýÿŷ", "Y": "ÝŸŶ",
+		"z": "źżž", "Z": "ŹŻŽ",
+		"ss": "ß", "ae": "æ", "AE": "Æ", "oe": "œ", "OE": "Œ",
+		"'": "‘’", `"`: "“”", "-": "–—", "...": "…",
+	} {
+		for _, r := range accented {
+			fold[r] = ascii
+		}
+	}
+	return fold
+}()
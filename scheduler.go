@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduledJob is a background task run at a fixed interval. The interval
+// is read from IntervalEnv when the scheduler starts (after .env has been
+// loaded), falling back to Every.
+type scheduledJob struct {
+	Name        string
+	IntervalEnv string
+	Every       time.Duration
+	Run         func() error
+	mu          sync.Mutex
+	running     bool
+	lastRun     time.Time
+	lastErr     error
+	progress    *jobProgress
+
+	// LeaderOnly jobs act on shared state and run only on the replica
+	// holding the leader lock; the rest maintain per-replica state.
+	LeaderOnly bool
+}
+
+// jobProgress is what long-running jobs report about their current run.
+type jobProgress struct {
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+	Total  int `json:"total"`
+}
+
+var scheduledJobs []*scheduledJob
+
+// schedule registers run to be called periodically once the scheduler
+// starts. Setting intervalEnv to a non-positive duration disables the job.
+func schedule(name, intervalEnv string, every time.Duration, run func() error) *scheduledJob {
+	j := &scheduledJob{Name: name, IntervalEnv: intervalEnv, Every: every, Run: run}
+	scheduledJobs = append(scheduledJobs, j)
+	return j
+}
+
+// runOnce runs the job unless a run is already in progress, which can
+// happen when it is triggered through the jobs API.
+func (j *scheduledJob) runOnce() {
+	if j.LeaderOnly && !isLeader() {
+		return
+	}
+
+	j.mu.Lock()
+	if j.running {
+		j.mu.Unlock()
+		return
+	}
+	j.running = true
+	j.progress = nil
+	j.mu.Unlock()
+
+	err := j.Run()
+	if err != nil {
+		log.Printf("Job %s failed: %v\n", j.Name, err)
+	}
+
+	j.mu.Lock()
+	// Only the first of consecutive failures alerts, so a job failing on
+	// every run does not alert on every run.
+	if err != nil && j.lastErr == nil {
+		sendAlert(Alert{
+			Kind:    "job_failed",
+			Message: fmt.Sprintf("Job %s failed: %v", j.Name, err),
+			Tags:    map[string]string{"job": j.Name},
+		})
+	}
+	j.running = false
+	j.lastRun = time.Now()
+	j.lastErr = err
+	j.mu.Unlock()
+}
+
+// reportProgress records how far the current run has got.
+func (j *scheduledJob) reportProgress(p jobProgress) {
+	j.mu.Lock()
+	j.progress = &p
+	j.mu.Unlock()
+}
+
+type jobStatus struct {
+	Name       string       `json:"name"`
+	Every      string       `json:"every"`
+	LeaderOnly bool         `json:"leader_only"`
+	Running    bool         `json:"running"`
+	LastRun    *time.Time   `json:"last_run"`
+	LastErr    string       `json:"last_error,omitempty"`
+	Progress   *jobProgress `json:"progress,omitempty"`
+}
+
+func (j *scheduledJob) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := jobStatus{Name: j.Name, Every: j.Every.String(), LeaderOnly: j.LeaderOnly, Running: j.running, Progress: j.progress}
+	if !j.lastRun.IsZero() {
+		lastRun := j.lastRun
+		s.LastRun = &lastRun
+	}
+	if j.lastErr != nil {
+		s.LastErr = j.lastErr.Error()
+	}
+	return s
+}
+
+// jobsAPI handles GET /api/admin/jobs, GET /api/admin/jobs/{name} and
+// POST /api/admin/jobs/{name}/run, which starts a run in the background.
+func jobsAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/jobs"), "/"), "/")
+
+	if parts[0] == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		statuses := make([]jobStatus, 0, len(scheduledJobs))
+		for _, j := range scheduledJobs {
+			statuses = append(statuses, j.status())
+		}
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	var job *scheduledJob
+	for _, j := range scheduledJobs {
+		if j.Name == parts[0] {
+			job = j
+		}
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		writeJSON(w, http.StatusOK, job.status())
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "run":
+		if job.LeaderOnly && !isLeader() {
+			writeError(w, http.StatusConflict, "job runs on the leader replica only")
+			return
+		}
+		go job.runOnce()
+		writeJSON(w, http.StatusAccepted, job.status())
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func startScheduler() {
+	for _, j := range scheduledJobs {
+		if j.IntervalEnv != "" {
+			j.Every = envDuration(j.IntervalEnv, j.Every)
+		}
+		if j.Every <= 0 {
+			log.Printf("Job %s disabled.\n", j.Name)
+			continue
+		}
+
+		go func(j *scheduledJob) {
+			ticker := time.NewTicker(j.Every)
+			defer ticker.Stop()
+			for range ticker.C {
+				j.runOnce()
+			}
+		}(j)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Secrets are resolved in order from NAME_FILE (e.g. a Docker secret
+// mounted under /run/secrets), from Vault when VAULT_ADDR is set, and
+// finally from the plain NAME environment variable.
+var (
+	secretsMu       sync.RWMutex
+	vaultData       map[string]string
+	onSecretsReload []func()
+)
+
+func secret(name string) string {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading %s_FILE: %v\n", name, err)
+		} else {
+			return strings.TrimSpace(string(content))
+		}
+	}
+
+	secretsMu.RLock()
+	value, ok := vaultData[name]
+	secretsMu.RUnlock()
+	if ok {
+		return value
+	}
+
+	return os.Getenv(name)
+}
+
+func loadVaultSecrets() error {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+
+	secretPath := strings.Trim(os.Getenv("VAULT_SECRET_PATH"), "/")
+	if secretPath == "" {
+		return fmt.Errorf("VAULT_SECRET_PATH must be set when VAULT_ADDR is set")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+secretPath, nil)
+	if err != nil {
+		return fmt.Errorf("error creating vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching secrets from vault: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault responded with status %d", response.StatusCode)
+	}
+
+	var payload struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("error decoding vault response: %w", err)
+	}
+
+	// KV version 2 nests the values one level deeper than version 1.
+	values := payload.Data
+	if nested, ok := values["data"].(map[string]interface{}); ok {
+		values = nested
+	}
+
+	data := make(map[string]string, len(values))
+	for k, v := range values {
+		data[k] = fmt.Sprint(v)
+	}
+
+	secretsMu.Lock()
+	vaultData = data
+	secretsMu.Unlock()
+
+	return nil
+}
+
+// watchSecretReload re-reads secrets on SIGHUP and runs the registered
+// reload hooks so rotated credentials take effect without a restart.
+func watchSecretReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			log.Println("SIGHUP received, reloading secrets...")
+			if err := loadVaultSecrets(); err != nil {
+				log.Printf("Error reloading secrets: %v\n", err)
+				continue
+			}
+			for _, hook := range onSecretsReload {
+				hook()
+			}
+		}
+	}()
+}
+
+func dbConnString() string {
+	return fmt.Sprintf(
+		"user=%s password=%s host=%s dbname=%s sslmode=%s",
+		secret("DB_USER"),
+		secret("DB_PASSWORD"),
+		secret("DB_HOST"),
+		secret("DB_NAME"),
+		os.Getenv("DB_SSLMODE"),
+	)
+}
+
+// rotatingConnector builds every new connection from the current secrets,
+// so a reload only needs to drop idle connections for new ones to pick up
+// rotated credentials.
+type rotatingConnector struct{}
+
+func (rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	connector, err := pq.NewConnector(dbConnString())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return timedConn{Conn: conn}, nil
+}
+
+func (rotatingConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func resetDBConnections() {
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(2)
+	log.Println("Database connections will reconnect with reloaded credentials.")
+}
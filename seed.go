@@ -0,0 +1,177 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// Development data: `shoti-srv seed --count 100` fills a database with
+// synthetic videos built from the recorded tikwm response in testdata, with
+// their metadata, stats and hashtags already recorded, and writes every
+// video to a fixtures file (seed-fixtures.json by default). Pointing
+// RESOLVER_FIXTURES at that file makes the server resolve URLs from it
+// instead of calling tikwm, so the full stack runs locally without real
+// TikTok links or upstream calls. Seeded URLs are submitted by "seed";
+// --replace deletes the previous ones first.
+
+//go:embed testdata/providers/tikwm/video.json
+var recordedTikwmVideo []byte
+
+var (
+	seedAuthors  = []string{"kusina.ni.lola", "dance.crew.mnl", "catsofcebu", "tito.jokes", "travel.with.ana", "gym.bro.ph", "study.notes", "street.food.hunter"}
+	seedSounds   = []string{"original sound", "Budots Remix", "Dalaga", "lo-fi study beat", "Pantropiko", "Tala"}
+	seedRegions  = []string{"PH", "PH", "PH", "US", "ID", "JP", "SG"}
+	seedHashtags = []string{"fyp", "foryou", "shoti", "dance", "cats", "food", "funny", "travel", "gym", "study", "ootd", "pinoy"}
+	seedCaptions = []string{"sayaw tayo", "try this at home", "part 2 as requested", "pov: monday morning", "wait for it", "day in my life"}
+)
+
+// seedVideos returns n synthetic videos derived from the recorded tikwm
+// video, keyed by a TikTok-style URL.
+func seedVideos(rng *rand.Rand, n int) (map[string]*Video, error) {
+	template, err := resolver.DecodeTikwm(recordedTikwmVideo)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding recorded video: %w", err)
+	}
+
+	videos := make(map[string]*Video, n)
+	for len(videos) < n {
+		v := *template
+		v.ID = "70" + strconv.FormatInt(1e16+rng.Int63n(9e16), 10)
+		v.Region = seedRegions[rng.Intn(len(seedRegions))]
+		v.Duration = 5 + rng.Intn(180)
+		v.CreatedAt = time.Now().Add(-time.Duration(rng.Int63n(int64(365 * 24 * time.Hour)))).Unix()
+		v.Cover = "https://seed.shoti.invalid/cover/" + v.ID + ".webp"
+		v.PlayURL = "https://seed.shoti.invalid/play/" + v.ID + ".mp4"
+		v.Provider = "fixtures"
+		v.Subtitles = nil
+
+		author := rng.Intn(len(seedAuthors))
+		v.Author.ID = strconv.Itoa(6800000000000000000 + author)
+		v.Author.Username = seedAuthors[author]
+		v.Author.Nickname = strings.ReplaceAll(seedAuthors[author], ".", " ")
+		v.Author.Avatar = "https://seed.shoti.invalid/avatar/" + v.Author.Username + ".jpeg"
+
+		sound := rng.Intn(len(seedSounds))
+		v.Music.ID = strconv.Itoa(7200000000000000000 + sound)
+		v.Music.Title = seedSounds[sound]
+		if sound == 0 {
+			v.Music.ID = strconv.Itoa(7210000000000000000 + author)
+			v.Music.Title += " - " + v.Author.Username
+		}
+		v.Music.URL = "https://seed.shoti.invalid/music/" + v.Music.ID + ".mp3"
+
+		title := seedCaptions[rng.Intn(len(seedCaptions))]
+		for _, i := range rng.Perm(len(seedHashtags))[:1+rng.Intn(4)] {
+			title += " #" + seedHashtags[i]
+		}
+		v.Title = title
+
+		plays := rng.Int63n(5_000_000)
+		v.Stats.Plays = plays
+		v.Stats.Likes = plays / int64(5+rng.Intn(20))
+		v.Stats.Comments = v.Stats.Likes / int64(10+rng.Intn(40))
+		v.Stats.Shares = v.Stats.Likes / int64(20+rng.Intn(80))
+
+		videos["https://www.tiktok.com/@"+v.Author.Username+"/video/"+v.ID] = &v
+	}
+	return videos, nil
+}
+
+func seedCommand(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	count := fs.Int("count", 100, "number of videos to add")
+	collection := fs.String("collection", "default", "collection the videos are added to")
+	fixtures := fs.String("fixtures", "seed-fixtures.json", "fixtures file for RESOLVER_FIXTURES, merged with an existing one")
+	seed := fs.Int64("seed", 0, "random seed, for reproducible data (default: random)")
+	replace := fs.Bool("replace", false, "delete previously seeded URLs first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 {
+		return errors.New("--count must be at least 1")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	initDB()
+
+	known := resolver.Fixtures{}
+	if *replace {
+		result, err := db.Exec("DELETE FROM urls WHERE submitted_by = 'seed'")
+		if err != nil {
+			return fmt.Errorf("error deleting seeded URLs: %w", err)
+		}
+		deleted, _ := result.RowsAffected()
+		fmt.Printf("Deleted %d previously seeded URLs.\n", deleted)
+	} else if _, err := os.Stat(*fixtures); err == nil {
+		if known, err = resolver.LoadFixtures(*fixtures); err != nil {
+			return err
+		}
+	}
+
+	videos, err := seedVideos(rand.New(rand.NewSource(*seed)), *count)
+	if err != nil {
+		return err
+	}
+
+	for url, video := range videos {
+		id := uuid.New().String()
+		_, err := db.Exec("INSERT INTO urls (id, url, collection_id, submitted_by, created_at) VALUES ($1, $2, $3, 'seed', to_timestamp($4))",
+			id, url, *collection, video.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error adding seeded URL %s: %w", url, err)
+		}
+		recordResolved(id, video)
+		known[url] = video
+	}
+
+	out, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*fixtures, out, 0o644); err != nil {
+		return fmt.Errorf("error writing fixtures: %w", err)
+	}
+
+	fmt.Printf("Seeded %d videos into %q with seed %d.\n", len(videos), *collection, *seed)
+	fmt.Printf("Set RESOLVER_FIXTURES=%s to serve them without upstream calls.\n", *fixtures)
+	return nil
+}
+
+var resolverFixtures struct {
+	once     sync.Once
+	fixtures resolver.Fixtures
+	err      error
+}
+
+// resolveViaFixtures resolves url from the RESOLVER_FIXTURES file, which
+// is read once.
+func resolveViaFixtures(url string) (*Video, error) {
+	resolverFixtures.once.Do(func() {
+		resolverFixtures.fixtures, resolverFixtures.err = resolver.LoadFixtures(os.Getenv("RESOLVER_FIXTURES"))
+	})
+	if resolverFixtures.err != nil {
+		return nil, resolverFixtures.err
+	}
+	return resolverFixtures.fixtures.Resolve(url)
+}
+
+func init() {
+	commands["seed"] = command{
+		Summary: "fill a development database with synthetic videos",
+		Run:     seedCommand,
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+func rendezvousScore(salt, id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(salt + ":" + id))
+	return h.Sum64()
+}
+
+// rendezvousTop returns the k entries with the lowest score for salt, in
+// order. The ranking depends only on the salt and each entry's id, so it is
+// deterministic across replicas and barely moves when the catalog changes.
+func rendezvousTop(entries []catalogEntry, salt string, k int) []catalogEntry {
+	type scored struct {
+		entry catalogEntry
+		score uint64
+	}
+
+	top := make([]scored, 0, k+1)
+	for _, e := range entries {
+		s := scored{e, rendezvousScore(salt, e.ID)}
+		if len(top) == k && s.score >= top[k-1].score {
+			continue
+		}
+		i := sort.Search(len(top), func(i int) bool { return top[i].score > s.score })
+		top = append(top, scored{})
+		copy(top[i+1:], top[i:])
+		top[i] = s
+		if len(top) > k {
+			top = top[:k]
+		}
+	}
+
+	picked := make([]catalogEntry, len(top))
+	for i, s := range top {
+		picked[i] = s.entry
+	}
+	return picked
+}
+
+// selectionParams are the /api/get options that narrow or steer which
+// video is picked.
+type selectionParams struct {
+	Seed       string
+	Favorites  *favoriteOwner
+	Exclude    map[string]bool
+	MinLikes   int64
+	MinPlays   int64
+	Hashtag    string
+	MusicID    string
+	Collection string
+	Country    string
+	Cohort     *cohort
+	Seen       *rotatingBloom
+	// DryRun picks without advancing pins or sessions.
+	DryRun bool
+}
+
+// cohort splits the catalog into disjoint buckets that are reshuffled every
+// COHORT_WINDOW. An end user passing ?user= draws only from their bucket,
+// so users of the same bot rarely see the same video at the same time while
+// each still gets a fresh pick per call.
+type cohort struct {
+	salt    string
+	bucket  uint64
+	buckets uint64
+}
+
+func newCohort(user string, now time.Time) *cohort {
+	buckets := uint64(envInt("COHORT_BUCKETS", 8))
+	if user == "" || buckets < 2 {
+		return nil
+	}
+	window := envDuration("COHORT_WINDOW", time.Hour)
+	if window <= 0 {
+		return nil
+	}
+	salt := fmt.Sprintf("cohort:%d", now.UnixNano()/int64(window))
+	return &cohort{
+		salt:    salt,
+		bucket:  rendezvousScore(salt, "user:"+user) % buckets,
+		buckets: buckets,
+	}
+}
+
+func (c *cohort) contains(e catalogEntry) bool {
+	return rendezvousScore(c.salt, e.ID)%c.buckets == c.bucket
+}
+
+// matches reports whether e passes every filter in p.
+func (p selectionParams) matches(e catalogEntry) bool {
+	if p.Exclude[e.ID] || (e.VideoID != "" && p.Exclude[e.VideoID]) {
+		return false
+	}
+	if e.Likes < p.MinLikes || e.Plays < p.MinPlays {
+		return false
+	}
+	if p.Hashtag != "" && !slices.Contains(e.Hashtags, p.Hashtag) {
+		return false
+	}
+	if p.MusicID != "" && e.MusicID != p.MusicID {
+		return false
+	}
+	if p.Collection != "" && e.Collection != p.Collection {
+		return false
+	}
+	if p.Country != "" && slices.Contains(e.Restricted, p.Country) {
+		return false
+	}
+	if p.Cohort != nil && !p.Cohort.contains(e) {
+		return false
+	}
+	if p.Seen != nil && p.Seen.has(e.ID) {
+		return false
+	}
+	return true
+}
+
+func (p selectionParams) filtered() bool {
+	return len(p.Exclude) > 0 || p.MinLikes > 0 || p.MinPlays > 0 || p.Hashtag != "" || p.MusicID != "" ||
+		p.Collection != "" || p.Country != "" || p.Cohort != nil || p.Seen != nil
+}
+
+// matcher returns p.matches, or nil when no filter is set so selectors can
+// take their unfiltered fast path.
+func (p selectionParams) matcher() func(catalogEntry) bool {
+	if !p.filtered() {
+		return nil
+	}
+	return p.matches
+}
+
+type selectionBody struct {
+	Exclude []string `json:"exclude"`
+}
+
+// parseSelectionParams reads selection options from the query string and,
+// for POST requests, from a JSON body so long exclusion lists don't have to
+// fit in a URL.
+func parseSelectionParams(r *http.Request) (selectionParams, error) {
+	query := r.URL.Query()
+	p := selectionParams{
+		Seed:       query.Get("seed"),
+		Exclude:    make(map[string]bool),
+		Hashtag:    strings.ToLower(strings.TrimPrefix(query.Get("hashtag"), "#")),
+		MusicID:    query.Get("music_id"),
+		Collection: query.Get("collection"),
+		Country:    requestCountry(r),
+		DryRun:     query.Get("dry_run") == "true",
+	}
+
+	if query.Get("from") != "favorites" && query.Get("seed") == "" {
+		p.Cohort = newCohort(query.Get("user"), time.Now())
+		p.Seen = noRepeatSession(r)
+	}
+
+	if query.Get("from") == "favorites" {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			return p, &httpError{http.StatusUnauthorized, "favorites require an X-API-Key header"}
+		}
+		p.Favorites = &favoriteOwner{KeyHash: keyHash(key), User: query.Get("user")}
+	}
+
+	for name, target := range map[string]*int64{"min_likes": &p.MinLikes, "min_plays": &p.MinPlays} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return p, &httpError{http.StatusBadRequest, name + " must be a non-negative integer"}
+			}
+			*target = n
+		}
+	}
+
+	for _, id := range strings.Split(query.Get("exclude"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			p.Exclude[id] = true
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		var body selectionBody
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body)
+		if err != nil && err != io.EOF {
+			return p, &httpError{http.StatusBadRequest, "invalid request payload"}
+		}
+		for _, id := range body.Exclude {
+			p.Exclude[id] = true
+		}
+	}
+
+	return p, nil
+}
+
+// picker returns the next candidate and the name of the strategy that
+// chose it.
+type picker func() (catalogEntry, string, error)
+
+// newPicker returns a picker for p. Plain random selection draws from the
+// index with the collection's configured Selector, after giving any due
+// pinned video its turn; seeded and favorites selection rank a fixed candidate
+// list up front and successive calls fall through to the next candidate,
+// so a dead link doesn't break the seed.
+func newPicker(p selectionParams) picker {
+	match := p.matcher()
+
+	if p.Seed == "" && p.Favorites == nil {
+		sel := selectorFor(p.Collection)
+		pinChecked := false
+		return func() (catalogEntry, string, error) {
+			if !pinChecked {
+				pinChecked = true
+				// Pins are served to every cohort.
+				wide := p
+				wide.Cohort = nil
+				duePin := index.duePin
+				if p.DryRun {
+					duePin = index.nextPin
+				}
+				if e, ok := duePin(wide.matcher()); ok {
+					return e, "pinned", nil
+				}
+			}
+			e, err := getRandomURL(sel, match)
+			if err == errNoMatches && p.Cohort != nil {
+				// The user's bucket has nothing left for these filters;
+				// widen to the whole catalog rather than failing.
+				wide := p
+				wide.Cohort = nil
+				e, err = getRandomURL(sel, wide.matcher())
+			}
+			if err == errNoMatches && p.Seen != nil {
+				// The session has seen everything that matches; start
+				// the rotation over.
+				unseen := p
+				if p.DryRun {
+					unseen.Seen = nil
+				} else {
+					p.Seen.reset()
+				}
+				e, err = getRandomURL(sel, unseen.matcher())
+			}
+			return e, sel.Name(), err
+		}
+	}
+
+	strategy := "seeded"
+	if p.Favorites != nil {
+		strategy = "favorites"
+	}
+
+	var candidates []catalogEntry
+	loaded := false
+
+	return func() (catalogEntry, string, error) {
+		if !loaded {
+			var (
+				entries []catalogEntry
+				err     error
+			)
+			if p.Favorites != nil {
+				entries, err = favoriteEntries(*p.Favorites)
+			} else {
+				entries, err = activeEntries()
+			}
+			if err != nil {
+				return catalogEntry{}, strategy, err
+			}
+
+			if len(entries) == 0 {
+				if p.Favorites != nil {
+					return catalogEntry{}, strategy, errNoFavorites
+				}
+				return catalogEntry{}, strategy, errNoURLs
+			}
+			if match != nil {
+				entries = selector.Filter(entries, match)
+			}
+
+			if p.Seed != "" {
+				candidates = rendezvousTop(entries, "seed:"+p.Seed, 3)
+			} else {
+				rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+				candidates = entries
+			}
+			loaded = true
+		}
+
+		if len(candidates) == 0 {
+			return catalogEntry{}, strategy, errNoMatches
+		}
+		e := candidates[0]
+		candidates = candidates[1:]
+		return e, strategy, nil
+	}
+}
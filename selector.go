@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+// Selector is a strategy for picking one video from the catalog; the
+// strategies themselves live in the selector package.
+type Selector = selector.Selector
+
+var selectors = selector.Builtin()
+
+var (
+	defaultSelector     Selector = selector.Uniform{}
+	collectionSelectors          = map[string]Selector{}
+)
+
+// loadSelectionStrategies reads SELECTION_STRATEGY (the default) and
+// SELECTION_STRATEGIES, a comma-separated list of collection=strategy.
+func loadSelectionStrategies() error {
+	if name := os.Getenv("SELECTION_STRATEGY"); name != "" {
+		sel, ok := selectors[name]
+		if !ok {
+			return fmt.Errorf("unknown SELECTION_STRATEGY %q", name)
+		}
+		defaultSelector = sel
+	}
+
+	for _, pair := range strings.Split(os.Getenv("SELECTION_STRATEGIES"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		collection, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid SELECTION_STRATEGIES entry %q", pair)
+		}
+		sel, ok := selectors[name]
+		if !ok {
+			return fmt.Errorf("unknown selection strategy %q for collection %s", name, collection)
+		}
+		collectionSelectors[collection] = sel
+	}
+
+	return nil
+}
+
+func selectorFor(collection string) Selector {
+	if sel, ok := collectionSelectors[collection]; ok {
+		return sel
+	}
+	return defaultSelector
+}
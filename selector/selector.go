@@ -0,0 +1,197 @@
+// Package selector holds the strategies shoti-srv uses to pick one video
+// from the catalog. It has no dependencies, so programs embedding the
+// engine can pick from entries loaded with the store package (or built any
+// other way):
+//
+//	entries, err := catalog.Active()
+//	e, ok := selector.Uniform{}.Select(entries, func(e selector.Entry) bool {
+//		return slices.Contains(e.Hashtags, "cats")
+//	})
+package selector
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Entry is the per-URL data selection works on. New selection criteria add
+// a field here and a column to store.EntryColumns.
+type Entry struct {
+	ID         string
+	URL        string
+	Collection string
+	VideoID    string
+	Plays      int64
+	Likes      int64
+	Hashtags   []string
+	MusicID    string
+	PinEvery   int
+	Weight     float64
+	LastServed time.Time
+	Restricted []string
+	AddedAt    time.Time
+}
+
+// Selector is a strategy for picking one video from the catalog. The server
+// calls Select with its index's read lock held, so it must not retain
+// entries or block.
+type Selector interface {
+	Name() string
+	// Select returns a random entry accepted by match (any entry when
+	// match is nil), or false when none matches.
+	Select(entries []Entry, match func(Entry) bool) (Entry, bool)
+}
+
+// Builtin returns the built-in strategies by name.
+func Builtin() map[string]Selector {
+	return map[string]Selector{
+		"uniform":    Uniform{},
+		"weighted":   Weighted{Strategy: "weighted", WeightOf: func(e Entry) float64 { return e.Weight }},
+		"engagement": Weighted{Strategy: "engagement", WeightOf: EngagementWeight},
+		"lrs":        LeastRecentlyServed{Sample: 16},
+	}
+}
+
+// Filter returns the entries accepted by match, reusing the backing array
+// of entries.
+func Filter(entries []Entry, match func(Entry) bool) []Entry {
+	filtered := entries[:0]
+	for _, e := range entries {
+		if match(e) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// Uniform gives every matching entry the same chance.
+type Uniform struct{}
+
+func (Uniform) Name() string { return "uniform" }
+
+func (Uniform) Select(entries []Entry, match func(Entry) bool) (Entry, bool) {
+	n := len(entries)
+	if n == 0 {
+		return Entry{}, false
+	}
+	if match == nil {
+		return entries[rand.Intn(n)], true
+	}
+
+	// Rejection sampling is cheap when most entries match; narrow filters
+	// fall through to a single reservoir-sampling pass over the catalog.
+	for i := 0; i < 32; i++ {
+		c := entries[rand.Intn(n)]
+		if match(c) {
+			return c, true
+		}
+	}
+
+	var e Entry
+	count := 0
+	for _, c := range entries {
+		if match(c) {
+			count++
+			if rand.Intn(count) == 0 {
+				e = c
+			}
+		}
+	}
+	return e, count > 0
+}
+
+// Weighted picks entries with probability proportional to WeightOf, in one
+// pass using exponential keys (the k=1 case of Efraimidis–Spirakis).
+type Weighted struct {
+	Strategy string
+	WeightOf func(Entry) float64
+}
+
+func (s Weighted) Name() string { return s.Strategy }
+
+// Weight returns the weight of e; entries weighing 0 or less are never
+// picked.
+func (s Weighted) Weight(e Entry) float64 { return s.WeightOf(e) }
+
+func (s Weighted) Select(entries []Entry, match func(Entry) bool) (Entry, bool) {
+	var (
+		best    Entry
+		bestKey = math.Inf(1)
+		found   bool
+	)
+	for _, c := range entries {
+		if match != nil && !match(c) {
+			continue
+		}
+		w := s.WeightOf(c)
+		if w <= 0 {
+			continue
+		}
+		if key := rand.ExpFloat64() / w; key < bestKey {
+			best, bestKey, found = c, key, true
+		}
+	}
+	return best, found
+}
+
+// EngagementWeight favours popular videos without letting a handful of
+// viral ones dominate: weight grows with the log of likes.
+func EngagementWeight(e Entry) float64 {
+	return 1 + math.Log1p(float64(e.Likes))
+}
+
+// LeastRecentlyServed draws a random sample of Sample entries and serves the
+// one that was served longest ago (never-served entries first). This keeps
+// coverage of a large catalog even without sorting it on every request;
+// narrow filters fall back to a full scan.
+type LeastRecentlyServed struct {
+	Sample int
+}
+
+func (LeastRecentlyServed) Name() string { return "lrs" }
+
+func (s LeastRecentlyServed) Select(entries []Entry, match func(Entry) bool) (Entry, bool) {
+	n := len(entries)
+	if n == 0 {
+		return Entry{}, false
+	}
+
+	var (
+		best  Entry
+		found bool
+	)
+	consider := func(c Entry) {
+		if !found || c.LastServed.Before(best.LastServed) {
+			best, found = c, true
+		}
+	}
+
+	if n <= s.Sample*4 {
+		for _, i := range rand.Perm(n) {
+			if match == nil || match(entries[i]) {
+				consider(entries[i])
+			}
+		}
+		return best, found
+	}
+
+	hits := 0
+	for tries := 0; tries < s.Sample*4 && hits < s.Sample; tries++ {
+		c := entries[rand.Intn(n)]
+		if match == nil || match(c) {
+			consider(c)
+			hits++
+		}
+	}
+	if found {
+		return best, true
+	}
+
+	for _, i := range rand.Perm(n) {
+		if match(entries[i]) {
+			consider(entries[i])
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Serve log: with TIMESCALE_URL set, every serve is also logged to the
+// hypertable serve_log in that database rather than the primary one,
+// where continuous aggregates roll it up into serves per video and API
+// key per hour (serves_hourly) and per day (serves_daily). Raw rows are
+// dropped by Timescale after SERVE_LOG_RETENTION; the aggregates are kept.
+// Each replica queues its serves and copies them in every
+// SERVE_LOG_INTERVAL, dropping them beyond SERVE_LOG_MAX_PENDING while the
+// database is unreachable.
+//
+// GET /api/admin/serves?by=video|key&bucket=hour|day answers the
+// aggregates, most recent first; since (RFC 3339, default a week ago), id
+// (a URL id or key id) and limit (default 1000) narrow it.
+
+// timescale is the TimescaleDB database of TIMESCALE_URL, nil when unset.
+var timescale *sql.DB
+
+func initTimescale() {
+	dsn := secret("TIMESCALE_URL")
+	if dsn == "" {
+		return
+	}
+	tsdb, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Printf("Timescale disabled: %v\n", err)
+		return
+	}
+	timescale = tsdb
+}
+
+var (
+	serveLogWritten = expvar.NewInt("serve_log_written")
+	serveLogDropped = expvar.NewInt("serve_log_dropped")
+)
+
+var serveLog struct {
+	mu      sync.Mutex
+	ready   bool
+	pending []serveEvent
+}
+
+// serveLogSetup creates the hypertable, its aggregates and their policies.
+// Timescale refuses to create continuous aggregates inside a transaction,
+// so every statement runs on its own.
+var serveLogSetup = []string{
+	`CREATE TABLE IF NOT EXISTS serve_log (
+		time TIMESTAMPTZ NOT NULL,
+		serve_id TEXT NOT NULL,
+		url_id UUID NOT NULL,
+		video_id TEXT NOT NULL,
+		key_id TEXT NOT NULL
+	)`,
+	`SELECT create_hypertable('serve_log', 'time', if_not_exists => TRUE)`,
+	`CREATE INDEX IF NOT EXISTS serve_log_url_idx ON serve_log (url_id, time DESC)`,
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS serves_hourly
+	WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 hour', time) AS bucket, url_id, key_id, count(*) AS serves
+	FROM serve_log GROUP BY bucket, url_id, key_id
+	WITH NO DATA`,
+	`SELECT add_continuous_aggregate_policy('serves_hourly',
+		start_offset => INTERVAL '3 hours', end_offset => INTERVAL '1 hour',
+		schedule_interval => INTERVAL '30 minutes', if_not_exists => TRUE)`,
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS serves_daily
+	WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 day', time) AS bucket, url_id, key_id, count(*) AS serves
+	FROM serve_log GROUP BY bucket, url_id, key_id
+	WITH NO DATA`,
+	`SELECT add_continuous_aggregate_policy('serves_daily',
+		start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 hour',
+		schedule_interval => INTERVAL '1 hour', if_not_exists => TRUE)`,
+	`SELECT remove_retention_policy('serve_log', if_exists => TRUE)`,
+}
+
+// setupServeLog prepares the database on the first flush, or the first
+// after it was unreachable. serveLog.mu must not be held.
+func setupServeLog() error {
+	serveLog.mu.Lock()
+	ready := serveLog.ready
+	serveLog.mu.Unlock()
+	if ready {
+		return nil
+	}
+
+	for _, query := range serveLogSetup {
+		if _, err := timescale.Exec(query); err != nil {
+			return fmt.Errorf("error setting up the serve log: %w", err)
+		}
+	}
+	retention := envDuration("SERVE_LOG_RETENTION", 30*24*time.Hour)
+	if retention > 0 {
+		_, err := timescale.Exec("SELECT add_retention_policy('serve_log', make_interval(secs => $1), if_not_exists => TRUE)", retention.Seconds())
+		if err != nil {
+			return fmt.Errorf("error setting the serve log retention: %w", err)
+		}
+	}
+
+	serveLog.mu.Lock()
+	serveLog.ready = true
+	serveLog.mu.Unlock()
+	return nil
+}
+
+// logServe queues ev for the serve log.
+func logServe(ev serveEvent) {
+	if timescale == nil {
+		return
+	}
+	serveLog.mu.Lock()
+	defer serveLog.mu.Unlock()
+	if len(serveLog.pending) >= envInt("SERVE_LOG_MAX_PENDING", 100000) {
+		serveLogDropped.Add(1)
+		return
+	}
+	serveLog.pending = append(serveLog.pending, ev)
+}
+
+// flushServeLog copies the queued serves into the serve log. They are
+// queued again when the copy fails, up to SERVE_LOG_MAX_PENDING.
+func flushServeLog() error {
+	if timescale == nil {
+		return nil
+	}
+	if err := setupServeLog(); err != nil {
+		return err
+	}
+
+	serveLog.mu.Lock()
+	events := serveLog.pending
+	serveLog.pending = nil
+	serveLog.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := copyServeLog(events); err != nil {
+		serveLog.mu.Lock()
+		room := max(0, envInt("SERVE_LOG_MAX_PENDING", 100000)-len(serveLog.pending))
+		if len(events) > room {
+			serveLogDropped.Add(int64(len(events) - room))
+			events = events[len(events)-room:]
+		}
+		serveLog.pending = append(events, serveLog.pending...)
+		serveLog.mu.Unlock()
+		return err
+	}
+	serveLogWritten.Add(int64(len(events)))
+	return nil
+}
+
+func copyServeLog(events []serveEvent) error {
+	tx, err := timescale.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting serve log copy: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("serve_log", "time", "serve_id", "url_id", "video_id", "key_id"))
+	if err != nil {
+		return fmt.Errorf("error starting serve log copy: %w", err)
+	}
+	for _, ev := range events {
+		if _, err := stmt.Exec(ev.Time, ev.ServeID, ev.URLID, ev.VideoID, ev.KeyID); err != nil {
+			stmt.Close()
+			return fmt.Errorf("error copying serve %s: %w", ev.ServeID, err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("error copying %d serves: %w", len(events), err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("error copying %d serves: %w", len(events), err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing %d serves: %w", len(events), err)
+	}
+	return nil
+}
+
+type serveCount struct {
+	Bucket time.Time `json:"bucket"`
+	ID     string    `json:"id"`
+	Serves int64     `json:"serves"`
+}
+
+// adminServes handles GET /api/admin/serves.
+func adminServes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if timescale == nil {
+		writeError(w, http.StatusNotImplemented, "the serve log needs TIMESCALE_URL")
+		return
+	}
+	query := r.URL.Query()
+
+	view := map[string]string{"": "serves_hourly", "hour": "serves_hourly", "day": "serves_daily"}[query.Get("bucket")]
+	if view == "" {
+		writeError(w, http.StatusBadRequest, "bucket must be hour or day")
+		return
+	}
+	column := map[string]string{"": "url_id::text", "video": "url_id::text", "key": "key_id"}[query.Get("by")]
+	if column == "" {
+		writeError(w, http.StatusBadRequest, "by must be video or key")
+		return
+	}
+	since := time.Now().Add(-7 * 24 * time.Hour)
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+	}
+	limit := 1000
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 10000")
+			return
+		}
+		limit = n
+	}
+
+	rows, err := timescale.Query(`
+	SELECT bucket, `+column+`, sum(serves)::bigint FROM `+view+`
+	WHERE bucket >= $1 AND ($2 = '' OR `+column+` = $2)
+	GROUP BY 1, 2 ORDER BY 1 DESC, 3 DESC
+	LIMIT $3
+	`, since, query.Get("id"), limit)
+	if err != nil {
+		log.Printf("Error querying %s: %v\n", view, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer rows.Close()
+
+	counts := []serveCount{}
+	for rows.Next() {
+		var c serveCount
+		if err := rows.Scan(&c.Bucket, &c.ID, &c.Serves); err != nil {
+			log.Printf("Error scanning %s: %v\n", view, err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		counts = append(counts, c)
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
+
+func init() {
+	schedule("serve-log", "SERVE_LOG_INTERVAL", 10*time.Second, flushServeLog)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// Sharding: CATALOG_SHARDS (a secret, so CATALOG_SHARDS_FILE works too) maps
+// shard names to Postgres connection strings, e.g.
+//
+//	{"primary": "", "eu-1": "postgres://shoti@eu-1/shoti", "us-1": "postgres://shoti@us-1/shoti"}
+//
+// where "" is the DB_* database. Collections are placed on the shards by
+// consistent hashing of their names (see store.Ring), so adding a shard
+// moves about one collection in n; the rows of moved collections have to
+// be copied over by hand, `shoti-srv shards` lists them. Every shard gets
+// the full schema.
+//
+// The selection index, serving, submissions, /api/list, the browse
+// endpoints (/api/videos, /api/hashtags, /api/music/top), the admin API,
+// stats, backups, purges, reports, takedowns, duplicates, favorites, related
+// videos and the backfill and retention jobs go through the shards: rows
+// about a URL live in its shard, and lists and counts span every shard, or
+// only the collection's when one is asked for. API keys, settings and jobs
+// stay in the DB_* database, which should then only hold its own
+// collections. Every shard notifies its changes, which reach the index as
+// those of the DB_* database do; events of changes on a shard are emitted
+// directly rather than through the outbox, which cannot span databases.
+
+// catalogShards returns the configured shard map, nil when not sharded.
+func catalogShards() (map[string]string, error) {
+	raw := secret("CATALOG_SHARDS")
+	if raw == "" {
+		return nil, nil
+	}
+	var shards map[string]string
+	if err := json.Unmarshal([]byte(raw), &shards); err != nil {
+		return nil, fmt.Errorf("invalid CATALOG_SHARDS: %w", err)
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("invalid CATALOG_SHARDS: no shards")
+	}
+	return shards, nil
+}
+
+// openCatalog opens the catalog on the DB_* database or, when sharded, on
+// every shard, migrating the schema of each.
+func openCatalog() (*store.Store, error) {
+	shards, err := catalogShards()
+	if err != nil {
+		return nil, err
+	}
+	if shards == nil {
+		return store.Open(db)
+	}
+
+	dbs := make(map[string]*sql.DB, len(shards))
+	for name, dsn := range shards {
+		if dsn == "" {
+			dbs[name] = db
+			continue
+		}
+		shardDB, err := openShard(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("error opening shard %s: %w", name, err)
+		}
+		dbs[name] = shardDB
+	}
+	log.Printf("Catalog sharded across %d databases.\n", len(dbs))
+	return store.OpenShards(dbs)
+}
+
+func openShard(dsn string) (*sql.DB, error) {
+	shardDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := shardDB.Ping(); err != nil {
+		return nil, err
+	}
+	if err := store.Migrate(shardDB); err != nil {
+		return nil, err
+	}
+	return shardDB, nil
+}
+
+// collectionDB is the database holding collection, or the DB_* database
+// for "".
+func collectionDB(collection string) *sql.DB {
+	if collection == "" {
+		return db
+	}
+	return catalog.ShardDB(catalog.Shard(collection))
+}
+
+// collectionDBs returns the databases to read collection from: its shard,
+// or every shard for "".
+func collectionDBs(collection string) []*sql.DB {
+	if collection == "" {
+		return catalog.DBs()
+	}
+	return []*sql.DB{collectionDB(collection)}
+}
+
+// findURLID returns the id found by query, a SELECT of one URL id, on the
+// first shard where it finds one, or sql.ErrNoRows.
+func findURLID(query string, args ...interface{}) (string, error) {
+	for _, shardDB := range catalog.DBs() {
+		var id string
+		err := shardDB.QueryRow(query, args...).Scan(&id)
+		if err != sql.ErrNoRows {
+			return id, err
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+// shardsCommand lists the collections of every shard and those stored on a
+// shard the ring no longer places them on.
+func shardsCommand(args []string) error {
+	fs := flag.NewFlagSet("shards", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	initDB()
+	if degraded.Load() {
+		return fmt.Errorf("the database is unavailable")
+	}
+	if !catalog.Sharded() {
+		fmt.Println("The catalog is not sharded; set CATALOG_SHARDS.")
+		return nil
+	}
+
+	shards, _ := catalogShards()
+	misplaced := 0
+	for name := range shards {
+		rows, err := catalog.ShardDB(name).Query("SELECT collection_id, count(*) FROM urls GROUP BY collection_id ORDER BY collection_id")
+		if err != nil {
+			return fmt.Errorf("error listing collections of shard %s: %w", name, err)
+		}
+		for rows.Next() {
+			var collection string
+			var count int
+			if err := rows.Scan(&collection, &count); err != nil {
+				rows.Close()
+				return err
+			}
+			status := "ok"
+			if want := catalog.Shard(collection); want != name {
+				status = "belongs on " + want
+				misplaced++
+			}
+			fmt.Printf("%s\t%s\t%d\t%s\n", name, collection, count, status)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	if misplaced > 0 {
+		return fmt.Errorf("%d collections are on the wrong shard", misplaced)
+	}
+	return nil
+}
+
+func init() {
+	commands["shards"] = command{Summary: "list collections by shard and those on the wrong one", Run: shardsCommand}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Signed requests: an issued key created with {"signing": true} can be
+// used without ever sending it. The caller sends the key's id in X-Key-Id,
+// the Unix time in X-Timestamp, a random X-Nonce and X-Signature, the hex
+// HMAC-SHA256 with the key of
+//
+//	METHOD \n /path?query \n timestamp \n nonce \n hex SHA-256 of the body
+//
+// where /path?query is as sent, including the prefix of a collection route.
+// Requests whose timestamp is more than SIGNATURE_MAX_SKEW away from the
+// server's clock are refused, and each nonce is remembered for that long
+// so a captured request cannot be replayed. Nonces are remembered per
+// replica, so a replay routed to another replica within the skew is only
+// caught by the timestamp. Unlike hashed keys, the server has to keep the
+// secret of signing keys to verify signatures.
+
+// maxSignedBody is the largest body of a signed request.
+const maxSignedBody = 1 << 20
+
+var signatureNonces = struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+var errBadSignature = errors.New("request signature is invalid")
+
+// signaturePayload returns the string a signed request's signature covers.
+func signaturePayload(method, target, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + target + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+}
+
+func signPayload(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature of r and returns the key it was
+// signed with. The body of r is read and replaced.
+func verifySignature(r *http.Request) (string, error) {
+	issuedKeys.mu.RLock()
+	k, ok := issuedKeys.byID[r.Header.Get("X-Key-Id")]
+	issuedKeys.mu.RUnlock()
+	if !ok {
+		return "", errBadSignature
+	}
+
+	timestamp, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > 128 {
+		return "", errBadSignature
+	}
+	skew := envDuration("SIGNATURE_MAX_SKEW", 5*time.Minute)
+	signedAt := time.Unix(unix, 0)
+	if d := time.Since(signedAt); d > skew || d < -skew {
+		return "", errors.New("request timestamp is too far from the server's clock")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody))
+		if err != nil {
+			return "", errBadSignature
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	got, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil {
+		return "", errBadSignature
+	}
+	payload := signaturePayload(r.Method, requestURI(r), timestamp, nonce, body)
+	key := ""
+	for _, secret := range []string{k.secret, k.previousSecret} {
+		want, _ := hex.DecodeString(signPayload(secret, payload))
+		if secret != "" && hmac.Equal(got, want) {
+			key = secret
+			break
+		}
+	}
+	if key == "" {
+		return "", errBadSignature
+	}
+
+	signatureNonces.mu.Lock()
+	defer signatureNonces.mu.Unlock()
+	nonceKey := k.ID + "/" + nonce
+	if _, seen := signatureNonces.expires[nonceKey]; seen {
+		return "", errors.New("request was already received")
+	}
+	signatureNonces.expires[nonceKey] = signedAt.Add(skew)
+	return key, nil
+}
+
+// sweepSignatureNonces forgets nonces whose timestamp is no longer
+// accepted anyway.
+func sweepSignatureNonces() error {
+	signatureNonces.mu.Lock()
+	defer signatureNonces.mu.Unlock()
+	for nonce, expires := range signatureNonces.expires {
+		if time.Now().After(expires) {
+			delete(signatureNonces.expires, nonce)
+		}
+	}
+	return nil
+}
+
+func init() {
+	schedule("signature-nonce-sweep", "", time.Minute, sweepSignatureNonces)
+}
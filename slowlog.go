@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slow calls are logged at warn level and counted, keyed by statement name
+// for queries and by provider for upstream resolves.
+var (
+	slowQueries   = expvar.NewMap("slow_queries")
+	slowUpstreams = expvar.NewMap("slow_upstream_calls")
+)
+
+// statementNames maps the SQL of prepared statements to their names so
+// slow query warnings can say which statement was slow.
+var statementNames sync.Map
+
+func statementName(query string) string {
+	if name, ok := statementNames.Load(query); ok {
+		return name.(string)
+	}
+	name := strings.Join(strings.Fields(query), " ")
+	if len(name) > 60 {
+		name = name[:60] + "..."
+	}
+	return name
+}
+
+func observeQuery(query string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed < envDuration("SLOW_QUERY_THRESHOLD", 500*time.Millisecond) {
+		return
+	}
+	name := statementName(query)
+	slowQueries.Add(name, 1)
+	log.Printf("WARN slow query %q took %s\n", name, elapsed.Round(time.Millisecond))
+}
+
+func observeUpstream(url string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if elapsed < envDuration("SLOW_UPSTREAM_THRESHOLD", 3*time.Second) {
+		return
+	}
+	provider := "tikwm"
+	if externalResolver() != nil {
+		provider = "external"
+	}
+	slowUpstreams.Add(provider, 1)
+	log.Printf("WARN slow upstream call to %s for %s took %s (error: %v)\n", provider, url, elapsed.Round(time.Millisecond), err)
+}
+
+// timedConn wraps a driver connection to time every query and statement
+// run on it.
+type timedConn struct {
+	driver.Conn
+}
+
+func (c timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return timedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeQuery(query, time.Now())
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeQuery(query, time.Now())
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type timedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer observeQuery(s.query, time.Now())
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValues(args))
+}
+
+func (s timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer observeQuery(s.query, time.Now())
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(namedValues(args))
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
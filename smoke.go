@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libyzxy0/shoti-srv/client"
+)
+
+// Smoke tests: `shoti-srv smoke --base-url https://... --url <tiktok url>`
+// checks a running deployment end to end after a deploy. It adds the URL,
+// moves it to a disposable collection through the admin API so real
+// traffic never gets it, waits for it to be listed, gets it from
+// /api/get?collection=, and deletes it again. The report is printed as JSON
+// on stdout and the command fails when any step did. The URL is deleted
+// even when an earlier step failed.
+
+type smokeReport struct {
+	BaseURL    string      `json:"base_url"`
+	Collection string      `json:"collection"`
+	URLID      string      `json:"url_id,omitempty"`
+	OK         bool        `json:"ok"`
+	StartedAt  time.Time   `json:"started_at"`
+	DurationMS int64       `json:"duration_ms"`
+	Steps      []smokeStep `json:"steps"`
+}
+
+type smokeStep struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Status     int    `json:"status,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// smokeAdmin calls the admin API of the instance under test.
+type smokeAdmin struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// do sends a JSON body (if any) with If-Match set to etag (if given) and
+// returns the response's ETag, decoding the body into out.
+func (a smokeAdmin) do(ctx context.Context, method, path, etag string, body, out interface{}) (string, error) {
+	var payload io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		payload = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, payload)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	response, err := a.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	raw, _ := io.ReadAll(response.Body)
+	if response.StatusCode >= 300 {
+		return "", &client.Error{StatusCode: response.StatusCode, Msg: strings.TrimSpace(string(raw))}
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return "", fmt.Errorf("error decoding %s %s: %w", method, path, err)
+		}
+	}
+	return response.Header.Get("ETag"), nil
+}
+
+// moveURL puts the URL with the given id in collection.
+func (a smokeAdmin) moveURL(ctx context.Context, id, collection string) error {
+	etag, err := a.do(ctx, http.MethodGet, "/api/admin/urls/"+id, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = a.do(ctx, http.MethodPatch, "/api/admin/urls/"+id, etag, map[string]string{"collection": collection}, nil)
+	return err
+}
+
+func (a smokeAdmin) deleteURL(ctx context.Context, id string) error {
+	etag, err := a.do(ctx, http.MethodGet, "/api/admin/urls/"+id, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = a.do(ctx, http.MethodDelete, "/api/admin/urls/"+id, etag, nil, nil)
+	return err
+}
+
+// pollUntil calls fn until it returns nil or timeout passes, returning its
+// last error. New URLs reach the selection index and listings shortly
+// after they are added, not at once.
+func pollUntil(ctx context.Context, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func smokeCommand(args []string) error {
+	fs := flag.NewFlagSet("smoke", flag.ContinueOnError)
+	baseURL := fs.String("base-url", "", "public URL of the instance to test")
+	adminURL := fs.String("admin-url", "", "URL of its admin listener (default: --base-url)")
+	adminToken := fs.String("admin-token", os.Getenv("ADMIN_TOKEN"), "admin token (default: $ADMIN_TOKEN)")
+	apiKey := fs.String("api-key", "", "API key sent with public requests")
+	videoURL := fs.String("url", "", "TikTok URL to add; it must resolve on the instance")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the URL to be listed and served")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *baseURL == "" || *videoURL == "" {
+		return errors.New("--base-url and --url are required")
+	}
+	if *adminURL == "" {
+		*adminURL = *baseURL
+	}
+
+	var opts []client.Option
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	public := client.New(*baseURL, opts...)
+	admin := smokeAdmin{baseURL: strings.TrimRight(*adminURL, "/"), token: *adminToken, http: &http.Client{Timeout: 30 * time.Second}}
+	ctx := context.Background()
+
+	report := smokeReport{
+		BaseURL:    *baseURL,
+		Collection: "smoke-" + uuid.New().String()[:8],
+		OK:         true,
+		StartedAt:  time.Now().UTC(),
+	}
+	step := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		s := smokeStep{Name: name, OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			s.Error = err.Error()
+			var apiErr *client.Error
+			if errors.As(err, &apiErr) {
+				s.Status = apiErr.StatusCode
+			}
+			report.OK = false
+		}
+		report.Steps = append(report.Steps, s)
+		return err == nil
+	}
+
+	added := step("add", func() error {
+		u, err := public.AddURL(ctx, *videoURL, "")
+		if err != nil {
+			return err
+		}
+		report.URLID = u.ID
+		return admin.moveURL(ctx, u.ID, report.Collection)
+	})
+	if added {
+		listed := step("list", func() error {
+			return pollUntil(ctx, *timeout, func() error {
+				page, err := public.Videos(ctx, client.VideosQuery{Collection: report.Collection, Status: "all"})
+				if err != nil {
+					return err
+				}
+				for _, v := range page.Videos {
+					if v.ID == report.URLID {
+						return nil
+					}
+				}
+				return errors.New("the added URL is not listed")
+			})
+		})
+		if listed {
+			step("get", func() error {
+				return pollUntil(ctx, *timeout, func() error {
+					v, err := public.Random(ctx, client.RandomOptions{Collection: report.Collection})
+					if err == nil && v.URL == "" {
+						err = errors.New("the served video has no url")
+					}
+					return err
+				})
+			})
+		}
+	}
+	if report.URLID != "" {
+		step("delete", func() error { return admin.deleteURL(ctx, report.URLID) })
+	}
+	report.DurationMS = time.Since(report.StartedAt).Milliseconds()
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if !report.OK {
+		return errors.New("smoke test failed")
+	}
+	return nil
+}
+
+func init() {
+	commands["smoke"] = command{
+		Summary: "add, list, get and delete a URL against a running instance",
+		Run:     smokeCommand,
+	}
+}
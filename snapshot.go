@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Warm standby: with SNAPSHOT_STORE set (s3, disk or gcs, configured like
+// the BACKUP_* store, see openBlobStore) the active catalog and the cached
+// metadata of its videos are written to catalog-snapshot.json.gz by the
+// leader every SNAPSHOT_INTERVAL. With SNAPSHOT_FALLBACK=true a replica
+// that cannot reach Postgres at startup loads the snapshot instead of
+// exiting and serves random and daily videos and media read-only; every
+// other endpoint answers 503. It keeps pinging the database and, once it is back, shuts
+// down gracefully so the orchestrator restarts it in normal mode.
+
+const snapshotKey = "catalog-snapshot.json.gz"
+
+var (
+	snapshotJob *scheduledJob
+
+	// degraded is set while serving from a snapshot without a database.
+	degraded atomic.Bool
+)
+
+type catalogSnapshot struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Entries   []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Collection string    `json:"collection"`
+	VideoID    string    `json:"video_id,omitempty"`
+	Plays      int64     `json:"plays"`
+	Likes      int64     `json:"likes"`
+	Hashtags   []string  `json:"hashtags,omitempty"`
+	MusicID    string    `json:"music_id,omitempty"`
+	PinEvery   int       `json:"pin_every,omitempty"`
+	Weight     float64   `json:"weight"`
+	Restricted []string  `json:"restricted,omitempty"`
+	AddedAt    time.Time `json:"added_at"`
+	Video      *Video    `json:"video,omitempty"`
+}
+
+func writeCatalogSnapshot() error {
+	store, err := openBlobStore("SNAPSHOT")
+	if err == errBlobStoreDisabled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := activeEntries()
+	if err != nil {
+		return err
+	}
+	snapshot := catalogSnapshot{Version: 1, CreatedAt: time.Now().UTC(), Entries: make([]snapshotEntry, len(entries))}
+	for i, e := range entries {
+		snapshot.Entries[i] = snapshotEntry{
+			ID: e.ID, URL: e.URL, Collection: e.Collection, VideoID: e.VideoID,
+			Plays: e.Plays, Likes: e.Likes, Hashtags: e.Hashtags, MusicID: e.MusicID,
+			PinEvery: e.PinEvery, Weight: e.Weight, Restricted: e.Restricted, AddedAt: e.AddedAt,
+			Video: videoCache.peek(e.URL),
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snapshot); err != nil {
+		return fmt.Errorf("error encoding catalog snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error compressing catalog snapshot: %w", err)
+	}
+
+	if err := store.Put(snapshotKey, bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		return fmt.Errorf("error uploading catalog snapshot: %w", err)
+	}
+	log.Printf("Wrote catalog snapshot of %d URLs (%d bytes) to %s.\n", len(entries), buf.Len(), store)
+	return nil
+}
+
+// loadCatalogSnapshot fills the URL index and the metadata cache from the
+// latest snapshot.
+func loadCatalogSnapshot() error {
+	store, err := openBlobStore("SNAPSHOT")
+	if err != nil {
+		return err
+	}
+	body, err := store.Get(snapshotKey)
+	if err != nil {
+		return fmt.Errorf("error reading catalog snapshot: %w", err)
+	}
+	defer body.Close()
+
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("error decompressing catalog snapshot: %w", err)
+	}
+	var snapshot catalogSnapshot
+	if err := json.NewDecoder(zr).Decode(&snapshot); err != nil {
+		return fmt.Errorf("error decoding catalog snapshot: %w", err)
+	}
+
+	entries := make([]catalogEntry, len(snapshot.Entries))
+	pos := make(map[string]int, len(entries))
+	pinned := make(map[string]bool)
+	videoCache.mu.Lock()
+	for i, s := range snapshot.Entries {
+		entries[i] = catalogEntry{
+			ID: s.ID, URL: s.URL, Collection: s.Collection, VideoID: s.VideoID,
+			Plays: s.Plays, Likes: s.Likes, Hashtags: s.Hashtags, MusicID: s.MusicID,
+			PinEvery: s.PinEvery, Weight: s.Weight, Restricted: s.Restricted, AddedAt: s.AddedAt,
+		}
+		pos[s.ID] = i
+		if s.PinEvery > 0 {
+			pinned[s.ID] = true
+		}
+		if s.Video != nil {
+			// Dated by the snapshot so they are refreshed when served.
+			videoCache.entries[s.URL] = &cachedVideo{info: s.Video, fetchedAt: snapshot.CreatedAt}
+		}
+	}
+	videoCache.mu.Unlock()
+
+	index.mu.Lock()
+	index.entries = entries
+	index.pos = pos
+	index.pinned = pinned
+	index.loaded = true
+	index.loadedAt = snapshot.CreatedAt
+	index.noteSize()
+	index.mu.Unlock()
+
+	log.Printf("Loaded catalog snapshot of %d URLs taken at %s.\n", len(entries), snapshot.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// startDegraded switches to read-only serving from the snapshot after the
+// database could not be reached at startup. It reports false when there is
+// no usable snapshot.
+func startDegraded(dbErr error) bool {
+	if os.Getenv("SNAPSHOT_FALLBACK") != "true" {
+		return false
+	}
+	if err := loadCatalogSnapshot(); err != nil {
+		log.Printf("Cannot fall back to a catalog snapshot: %v\n", err)
+		return false
+	}
+
+	degraded.Store(true)
+	sendAlert(Alert{Kind: "degraded", Level: "error", Message: fmt.Sprintf("Database unavailable (%v); serving read-only from the catalog snapshot.", dbErr)})
+	go awaitDatabase()
+	return true
+}
+
+// awaitDatabase signals a graceful shutdown once the database answers.
+func awaitDatabase() {
+	for range time.Tick(30 * time.Second) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			log.Println("Database is reachable again; restarting to leave degraded mode.")
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(syscall.SIGTERM)
+			}
+			return
+		}
+	}
+}
+
+// readOnlyPaths are served in degraded mode; their handlers work from the
+// URL index and the metadata cache.
+var readOnlyPaths = []string{"/livez", "/readyz", "/startupz", "/openapi.json", "/.well-known/jwks.json", "/api/get", "/api/v1/get", "/api/daily", "/api/media/", "/api/thumb/", "/api/qr/", "/api/collage", "/watch/", "/api/v2/get", "/api/v2/daily", "/debug/vars"}
+
+// readOnly answers 503 for every path outside readOnlyPaths while the
+// server is degraded.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if degraded.Load() && !readOnlyPath(r.URL.Path) {
+			writeJSON(w, http.StatusServiceUnavailable, statusResponse{
+				Code:  http.StatusServiceUnavailable,
+				Msg:   "read-only while the database is unavailable",
+				Error: "degraded",
+				Hint:  "Only /api/get, /api/daily and /api/media are served from the catalog snapshot; retry later.",
+			})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func readOnlyPath(path string) bool {
+	for _, p := range readOnlyPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	snapshotJob = schedule("catalog-snapshot", "SNAPSHOT_INTERVAL", 10*time.Minute, writeCatalogSnapshot)
+	snapshotJob.LeaderOnly = true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Catalog statistics: GET /api/admin/stats shows how the active videos are
+// distributed by region, duration, author, hashtag and time in the
+// catalog, so operators can spot gaps at a glance. ?collection= narrows it
+// to one collection and ?top= (default 20) caps the author and hashtag
+// lists. Videos whose metadata was never resolved count as "unknown". A
+// sharded catalog is counted on every shard, or on the collection's.
+
+type statCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type catalogStats struct {
+	Collection string      `json:"collection,omitempty"`
+	Total      int         `json:"total"`
+	Regions    []statCount `json:"regions"`
+	Durations  []statCount `json:"durations"`
+	Authors    []statCount `json:"authors"`
+	Hashtags   []statCount `json:"hashtags"`
+	Age        []statCount `json:"age"`
+}
+
+var (
+	durationBuckets = []string{"0-15s", "15-30s", "30-60s", "1-3m", "3m+", "unknown"}
+	ageBuckets      = []string{"<1d", "1-7d", "7-30d", "30-90d", "90-365d", "1y+"}
+)
+
+const statsFilter = "u.status = 'active' AND ($1 = '' OR u.collection_id = $1)"
+
+var statsQueries = map[string]string{
+	"regions": `SELECT COALESCE(NULLIF(u.region, ''), 'unknown'), count(*) FROM urls u WHERE ` + statsFilter + `
+		GROUP BY 1 ORDER BY 2 DESC, 1`,
+	"durations": `SELECT CASE
+			WHEN u.duration IS NULL THEN 'unknown'
+			WHEN u.duration < 15 THEN '0-15s'
+			WHEN u.duration < 30 THEN '15-30s'
+			WHEN u.duration < 60 THEN '30-60s'
+			WHEN u.duration < 180 THEN '1-3m'
+			ELSE '3m+' END, count(*)
+		FROM urls u WHERE ` + statsFilter + ` GROUP BY 1`,
+	"authors": `SELECT COALESCE(NULLIF(u.author_username, ''), 'unknown'), count(*) FROM urls u WHERE ` + statsFilter + `
+		GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $2`,
+	"hashtags": `SELECT h.tag, count(*) FROM hashtags h JOIN urls u ON u.id = h.url_id WHERE ` + statsFilter + `
+		GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $2`,
+	"age": `SELECT CASE
+			WHEN u.created_at > now() - interval '1 day' THEN '<1d'
+			WHEN u.created_at > now() - interval '7 days' THEN '1-7d'
+			WHEN u.created_at > now() - interval '30 days' THEN '7-30d'
+			WHEN u.created_at > now() - interval '90 days' THEN '30-90d'
+			WHEN u.created_at > now() - interval '365 days' THEN '90-365d'
+			ELSE '1y+' END, count(*)
+		FROM urls u WHERE ` + statsFilter + ` GROUP BY 1`,
+}
+
+// queryStatCounts runs the stats query name on every shard holding
+// collection and adds up the counts by key. The top lists keep limit keys,
+// all of them when limit is 0; across shards, only the merged list is cut.
+func queryStatCounts(name, collection string, limit int) ([]statCount, error) {
+	conns := collectionDBs(collection)
+	args := []interface{}{collection}
+	if limit > 0 {
+		// A NULL limit is none.
+		var shardLimit interface{}
+		if len(conns) == 1 {
+			shardLimit = limit
+		}
+		args = append(args, shardLimit)
+	}
+	byKey := make(map[string]int)
+	for _, conn := range conns {
+		if err := addStatCounts(conn, name, byKey, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	counts := []statCount{}
+	for key, count := range byKey {
+		counts = append(counts, statCount{Key: key, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if limit > 0 {
+		counts = counts[:min(limit, len(counts))]
+	}
+	return counts, nil
+}
+
+func addStatCounts(conn *sql.DB, name string, byKey map[string]int, args ...interface{}) error {
+	rows, err := conn.Query(statsQueries[name], args...)
+	if err != nil {
+		return fmt.Errorf("error counting %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c statCount
+		if err := rows.Scan(&c.Key, &c.Count); err != nil {
+			return fmt.Errorf("error scanning %s: %w", name, err)
+		}
+		byKey[c.Key] += c.Count
+	}
+	return rows.Err()
+}
+
+// inBucketOrder returns counts in the order of buckets, with empty buckets
+// included so histograms show their gaps.
+func inBucketOrder(counts []statCount, buckets []string) []statCount {
+	byKey := make(map[string]int, len(counts))
+	for _, c := range counts {
+		byKey[c.Key] = c.Count
+	}
+	ordered := make([]statCount, len(buckets))
+	for i, bucket := range buckets {
+		ordered[i] = statCount{Key: bucket, Count: byKey[bucket]}
+	}
+	return ordered
+}
+
+// adminStats handles GET /api/admin/stats.
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	top := 20
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "top must be between 1 and 1000")
+			return
+		}
+		top = n
+	}
+	collection := r.URL.Query().Get("collection")
+
+	stats := catalogStats{Collection: collection}
+	var err error
+	for _, step := range []struct {
+		name   string
+		target *[]statCount
+		limit  int
+	}{
+		{"regions", &stats.Regions, 0},
+		{"durations", &stats.Durations, 0},
+		{"authors", &stats.Authors, top},
+		{"hashtags", &stats.Hashtags, top},
+		{"age", &stats.Age, 0},
+	} {
+		if *step.target, err = queryStatCounts(step.name, collection, step.limit); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+	}
+
+	for _, c := range stats.Regions {
+		stats.Total += c.Count
+	}
+	stats.Durations = inBucketOrder(stats.Durations, durationBuckets)
+	stats.Age = inBucketOrder(stats.Age, ageBuckets)
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/store"
+)
+
+// catalog reads and records the catalog; see the store package.
+var catalog *store.Store
+
+// prepareStatements opens the catalog, whose hot queries are prepared once
+// at startup instead of being parsed and planned on every request.
+func prepareStatements() error {
+	var err error
+	if catalog, err = openCatalog(); err != nil {
+		return err
+	}
+	for name, query := range catalog.Statements() {
+		statementNames.Store(query, name)
+	}
+	return nil
+}
+
+var (
+	errNoURLs    = store.ErrNoURLs
+	errNoMatches = errors.New("no videos match the requested filters")
+)
+
+// getRandomURL picks an entry accepted by match with sel from the
+// in-memory index, falling back to the database while the index has not
+// loaded yet.
+func getRandomURL(sel Selector, match func(catalogEntry) bool) (catalogEntry, error) {
+	e, ok, loaded := index.selectWith(sel, match)
+	if !loaded {
+		if match == nil && sel.Name() == "uniform" {
+			return catalog.Random()
+		}
+		entries, err := activeEntries()
+		if err != nil {
+			return e, err
+		}
+		if len(entries) == 0 {
+			return e, errNoURLs
+		}
+		e, ok = sel.Select(entries, match)
+		if !ok {
+			return e, errNoMatches
+		}
+		return e, nil
+	}
+	if !ok {
+		if index.size() == 0 {
+			return e, errNoURLs
+		}
+		return e, errNoMatches
+	}
+	return e, nil
+}
+
+func activeEntryByID(id string) (catalogEntry, error) {
+	if degraded.Load() {
+		if e, ok := index.lookup(id); ok {
+			return e, nil
+		}
+		return catalogEntry{}, sql.ErrNoRows
+	}
+	return catalog.Entry(id)
+}
+
+// sampleEntries returns up to n distinct random active entries.
+func sampleEntries(n int) ([]catalogEntry, error) {
+	if picked, loaded := index.sample(n); loaded {
+		return picked, nil
+	}
+	return catalog.Sample(n)
+}
+
+// activeEntries returns every active entry, from the index when loaded.
+func activeEntries() ([]catalogEntry, error) {
+	if entries, loaded := index.snapshot(); loaded {
+		return entries, nil
+	}
+	return catalog.Active()
+}
+
+// recordResolved stores what was learned from the upstream (see
+// Store.RecordResolved). Identifier changes are broadcast by the
+// urls_changed trigger; stats change on nearly every resolve, so they are
+// kept out of the trigger and only patched into the local index, reaching
+// other replicas on their next full reload.
+func recordResolved(id string, video *Video) {
+	tags, changed, err := catalog.RecordResolved(id, video)
+	if err != nil {
+		log.Printf("Error recording video %s: %v\n", id, err)
+	}
+	recordHistory(id, video.Stats)
+
+	st := video.Stats
+	index.update(id, func(e *catalogEntry) {
+		e.VideoID = video.ID
+		e.Plays = st.Plays
+		e.Likes = st.Likes
+		e.MusicID = video.Music.ID
+		if changed {
+			e.Hashtags = tags
+		}
+	})
+}
+
+// recordServed counts a serve of id, emits its video.served event and
+// logs it to the serve log.
+func recordServed(id string, ev serveEvent) {
+	logServe(ev)
+	index.update(id, func(e *catalogEntry) {
+		e.LastServed = time.Now()
+	})
+
+	var err error
+	if catalog.Sharded() {
+		if err = catalog.RecordServed(id); err == nil {
+			emitEvent(ev.Type, ev)
+		}
+	} else {
+		_, err = execWithEvent("UPDATE urls SET serve_count = serve_count + 1, last_served_at = now() WHERE id = $1", ev.Type, ev, id)
+	}
+	if err != nil {
+		log.Printf("Error recording serve of %s: %v\n", id, err)
+	}
+}
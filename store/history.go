@@ -0,0 +1,121 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// Snapshot is the engagement of a video at one point in time.
+type Snapshot struct {
+	Stats      resolver.Stats
+	RecordedAt time.Time
+}
+
+// RecordHistory adds stats to the history of the URL with the given id,
+// unless a snapshot was taken less than every ago, so frequently served
+// videos do not grow a row per resolve.
+func (s *Store) RecordHistory(id string, stats resolver.Stats, every time.Duration) error {
+	sh, err := s.owner(id)
+	if err != nil {
+		return err
+	}
+	_, err = sh.db.Exec(`
+	INSERT INTO video_stats_history (url_id, play_count, digg_count, comment_count, share_count)
+	SELECT $1, $2, $3, $4, $5
+	WHERE NOT EXISTS (
+		SELECT 1 FROM video_stats_history
+		WHERE url_id = $1 AND recorded_at > now() - make_interval(secs => $6)
+	)
+	`, id, stats.Plays, stats.Likes, stats.Comments, stats.Shares, every.Seconds())
+	if err != nil {
+		return fmt.Errorf("error recording stats history: %w", err)
+	}
+	return nil
+}
+
+// History returns up to limit snapshots of the URL with the given id taken
+// after since, oldest first.
+func (s *Store) History(id string, since time.Time, limit int) ([]Snapshot, error) {
+	sh, err := s.owner(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sh.db.Query(`
+	SELECT play_count, digg_count, comment_count, share_count, recorded_at
+	FROM video_stats_history
+	WHERE url_id = $1 AND recorded_at > $2
+	ORDER BY recorded_at
+	LIMIT $3
+	`, id, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error loading stats history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []Snapshot
+	for rows.Next() {
+		var snap Snapshot
+		st := &snap.Stats
+		if err := rows.Scan(&st.Plays, &st.Likes, &st.Comments, &st.Shares, &snap.RecordedAt); err != nil {
+			return nil, fmt.Errorf("error scanning stats history: %w", err)
+		}
+		history = append(history, snap)
+	}
+	return history, rows.Err()
+}
+
+// PruneHistory deletes the snapshots taken before before on every shard and
+// returns how many it deleted.
+func (s *Store) PruneHistory(before time.Time) (int64, error) {
+	var total int64
+	for _, sh := range s.shards {
+		result, err := sh.db.Exec("DELETE FROM video_stats_history WHERE recorded_at < $1", before)
+		if err != nil {
+			return total, fmt.Errorf("error pruning stats history on shard %s: %w", sh.name, err)
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// Engagement is the latest stats of a resolved video.
+type Engagement struct {
+	ID         string
+	Collection string
+	VideoID    string
+	Stats      resolver.Stats
+	Serves     int64
+}
+
+// Engagements returns the latest stats of every resolved active URL on
+// every shard.
+func (s *Store) Engagements() ([]Engagement, error) {
+	var all []Engagement
+	for _, sh := range s.shards {
+		rows, err := sh.db.Query(`
+		SELECT id, collection_id, COALESCE(video_id, ''), play_count, digg_count, comment_count, share_count, serve_count
+		FROM urls
+		WHERE status = 'active' AND stats_updated_at IS NOT NULL
+		`)
+		if err != nil {
+			return nil, fmt.Errorf("error loading engagement on shard %s: %w", sh.name, err)
+		}
+		for rows.Next() {
+			var e Engagement
+			st := &e.Stats
+			if err := rows.Scan(&e.ID, &e.Collection, &e.VideoID, &st.Plays, &st.Likes, &st.Comments, &st.Shares, &e.Serves); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning engagement: %w", err)
+			}
+			all = append(all, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
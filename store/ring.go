@@ -0,0 +1,58 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points each shard has on a Ring. More
+// points spread collections more evenly.
+const ringReplicas = 128
+
+// Ring places collections on shards by consistent hashing: each shard owns
+// the arcs of a hash ring ending at its points, so adding or removing a
+// shard only moves the collections on its arcs, about one in n, instead of
+// nearly all of them as hashing modulo the shard count would.
+type Ring struct {
+	points []uint64
+	owners map[uint64]string
+}
+
+// NewRing returns a ring of the named shards.
+func NewRing(shards ...string) *Ring {
+	r := &Ring{owners: make(map[uint64]string)}
+	for _, name := range shards {
+		for i := 0; i < ringReplicas; i++ {
+			p := ringHash(name + "#" + strconv.Itoa(i))
+			if owner, taken := r.owners[p]; taken && owner < name {
+				continue
+			}
+			r.owners[p] = name
+		}
+	}
+	for p := range r.owners {
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Locate returns the shard holding collection, or "" for an empty ring.
+func (r *Ring) Locate(collection string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(collection)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
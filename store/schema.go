@@ -0,0 +1,419 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Migration is one step of the schema.
+type Migration struct {
+	Name  string
+	Query string
+}
+
+// Migrations are applied in order and recorded in schema_migrations, so
+// append new entries at the end and never edit one that has shipped.
+var Migrations = []Migration{
+	{"0001_create_urls", `
+	CREATE TABLE IF NOT EXISTS urls (
+		id UUID PRIMARY KEY,
+		url TEXT NOT NULL
+	);
+	`},
+	{"0002_url_metadata_columns", `
+	ALTER TABLE urls
+		ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active',
+		ADD COLUMN IF NOT EXISTS collection_id TEXT NOT NULL DEFAULT 'default',
+		ADD COLUMN IF NOT EXISTS video_id TEXT,
+		ADD COLUMN IF NOT EXISTS author_id TEXT,
+		ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	`},
+	{"0003_url_indexes", `
+	CREATE INDEX IF NOT EXISTS urls_status_id_idx ON urls (status, id);
+	CREATE INDEX IF NOT EXISTS urls_collection_id_idx ON urls (collection_id);
+	CREATE INDEX IF NOT EXISTS urls_author_id_idx ON urls (author_id);
+	CREATE INDEX IF NOT EXISTS urls_video_id_idx ON urls (video_id);
+	`},
+	{"0004_urls_changed_notify", `
+	CREATE OR REPLACE FUNCTION notify_urls_changed() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('urls_changed', '');
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS urls_changed ON urls;
+	CREATE TRIGGER urls_changed
+		AFTER INSERT OR UPDATE OF url, status OR DELETE OR TRUNCATE ON urls
+		FOR EACH STATEMENT EXECUTE FUNCTION notify_urls_changed();
+	`},
+	{"0005_urls_changed_row_events", `
+	CREATE OR REPLACE FUNCTION notify_urls_changed() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'TRUNCATE' THEN
+			PERFORM pg_notify('urls_changed', json_build_object('op', TG_OP)::text);
+		ELSIF TG_OP = 'DELETE' THEN
+			PERFORM pg_notify('urls_changed', json_build_object('op', TG_OP, 'id', OLD.id)::text);
+		ELSE
+			PERFORM pg_notify('urls_changed', json_build_object('op', TG_OP, 'id', NEW.id, 'url', NEW.url, 'status', NEW.status)::text);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS urls_changed ON urls;
+	DROP TRIGGER IF EXISTS urls_truncated ON urls;
+	CREATE TRIGGER urls_changed
+		AFTER INSERT OR UPDATE OF url, status OR DELETE ON urls
+		FOR EACH ROW EXECUTE FUNCTION notify_urls_changed();
+	CREATE TRIGGER urls_truncated
+		AFTER TRUNCATE ON urls
+		FOR EACH STATEMENT EXECUTE FUNCTION notify_urls_changed();
+	`},
+	{"0006_create_playlists", `
+	CREATE TABLE IF NOT EXISTS playlists (
+		id UUID PRIMARY KEY,
+		url_ids UUID[] NOT NULL,
+		position INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS playlists_created_at_idx ON playlists (created_at);
+	`},
+	{"0007_create_favorites", `
+	CREATE TABLE IF NOT EXISTS favorites (
+		api_key TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
+		url_id UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (api_key, user_id, url_id)
+	);
+	`},
+	{"0008_urls_changed_on_catalog_columns", `
+	DROP TRIGGER IF EXISTS urls_changed ON urls;
+	CREATE TRIGGER urls_changed
+		AFTER INSERT OR UPDATE OF url, status, collection_id, video_id OR DELETE ON urls
+		FOR EACH ROW EXECUTE FUNCTION notify_urls_changed();
+	`},
+	{"0009_url_stats", `
+	ALTER TABLE urls
+		ADD COLUMN IF NOT EXISTS play_count BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS digg_count BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS comment_count BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS share_count BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS stats_updated_at TIMESTAMPTZ;
+	`},
+	{"0010_hashtags", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS title TEXT;
+
+	CREATE TABLE IF NOT EXISTS hashtags (
+		url_id UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (url_id, tag)
+	);
+	CREATE INDEX IF NOT EXISTS hashtags_tag_idx ON hashtags (tag);
+	`},
+	{"0011_url_music", `
+	ALTER TABLE urls
+		ADD COLUMN IF NOT EXISTS music_id TEXT,
+		ADD COLUMN IF NOT EXISTS music_title TEXT;
+	CREATE INDEX IF NOT EXISTS urls_music_id_idx ON urls (music_id);
+	`},
+	{"0012_cover_phash", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS cover_phash BIGINT;
+
+	CREATE TABLE IF NOT EXISTS duplicate_candidates (
+		id UUID PRIMARY KEY,
+		url_id UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		duplicate_of UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		distance INT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS duplicate_candidates_status_idx ON duplicate_candidates (status);
+	`},
+	{"0013_retention", `
+	ALTER TABLE urls
+		ADD COLUMN IF NOT EXISTS serve_count BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS last_served_at TIMESTAMPTZ;
+
+	CREATE TABLE IF NOT EXISTS retention_policies (
+		collection_id TEXT PRIMARY KEY,
+		max_age_days INT,
+		max_serves INT
+	);
+	`},
+	{"0014_pinned_videos", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS pinned_every INT;
+
+	DROP TRIGGER IF EXISTS urls_changed ON urls;
+	CREATE TRIGGER urls_changed
+		AFTER INSERT OR UPDATE OF url, status, collection_id, video_id, pinned_every OR DELETE ON urls
+		FOR EACH ROW EXECUTE FUNCTION notify_urls_changed();
+	`},
+	{"0015_url_weight", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS weight DOUBLE PRECISION NOT NULL DEFAULT 1;
+
+	DROP TRIGGER IF EXISTS urls_changed ON urls;
+	CREATE TRIGGER urls_changed
+		AFTER INSERT OR UPDATE OF url, status, collection_id, video_id, pinned_every, weight OR DELETE ON urls
+		FOR EACH ROW EXECUTE FUNCTION notify_urls_changed();
+	`},
+	{"0016_backfill_attempts", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS backfill_attempted_at TIMESTAMPTZ;
+
+	CREATE INDEX IF NOT EXISTS urls_missing_metadata_idx ON urls (backfill_attempted_at NULLS FIRST, created_at)
+		WHERE stats_updated_at IS NULL;
+	`},
+	{"0017_video_details", `
+	ALTER TABLE urls
+		ADD COLUMN IF NOT EXISTS author_username TEXT,
+		ADD COLUMN IF NOT EXISTS author_nickname TEXT,
+		ADD COLUMN IF NOT EXISTS duration INT,
+		ADD COLUMN IF NOT EXISTS region TEXT;
+	`},
+	{"0018_reports", `
+	CREATE TABLE IF NOT EXISTS reports (
+		id UUID PRIMARY KEY,
+		url_id UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		reporter TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS reports_open_reporter_idx ON reports (url_id, reporter) WHERE status = 'open';
+	`},
+	{"0019_restricted_countries", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS restricted_countries TEXT[] NOT NULL DEFAULT '{}';
+
+	DROP TRIGGER IF EXISTS urls_changed ON urls;
+	CREATE TRIGGER urls_changed
+		AFTER INSERT OR UPDATE OF url, status, collection_id, video_id, pinned_every, weight, restricted_countries OR DELETE ON urls
+		FOR EACH ROW EXECUTE FUNCTION notify_urls_changed();
+	`},
+	{"0020_data_deletion", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS submitted_by TEXT;
+	CREATE INDEX IF NOT EXISTS urls_submitted_by_idx ON urls (submitted_by) WHERE submitted_by IS NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS deletion_tombstones (
+		id UUID PRIMARY KEY,
+		subject_hash TEXT NOT NULL,
+		deleted JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS deletion_tombstones_subject_idx ON deletion_tombstones (subject_hash);
+	`},
+	{"0021_takedowns", `
+	CREATE TABLE IF NOT EXISTS takedowns (
+		id UUID PRIMARY KEY,
+		url_id UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		claimed_url TEXT NOT NULL,
+		claimant_name TEXT NOT NULL,
+		claimant_email TEXT NOT NULL,
+		statement TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		resolved_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS takedowns_status_idx ON takedowns (status);
+	`},
+	{"0022_region_heartbeats", `
+	CREATE TABLE IF NOT EXISTS region_heartbeats (
+		region TEXT NOT NULL,
+		instance TEXT NOT NULL,
+		seen_at TIMESTAMPTZ NOT NULL,
+		index_size INT NOT NULL,
+		upstream_ok BIGINT NOT NULL,
+		upstream_failed BIGINT NOT NULL,
+		last_upstream_error TEXT,
+		PRIMARY KEY (region, instance)
+	);
+	`},
+	{"0023_outbox", `
+	CREATE TABLE IF NOT EXISTS outbox (
+		id BIGSERIAL PRIMARY KEY,
+		event_type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`},
+	{"0024_url_version", `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+	CREATE OR REPLACE FUNCTION bump_url_version() RETURNS trigger AS $$
+	BEGIN
+		NEW.version := OLD.version + 1;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS urls_version ON urls;
+	CREATE TRIGGER urls_version
+		BEFORE UPDATE OF url, status, collection_id, pinned_every, weight, restricted_countries ON urls
+		FOR EACH ROW EXECUTE FUNCTION bump_url_version();
+	`},
+	{"0025_urls_created_at_id_idx", `
+	CREATE INDEX IF NOT EXISTS urls_created_at_id_idx ON urls (created_at, id);
+	`},
+	{"0026_api_key_tiers", `
+	CREATE TABLE IF NOT EXISTS api_key_tiers (
+		key_hash TEXT PRIMARY KEY,
+		tier TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`},
+	{"0027_api_keys", `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id UUID PRIMARY KEY,
+		key_hash TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		scopes TEXT[] NOT NULL DEFAULT '{}',
+		expires_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS api_keys_expires_at_idx ON api_keys (expires_at) WHERE expires_at IS NOT NULL;
+	`},
+	{"0028_api_key_rotation", `
+	ALTER TABLE api_keys
+		ADD COLUMN IF NOT EXISTS previous_key_hash TEXT UNIQUE,
+		ADD COLUMN IF NOT EXISTS previous_expires_at TIMESTAMPTZ;
+	`},
+	{"0029_api_key_signing", `
+	ALTER TABLE api_keys
+		ADD COLUMN IF NOT EXISTS signing_secret TEXT,
+		ADD COLUMN IF NOT EXISTS previous_signing_secret TEXT;
+	`},
+	{"0030_debug_captures", `
+	CREATE TABLE IF NOT EXISTS debug_captures (
+		key_hash TEXT PRIMARY KEY,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS debug_capture_entries (
+		id BIGSERIAL PRIMARY KEY,
+		key_hash TEXT NOT NULL REFERENCES debug_captures (key_hash) ON DELETE CASCADE,
+		captured_at TIMESTAMPTZ NOT NULL,
+		entry JSONB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS debug_capture_entries_key_hash_idx ON debug_capture_entries (key_hash, captured_at);
+	`},
+	{"0031_url_suggestions", `
+	CREATE TABLE IF NOT EXISTS url_suggestions (
+		id UUID PRIMARY KEY,
+		url TEXT NOT NULL,
+		video_id TEXT NOT NULL UNIQUE,
+		author_username TEXT NOT NULL,
+		title TEXT,
+		collection_id TEXT NOT NULL DEFAULT 'default',
+		posted_at TIMESTAMPTZ,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS url_suggestions_status_idx ON url_suggestions (status);
+	CREATE TABLE IF NOT EXISTS author_feed_checks (
+		author_username TEXT PRIMARY KEY,
+		checked_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS urls_author_username_idx ON urls (author_username);
+	`},
+	{"0032_submissions", `
+	CREATE TABLE IF NOT EXISTS submissions (
+		id UUID PRIMARY KEY,
+		url TEXT NOT NULL,
+		url_id UUID NOT NULL,
+		submitted_by TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS submissions_status_idx ON submissions (status, updated_at);
+	`},
+	{"0033_collection_routes", `
+	ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS collection TEXT NOT NULL DEFAULT '';
+	ALTER TABLE submissions ADD COLUMN IF NOT EXISTS collection TEXT NOT NULL DEFAULT 'default';
+	`},
+	{"0034_api_key_notifications", `
+	ALTER TABLE api_keys
+		ADD COLUMN IF NOT EXISTS notify_url TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS notify_email TEXT NOT NULL DEFAULT '';
+	`},
+	{"0035_video_stats_history", `
+	CREATE TABLE IF NOT EXISTS video_stats_history (
+		url_id UUID NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+		play_count BIGINT NOT NULL,
+		digg_count BIGINT NOT NULL,
+		comment_count BIGINT NOT NULL,
+		share_count BIGINT NOT NULL,
+		recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS video_stats_history_url_idx ON video_stats_history (url_id, recorded_at);
+	CREATE INDEX IF NOT EXISTS video_stats_history_recorded_at_idx ON video_stats_history (recorded_at);
+	`},
+	{"0036_report_ips", `
+	ALTER TABLE reports ADD COLUMN IF NOT EXISTS reporter_ip TEXT NOT NULL DEFAULT '';
+	`},
+	{"0037_hash_submitter_keys", `
+	UPDATE urls SET submitted_by = 'key:' || encode(sha256(convert_to(substr(submitted_by, 5), 'UTF8')), 'hex')
+	WHERE submitted_by LIKE 'key:%';
+	UPDATE submissions SET submitted_by = 'key:' || encode(sha256(convert_to(substr(submitted_by, 5), 'UTF8')), 'hex')
+	WHERE submitted_by LIKE 'key:%';
+	UPDATE reports SET reporter = 'key:' || encode(sha256(convert_to(substr(reporter, 5), 'UTF8')), 'hex')
+	WHERE reporter LIKE 'key:%';
+	UPDATE favorites SET api_key = encode(sha256(convert_to(api_key, 'UTF8')), 'hex');
+	`},
+}
+
+// Migrate applies the pending Migrations to db.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	applied := make(map[string]bool)
+	rows, err := db.Query("SELECT name FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("error reading schema_migrations: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning schema_migrations: %w", err)
+		}
+		applied[name] = true
+	}
+	rows.Close()
+
+	for _, m := range Migrations {
+		if applied[m.Name] {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("error starting migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec(m.Query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (name) VALUES ($1)", m.Name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording migration %s: %w", m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing migration %s: %w", m.Name, err)
+		}
+
+		log.Printf("Applied migration %s\n", m.Name)
+	}
+
+	return nil
+}
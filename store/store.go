@@ -0,0 +1,467 @@
+// Package store reads and records the catalog in the shoti-srv Postgres
+// schema, so a program embedding the engine can share a database with the
+// server, or run on its own after Migrate:
+//
+//	catalog, err := store.Open(db)
+//	entries, err := catalog.Active()
+//	e, ok := selector.Uniform{}.Select(entries, nil)
+//	video, err := resolver.Tikwm{}.Resolve(e.URL)
+//	catalog.RecordResolved(e.ID, video)
+//	catalog.RecordServed(e.ID)
+//
+// Changes made through a Store reach running servers through the database
+// triggers like any other, but emit no webhook events.
+//
+// A Store opened with OpenShards partitions collections across several
+// databases (see Ring) and routes every call to the right one.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/libyzxy0/shoti-srv/resolver"
+	"github.com/libyzxy0/shoti-srv/selector"
+)
+
+// EntryColumns are the columns of urls that ScanEntry reads.
+const EntryColumns = `id, url, collection_id, COALESCE(video_id, ''), play_count, digg_count,
+	ARRAY(SELECT tag FROM hashtags WHERE hashtags.url_id = urls.id), COALESCE(music_id, ''),
+	COALESCE(pinned_every, 0), weight, COALESCE(last_served_at, 'epoch'), restricted_countries, created_at`
+
+// Scanner is a *sql.Row or *sql.Rows.
+type Scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// ScanEntry reads an entry selected with EntryColumns.
+func ScanEntry(row Scanner) (selector.Entry, error) {
+	var e selector.Entry
+	err := row.Scan(&e.ID, &e.URL, &e.Collection, &e.VideoID, &e.Plays, &e.Likes, pq.Array(&e.Hashtags), &e.MusicID, &e.PinEvery, &e.Weight, &e.LastServed, pq.Array(&e.Restricted), &e.AddedAt)
+	return e, err
+}
+
+// ErrNoURLs is returned by Random when the catalog has no active URL.
+var ErrNoURLs = errors.New("no URLs found in the database")
+
+// Store is the catalog in one or more databases. It is safe for concurrent
+// use.
+type Store struct {
+	shards []*shard
+	ring   *Ring
+	// owners maps the ids of entries seen so far to their shard.
+	owners sync.Map
+}
+
+// shard is the catalog in one database.
+type shard struct {
+	name string
+	db   *sql.DB
+
+	randomFrom *sql.Stmt
+	first      *sql.Stmt
+	resolved   *sql.Stmt
+	stats      *sql.Stmt
+	list       *sql.Stmt
+	listPage   *sql.Stmt
+}
+
+var statements = map[string]string{
+	"randomFrom": "SELECT " + EntryColumns + " FROM urls WHERE status = 'active' AND id >= $1 ORDER BY id LIMIT 1",
+	"first":      "SELECT " + EntryColumns + " FROM urls WHERE status = 'active' ORDER BY id LIMIT 1",
+	"resolved": `
+		UPDATE urls SET video_id = $2, author_id = $3
+		WHERE id = $1 AND (video_id IS DISTINCT FROM $2 OR author_id IS DISTINCT FROM $3)
+		`,
+	"stats": `
+		UPDATE urls SET play_count = $2, digg_count = $3, comment_count = $4, share_count = $5,
+			music_id = NULLIF($6, ''), music_title = NULLIF($7, ''),
+			author_username = NULLIF($8, ''), author_nickname = NULLIF($9, ''), duration = $10, region = NULLIF($11, ''),
+			stats_updated_at = now()
+		WHERE id = $1
+		`,
+	"list":     "SELECT id, url, created_at FROM urls WHERE $1 = '' OR collection_id = $1",
+	"listPage": "SELECT id, url, created_at FROM urls WHERE (created_at, id) > ($1, $2) AND ($4 = '' OR collection_id = $4) ORDER BY created_at, id LIMIT $3",
+}
+
+// Open prepares the hot queries of the catalog on db, whose schema must
+// be migrated.
+func Open(db *sql.DB) (*Store, error) {
+	return OpenShards(map[string]*sql.DB{"default": db})
+}
+
+// OpenShards opens a catalog partitioned across the databases in shards,
+// by name, each with a migrated schema. Every collection lives in the
+// shard Ring places it in: entries are added there, and reads of all
+// entries span every shard.
+func OpenShards(shards map[string]*sql.DB) (*Store, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	s := &Store{}
+	var names []string
+	for name, db := range shards {
+		sh := &shard{name: name, db: db}
+		for stmtName, target := range map[string]**sql.Stmt{
+			"randomFrom": &sh.randomFrom,
+			"first":      &sh.first,
+			"resolved":   &sh.resolved,
+			"stats":      &sh.stats,
+			"list":       &sh.list,
+			"listPage":   &sh.listPage,
+		} {
+			stmt, err := db.Prepare(statements[stmtName])
+			if err != nil {
+				return nil, fmt.Errorf("error preparing %q on shard %s: %w", statements[stmtName], name, err)
+			}
+			*target = stmt
+		}
+		s.shards = append(s.shards, sh)
+		names = append(names, name)
+	}
+	sort.Slice(s.shards, func(i, j int) bool { return s.shards[i].name < s.shards[j].name })
+	s.ring = NewRing(names...)
+	return s, nil
+}
+
+// Shard returns the name of the shard holding collection.
+func (s *Store) Shard(collection string) string {
+	return s.ring.Locate(collection)
+}
+
+// ShardDB returns the database of the named shard.
+func (s *Store) ShardDB(name string) *sql.DB {
+	return s.byName(name).db
+}
+
+// Sharded reports whether the catalog spans more than one database.
+func (s *Store) Sharded() bool {
+	return len(s.shards) > 1
+}
+
+// DB returns the database holding the URL with the given id, or
+// sql.ErrNoRows when no shard has it. Rows referring to a URL, such as its
+// reports, live in the same database.
+func (s *Store) DB(id string) (*sql.DB, error) {
+	sh, err := s.owner(id)
+	if err != nil {
+		return nil, err
+	}
+	return sh.db, nil
+}
+
+// DBs returns the database of every shard, in the order of their names.
+func (s *Store) DBs() []*sql.DB {
+	dbs := make([]*sql.DB, len(s.shards))
+	for i, sh := range s.shards {
+		dbs[i] = sh.db
+	}
+	return dbs
+}
+
+func (s *Store) byName(name string) *shard {
+	for _, sh := range s.shards {
+		if sh.name == name {
+			return sh
+		}
+	}
+	return s.shards[0]
+}
+
+// owner returns the shard holding the URL with the given id, asking each
+// shard for ids not seen yet.
+func (s *Store) owner(id string) (*shard, error) {
+	if len(s.shards) == 1 {
+		return s.shards[0], nil
+	}
+	if sh, ok := s.owners.Load(id); ok {
+		return sh.(*shard), nil
+	}
+	for _, sh := range s.shards {
+		var found bool
+		err := sh.db.QueryRow("SELECT true FROM urls WHERE id = $1", id).Scan(&found)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error locating URL on shard %s: %w", sh.name, err)
+		}
+		s.owners.Store(id, sh)
+		return sh, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// scanned remembers that e came from sh.
+func (s *Store) scanned(sh *shard, e selector.Entry) selector.Entry {
+	if len(s.shards) > 1 {
+		s.owners.Store(e.ID, sh)
+	}
+	return e
+}
+
+// Statements returns the SQL of the prepared statements by name.
+func (s *Store) Statements() map[string]string {
+	copied := make(map[string]string, len(statements))
+	for name, query := range statements {
+		copied[name] = query
+	}
+	return copied
+}
+
+// Random returns a random active entry. It seeks to a random point in the
+// primary key index and takes the next active row, wrapping to the first
+// row when the pivot lands past the end. Because ids are random v4 UUIDs
+// this is close to uniform while costing a single index seek rather than
+// an OFFSET scan. A sharded catalog picks a random shard first, so entries
+// of smaller shards are picked more often.
+func (s *Store) Random() (selector.Entry, error) {
+	for _, i := range rand.Perm(len(s.shards)) {
+		sh := s.shards[i]
+		e, err := ScanEntry(sh.randomFrom.QueryRow(uuid.New().String()))
+		if err == sql.ErrNoRows {
+			e, err = ScanEntry(sh.first.QueryRow())
+			if err == sql.ErrNoRows {
+				continue
+			}
+		}
+		if err != nil {
+			return e, fmt.Errorf("error retrieving random URL: %w", err)
+		}
+		return s.scanned(sh, e), nil
+	}
+	return selector.Entry{}, ErrNoURLs
+}
+
+// Entry returns the active entry with the given id, or sql.ErrNoRows.
+func (s *Store) Entry(id string) (selector.Entry, error) {
+	sh, err := s.owner(id)
+	if err != nil {
+		return selector.Entry{}, err
+	}
+	return ScanEntry(sh.db.QueryRow("SELECT "+EntryColumns+" FROM urls WHERE id = $1 AND status = 'active'", id))
+}
+
+// EntryByVideo returns the first active entry of the upstream video with
+// the given id, or sql.ErrNoRows.
+func (s *Store) EntryByVideo(videoID string) (selector.Entry, error) {
+	for _, sh := range s.shards {
+		e, err := ScanEntry(sh.db.QueryRow("SELECT "+EntryColumns+" FROM urls WHERE video_id = $1 AND status = 'active' ORDER BY created_at LIMIT 1", videoID))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return e, err
+		}
+		return s.scanned(sh, e), nil
+	}
+	return selector.Entry{}, sql.ErrNoRows
+}
+
+// Active returns every active entry.
+func (s *Store) Active() ([]selector.Entry, error) {
+	return s.query("error retrieving URLs", "SELECT "+EntryColumns+" FROM urls WHERE status = 'active'")
+}
+
+// Sample returns up to n distinct random active entries.
+func (s *Store) Sample(n int) ([]selector.Entry, error) {
+	entries, err := s.query("error sampling URLs", "SELECT "+EntryColumns+" FROM urls WHERE status = 'active' ORDER BY random() LIMIT $1", n)
+	if len(s.shards) > 1 {
+		rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+		entries = entries[:min(n, len(entries))]
+	}
+	return entries, err
+}
+
+// query runs query on every shard and returns the entries of all.
+func (s *Store) query(failure, query string, args ...interface{}) ([]selector.Entry, error) {
+	var entries []selector.Entry
+	for _, sh := range s.shards {
+		rows, err := sh.db.Query(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("%s on shard %s: %w", failure, sh.name, err)
+		}
+		for rows.Next() {
+			e, err := ScanEntry(rows)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning URL: %w", err)
+			}
+			entries = append(entries, s.scanned(sh, e))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("%s on shard %s: %w", failure, sh.name, err)
+		}
+	}
+	return entries, nil
+}
+
+// Listed is a URL as listed by List.
+type Listed struct {
+	ID      string
+	URL     string
+	AddedAt time.Time
+}
+
+// List returns every URL of collection ("" for all), of any status, or with
+// limit > 0 the first limit URLs added after the one added at after with id
+// afterID, in (AddedAt, ID) order.
+func (s *Store) List(collection string, after time.Time, afterID string, limit int) ([]Listed, error) {
+	shards := s.shards
+	if collection != "" {
+		shards = []*shard{s.byName(s.Shard(collection))}
+	}
+	var urls []Listed
+	for _, sh := range shards {
+		var (
+			rows *sql.Rows
+			err  error
+		)
+		if limit > 0 {
+			rows, err = sh.listPage.Query(after, afterID, limit, collection)
+		} else {
+			rows, err = sh.list.Query(collection)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error listing URLs on shard %s: %w", sh.name, err)
+		}
+		for rows.Next() {
+			var u Listed
+			if err := rows.Scan(&u.ID, &u.URL, &u.AddedAt); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning URL: %w", err)
+			}
+			urls = append(urls, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error listing URLs on shard %s: %w", sh.name, err)
+		}
+	}
+	if limit > 0 && len(shards) > 1 {
+		sort.Slice(urls, func(i, j int) bool {
+			if !urls[i].AddedAt.Equal(urls[j].AddedAt) {
+				return urls[i].AddedAt.Before(urls[j].AddedAt)
+			}
+			return urls[i].ID < urls[j].ID
+		})
+		urls = urls[:min(limit, len(urls))]
+	}
+	return urls, nil
+}
+
+// Add adds url to collection as submitted by submitter and returns its id.
+func (s *Store) Add(url, collection, submitter string) (string, error) {
+	id := uuid.New().String()
+	if _, err := s.Insert(id, url, collection, submitter); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Insert adds url to collection with the given id, unless a URL with that
+// id exists already, and reports whether it did.
+func (s *Store) Insert(id, url, collection, submitter string) (bool, error) {
+	sh := s.byName(s.Shard(collection))
+	result, err := sh.db.Exec("INSERT INTO urls (id, url, collection_id, submitted_by) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING", id, url, collection, submitter)
+	if err != nil {
+		return false, fmt.Errorf("error adding URL: %w", err)
+	}
+	s.owners.Store(id, sh)
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// RecordResolved stores the identifiers, details and engagement stats of
+// the video resolved for the URL with the given id, so they can be used for
+// filtering and listing. It returns the video's hashtags when they changed.
+func (s *Store) RecordResolved(id string, video *resolver.Video) (tags []string, changed bool, err error) {
+	sh, err := s.owner(id)
+	if err != nil {
+		return nil, false, err
+	}
+	var errs []error
+	if _, err := sh.resolved.Exec(id, video.ID, video.Author.ID); err != nil {
+		errs = append(errs, fmt.Errorf("error recording resolved video: %w", err))
+	}
+
+	st := video.Stats
+	_, err = sh.stats.Exec(id, st.Plays, st.Likes, st.Comments, st.Shares, video.Music.ID, video.Music.Title,
+		video.Author.Username, video.Author.Nickname, video.Duration, video.Region)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error recording stats: %w", err))
+	}
+
+	tags, changed, err = sh.recordTitle(id, video.Title)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error recording title: %w", err))
+	}
+	return tags, changed, errors.Join(errs...)
+}
+
+// RecordServed counts a serve of the URL with the given id.
+func (s *Store) RecordServed(id string) error {
+	sh, err := s.owner(id)
+	if err != nil {
+		return err
+	}
+	_, err = sh.db.Exec("UPDATE urls SET serve_count = serve_count + 1, last_served_at = now() WHERE id = $1", id)
+	return err
+}
+
+var hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+// Hashtags returns the distinct, lowercased hashtags in title.
+func Hashtags(title string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, m := range hashtagPattern.FindAllStringSubmatch(title, -1) {
+		tag := strings.ToLower(m[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// recordTitle stores title and, when it changed, replaces the URL's
+// hashtag rows. It returns the new hashtags and whether they were updated.
+func (s *shard) recordTitle(id, title string) ([]string, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE urls SET title = $2 WHERE id = $1 AND title IS DISTINCT FROM $2", id, title)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, false, nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM hashtags WHERE url_id = $1", id); err != nil {
+		return nil, false, err
+	}
+
+	tags := Hashtags(title)
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO hashtags (url_id, tag) VALUES ($1, $2)", id, tag); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return tags, true, tx.Commit()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Asynchronous submissions: a POST /api/new sent with "Prefer:
+// respond-async" (or ?async=true) is answered with 202 and a submission as
+// soon as it is recorded, with its status URL in Location; the URL is added
+// in the background. GET /api/submissions/{id} reports the status: pending,
+// processing, accepted (url_id is then in the catalog) or failed. Only the
+// key that made a submission can see it.
+//
+// Submissions are processed by the replica that accepted them. The leader
+// picks up those left pending by a replica that went away, and retries
+// those stuck processing; adding a URL is idempotent, so a retry never adds
+// it twice. Finished submissions are deleted after SUBMISSION_RETENTION.
+
+type submission struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	URLID     string    `json:"url_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type submissionResponse struct {
+	Code int        `json:"code"`
+	Msg  string     `json:"msg"`
+	Data submission `json:"data"`
+}
+
+// prefersAsync reports whether the caller asked for an asynchronous add.
+func prefersAsync(r *http.Request) bool {
+	if r.URL.Query().Get("async") == "true" {
+		return true
+	}
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptSubmission records url as a pending submission of submitter (see
+// submitterID), answers 202 and adds it in the background.
+func acceptSubmission(w http.ResponseWriter, r *http.Request, url URL, submitter string) {
+	s := submission{ID: uuid.New().String(), URL: url.URL, URLID: url.ID, Status: "pending"}
+	err := db.QueryRow("INSERT INTO submissions (id, url, url_id, submitted_by, collection) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at",
+		s.ID, s.URL, s.URLID, submitter, url.collection()).Scan(&s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		log.Printf("Error recording submission: %v\n", err)
+		abuse.recordError("db")
+		writeCompatError(w, r, http.StatusInternalServerError, "Error adding URL to database")
+		return
+	}
+
+	background(func() {
+		if err := processSubmission(s.ID); err != nil {
+			log.Printf("Error processing submission %s: %v\n", s.ID, err)
+		}
+	})
+
+	w.Header().Set("Location", "/api/submissions/"+s.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeSubmission(w, r, http.StatusAccepted, s)
+}
+
+func writeSubmission(w http.ResponseWriter, r *http.Request, status int, s submission) {
+	if apiVersion(r) >= 2 {
+		writeJSON(w, status, submissionResponse{Code: status, Msg: "success", Data: s})
+		return
+	}
+	writeJSON(w, status, s)
+}
+
+// processSubmission adds the URL of a pending submission, unless another
+// replica claimed it first.
+func processSubmission(id string) error {
+	var url URL
+	var submitter string
+	err := db.QueryRow(`
+		UPDATE submissions SET status = 'processing', updated_at = now()
+		WHERE id = $1 AND status = 'pending'
+		RETURNING url_id, url, submitted_by, collection
+		`, id).Scan(&url.ID, &url.URL, &submitter, &url.Collection)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := insertURL(url, submitter); err != nil {
+		abuse.recordError("db")
+		_, uerr := db.Exec("UPDATE submissions SET status = 'failed', error = $2, updated_at = now() WHERE id = $1", id, "Error adding URL to database")
+		if uerr != nil {
+			log.Printf("Error recording failure of submission %s: %v\n", id, uerr)
+		}
+		return err
+	}
+	if _, err := db.Exec("UPDATE submissions SET status = 'accepted', updated_at = now() WHERE id = $1", id); err != nil {
+		return err
+	}
+	fingerprintURL(url.ID, url.URL)
+	return nil
+}
+
+func getSubmission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/submissions/"), "/")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusNotFound, "submission not found")
+		return
+	}
+
+	var s submission
+	var submitter string
+	var failure sql.NullString
+	err := db.QueryRow("SELECT id, url, url_id, status, error, created_at, updated_at, submitted_by FROM submissions WHERE id = $1", id).
+		Scan(&s.ID, &s.URL, &s.URLID, &s.Status, &failure, &s.CreatedAt, &s.UpdatedAt, &submitter)
+	if err == sql.ErrNoRows || (err == nil && submitter != submitterID(r)) {
+		writeError(w, http.StatusNotFound, "submission not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up submission %s: %v\n", id, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	s.Error = failure.String
+	if s.Status == "pending" || s.Status == "processing" {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, http.StatusOK, submissionResponse{Code: http.StatusOK, Msg: "success", Data: s})
+}
+
+// recoverSubmissions processes submissions left behind by replicas that
+// went away and deletes old finished ones.
+func recoverSubmissions() error {
+	_, err := db.Exec("UPDATE submissions SET status = 'pending' WHERE status = 'processing' AND updated_at < now() - interval '5 minutes'")
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT id FROM submissions WHERE status = 'pending' AND updated_at < now() - interval '1 minute' ORDER BY created_at LIMIT 100")
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := processSubmission(id); err != nil {
+			log.Printf("Error processing submission %s: %v\n", id, err)
+		}
+	}
+
+	retention := envDuration("SUBMISSION_RETENTION", 7*24*time.Hour)
+	_, err = db.Exec("DELETE FROM submissions WHERE status IN ('accepted', 'failed') AND updated_at < $1", time.Now().Add(-retention))
+	return err
+}
+
+func init() {
+	schedule("submissions", "", time.Minute, recoverSubmissions).LeaderOnly = true
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// Catalog suggestions keep the catalog growing without manual curation:
+// every SUGGESTIONS_INTERVAL (disabled by default) the leader fetches the
+// recent posts of up to SUGGESTIONS_AUTHORS authors already in the
+// catalog, least recently checked first, from tikwm's user feed and queues
+// posts that are not in the catalog yet for review. Only posts made since
+// the author was last checked, or within SUGGESTIONS_LOOKBACK on the first
+// check, are suggested. Feed requests share the upstream keys and rate
+// limit with resolves.
+//
+// GET /api/admin/suggestions lists the pending suggestions and POST
+// /api/admin/suggestions/{id}/approve or /dismiss reviews one; approving
+// adds the URL to the collection its author's videos are in.
+
+var suggestionsJob *scheduledJob
+
+type urlSuggestion struct {
+	ID         string     `json:"id"`
+	URL        string     `json:"url"`
+	VideoID    string     `json:"video_id"`
+	Author     string     `json:"author"`
+	Title      string     `json:"title"`
+	Collection string     `json:"collection"`
+	PostedAt   *time.Time `json:"posted_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type tikwmUserPosts struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		Videos []struct {
+			VideoID    string `json:"video_id"`
+			Title      string `json:"title"`
+			CreateTime int64  `json:"create_time"`
+		} `json:"videos"`
+	} `json:"data"`
+}
+
+func suggestFromAuthors() error {
+	rows, err := db.Query(`
+	SELECT u.author_username, (array_agg(u.collection_id ORDER BY u.created_at DESC))[1], c.checked_at
+	FROM urls u LEFT JOIN author_feed_checks c ON c.author_username = u.author_username
+	WHERE u.status = 'active' AND COALESCE(u.author_username, '') <> ''
+	GROUP BY u.author_username, c.checked_at
+	ORDER BY c.checked_at NULLS FIRST, u.author_username
+	LIMIT $1
+	`, envInt("SUGGESTIONS_AUTHORS", 20))
+	if err != nil {
+		return fmt.Errorf("error loading authors: %w", err)
+	}
+	type author struct {
+		username, collection string
+		checkedAt            sql.NullTime
+	}
+	var authors []author
+	for rows.Next() {
+		var a author
+		if err := rows.Scan(&a.username, &a.collection, &a.checkedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning authors: %w", err)
+		}
+		authors = append(authors, a)
+	}
+	rows.Close()
+
+	progress := jobProgress{Total: len(authors)}
+	suggestionsJob.reportProgress(progress)
+
+	suggested := 0
+	for _, a := range authors {
+		since := time.Now().Add(-envDuration("SUGGESTIONS_LOOKBACK", 30*24*time.Hour))
+		if a.checkedAt.Valid {
+			since = a.checkedAt.Time
+		}
+		checkedAt := time.Now()
+
+		n, err := suggestAuthorPosts(a.username, a.collection, since)
+		progress.Done++
+		if err != nil {
+			log.Printf("Error fetching posts of %s: %v\n", a.username, err)
+			progress.Failed++
+			suggestionsJob.reportProgress(progress)
+			if pe, ok := err.(*providerError); ok && pe.Kind == providerRateLimited {
+				return err
+			}
+			continue
+		}
+		suggested += n
+		suggestionsJob.reportProgress(progress)
+
+		_, err = db.Exec(`
+		INSERT INTO author_feed_checks (author_username, checked_at) VALUES ($1, $2)
+		ON CONFLICT (author_username) DO UPDATE SET checked_at = $2
+		`, a.username, checkedAt)
+		if err != nil {
+			return fmt.Errorf("error recording feed check: %w", err)
+		}
+	}
+
+	if suggested > 0 {
+		log.Printf("Suggested %d new video(s) from %d author(s).\n", suggested, len(authors))
+	}
+	return nil
+}
+
+// suggestAuthorPosts queues the posts of username made after since that
+// are not in the catalog yet, and returns how many were queued.
+func suggestAuthorPosts(username, collection string, since time.Time) (int, error) {
+	if err := waitForUpstreamQuota(); err != nil {
+		return 0, err
+	}
+	key := acquireUpstreamKey()
+	req, err := tikwmAPIRequest("/user/posts", url.Values{"unique_id": {username}, "count": {"30"}}, key)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %w", err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		key.recordFailure(false)
+		return 0, fmt.Errorf("error fetching posts: %w", err)
+	}
+	defer response.Body.Close()
+
+	var posts tikwmUserPosts
+	if err := json.NewDecoder(io.LimitReader(response.Body, 4<<20)).Decode(&posts); err != nil {
+		return 0, fmt.Errorf("error decoding posts: %w", err)
+	}
+	if posts.Code != 0 {
+		pe := &providerError{Provider: "tikwm", Msg: posts.Msg, Kind: resolver.ClassifyTikwmError(posts.Msg)}
+		key.recordFailure(pe.Kind == providerRateLimited)
+		if pe.Kind == providerRateLimited {
+			noteUpstreamRateLimited()
+		}
+		return 0, pe
+	}
+
+	queued := 0
+	for _, post := range posts.Data.Videos {
+		postedAt := time.Unix(post.CreateTime, 0)
+		if post.VideoID == "" || !postedAt.After(since) {
+			continue
+		}
+		result, err := db.Exec(`
+		INSERT INTO url_suggestions (id, url, video_id, author_username, title, collection_id, posted_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7
+		WHERE NOT EXISTS (SELECT 1 FROM urls WHERE video_id = $3)
+		ON CONFLICT (video_id) DO NOTHING
+		`, uuid.New().String(), "https://www.tiktok.com/@"+username+"/video/"+post.VideoID, post.VideoID, username,
+			post.Title, collection, postedAt)
+		if err != nil {
+			return queued, fmt.Errorf("error saving suggestion: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			queued++
+		}
+	}
+	return queued, nil
+}
+
+func init() {
+	suggestionsJob = schedule("suggestions", "SUGGESTIONS_INTERVAL", 0, suggestFromAuthors)
+	suggestionsJob.LeaderOnly = true
+}
+
+// listSuggestions handles GET /api/admin/suggestions, the pending review
+// queue, newest posts first.
+func listSuggestions(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+	SELECT id, url, video_id, author_username, COALESCE(title, ''), collection_id, posted_at, created_at
+	FROM url_suggestions
+	WHERE status = 'pending'
+	ORDER BY posted_at DESC NULLS LAST
+	`)
+	if err != nil {
+		log.Printf("Error retrieving suggestions: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer rows.Close()
+
+	suggestions := []urlSuggestion{}
+	for rows.Next() {
+		var s urlSuggestion
+		if err := rows.Scan(&s.ID, &s.URL, &s.VideoID, &s.Author, &s.Title, &s.Collection, &s.PostedAt, &s.CreatedAt); err != nil {
+			log.Printf("Error scanning suggestion: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	writeJSON(w, http.StatusOK, suggestions)
+}
+
+// reviewSuggestion handles POST /api/admin/suggestions/{id}/approve and
+// POST /api/admin/suggestions/{id}/dismiss.
+func reviewSuggestion(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/suggestions/"), "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 || (parts[1] != "approve" && parts[1] != "dismiss") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	status := "dismissed"
+	if parts[1] == "approve" {
+		status = "approved"
+	}
+
+	var (
+		added      URL
+		collection string
+	)
+	err := db.QueryRow(
+		"UPDATE url_suggestions SET status = $2 WHERE id = $1 AND status = 'pending' RETURNING url, collection_id",
+		parts[0], status,
+	).Scan(&added.URL, &collection)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "pending suggestion not found")
+		return
+	}
+	if status == "dismissed" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	added.ID = uuid.New().String()
+	_, err = execWithEvent("INSERT INTO urls (id, url, collection_id, submitted_by) VALUES ($1, $2, $3, 'suggestions')",
+		"url.added", added, added.ID, added.URL, collection)
+	if err != nil {
+		log.Printf("Error adding suggested URL %s: %v\n", added.URL, err)
+		if _, err := db.Exec("UPDATE url_suggestions SET status = 'pending' WHERE id = $1", parts[0]); err != nil {
+			log.Printf("Error returning suggestion %s to the queue: %v\n", parts[0], err)
+		}
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	background(func() { fingerprintURL(added.ID, added.URL) })
+
+	writeJSON(w, http.StatusCreated, added)
+}
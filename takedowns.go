@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// noPendingTakedown is appended to updates that would return a suspended
+// video to rotation, so a video stays suspended while any claim is open.
+const noPendingTakedown = "NOT EXISTS (SELECT 1 FROM takedowns WHERE takedowns.url_id = urls.id AND takedowns.status = 'pending')"
+
+type takedownRequest struct {
+	URL       string `json:"url"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Statement string `json:"statement"`
+}
+
+type takedown struct {
+	ID         string    `json:"id"`
+	URLID      string    `json:"url_id"`
+	URL        string    `json:"url"`
+	ClaimedURL string    `json:"claimed_url"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email"`
+	Statement  string    `json:"statement"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type takedownResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// submitTakedown handles POST /api/takedowns, where rights holders file a
+// claim against a video. The claimed URL is matched against the catalog
+// directly or, failing that, by the video id it resolves to; the matching
+// video is suspended until a moderator accepts or rejects the claim.
+func submitTakedown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if until, throttled := abuse.throttledUntil(abuseKeys(r)...); throttled {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(time.Until(until).Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too many requests, try again later")
+		return
+	}
+
+	if captchaEnabled() {
+		if err := verifyCaptcha(r.Header.Get("X-Captcha-Token"), clientIP(r)); err != nil {
+			log.Printf("Captcha verification failed: %v\n", err)
+			writeError(w, http.StatusForbidden, "captcha verification failed")
+			return
+		}
+	}
+
+	var req takedownRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	req.Name = strings.TrimSpace(req.Name)
+	req.Statement = strings.TrimSpace(req.Statement)
+	if req.URL == "" || req.Name == "" || req.Statement == "" {
+		writeError(w, http.StatusBadRequest, "url, name, email and statement are required")
+		return
+	}
+	if _, err := mail.ParseAddress(req.Email); err != nil {
+		writeError(w, http.StatusBadRequest, "email is not a valid address")
+		return
+	}
+	if len(req.Statement) > 5000 {
+		writeError(w, http.StatusBadRequest, "statement must be at most 5000 characters")
+		return
+	}
+
+	urlID, err := findClaimedVideo(req.URL)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "video not found in the catalog")
+		return
+	}
+	if err != nil {
+		log.Printf("Error matching takedown claim: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	conn, err := catalog.DB(urlID)
+	if err != nil {
+		log.Printf("Error locating claimed video %s: %v\n", urlID, err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer tx.Rollback()
+
+	id := uuid.New().String()
+	_, err = tx.Exec(`
+	INSERT INTO takedowns (id, url_id, claimed_url, claimant_name, claimant_email, statement)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`, id, urlID, req.URL, req.Name, req.Email, req.Statement)
+	if err != nil {
+		log.Printf("Error recording takedown: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if _, err := tx.Exec("UPDATE urls SET status = 'suspended' WHERE id = $1 AND status = 'active'", urlID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+
+	sendAlert(Alert{
+		Kind:    "takedowns.received",
+		Message: fmt.Sprintf("Takedown claim %s filed against video %s; it is suspended pending review", id, urlID),
+		Tags:    map[string]string{"takedown_id": id, "url_id": urlID},
+	})
+
+	var response takedownResponse
+	response.Code = http.StatusAccepted
+	response.Msg = "claim received"
+	response.Data.ID = id
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+// findClaimedVideo returns the id of the catalog entry a claimed URL refers
+// to.
+func findClaimedVideo(claimed string) (string, error) {
+	urlID, err := findURLID("SELECT id FROM urls WHERE url = $1 LIMIT 1", claimed)
+	if err != sql.ErrNoRows {
+		return urlID, err
+	}
+
+	video, err := resolveVideo(claimed)
+	if err != nil {
+		return "", sql.ErrNoRows
+	}
+	return findURLID("SELECT id FROM urls WHERE video_id = $1 LIMIT 1", video.ID)
+}
+
+// listTakedowns handles GET /api/admin/takedowns, the pending claims queue,
+// oldest first.
+func listTakedowns(w http.ResponseWriter, r *http.Request) {
+	claims := []takedown{}
+	for _, conn := range catalog.DBs() {
+		pending, err := pendingTakedowns(conn)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		claims = append(claims, pending...)
+	}
+	sort.SliceStable(claims, func(i, j int) bool { return claims[i].CreatedAt.Before(claims[j].CreatedAt) })
+
+	writeJSON(w, http.StatusOK, claims)
+}
+
+// pendingTakedowns returns the pending claims in conn.
+func pendingTakedowns(conn *sql.DB) ([]takedown, error) {
+	rows, err := conn.Query(`
+	SELECT t.id, t.url_id, u.url, t.claimed_url, t.claimant_name, t.claimant_email, t.statement, t.created_at
+	FROM takedowns t
+	JOIN urls u ON u.id = t.url_id
+	WHERE t.status = 'pending'
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving takedowns: %w", err)
+	}
+	defer rows.Close()
+
+	var claims []takedown
+	for rows.Next() {
+		var t takedown
+		if err := rows.Scan(&t.ID, &t.URLID, &t.URL, &t.ClaimedURL, &t.Name, &t.Email, &t.Statement, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning takedown: %w", err)
+		}
+		claims = append(claims, t)
+	}
+	return claims, rows.Err()
+}
+
+// reviewTakedown handles POST /api/admin/takedowns/{id}/accept, which
+// blocks the video, and POST /api/admin/takedowns/{id}/reject, which
+// returns it to rotation once no other claim is pending.
+func reviewTakedown(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/takedowns/"), "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 || (parts[1] != "accept" && parts[1] != "reject") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	status, urlUpdate := "accepted", "UPDATE urls SET status = 'blocked' WHERE id = $1"
+	if parts[1] == "reject" {
+		status, urlUpdate = "rejected", "UPDATE urls SET status = 'active' WHERE id = $1 AND status = 'suspended' AND "+noPendingTakedown
+	}
+
+	// The claim is in the shard of its video, so each is tried in turn.
+	for _, conn := range catalog.DBs() {
+		err := resolveTakedown(conn, parts[0], status, urlUpdate)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusNotFound, "pending takedown not found")
+}
+
+// resolveTakedown gives the pending claim id in conn status and applies
+// urlUpdate to its video, or returns sql.ErrNoRows when conn has no such
+// claim.
+func resolveTakedown(conn *sql.DB, id, status, urlUpdate string) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting takedown review: %w", err)
+	}
+	defer tx.Rollback()
+
+	var urlID string
+	err = tx.QueryRow(
+		"UPDATE takedowns SET status = $2, resolved_at = now() WHERE id = $1 AND status = 'pending' RETURNING url_id",
+		id, status,
+	).Scan(&urlID)
+	if err == sql.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error reviewing takedown %s: %w", id, err)
+	}
+
+	if _, err := tx.Exec(urlUpdate, urlID); err != nil {
+		return fmt.Errorf("error updating video %s: %w", urlID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error reviewing takedown %s: %w", id, err)
+	}
+	return nil
+}
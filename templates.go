@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/template"
+)
+
+// RESPONSE_TEMPLATES_FILE points at a JSON file of Go text/template
+// sources keyed by API key or collection, for example:
+//
+//	{
+//	  "content_type": "application/json",
+//	  "keys": {"legacy-bot-key": "{\"link\": {{json .Response.Data.URL}}}"},
+//	  "collections": {"cats": "..."}
+//	}
+//
+// A key template takes precedence over a collection template; requests that
+// match neither get the standard response.
+type responseTemplateConfig struct {
+	ContentType string            `json:"content_type"`
+	Keys        map[string]string `json:"keys"`
+	Collections map[string]string `json:"collections"`
+}
+
+// templateData is what a response template is executed against.
+type templateData struct {
+	Response   VideoDataResponse
+	Video      *Video
+	Collection string
+}
+
+var responseTemplates struct {
+	contentType string
+	keys        map[string]*template.Template
+	collections map[string]*template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func loadResponseTemplates() error {
+	path := os.Getenv("RESPONSE_TEMPLATES_FILE")
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading response templates: %w", err)
+	}
+
+	var config responseTemplateConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("error decoding response templates: %w", err)
+	}
+
+	parse := func(kind string, sources map[string]string) (map[string]*template.Template, error) {
+		parsed := make(map[string]*template.Template, len(sources))
+		for name, source := range sources {
+			tmpl, err := template.New(kind + ":" + name).Funcs(templateFuncs).Parse(source)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s template %q: %w", kind, name, err)
+			}
+			parsed[name] = tmpl
+		}
+		return parsed, nil
+	}
+
+	keys, err := parse("key", config.Keys)
+	if err != nil {
+		return err
+	}
+	collections, err := parse("collection", config.Collections)
+	if err != nil {
+		return err
+	}
+
+	responseTemplates.contentType = config.ContentType
+	if responseTemplates.contentType == "" {
+		responseTemplates.contentType = "application/json"
+	}
+	responseTemplates.keys = keys
+	responseTemplates.collections = collections
+
+	return nil
+}
+
+func responseTemplateFor(r *http.Request, collection string) *template.Template {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if tmpl, ok := responseTemplates.keys[key]; ok {
+			return tmpl
+		}
+	}
+	return responseTemplates.collections[collection]
+}
+
+// writeTemplatedResponse renders the operator's template for this request,
+// if any. It reports false when no template applies or rendering failed, so
+// the caller falls back to the standard response.
+func writeTemplatedResponse(w http.ResponseWriter, r *http.Request, entry catalogEntry, video *Video, response VideoDataResponse) bool {
+	tmpl := responseTemplateFor(r, entry.Collection)
+	if tmpl == nil {
+		return false
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, templateData{
+		Response:   response,
+		Video:      video,
+		Collection: entry.Collection,
+	})
+	if err != nil {
+		log.Printf("Error rendering template %s: %v\n", tmpl.Name(), err)
+		return false
+	}
+
+	w.Header().Set("Content-Type", responseTemplates.contentType)
+	w.Write(buf.Bytes())
+	return true
+}
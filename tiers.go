@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API key tiers: every caller gets the limits of a named tier, free unless
+// its API key has been assigned another one through the admin API. The
+// free tier takes its limits from RATE_LIMIT and MEDIA_KEY_QUOTA, partner
+// allows ten times as much and unlimited has no limits. KEY_TIERS_FILE
+// overrides these or adds tiers, for example:
+//
+//	{"partner": {"requests": 6000, "media_bytes": 53687091200}}
+//
+// requests are per RATE_LIMIT_WINDOW, media_bytes per
+// MEDIA_KEY_QUOTA_WINDOW, and zero means unlimited. Assignments are stored
+// by the SHA-256 of the key and reloaded by every replica each
+// KEY_TIERS_REFRESH_INTERVAL.
+
+type keyLimits struct {
+	Requests   int   `json:"requests"`
+	MediaBytes int64 `json:"media_bytes"`
+}
+
+type keyTierAssignment struct {
+	KeyHash   string    `json:"key_hash"`
+	KeyID     string    `json:"key_id"`
+	Tier      string    `json:"tier"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var keyTiers = struct {
+	mu       sync.RWMutex
+	config   map[string]keyLimits
+	assigned map[string]string
+}{assigned: make(map[string]string)}
+
+var keyHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func loadKeyTiers() error {
+	path := os.Getenv("KEY_TIERS_FILE")
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading key tiers: %w", err)
+	}
+	var config map[string]keyLimits
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("error decoding key tiers: %w", err)
+	}
+	for name, limits := range config {
+		if limits.Requests < 0 || limits.MediaBytes < 0 {
+			return fmt.Errorf("key tier %s: limits must not be negative", name)
+		}
+	}
+
+	keyTiers.mu.Lock()
+	keyTiers.config = config
+	keyTiers.mu.Unlock()
+	return nil
+}
+
+// tierLimits returns the limits of tier, or false if there is no such tier.
+func tierLimits(tier string) (keyLimits, bool) {
+	keyTiers.mu.RLock()
+	limits, ok := keyTiers.config[tier]
+	keyTiers.mu.RUnlock()
+	if ok {
+		return limits, true
+	}
+
+	free := keyLimits{Requests: envInt("RATE_LIMIT", 0), MediaBytes: int64(envInt("MEDIA_KEY_QUOTA", 0))}
+	switch tier {
+	case "free":
+		return free, true
+	case "partner":
+		return keyLimits{Requests: free.Requests * 10, MediaBytes: free.MediaBytes * 10}, true
+	case "unlimited":
+		return keyLimits{}, true
+	}
+	return keyLimits{}, false
+}
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifiedKey returns the X-API-Key of r when it is an issued key or has
+// been assigned a tier, and "" for any other value. authorizeKeys has
+// already refused expired issued keys.
+func verifiedKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return ""
+	}
+	hash := keyHash(key)
+	issuedKeys.mu.RLock()
+	_, issued := issuedKeys.byHash[hash]
+	issuedKeys.mu.RUnlock()
+	keyTiers.mu.RLock()
+	_, assigned := keyTiers.assigned[hash]
+	keyTiers.mu.RUnlock()
+	if !issued && !assigned {
+		return ""
+	}
+	return key
+}
+
+// limitsFor returns the tier of the caller of r and its limits.
+func limitsFor(r *http.Request) (string, keyLimits) {
+	tier := "free"
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		keyTiers.mu.RLock()
+		if assigned, ok := keyTiers.assigned[keyHash(key)]; ok {
+			tier = assigned
+		}
+		keyTiers.mu.RUnlock()
+	}
+	limits, ok := tierLimits(tier)
+	if !ok {
+		// The tier was removed from KEY_TIERS_FILE after being assigned.
+		tier = "free"
+		limits, _ = tierLimits(tier)
+	}
+	return tier, limits
+}
+
+func reloadKeyTiers() error {
+	rows, err := db.Query("SELECT key_hash, tier FROM api_key_tiers")
+	if err != nil {
+		return fmt.Errorf("error loading key tiers: %w", err)
+	}
+	defer rows.Close()
+
+	assigned := make(map[string]string)
+	for rows.Next() {
+		var hash, tier string
+		if err := rows.Scan(&hash, &tier); err != nil {
+			return fmt.Errorf("error scanning key tiers: %w", err)
+		}
+		assigned[hash] = tier
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error loading key tiers: %w", err)
+	}
+
+	keyTiers.mu.Lock()
+	keyTiers.assigned = assigned
+	keyTiers.mu.Unlock()
+	return nil
+}
+
+// adminKeys handles GET /api/admin/keys, which lists the tiers, the keys
+// assigned to them and the issued keys, and PUT/DELETE
+// /api/admin/keys/{key_hash}, which assign a tier with {"tier": "partner"}
+// or return the key to free. The key hash is the hex SHA-256 of the key,
+// e.g. printf %s KEY | sha256sum. POST /api/admin/keys, DELETE
+// /api/admin/keys/{id} and POST /api/admin/keys/{id}/rotate issue, revoke
+// and rotate keys (see keys.go); PATCH /api/admin/keys/{id} changes where
+// their quota notices go (see quotanotify.go).
+func adminKeys(w http.ResponseWriter, r *http.Request) {
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/keys"), "/")
+	id, action, _ := strings.Cut(hash, "/")
+	if _, err := uuid.Parse(id); err == nil {
+		switch {
+		case r.Method == http.MethodDelete && action == "":
+			revokeKey(w, id)
+		case r.Method == http.MethodPost && action == "rotate":
+			rotateKey(w, r, id)
+		case r.Method == http.MethodPatch && action == "":
+			updateKeyNotifications(w, r, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	if hash != "" && !keyHashPattern.MatchString(hash) {
+		writeError(w, http.StatusBadRequest, "key hash must be the hex SHA-256 of the key")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && hash == "":
+		issueKey(w, r)
+
+	case r.Method == http.MethodGet && hash == "":
+		rows, err := db.Query("SELECT key_hash, tier, updated_at FROM api_key_tiers ORDER BY tier, key_hash")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		defer rows.Close()
+
+		keys := []keyTierAssignment{}
+		for rows.Next() {
+			var a keyTierAssignment
+			if err := rows.Scan(&a.KeyHash, &a.Tier, &a.UpdatedAt); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed")
+				return
+			}
+			a.KeyID = a.KeyHash[:8]
+			keys = append(keys, a)
+		}
+
+		tiers := make(map[string]keyLimits)
+		for _, name := range []string{"free", "partner", "unlimited"} {
+			tiers[name], _ = tierLimits(name)
+		}
+		keyTiers.mu.RLock()
+		for name, limits := range keyTiers.config {
+			tiers[name] = limits
+		}
+		keyTiers.mu.RUnlock()
+
+		issued, err := listIssuedKeys()
+		if err != nil {
+			log.Printf("Error listing API keys: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tiers": tiers, "keys": keys, "issued": issued})
+
+	case r.Method == http.MethodPut && hash != "":
+		var body struct {
+			Tier string `json:"tier"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+		if _, ok := tierLimits(body.Tier); !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown tier %q", body.Tier))
+			return
+		}
+
+		a := keyTierAssignment{KeyHash: hash, KeyID: hash[:8], Tier: body.Tier}
+		err := db.QueryRow(`
+		INSERT INTO api_key_tiers (key_hash, tier) VALUES ($1, $2)
+		ON CONFLICT (key_hash) DO UPDATE SET tier = $2, updated_at = now()
+		RETURNING updated_at
+		`, hash, body.Tier).Scan(&a.UpdatedAt)
+		if err != nil {
+			log.Printf("Error saving key tier: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		keyTiers.mu.Lock()
+		keyTiers.assigned[hash] = body.Tier
+		keyTiers.mu.Unlock()
+		writeJSON(w, http.StatusOK, a)
+
+	case r.Method == http.MethodDelete && hash != "":
+		if _, err := db.Exec("DELETE FROM api_key_tiers WHERE key_hash = $1", hash); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		keyTiers.mu.Lock()
+		delete(keyTiers.assigned, hash)
+		keyTiers.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func init() {
+	schedule("key-tiers", "KEY_TIERS_REFRESH_INTERVAL", time.Minute, reloadKeyTiers)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transcoding: ?quality=discord on /api/get and /api/media/{url_id}/video
+// serves an H.264/AAC MP4 under TRANSCODE_DISCORD_MAX_BYTES (8 MB, the
+// Discord upload limit for regular users), made with the ffmpeg binary at
+// FFMPEG_PATH. Renditions are cached with the other proxied media. At most
+// TRANSCODE_CONCURRENCY ffmpeg processes run at once.
+
+var transcodeSlots struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func ffmpegPath() string {
+	if path := os.Getenv("FFMPEG_PATH"); path != "" {
+		return path
+	}
+	return "ffmpeg"
+}
+
+func transcodingEnabled() bool {
+	if os.Getenv("TRANSCODE_ENABLED") != "true" {
+		return false
+	}
+	_, err := exec.LookPath(ffmpegPath())
+	return err == nil
+}
+
+// serveTranscoded serves the discord rendition of video, transcoding it
+// from the cached original when there is one and from source otherwise.
+func serveTranscoded(w http.ResponseWriter, r *http.Request, urlID string, video *Video, source string) {
+	transcode := func(dst io.Writer) (string, error) {
+		var original *os.File
+		if mediaCache != nil {
+			f, _, _, err := mediaCache.open(urlID+"/video", func(dst io.Writer) (string, error) {
+				return fetchMedia(dst, source)
+			})
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			original = f
+		}
+		return transcodeForDiscord(dst, source, original, video.Duration)
+	}
+
+	if mediaCache != nil {
+		f, cached, hit, err := mediaCache.open(urlID+"/video/discord", transcode)
+		if err != nil {
+			log.Printf("Error transcoding %s: %v\n", urlID, err)
+			writeError(w, http.StatusBadGateway, "failed to transcode video")
+			return
+		}
+		defer f.Close()
+		serveMediaFile(w, r, f, cached, hit)
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "shoti-discord-*.mp4")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := transcode(tmp); err != nil {
+		log.Printf("Error transcoding %s: %v\n", urlID, err)
+		writeError(w, http.StatusBadGateway, "failed to transcode video")
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", time.Now(), tmp)
+}
+
+// transcodeForDiscord writes the rendition to dst. The video bitrate is
+// derived from the duration so the file fits the size budget; if it still
+// comes out too large the transcode is retried once at a lower bitrate.
+func transcodeForDiscord(dst io.Writer, source string, original *os.File, duration int) (string, error) {
+	transcodeSlots.once.Do(func() {
+		transcodeSlots.ch = make(chan struct{}, max(1, envInt("TRANSCODE_CONCURRENCY", 2)))
+	})
+	transcodeSlots.ch <- struct{}{}
+	defer func() { <-transcodeSlots.ch }()
+
+	if duration <= 0 {
+		duration = 60
+	}
+	budget := int64(envInt("TRANSCODE_DISCORD_MAX_BYTES", 8_000_000))
+	const audioKbps = 96
+	// Leave 5% for container overhead.
+	videoKbps := int(float64(budget)*8*0.95/1000/float64(duration)) - audioKbps
+	if videoKbps < 100 {
+		return "", fmt.Errorf("a %ds video cannot fit in %d bytes", duration, budget)
+	}
+
+	out, err := os.CreateTemp("", "shoti-transcode-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+	out.Close()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := runFFmpeg(source, original, out.Name(), videoKbps, audioKbps); err != nil {
+			return "", err
+		}
+		info, err := os.Stat(out.Name())
+		if err != nil {
+			return "", err
+		}
+		if info.Size() <= budget {
+			f, err := os.Open(out.Name())
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			_, err = io.Copy(dst, f)
+			return "video/mp4", err
+		}
+		videoKbps = videoKbps * 3 / 4
+	}
+	return "", fmt.Errorf("rendition exceeds %d bytes", budget)
+}
+
+func runFFmpeg(source string, original *os.File, output string, videoKbps, audioKbps int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("TRANSCODE_TIMEOUT", 2*time.Minute))
+	defer cancel()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	var extra []*os.File
+	if original != nil {
+		// The cached file is passed as an open descriptor so eviction
+		// while ffmpeg runs cannot pull it away.
+		if _, err := original.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		extra = append(extra, original)
+		args = append(args, "-i", "/dev/fd/3")
+	} else {
+		args = append(args, "-user_agent", "Mozilla/5.0", "-i", source)
+	}
+	rate := strconv.Itoa(videoKbps) + "k"
+	args = append(args,
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "high", "-pix_fmt", "yuv420p",
+		"-b:v", rate, "-maxrate", rate, "-bufsize", strconv.Itoa(videoKbps*2)+"k",
+		"-vf", "scale='min(720,iw)':-2",
+		"-c:a", "aac", "-b:a", strconv.Itoa(audioKbps)+"k",
+		"-movflags", "+faststart", "-f", "mp4", output,
+	)
+
+	cmd := exec.CommandContext(ctx, ffmpegPath(), args...)
+	cmd.ExtraFiles = extra
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// openAPISpec describes the public API. It is served at /openapi.json and
+// is the source of the generated TypeScript client.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// The subset of OpenAPI 3 the generator understands: component schemas,
+// parameters and responses, JSON request and response bodies, image
+// responses (returned as Blobs), and query, path and header parameters.
+type apiSpec struct {
+	Info struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]*apiOperation `json:"paths"`
+	Components struct {
+		Schemas    map[string]*apiSchema    `json:"schemas"`
+		Parameters map[string]*apiParameter `json:"parameters"`
+		Responses  map[string]*apiResponse  `json:"responses"`
+	} `json:"components"`
+}
+
+type apiOperation struct {
+	OperationID string          `json:"operationId"`
+	Summary     string          `json:"summary"`
+	Unsafe      bool            `json:"x-unsafe"`
+	Parameters  []*apiParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool                  `json:"required"`
+		Content  map[string]apiContent `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]*apiResponse `json:"responses"`
+}
+
+type apiParameter struct {
+	Ref         string     `json:"$ref"`
+	Name        string     `json:"name"`
+	In          string     `json:"in"`
+	Description string     `json:"description"`
+	Required    bool       `json:"required"`
+	Schema      *apiSchema `json:"schema"`
+}
+
+type apiResponse struct {
+	Ref     string                `json:"$ref"`
+	Content map[string]apiContent `json:"content"`
+}
+
+type apiContent struct {
+	Schema *apiSchema `json:"schema"`
+}
+
+type apiSchema struct {
+	Ref         string                `json:"$ref"`
+	Type        string                `json:"type"`
+	Description string                `json:"description"`
+	Properties  map[string]*apiSchema `json:"properties"`
+	Required    []string              `json:"required"`
+	Items       *apiSchema            `json:"items"`
+	Enum        []string              `json:"enum"`
+	Nullable    bool                  `json:"nullable"`
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+func (s *apiSpec) parameter(p *apiParameter) *apiParameter {
+	if p.Ref != "" {
+		if resolved, ok := s.Components.Parameters[refName(p.Ref)]; ok {
+			return resolved
+		}
+	}
+	return p
+}
+
+func (s *apiSpec) response(r *apiResponse) *apiResponse {
+	if r.Ref != "" {
+		if resolved, ok := s.Components.Responses[refName(r.Ref)]; ok {
+			return resolved
+		}
+	}
+	return r
+}
+
+func tsType(s *apiSchema, indent string) string {
+	var t string
+	switch {
+	case s == nil:
+		t = "unknown"
+	case s.Ref != "":
+		t = refName(s.Ref)
+	case len(s.Enum) > 0:
+		values := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			values[i] = fmt.Sprintf("%q", v)
+		}
+		t = strings.Join(values, " | ")
+	case s.Type == "string":
+		t = "string"
+	case s.Type == "integer", s.Type == "number":
+		t = "number"
+	case s.Type == "boolean":
+		t = "boolean"
+	case s.Type == "array":
+		t = tsType(s.Items, indent) + "[]"
+	case s.Type == "object" && len(s.Properties) > 0:
+		t = "{\n" + tsFields(s, indent+"  ") + indent + "}"
+	default:
+		t = "Record<string, unknown>"
+	}
+	if s != nil && s.Nullable {
+		t += " | null"
+	}
+	return t
+}
+
+func tsFields(s *apiSchema, indent string) string {
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		prop := s.Properties[name]
+		optional := "?"
+		for _, r := range s.Required {
+			if r == name {
+				optional = ""
+			}
+		}
+		if prop.Description != "" {
+			fmt.Fprintf(&b, "%s/** %s */\n", indent, prop.Description)
+		}
+		fmt.Fprintf(&b, "%s%s%s: %s;\n", indent, name, optional, tsType(prop, indent))
+	}
+	return b.String()
+}
+
+// headerField turns a header name such as X-Captcha-Token into the
+// captchaToken field of the generated params type.
+func headerField(name string) string {
+	parts := strings.Split(strings.TrimPrefix(name, "X-"), "-")
+	for i, p := range parts {
+		p = strings.ToLower(p)
+		if i > 0 && p != "" {
+			p = string(unicode.ToUpper(rune(p[0]))) + p[1:]
+		}
+		parts[i] = p
+	}
+	return strings.Join(parts, "")
+}
+
+func exportedName(id string) string {
+	return string(unicode.ToUpper(rune(id[0]))) + id[1:]
+}
+
+// generateTSClient renders a dependency-free TypeScript client (using the
+// global fetch) from spec.
+func generateTSClient(raw []byte) (string, error) {
+	var spec apiSpec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return "", fmt.Errorf("error parsing spec: %w", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Code generated by `shoti-srv client-ts` from openapi.json. DO NOT EDIT.\n")
+	fmt.Fprintf(&b, "// %s API %s\n\n", spec.Info.Title, spec.Info.Version)
+	b.WriteString(tsRuntime)
+
+	names := make([]string, 0, len(spec.Components.Schemas))
+	for name := range spec.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := spec.Components.Schemas[name]
+		if s.Description != "" {
+			fmt.Fprintf(&b, "/** %s */\n", s.Description)
+		}
+		if s.Type == "object" {
+			fmt.Fprintf(&b, "export interface %s {\n%s}\n\n", name, tsFields(s, "  "))
+		} else {
+			fmt.Fprintf(&b, "export type %s = %s;\n\n", name, tsType(s, ""))
+		}
+	}
+
+	paths := make([]string, 0, len(spec.Paths))
+	for path := range spec.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var methods strings.Builder
+	for _, path := range paths {
+		for _, method := range []string{"get", "post", "put", "patch", "delete"} {
+			op, ok := spec.Paths[path][method]
+			if !ok {
+				continue
+			}
+			if op.OperationID == "" {
+				return "", fmt.Errorf("%s %s has no operationId", strings.ToUpper(method), path)
+			}
+			params, method := generateTSOperation(&spec, &b, path, method, op)
+			if err := checkTSParams(path, params); err != nil {
+				return "", err
+			}
+			methods.WriteString(method)
+		}
+	}
+
+	b.WriteString("export class ShotiClient extends BaseClient {\n")
+	b.WriteString(strings.TrimSuffix(methods.String(), "\n"))
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// generateTSOperation writes the params interface of op to b and returns
+// the path parameters and the client method.
+func generateTSOperation(spec *apiSpec, b *strings.Builder, path, method string, op *apiOperation) ([]string, string) {
+	var (
+		pathParams        []string
+		query, header     []string
+		fields            strings.Builder
+		paramsRequired    bool
+		args              []string
+		paramsType        = exportedName(op.OperationID) + "Params"
+		responseType      = "void"
+		binary            bool
+		bodyType, bodyArg string
+	)
+
+	for _, p := range op.Parameters {
+		p = spec.parameter(p)
+		switch p.In {
+		case "path":
+			pathParams = append(pathParams, p.Name)
+			args = append(args, p.Name+": string")
+			continue
+		case "query":
+			query = append(query, p.Name)
+		case "header":
+			header = append(header, p.Name)
+		default:
+			continue
+		}
+
+		name := p.Name
+		if p.In == "header" {
+			name = headerField(p.Name)
+		}
+		optional := "?"
+		if p.Required {
+			optional = ""
+			paramsRequired = true
+		}
+		if p.Description != "" {
+			fmt.Fprintf(&fields, "  /** %s */\n", p.Description)
+		}
+		fmt.Fprintf(&fields, "  %s%s: %s;\n", name, optional, tsType(p.Schema, "  "))
+	}
+
+	if op.RequestBody != nil {
+		if c, ok := op.RequestBody.Content["application/json"]; ok {
+			bodyType = tsType(c.Schema, "  ")
+			bodyArg = "body"
+			if !op.RequestBody.Required {
+				bodyArg += "?"
+			}
+		}
+	}
+
+	codes := make([]string, 0, len(op.Responses))
+	for code := range op.Responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if !strings.HasPrefix(code, "2") {
+			continue
+		}
+		content := spec.response(op.Responses[code]).Content
+		if c, ok := content["application/json"]; ok {
+			responseType = tsType(c.Schema, "  ")
+		} else {
+			for contentType := range content {
+				if strings.HasPrefix(contentType, "image/") {
+					responseType, binary = "Blob", true
+				}
+			}
+		}
+		break
+	}
+
+	if len(query)+len(header) > 0 {
+		fmt.Fprintf(b, "export interface %s {\n%s}\n\n", paramsType, fields.String())
+	}
+
+	// Required arguments come before optional ones.
+	if bodyArg == "body" {
+		args = append(args, "body: "+bodyType)
+	}
+	if len(query)+len(header) > 0 {
+		if paramsRequired {
+			args = append(args, "params: "+paramsType)
+		} else {
+			args = append(args, "params: "+paramsType+" = {}")
+		}
+	}
+	if bodyArg == "body?" {
+		args = append(args, "body?: "+bodyType)
+	}
+
+	tsPath := "`" + path + "`"
+	for _, name := range pathParams {
+		tsPath = strings.ReplaceAll(tsPath, "{"+name+"}", "${encodeURIComponent("+name+")}")
+	}
+
+	var m strings.Builder
+	if op.Summary != "" {
+		fmt.Fprintf(&m, "  /** %s */\n", op.Summary)
+	}
+	fmt.Fprintf(&m, "  %s(%s): Promise<%s> {\n", op.OperationID, strings.Join(args, ", "), responseType)
+
+	queryExpr, headerExpr, bodyExpr := "{}", "{}", "undefined"
+	if len(query) > 0 {
+		pairs := make([]string, len(query))
+		for i, name := range query {
+			pairs[i] = fmt.Sprintf("%q: params.%s", name, name)
+		}
+		queryExpr = "{ " + strings.Join(pairs, ", ") + " }"
+	}
+	if len(header) > 0 {
+		pairs := make([]string, len(header))
+		for i, name := range header {
+			pairs[i] = fmt.Sprintf("%q: params.%s", name, headerField(name))
+		}
+		headerExpr = "{ " + strings.Join(pairs, ", ") + " }"
+	}
+	if bodyArg != "" {
+		bodyExpr = "body"
+	}
+	unsafeExpr := fmt.Sprint(op.Unsafe)
+	if binary {
+		unsafeExpr += ", true"
+	}
+	fmt.Fprintf(&m, "    return this.request<%s>(%q, %s, %s, %s, %s, %s);\n", responseType, strings.ToUpper(method), tsPath, queryExpr, headerExpr, bodyExpr, unsafeExpr)
+	m.WriteString("  }\n\n")
+
+	return pathParams, m.String()
+}
+
+func checkTSParams(path string, params []string) error {
+	for _, name := range params {
+		if !strings.Contains(path, "{"+name+"}") {
+			return fmt.Errorf("%s: path parameter %s is not in the path", path, name)
+		}
+	}
+	return nil
+}
+
+// tsRuntime is the hand-written part of the generated client: transport,
+// retries with jittered exponential backoff, and errors. It mirrors the
+// behaviour of the Go client package.
+const tsRuntime = `export interface ClientOptions {
+  /** Sent as X-API-Key; required for favorites. */
+  apiKey?: string;
+  /** Retries after network errors, 429 and 5xx (default 3). */
+  retries?: number;
+  minBackoffMs?: number;
+  maxBackoffMs?: number;
+  fetch?: typeof fetch;
+}
+
+export class ShotiError extends Error {
+  constructor(public readonly status: number, message: string) {
+    super(` + "`shoti: ${status} ${message}`" + `);
+    this.name = "ShotiError";
+  }
+}
+
+type Query = Record<string, string | number | boolean | undefined>;
+
+class BaseClient {
+  private readonly baseUrl: string;
+  private readonly options: Required<Omit<ClientOptions, "apiKey">> & { apiKey?: string };
+
+  constructor(baseUrl: string, options: ClientOptions = {}) {
+    this.baseUrl = baseUrl.replace(/\/+$/, "");
+    this.options = {
+      retries: 3,
+      minBackoffMs: 200,
+      maxBackoffMs: 5000,
+      fetch: globalThis.fetch.bind(globalThis),
+      ...options,
+    };
+  }
+
+  protected async request<T>(method: string, path: string, query: Query, headers: Record<string, string | undefined>, body: unknown, unsafe: boolean, binary = false): Promise<T> {
+    const url = new URL(this.baseUrl + path);
+    for (const [name, value] of Object.entries(query)) {
+      if (value !== undefined && value !== "") url.searchParams.set(name, String(value));
+    }
+    const init: RequestInit = { method, headers: {} };
+    const h = init.headers as Record<string, string>;
+    for (const [name, value] of Object.entries(headers)) {
+      if (value !== undefined) h[name] = value;
+    }
+    if (this.options.apiKey) h["X-API-Key"] = this.options.apiKey;
+    if (body !== undefined) {
+      h["Content-Type"] = "application/json";
+      init.body = JSON.stringify(body);
+    }
+
+    for (let attempt = 0; ; attempt++) {
+      let res: Response;
+      try {
+        res = await this.options.fetch(url, init);
+      } catch (err) {
+        if (unsafe || attempt >= this.options.retries) throw err;
+        await sleep(this.backoff(attempt));
+        continue;
+      }
+
+      const retryable = res.status === 429 || res.status === 503 || (!unsafe && res.status >= 500);
+      if (retryable && attempt < this.options.retries) {
+        await sleep(this.backoff(attempt, res.headers.get("Retry-After")));
+        continue;
+      }
+
+      if (res.ok && binary) return (await res.blob()) as T;
+      const text = await res.text();
+      if (!res.ok) {
+        let message = text.trim();
+        try {
+          message = JSON.parse(text).msg ?? message;
+        } catch {
+          // Not every error is JSON.
+        }
+        throw new ShotiError(res.status, message);
+      }
+      return (text ? JSON.parse(text) : undefined) as T;
+    }
+  }
+
+  private backoff(attempt: number, retryAfter?: string | null): number {
+    const seconds = Number(retryAfter);
+    if (retryAfter && Number.isInteger(seconds) && seconds >= 0) return seconds * 1000;
+    const max = Math.min(this.options.minBackoffMs * 2 ** attempt, this.options.maxBackoffMs);
+    return Math.random() * max;
+  }
+}
+
+function sleep(ms: number): Promise<void> {
+  return new Promise((resolve) => setTimeout(resolve, ms));
+}
+
+`
+
+func clientTSCommand(args []string) error {
+	fs := flag.NewFlagSet("client-ts", flag.ContinueOnError)
+	specPath := fs.String("spec", "", "OpenAPI spec to generate from (default: the embedded openapi.json)")
+	out := fs.String("out", "clients/typescript/src/index.ts", "file to write, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	raw := openAPISpec
+	if *specPath != "" {
+		var err error
+		if raw, err = os.ReadFile(*specPath); err != nil {
+			return err
+		}
+	}
+
+	code, err := generateTSClient(raw)
+	if err != nil {
+		return err
+	}
+	if *out == "-" {
+		fmt.Print(code)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(*out), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(*out, []byte(code), 0o644)
+}
+
+func init() {
+	commands["client-ts"] = command{
+		Summary: "generate the TypeScript client from openapi.json",
+		Run:     clientTSCommand,
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// catalogTUI is an interactive terminal browser for a running instance. It
+// lists videos through the public /api/videos endpoint and moderates them
+// through the admin API, so it needs no database access of its own.
+type catalogTUI struct {
+	api    string
+	admin  string
+	token  string
+	client *http.Client
+
+	page   int
+	status string
+	search string
+	videos []videoListing
+	total  int
+	cursor int
+
+	// mode is what keys do: browse the list, edit the search, confirm a
+	// delete or show the details of the selected row.
+	mode    tuiMode
+	input   string
+	loading bool
+	err     error
+	width   int
+	height  int
+}
+
+type tuiMode int
+
+const (
+	tuiBrowse tuiMode = iota
+	tuiSearch
+	tuiConfirm
+	tuiDetails
+)
+
+const tuiPerPage = 50
+
+// tuiStatuses are the status filters f cycles through.
+var tuiStatuses = []string{"all", "active", "suspended", "blocked", "archived"}
+
+const tuiHelp = "↑/↓ select  ←/→ page  / search  f filter  enter view  a approve  b block  d delete  r reload  q quit"
+
+// tuiLoaded and tuiFailed report the result of an API call back to the
+// model.
+type (
+	tuiLoaded struct {
+		videos []videoListing
+		total  int
+	}
+	tuiFailed struct{ err error }
+)
+
+func tuiCommand(args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	api := fs.String("api", envOr("SHOTI_API_URL", "http://localhost:8080"), "public API base URL")
+	admin := fs.String("admin", envOr("SHOTI_ADMIN_URL", "http://127.0.0.1:9090"), "admin API base URL")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin bearer token")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	t := &catalogTUI{
+		api:    strings.TrimRight(*api, "/"),
+		admin:  strings.TrimRight(*admin, "/"),
+		token:  *token,
+		client: &http.Client{Timeout: 15 * time.Second},
+		page:   1,
+		status: "all",
+	}
+	_, err := tea.NewProgram(t, tea.WithAltScreen()).Run()
+	return err
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (t *catalogTUI) Init() tea.Cmd {
+	return t.load()
+}
+
+func (t *catalogTUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		t.width, t.height = msg.Width, msg.Height
+	case tuiLoaded:
+		t.loading, t.err = false, nil
+		t.videos, t.total = msg.videos, msg.total
+		t.cursor = min(t.cursor, max(0, len(t.videos)-1))
+	case tuiFailed:
+		t.loading, t.err = false, msg.err
+	case tea.KeyMsg:
+		if msg.Type == tea.KeyCtrlC {
+			return t, tea.Quit
+		}
+		switch t.mode {
+		case tuiSearch:
+			return t, t.searchKey(msg)
+		case tuiConfirm:
+			t.mode = tuiBrowse
+			if msg.String() == "y" {
+				return t, t.moderate(http.MethodDelete, "")
+			}
+		case tuiDetails:
+			t.mode = tuiBrowse
+		default:
+			return t, t.browseKey(msg)
+		}
+	}
+	return t, nil
+}
+
+func (t *catalogTUI) browseKey(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "q", "esc":
+		return tea.Quit
+	case "up", "k":
+		t.cursor = max(0, t.cursor-1)
+	case "down", "j":
+		t.cursor = min(max(0, len(t.videos)-1), t.cursor+1)
+	case "right", "l", "n":
+		if t.page*tuiPerPage < t.total {
+			t.page, t.cursor = t.page+1, 0
+			return t.load()
+		}
+	case "left", "h", "p":
+		if t.page > 1 {
+			t.page, t.cursor = t.page-1, 0
+			return t.load()
+		}
+	case "/", "s":
+		t.mode, t.input = tuiSearch, t.search
+	case "f":
+		for i, status := range tuiStatuses {
+			if status == t.status {
+				t.status = tuiStatuses[(i+1)%len(tuiStatuses)]
+				break
+			}
+		}
+		t.page, t.cursor = 1, 0
+		return t.load()
+	case "r":
+		return t.load()
+	case "enter", "v":
+		if len(t.videos) > 0 {
+			t.mode = tuiDetails
+		}
+	case "a":
+		return t.moderate(http.MethodPost, "/unblock")
+	case "b":
+		return t.moderate(http.MethodPost, "/block")
+	case "d":
+		if len(t.videos) > 0 {
+			t.mode = tuiConfirm
+		}
+	}
+	return nil
+}
+
+func (t *catalogTUI) searchKey(msg tea.KeyMsg) tea.Cmd {
+	switch msg.Type {
+	case tea.KeyEsc:
+		t.mode = tuiBrowse
+	case tea.KeyEnter:
+		t.mode = tuiBrowse
+		t.search, t.page, t.cursor = strings.TrimSpace(t.input), 1, 0
+		return t.load()
+	case tea.KeyBackspace:
+		if r := []rune(t.input); len(r) > 0 {
+			t.input = string(r[:len(r)-1])
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		t.input += string(msg.Runes)
+	}
+	return nil
+}
+
+func (t *catalogTUI) View() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "shoti-srv catalog  %s  status=%s  search=%q  page %d (%d videos)\n\n", t.api, t.status, t.search, t.page, t.total)
+
+	if t.mode == tuiDetails && t.cursor < len(t.videos) {
+		out, _ := json.MarshalIndent(t.videos[t.cursor], "", "  ")
+		b.Write(out)
+		b.WriteString("\n\nPress any key to go back.")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "   %-9s  %-18s  %8s  %-40s\n", "STATUS", "AUTHOR", "LIKES", "TITLE")
+	// Keep the selected row in view when the page is taller than the
+	// terminal, leaving room for the header and the footer.
+	rows := len(t.videos)
+	if t.height > 8 {
+		rows = min(rows, t.height-8)
+	}
+	first := max(0, t.cursor-rows+1)
+	for i := first; i < len(t.videos) && i < first+rows; i++ {
+		v := t.videos[i]
+		line := fmt.Sprintf("%-9s  %-18s  %8d  %-40s", v.Status, truncate(v.Author.Username, 18), v.Stats.Likes, truncate(v.Title, 40))
+		if i == t.cursor {
+			fmt.Fprintf(&b, "\033[7m > %s\033[0m\n", line)
+		} else {
+			fmt.Fprintf(&b, "   %s\n", line)
+		}
+	}
+	if len(t.videos) == 0 && !t.loading {
+		b.WriteString("   No videos.\n")
+	}
+
+	b.WriteString("\n")
+	switch {
+	case t.mode == tuiSearch:
+		fmt.Fprintf(&b, "Search: %s█  (enter apply, esc cancel)", t.input)
+	case t.mode == tuiConfirm:
+		fmt.Fprintf(&b, "Delete %s? [y/N]", t.videos[t.cursor].URL)
+	case t.loading:
+		b.WriteString("Loading…")
+	case t.err != nil:
+		fmt.Fprintf(&b, "Error: %v", t.err)
+	default:
+		b.WriteString(tuiHelp)
+	}
+	return b.String()
+}
+
+// load fetches the current page.
+func (t *catalogTUI) load() tea.Cmd {
+	t.loading = true
+	query := url.Values{"page": {strconv.Itoa(t.page)}, "per_page": {strconv.Itoa(tuiPerPage)}, "status": {t.status}}
+	if t.search != "" {
+		query.Set("q", t.search)
+	}
+	target := t.api + "/api/videos?" + query.Encode()
+	return func() tea.Msg {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			return tuiFailed{err}
+		}
+		var response videosResponse
+		if err := t.do(req, &response); err != nil {
+			return tuiFailed{fmt.Errorf("error listing videos: %w", err)}
+		}
+		return tuiLoaded{response.Data.Videos, response.Data.Total}
+	}
+}
+
+// moderate applies an admin action to the selected row and reloads the
+// page.
+func (t *catalogTUI) moderate(method, action string) tea.Cmd {
+	if t.cursor >= len(t.videos) {
+		return nil
+	}
+	v := t.videos[t.cursor]
+	t.loading = true
+	reload := t.load()
+	return func() tea.Msg {
+		req, err := http.NewRequest(method, t.admin+"/api/admin/urls/"+v.ID+action, nil)
+		if err != nil {
+			return tuiFailed{err}
+		}
+		if t.token != "" {
+			req.Header.Set("Authorization", "Bearer "+t.token)
+		}
+		req.Header.Set("If-Match", strconv.Quote(strconv.FormatInt(v.Version, 10)))
+		if err := t.do(req, nil); err != nil {
+			return tuiFailed{err}
+		}
+		return reload()
+	}
+}
+
+func (t *catalogTUI) do(req *http.Request, v interface{}) error {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func init() {
+	commands["tui"] = command{
+		Summary: "browse and moderate the catalog of a running instance",
+		Run:     tuiCommand,
+	}
+}
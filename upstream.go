@@ -0,0 +1,196 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// Paid tikwm tiers authenticate with an API key. TIKWM_API_KEY may hold
+// several comma-separated keys; requests rotate across them, each limited
+// to TIKWM_KEY_RPS requests per second (0 for unlimited). The key is sent
+// as the TIKWM_API_KEY_PARAM query parameter ("key" by default), or as the
+// TIKWM_API_KEY_HEADER header when that is set. TIKWM_API_URL overrides the
+// endpoint for operators on an authenticated host, optionally per region.
+
+var upstreamClient = &http.Client{}
+
+var (
+	upstreamRequests    = expvar.NewMap("upstream_key_requests")
+	upstreamFailures    = expvar.NewMap("upstream_key_failures")
+	upstreamRateLimited = expvar.NewMap("upstream_key_rate_limited")
+	upstreamQueued      = expvar.NewInt("upstream_queue_waits")
+	upstreamQueueFull   = expvar.NewInt("upstream_queue_rejected")
+)
+
+type upstreamKey struct {
+	secret string
+	label  string
+
+	mu          sync.Mutex
+	windowStart time.Time
+	used        int
+}
+
+var upstreamAuth struct {
+	once sync.Once
+	keys []*upstreamKey
+	next int
+	mu   sync.Mutex
+}
+
+func loadUpstreamKeys() {
+	for _, k := range strings.Split(secret("TIKWM_API_KEY"), ",") {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		label := k
+		if len(label) > 4 {
+			label = "..." + label[len(label)-4:]
+		}
+		upstreamAuth.keys = append(upstreamAuth.keys, &upstreamKey{secret: k, label: label})
+	}
+}
+
+// take reserves one request in the key's current one-second window.
+func (k *upstreamKey) take(limit int, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if now.Sub(k.windowStart) >= time.Second {
+		k.windowStart = now
+		k.used = 0
+	}
+	if limit > 0 && k.used >= limit {
+		return false
+	}
+	k.used++
+	return true
+}
+
+// acquireUpstreamKey returns the next key with spare capacity, waiting for
+// the next window when all are saturated. It returns nil when no keys are
+// configured (free tier).
+func acquireUpstreamKey() *upstreamKey {
+	upstreamAuth.once.Do(loadUpstreamKeys)
+	if len(upstreamAuth.keys) == 0 {
+		return nil
+	}
+
+	limit := envInt("TIKWM_KEY_RPS", 0)
+	for {
+		upstreamAuth.mu.Lock()
+		start := upstreamAuth.next
+		upstreamAuth.next = (upstreamAuth.next + 1) % len(upstreamAuth.keys)
+		upstreamAuth.mu.Unlock()
+
+		now := time.Now()
+		for i := range upstreamAuth.keys {
+			k := upstreamAuth.keys[(start+i)%len(upstreamAuth.keys)]
+			if k.take(limit, now) {
+				upstreamRequests.Add(k.label, 1)
+				return k
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (k *upstreamKey) recordFailure(rateLimited bool) {
+	if k == nil {
+		return
+	}
+	upstreamFailures.Add(k.label, 1)
+	if rateLimited {
+		upstreamRateLimited.Add(k.label, 1)
+	}
+}
+
+// tikwmResolver returns the tikwm resolver for the caller's region,
+// authenticated with key.
+func tikwmResolver(key *upstreamKey) resolver.Tikwm {
+	t := resolver.Tikwm{
+		Endpoint:  regionEnv("TIKWM_API_URL"),
+		KeyParam:  os.Getenv("TIKWM_API_KEY_PARAM"),
+		KeyHeader: os.Getenv("TIKWM_API_KEY_HEADER"),
+		Client:    upstreamClient,
+	}
+	if key != nil {
+		t.Key = key.secret
+	}
+	return t
+}
+
+// tikwmAPIRequest returns a request for path under the tikwm API, such as
+// "/user/posts", authenticated with key.
+func tikwmAPIRequest(path string, query url.Values, key *upstreamKey) (*http.Request, error) {
+	return tikwmResolver(key).Request(path, query)
+}
+
+// When tikwm reports its rate limit, resolves stop hitting it for
+// UPSTREAM_BACKOFF and queue instead: each waiter is given a slot after
+// the backoff, UPSTREAM_QUEUE_RPS slots per second, so the queue drains at
+// the rate the upstream allows rather than all at once. A resolve whose slot
+// would be more than UPSTREAM_QUEUE_TIMEOUT away, or that finds
+// UPSTREAM_QUEUE_SIZE resolves already waiting, fails as rate limited
+// straight away (and the metadata cache answers from a stale entry if it
+// has one).
+var upstreamQuota struct {
+	mu       sync.Mutex
+	until    time.Time
+	nextSlot time.Time
+	waiting  int
+}
+
+func noteUpstreamRateLimited() {
+	upstreamQuota.mu.Lock()
+	defer upstreamQuota.mu.Unlock()
+
+	until := time.Now().Add(envDuration("UPSTREAM_BACKOFF", time.Second))
+	if until.After(upstreamQuota.until) {
+		upstreamQuota.until = until
+	}
+	if upstreamQuota.nextSlot.Before(upstreamQuota.until) {
+		upstreamQuota.nextSlot = upstreamQuota.until
+	}
+}
+
+// waitForUpstreamQuota returns at once unless the upstream is backing off,
+// in which case it waits for a slot.
+func waitForUpstreamQuota() error {
+	upstreamQuota.mu.Lock()
+	now := time.Now()
+	if !now.Before(upstreamQuota.until) && !now.Before(upstreamQuota.nextSlot) {
+		upstreamQuota.mu.Unlock()
+		return nil
+	}
+
+	slot := upstreamQuota.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	if upstreamQuota.waiting >= envInt("UPSTREAM_QUEUE_SIZE", 100) ||
+		slot.Sub(now) > envDuration("UPSTREAM_QUEUE_TIMEOUT", 5*time.Second) {
+		upstreamQuota.mu.Unlock()
+		upstreamQueueFull.Add(1)
+		return &providerError{Provider: "tikwm", Msg: "rate limited, upstream queue is full", Kind: providerRateLimited}
+	}
+	rps := max(1, envInt("UPSTREAM_QUEUE_RPS", 1))
+	upstreamQuota.nextSlot = slot.Add(time.Second / time.Duration(rps))
+	upstreamQuota.waiting++
+	upstreamQuota.mu.Unlock()
+
+	upstreamQueued.Add(1)
+	time.Sleep(time.Until(slot))
+
+	upstreamQuota.mu.Lock()
+	upstreamQuota.waiting--
+	upstreamQuota.mu.Unlock()
+	return nil
+}
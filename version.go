@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Version 2 of the API lives under /api/v2/. Every /api/ endpoint is
+// reachable there: apiV2 strips the version from the path and dispatches
+// to the same handler, which checks apiVersion where the v2 response
+// differs from v1.
+
+type apiVersionKey struct{}
+
+func apiV2(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, 2))
+		r.URL.Path = "/api/" + strings.TrimPrefix(r.URL.Path, "/api/v2/")
+		r.URL.RawPath = ""
+		mux.ServeHTTP(w, r)
+	}
+}
+
+// apiVersion is 2 for requests made under /api/v2/ and 1 otherwise.
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// writeCompatError writes msg as plain text to v1 callers of the endpoints
+// that predate the JSON envelope, and as an envelope to v2 callers.
+func writeCompatError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if apiVersion(r) >= 2 {
+		writeError(w, status, msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// videoResponseV2 is the v2 served video: duration is in seconds, the
+// catalog and upload times are RFC 3339 timestamps and field names are
+// snake_case throughout.
+type videoResponseV2 struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data videoDataV2 `json:"data"`
+}
+
+type videoDataV2 struct {
+	Region    string          `json:"region"`
+	URL       string          `json:"url"`
+	Cover     string          `json:"cover"`
+	Title     string          `json:"title"`
+	Duration  int             `json:"duration"`
+	VideoID   string          `json:"video_id"`
+	ServeID   string          `json:"serve_id,omitempty"`
+	User      videoUserV2     `json:"user"`
+	Subtitles []VideoSubtitle `json:"subtitles,omitempty"`
+	// CreatedAt is when the URL was added to the catalog.
+	CreatedAt string `json:"created_at,omitempty"`
+	// PostedAt is when the video was posted upstream.
+	PostedAt string `json:"posted_at,omitempty"`
+}
+
+type videoUserV2 struct {
+	Username string `json:"username"`
+	Nickname string `json:"nickname"`
+	UserID   string `json:"user_id"`
+}
+
+// newVideoResponseV2 converts the v1 response, after its URLs and title
+// have been rewritten, to v2.
+func newVideoResponseV2(v1 VideoDataResponse, entry catalogEntry, video *Video) videoResponseV2 {
+	var response videoResponseV2
+	response.Code = v1.Code
+	response.Msg = v1.Msg
+	response.Data = videoDataV2{
+		Region:    v1.Data.Region,
+		URL:       v1.Data.URL,
+		Cover:     v1.Data.Cover,
+		Title:     v1.Data.Title,
+		Duration:  video.Duration,
+		VideoID:   v1.Data.VideoID,
+		ServeID:   v1.Data.ServeID,
+		Subtitles: v1.Data.Subtitles,
+		User: videoUserV2{
+			Username: v1.Data.User.Username,
+			Nickname: v1.Data.User.Nickname,
+			UserID:   v1.Data.User.UserID,
+		},
+	}
+	if !entry.AddedAt.IsZero() {
+		response.Data.CreatedAt = entry.AddedAt.UTC().Format(time.RFC3339)
+	}
+	if video.CreatedAt > 0 {
+		response.Data.PostedAt = time.Unix(video.CreatedAt, 0).UTC().Format(time.RFC3339)
+	}
+	return response
+}
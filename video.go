@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/libyzxy0/shoti-srv/resolver"
+)
+
+// The Video model and the provider decoders live in the resolver package;
+// these aliases keep the names the rest of the server uses.
+type (
+	Video         = resolver.Video
+	VideoAuthor   = resolver.Author
+	VideoSubtitle = resolver.Subtitle
+
+	providerError     = resolver.Error
+	providerErrorKind = resolver.ErrorKind
+)
+
+const (
+	providerInvalidURL  = resolver.InvalidURL
+	providerRateLimited = resolver.RateLimited
+)
+
+// upstreamErrorStatus returns the HTTP status, error code and message
+// answering a request whose video could not be resolved because of err.
+func upstreamErrorStatus(err error) (int, string, string) {
+	var pe *providerError
+	if errors.As(err, &pe) {
+		switch pe.Kind {
+		case providerInvalidURL:
+			return http.StatusUnprocessableEntity, "upstream_invalid_url", "the upstream cannot resolve this video"
+		case providerRateLimited:
+			return http.StatusTooManyRequests, "upstream_rate_limited", "the upstream rate limit was reached, try again shortly"
+		}
+	}
+	return http.StatusBadGateway, "upstream_failed", "failed to resolve video"
+}
+
+// writeUpstreamError answers a request that failed because err kept the
+// video from resolving.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	status, code, msg := upstreamErrorStatus(err)
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, status, statusResponse{Code: status, Msg: msg, Error: code})
+}
+
+// providerDecoders maps each provider to the function that turns its raw
+// response body into a Video.
+var providerDecoders = map[string]func(raw []byte) (*Video, error){
+	"tikwm":    resolver.DecodeTikwm,
+	"external": resolver.DecodeExternal,
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// videoListing is a catalog row joined with the metadata stored on its
+// last resolve. Fields are empty until the URL has been resolved.
+type videoListing struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Status     string `json:"status"`
+	Collection string `json:"collection"`
+	VideoID    string `json:"video_id"`
+	Title      string `json:"title"`
+	Duration   int    `json:"duration"`
+	Region     string `json:"region"`
+	Author     struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+	} `json:"author"`
+	Music struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"music"`
+	Stats struct {
+		Plays    int64 `json:"plays"`
+		Likes    int64 `json:"likes"`
+		Comments int64 `json:"comments"`
+		Shares   int64 `json:"shares"`
+		Serves   int64 `json:"serves"`
+	} `json:"stats"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	// Version changes on every moderation change; the admin API takes it
+	// in If-Match.
+	Version int64 `json:"version"`
+}
+
+const videoListingColumns = `id, url, status, collection_id, COALESCE(video_id, ''), COALESCE(title, ''), COALESCE(duration, 0),
+	COALESCE(region, ''), COALESCE(author_id, ''), COALESCE(author_username, ''), COALESCE(author_nickname, ''),
+	COALESCE(music_id, ''), COALESCE(music_title, ''), play_count, digg_count, comment_count, share_count,
+	serve_count, created_at, stats_updated_at, version`
+
+func scanVideoListing(row rowScanner, extra ...interface{}) (videoListing, error) {
+	var v videoListing
+	err := row.Scan(append([]interface{}{&v.ID, &v.URL, &v.Status, &v.Collection, &v.VideoID, &v.Title, &v.Duration,
+		&v.Region, &v.Author.ID, &v.Author.Username, &v.Author.Nickname,
+		&v.Music.ID, &v.Music.Title, &v.Stats.Plays, &v.Stats.Likes, &v.Stats.Comments, &v.Stats.Shares,
+		&v.Stats.Serves, &v.CreatedAt, &v.ResolvedAt, &v.Version}, extra...)...)
+	return v, err
+}
+
+type videosResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		Videos  []videoListing `json:"videos"`
+		Page    int            `json:"page"`
+		PerPage int            `json:"per_page"`
+		// Total is -1 on pages requested by cursor.
+		Total      int    `json:"total"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	} `json:"data"`
+}
+
+var videoSorts = map[string]string{
+	"newest": "created_at DESC, id DESC",
+	"oldest": "created_at, id",
+	"likes":  "digg_count DESC, id",
+	"plays":  "play_count DESC, id",
+	"serves": "serve_count DESC, id",
+}
+
+// videoSortCompare orders listings as videoSorts does, to merge the pages
+// of several shards.
+var videoSortCompare = map[string]func(a, b videoListing) int{
+	"newest": func(a, b videoListing) int { return -compareCreated(a, b) },
+	"oldest": compareCreated,
+	"likes":  func(a, b videoListing) int { return compareCount(a.Stats.Likes, b.Stats.Likes, a, b) },
+	"plays":  func(a, b videoListing) int { return compareCount(a.Stats.Plays, b.Stats.Plays, a, b) },
+	"serves": func(a, b videoListing) int { return compareCount(a.Stats.Serves, b.Stats.Serves, a, b) },
+}
+
+func compareCreated(a, b videoListing) int {
+	if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// compareCount orders a before b when its count x is higher than b's y.
+func compareCount(x, y int64, a, b videoListing) int {
+	if c := cmp.Compare(y, x); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// keysetSorts are the sorts on (created_at, id), which can be paginated
+// with a cursor, mapped to the comparison selecting the rows after it.
+var keysetSorts = map[string]string{
+	"newest": "<",
+	"oldest": ">",
+}
+
+// listVideos handles GET /api/videos, the catalog joined with resolved
+// metadata for dashboards and integrations. It is paginated with page and
+// per_page, ordered by sort (newest, oldest, likes, plays or serves) and
+// filtered by status (default active, or "all"), collection, author
+// (username), hashtag, min_likes, min_plays, resolved (true/false) and q, a
+// case-insensitive title search. Full pages sorted by newest or oldest carry
+// a next_cursor; passing it as cursor instead of page continues after the
+// last row, stable under concurrent inserts and without counting total.
+func listVideos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+
+	page, err := queryInt(query.Get("page"), 1, 1, 1<<20)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "page must be a positive integer")
+		return
+	}
+	perPage, err := queryInt(query.Get("per_page"), 50, 1, 500)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "per_page must be between 1 and 500")
+		return
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "newest"
+	}
+	order, ok := videoSorts[sort]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "sort must be one of newest, oldest, likes, plays, serves")
+		return
+	}
+
+	var cursor *pageCursor
+	if v := query.Get("cursor"); v != "" {
+		if query.Get("page") != "" {
+			writeError(w, http.StatusBadRequest, "cursor and page cannot be combined")
+			return
+		}
+		if keysetSorts[sort] == "" {
+			writeError(w, http.StatusBadRequest, "cursor requires sort newest or oldest")
+			return
+		}
+		c, err := decodeCursor(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		cursor = &c
+	}
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	switch status := query.Get("status"); status {
+	case "", "active", "suspended", "blocked", "archived":
+		if status == "" {
+			status = "active"
+		}
+		where = append(where, "status = "+arg(status))
+	case "all":
+	default:
+		writeError(w, http.StatusBadRequest, "status must be one of active, suspended, blocked, archived, all")
+		return
+	}
+
+	if v := query.Get("collection"); v != "" {
+		where = append(where, "collection_id = "+arg(v))
+	}
+	if v := query.Get("author"); v != "" {
+		where = append(where, "author_username = "+arg(strings.TrimPrefix(v, "@")))
+	}
+	if v := query.Get("hashtag"); v != "" {
+		tag := strings.ToLower(strings.TrimPrefix(v, "#"))
+		where = append(where, "EXISTS (SELECT 1 FROM hashtags WHERE hashtags.url_id = urls.id AND tag = "+arg(tag)+")")
+	}
+	if v := query.Get("q"); v != "" {
+		where = append(where, "title ILIKE "+arg("%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(v)+"%"))
+	}
+	for name, column := range map[string]string{"min_likes": "digg_count", "min_plays": "play_count"} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, name+" must be a non-negative integer")
+				return
+			}
+			where = append(where, column+" >= "+arg(n))
+		}
+	}
+	switch query.Get("resolved") {
+	case "true":
+		where = append(where, "stats_updated_at IS NOT NULL")
+	case "false":
+		where = append(where, "stats_updated_at IS NULL")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var response videosResponse
+	response.Code = 200
+	response.Msg = "success"
+	response.Data.Page = page
+	response.Data.PerPage = perPage
+	response.Data.Videos = []videoListing{}
+
+	conns := collectionDBs(query.Get("collection"))
+	offset := (page - 1) * perPage
+	if cursor != nil {
+		// Counting would scan every match, which cursors are meant to avoid.
+		response.Data.Total = -1
+		offset = 0
+		where = append(where, "(created_at, id) "+keysetSorts[sort]+" ("+arg(cursor.CreatedAt)+", "+arg(cursor.ID)+")")
+		filter = " WHERE " + strings.Join(where, " AND ")
+	} else {
+		for _, conn := range conns {
+			var total int
+			if err := conn.QueryRow("SELECT COUNT(*) FROM urls"+filter, args...).Scan(&total); err != nil {
+				log.Printf("Error counting videos: %v\n", err)
+				writeError(w, http.StatusInternalServerError, "failed")
+				return
+			}
+			response.Data.Total += total
+		}
+	}
+
+	// A page spanning shards is cut from the first offset+perPage rows of
+	// every shard, merged in order.
+	limit, shardOffset := perPage, offset
+	if len(conns) > 1 {
+		limit, shardOffset = offset+perPage, 0
+	}
+	listQuery := "SELECT " + videoListingColumns + " FROM urls" + filter + " ORDER BY " + order + " LIMIT " + arg(limit) + " OFFSET " + arg(shardOffset)
+	for _, conn := range conns {
+		videos, err := queryVideoListings(conn, listQuery, args...)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "failed")
+			return
+		}
+		response.Data.Videos = append(response.Data.Videos, videos...)
+	}
+	if len(conns) > 1 {
+		slices.SortStableFunc(response.Data.Videos, videoSortCompare[sort])
+		videos := response.Data.Videos
+		response.Data.Videos = videos[min(offset, len(videos)):min(offset+perPage, len(videos))]
+	}
+
+	policy := titlePolicyFor(r)
+	for i, v := range response.Data.Videos {
+		response.Data.Videos[i].Title = sanitizeTitle(maskTitle(v.Collection, v.Title), policy)
+	}
+
+	if n := len(response.Data.Videos); n == perPage && keysetSorts[sort] != "" {
+		last := response.Data.Videos[n-1]
+		response.Data.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// queryVideoListings returns the listings query selects from conn.
+func queryVideoListings(conn *sql.DB, query string, args ...interface{}) ([]videoListing, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing videos: %w", err)
+	}
+	defer rows.Close()
+
+	var videos []videoListing
+	for rows.Next() {
+		v, err := scanVideoListing(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning video: %w", err)
+		}
+		videos = append(videos, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing videos: %w", err)
+	}
+	return videos, nil
+}
+
+// queryInt parses an optional integer query parameter within [min, max].
+func queryInt(value string, fallback, min, max int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("out of range")
+	}
+	return n, nil
+}
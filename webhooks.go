@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serve webhooks: when SERVE_WEBHOOK_URLS is set, every served video is
+// queued as a video.served event and the queue is POSTed to each endpoint
+// as {"events": [...]} every SERVE_WEBHOOK_INTERVAL, in batches of at most
+// SERVE_WEBHOOK_BATCH. With SERVE_WEBHOOK_SECRET set, each body is signed in
+// X-Shoti-Signature as sha256=<hex HMAC-SHA256 of the body>.
+
+type serveEvent struct {
+	Type    string    `json:"type"`
+	ServeID string    `json:"serve_id"`
+	URLID   string    `json:"url_id"`
+	VideoID string    `json:"video_id"`
+	KeyID   string    `json:"key_id,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+type serveEventBatch struct {
+	Events []serveEvent `json:"events"`
+}
+
+var (
+	serveWebhookDelivered = expvar.NewInt("serve_webhook_delivered")
+	serveWebhookDropped   = expvar.NewInt("serve_webhook_dropped")
+)
+
+var serveWebhooks struct {
+	mu      sync.Mutex
+	pending []serveEvent
+}
+
+var serveWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func serveWebhookURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("SERVE_WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func newServeEvent(r *http.Request, entry catalogEntry, video *Video, serveID string) serveEvent {
+	return serveEvent{
+		Type:    "video.served",
+		ServeID: serveID,
+		URLID:   entry.ID,
+		VideoID: video.ID,
+		KeyID:   keyID(r),
+		Time:    time.Now().UTC(),
+	}
+}
+
+// recordServeEvent queues ev for the serve webhooks. Events beyond
+// SERVE_WEBHOOK_MAX_PENDING are dropped so a dead endpoint cannot grow the
+// queue without bound.
+func recordServeEvent(ev serveEvent) {
+	if os.Getenv("SERVE_WEBHOOK_URLS") == "" {
+		return
+	}
+
+	serveWebhooks.mu.Lock()
+	defer serveWebhooks.mu.Unlock()
+	if len(serveWebhooks.pending) >= envInt("SERVE_WEBHOOK_MAX_PENDING", 100000) {
+		serveWebhookDropped.Add(1)
+		return
+	}
+	serveWebhooks.pending = append(serveWebhooks.pending, ev)
+}
+
+// flushServeEvents delivers the queued events to every endpoint. A batch
+// that still fails after three attempts is dropped for that endpoint.
+func flushServeEvents() error {
+	serveWebhooks.mu.Lock()
+	events := serveWebhooks.pending
+	serveWebhooks.pending = nil
+	serveWebhooks.mu.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	size := envInt("SERVE_WEBHOOK_BATCH", 1000)
+	var failed int
+	for _, target := range serveWebhookURLs() {
+		for start := 0; start < len(events); start += size {
+			batch := events[start:min(start+size, len(events))]
+			if err := deliverServeEvents(target, batch); err != nil {
+				log.Printf("Error delivering %d serve events: %v\n", len(batch), err)
+				serveWebhookDropped.Add(int64(len(batch)))
+				failed++
+				continue
+			}
+			serveWebhookDelivered.Add(int64(len(batch)))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d serve event batches could not be delivered", failed)
+	}
+	return nil
+}
+
+func deliverServeEvents(target string, events []serveEvent) error {
+	body, err := json.Marshal(serveEventBatch{Events: events})
+	if err != nil {
+		return fmt.Errorf("error encoding events: %w", err)
+	}
+
+	var signature string
+	if key := secret("SERVE_WEBHOOK_SECRET"); key != "" {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = postServeEvents(target, body, signature)
+		if err == nil || attempt == 2 {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+func postServeEvents(target string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set("X-Shoti-Signature", signature)
+	}
+
+	response, err := serveWebhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %w", req.URL.Host, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", req.URL.Host, response.StatusCode)
+	}
+	return nil
+}
+
+func init() {
+	schedule("serve-webhooks", "SERVE_WEBHOOK_INTERVAL", 10*time.Second, flushServeEvents)
+}